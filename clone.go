@@ -2,12 +2,23 @@ package git
 
 /*
 #include <git2.h>
+#include <git2/sys/transport.h>
 
 extern void _go_git_populate_clone_callbacks(git_clone_options *opts);
+extern void _go_git_setup_stoppable_transport(git_remote_callbacks *callbacks);
+extern void _go_git_transport_cancel(git_transport *transport);
 */
 import "C"
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -19,37 +30,441 @@ type CloneOptions struct {
 	Bare                 bool
 	CheckoutBranch       string
 	RemoteCreateCallback RemoteCreateCallback
+
+	// Mirror makes a bare clone that mirrors all the refs of the remote,
+	// like git clone --mirror: the remote fetches +refs/*:refs/* and has
+	// remote.<name>.mirror set.
+	Mirror bool
+	// SingleBranch only fetches CheckoutBranch, or the default branch of
+	// the remote if it is empty, and configures the remote to only fetch
+	// that branch, like git clone --single-branch.
+	SingleBranch bool
+	// NoTags does not fetch the tags, and configures the remote not to
+	// follow them, like git clone --no-tags.
+	//
+	// Mirror, SingleBranch and NoTags cannot be combined with
+	// RemoteCreateCallback.
+	NoTags bool
 }
 
 func Clone(url string, path string, options *CloneOptions) (*Repository, error) {
+	return CloneContext(context.Background(), url, path, options)
+}
+
+// CloneContext clones a repository like Clone, but aborts the operation as
+// soon as ctx is done. In that case the error returned is ctx.Err().
+func CloneContext(ctx context.Context, url string, path string, options *CloneOptions) (*Repository, error) {
+	repo, _, err := clone(ctx, url, path, options)
+	return repo, err
+}
+
+// CloneWithResult clones a repository like Clone, and returns what the
+// fetch of the clone created: the local refs and the totals of the
+// transfer.
+func CloneWithResult(url string, path string, options *CloneOptions) (*Repository, *FetchResult, error) {
+	return CloneWithResultContext(context.Background(), url, path, options)
+}
+
+// CloneWithResultContext clones a repository like CloneWithResult, but
+// aborts the operation as soon as ctx is done. In that case the error
+// returned is ctx.Err().
+func CloneWithResultContext(ctx context.Context, url string, path string, options *CloneOptions) (*Repository, *FetchResult, error) {
+	return clone(ctx, url, path, options)
+}
+
+func clone(ctx context.Context, url string, path string, options *CloneOptions) (repo *Repository, result *FetchResult, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if options == nil {
+		options = defaultCloneOptions()
+	}
+	if helper, started := options.FetchOptions.RemoteCallbacks.CredentialHelper.beginOperation(); started {
+		cloneOptions := *options
+		cloneOptions.FetchOptions.RemoteCallbacks.CredentialHelper = helper
+		options = &cloneOptions
+		defer func() {
+			helper.completeOperation(err)
+		}()
+	}
+
 	curl := C.CString(url)
 	defer C.free(unsafe.Pointer(curl))
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	var err error
+	if options.FetchOptions.Unshallow {
+		return nil, nil, errors.New("Unshallow cannot be used when cloning")
+	}
+	if options.Mirror || options.SingleBranch || options.NoTags {
+		if options.RemoteCreateCallback != nil {
+			return nil, nil, errors.New("Mirror, SingleBranch and NoTags cannot be combined with RemoteCreateCallback")
+		}
+		if options.SingleBranch && options.CheckoutBranch == "" {
+			return cloneDefaultBranch(ctx, url, path, options)
+		}
+		remoteOptions := *options
+		remoteOptions.RemoteCreateCallback = remoteOptions.remoteCreateCallback()
+		if remoteOptions.Mirror {
+			remoteOptions.Bare = true
+		}
+		if remoteOptions.NoTags {
+			remoteOptions.FetchOptions.DownloadTags = DownloadTagsNone
+		}
+		options = &remoteOptions
+	}
+	shallow, err := newShallowFetch(&options.FetchOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetch := &fetchState{}
 	cOptions := populateCloneOptions(&C.git_clone_options{}, options, &err)
 	defer freeCloneOptions(cOptions)
+	setCallbacksContext(&cOptions.fetch_opts.callbacks, ctx)
+	setCallbacksShallowFetch(&cOptions.fetch_opts.callbacks, shallow)
+	setCallbacksFetchState(&cOptions.fetch_opts.callbacks, fetch)
 
 	if len(options.CheckoutBranch) != 0 {
 		cOptions.checkout_branch = C.CString(options.CheckoutBranch)
 	}
 
+	stop := stopTransportsWhenDone(ctx, &cOptions.fetch_opts.callbacks)
+	defer stop()
+
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
 	var ptr *C.git_repository
 	ret := C.git_clone(&ptr, curl, cpath, cOptions)
 
+	if ret < 0 && ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
 	if ret == C.int(ErrorCodeUser) && err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if ret < 0 {
-		return nil, MakeGitError(ret)
+		return nil, nil, MakeGitError(ret)
+	}
+
+	repo = newRepositoryFromC(ptr)
+	if shallow != nil {
+		if err := shallow.update(repo); err != nil {
+			repo.Free()
+			return nil, nil, err
+		}
+	}
+	refspecs, err := cloneRefspecs(repo)
+	if err != nil {
+		repo.Free()
+		return nil, nil, err
+	}
+	return repo, fetch.result(repo, refspecs), nil
+}
+
+// defaultCloneOptions returns the options that nil CloneOptions stand for,
+// which are the defaults of libgit2.
+func defaultCloneOptions() *CloneOptions {
+	return &CloneOptions{
+		CheckoutOptions: CheckoutOptions{Strategy: CheckoutSafe},
+		FetchOptions:    *defaultFetchOptions(),
+	}
+}
+
+// transportStopper cancels the transports of an operation whose remote
+// belongs to libgit2, like git_remote_stop does for a remote of ours.
+type transportStopper struct {
+	mu         sync.Mutex
+	transports map[*C.git_transport]bool
+	stopped    bool
+}
+
+// stoppableTransports maps the transports that a transportStopper watches
+// to it.
+var stoppableTransports struct {
+	sync.Mutex
+	transports map[*C.git_transport]*transportStopper
+}
+
+// stopTransportsWhenDone cancels the transports that libgit2 creates with
+// callbacks as soon as ctx is done. The returned function must be called
+// once the operation has finished.
+func stopTransportsWhenDone(ctx context.Context, callbacks *C.git_remote_callbacks) func() {
+	if ctx.Done() == nil || callbacks.payload == nil {
+		return func() {}
+	}
+
+	stopper := &transportStopper{transports: make(map[*C.git_transport]bool)}
+	pointerHandles.Get(callbacks.payload).(*remoteCallbacksData).stopper = stopper
+	C._go_git_setup_stoppable_transport(callbacks)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			stopper.stop()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// stop cancels the transports, and those created later on.
+func (s *transportStopper) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for transport := range s.transports {
+		C._go_git_transport_cancel(transport)
+	}
+}
+
+//export stoppableTransportCreatedCallback
+func stoppableTransportCreatedCallback(transport *C.git_transport, handle unsafe.Pointer) {
+	stopper := pointerHandles.Get(handle).(*remoteCallbacksData).stopper
+
+	stoppableTransports.Lock()
+	if stoppableTransports.transports == nil {
+		stoppableTransports.transports = make(map[*C.git_transport]*transportStopper)
+	}
+	stoppableTransports.transports[transport] = stopper
+	stoppableTransports.Unlock()
+
+	stopper.mu.Lock()
+	defer stopper.mu.Unlock()
+	stopper.transports[transport] = true
+	if stopper.stopped {
+		C._go_git_transport_cancel(transport)
+	}
+}
+
+// stoppableTransportFreeCallback forgets a transport that libgit2 is about
+// to free.
+//
+//export stoppableTransportFreeCallback
+func stoppableTransportFreeCallback(transport *C.git_transport) {
+	stoppableTransports.Lock()
+	stopper := stoppableTransports.transports[transport]
+	delete(stoppableTransports.transports, transport)
+	stoppableTransports.Unlock()
+
+	stopper.mu.Lock()
+	defer stopper.mu.Unlock()
+	delete(stopper.transports, transport)
+}
+
+// remoteCreateCallback returns the callback that creates the remote of a
+// clone with the fetch refspec and the configuration that Mirror,
+// SingleBranch and NoTags ask for.
+func (options *CloneOptions) remoteCreateCallback() RemoteCreateCallback {
+	var branch string
+	if options.SingleBranch {
+		branch = strings.TrimPrefix(options.CheckoutBranch, "refs/heads/")
+	}
+
+	return func(repo *Repository, name, url string) (*Remote, error) {
+		remote, err := repo.Remotes.CreateWithFetchspec(name, url, options.fetchspec(name, branch))
+		if err != nil {
+			return nil, err
+		}
+		if err := options.configureRemote(repo, name); err != nil {
+			remote.Free()
+			return nil, err
+		}
+		return remote, nil
+	}
+}
+
+// fetchspec returns the fetch refspec of the remote of a clone, which only
+// fetches branch if it is not empty.
+func (options *CloneOptions) fetchspec(name, branch string) string {
+	switch {
+	case options.Mirror && branch != "":
+		return "+refs/heads/" + branch + ":refs/heads/" + branch
+	case options.Mirror:
+		return "+refs/*:refs/*"
+	case branch != "":
+		return "+refs/heads/" + branch + ":refs/remotes/" + name + "/" + branch
+	}
+	return "+refs/heads/*:refs/remotes/" + name + "/*"
+}
+
+// configureRemote sets the configuration of the remote of a clone that
+// Mirror and NoTags ask for.
+func (options *CloneOptions) configureRemote(repo *Repository, name string) error {
+	config, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	defer config.Free()
+	if options.Mirror {
+		if err := config.SetBool("remote."+name+".mirror", true); err != nil {
+			return err
+		}
+	}
+	if options.NoTags {
+		return config.SetString("remote."+name+".tagopt", "--no-tags")
 	}
+	return nil
+}
 
-	return newRepositoryFromC(ptr), nil
+// cloneDefaultBranch clones only the default branch of the remote at url,
+// like git clone --single-branch. libgit2 sets the refspecs of the remote
+// of a clone before it connects, so the clone is made here instead: the
+// branch is learned from the connection, which the fetch then uses, and
+// it is checked out as libgit2 would.
+func cloneDefaultBranch(ctx context.Context, url, path string, options *CloneOptions) (repo *Repository, result *FetchResult, err error) {
+	entries, err := ioutil.ReadDir(path)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return nil, nil, err
+	}
+	if len(entries) > 0 {
+		return nil, nil, fmt.Errorf("'%s' exists and is not an empty directory", path)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if repo != nil {
+			repo.Free()
+			repo = nil
+		}
+		if created {
+			os.RemoveAll(path)
+			return
+		}
+		entries, _ := ioutil.ReadDir(path)
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(path, entry.Name()))
+		}
+	}()
+
+	bare := options.Bare || options.Mirror
+	repo, err = InitRepository(path, bare)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := repo.Remotes.CreateWithOptions(url, &RemoteCreateOptions{
+		Name:  "origin",
+		Flags: RemoteCreateSkipDefaultFetchspec,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer remote.Free()
+
+	opts := options.FetchOptions
+	if options.NoTags {
+		opts.DownloadTags = DownloadTagsNone
+	}
+	if err := remote.ConnectContext(ctx, ConnectDirectionFetch, &opts.RemoteCallbacks, &opts.ProxyOptions, opts.Headers); err != nil {
+		return nil, nil, err
+	}
+	defer remote.Disconnect()
+	branch, err := singleBranch(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetchspec := options.fetchspec("origin", branch)
+	if err := repo.Remotes.AddFetch("origin", fetchspec); err != nil {
+		return nil, nil, err
+	}
+	if err := options.configureRemote(repo, "origin"); err != nil {
+		return nil, nil, err
+	}
+	result, err = remote.fetch(ctx, []string{fetchspec}, &opts, "clone: from "+url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetched := "refs/remotes/origin/" + branch
+	if options.Mirror {
+		fetched = "refs/heads/" + branch
+	}
+	ref, err := repo.References.Lookup(fetched)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ref.Free()
+	if !options.Mirror {
+		commit, err := repo.LookupCommit(ref.Target())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer commit.Free()
+		local, err := repo.CreateBranch(branch, commit, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer local.Free()
+		if err := local.SetUpstream("origin/" + branch); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := repo.SetHead("refs/heads/" + branch); err != nil {
+		return nil, nil, err
+	}
+	if !bare {
+		if err := repo.CheckoutHead(&options.CheckoutOptions); err != nil {
+			return nil, nil, err
+		}
+	}
+	return repo, result, nil
+}
+
+// singleBranch returns the short name of the branch that a single-branch
+// clone fetches from the connected remote: the one that HEAD points to or,
+// if HEAD is detached, the first branch, as git does.
+func singleBranch(remote *Remote) (string, error) {
+	branch, err := remote.DefaultBranch()
+	if err == nil {
+		return strings.TrimPrefix(branch, "refs/heads/"), nil
+	}
+	if !IsErrorCode(err, ErrorCodeNotFound) {
+		return "", err
+	}
+	heads, err := remote.Ls()
+	if err != nil {
+		return "", err
+	}
+	for _, head := range heads {
+		if strings.HasPrefix(head.Name, "refs/heads/") {
+			return strings.TrimPrefix(head.Name, "refs/heads/"), nil
+		}
+	}
+	return "", errors.New("the remote has no branch to clone")
+}
+
+// cloneRefspecs returns the fetch refspecs of the remote that a clone
+// created.
+func cloneRefspecs(repo *Repository) ([]string, error) {
+	names, err := repo.Remotes.List()
+	if err != nil {
+		return nil, err
+	}
+	var refspecs []string
+	for _, name := range names {
+		remote, err := repo.Remotes.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		remoteRefspecs, err := remote.FetchRefspecs()
+		remote.Free()
+		if err != nil {
+			return nil, err
+		}
+		refspecs = append(refspecs, remoteRefspecs...)
+	}
+	return refspecs, nil
 }
 
 //export remoteCreateCallback
@@ -1,8 +1,10 @@
 package git
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -34,6 +36,17 @@ func TestClone(t *testing.T) {
 	if ref.Cmp(ref2) != 0 {
 		t.Fatal("reference in clone does not match original ref")
 	}
+
+	// Nil options stand for the defaults of libgit2, which check out the
+	// default branch.
+	path, err = ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	repo3, err := Clone(repo.Path(), path, nil)
+	checkFatal(t, err)
+	defer cleanupTestRepo(t, repo3)
+	if _, err := os.Stat(filepath.Join(path, "README")); err != nil {
+		t.Errorf("the default branch was not checked out: %v", err)
+	}
 }
 
 func TestCloneWithCallback(t *testing.T) {
@@ -85,3 +98,162 @@ func TestCloneWithExternalHTTPUrl(t *testing.T) {
 		t.Fatal("cannot clone remote repo via https, error: ", err)
 	}
 }
+
+func TestCloneMirror(t *testing.T) {
+	t.Parallel()
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	commitId, _ := seedTestRepo(t, repo)
+	commit, err := repo.LookupCommit(commitId)
+	checkFatal(t, err)
+	defer commit.Free()
+	tagId := createTestTag(t, repo, commit)
+	custom, err := repo.References.Create("refs/custom/ref", commitId, false, "")
+	checkFatal(t, err)
+	defer custom.Free()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	mirror, err := Clone(repo.Path(), path, &CloneOptions{Mirror: true})
+	checkFatal(t, err)
+	defer cleanupTestRepo(t, mirror)
+
+	if !mirror.IsBare() {
+		t.Error("the mirror is not bare")
+	}
+	for name, id := range map[string]*Oid{
+		"refs/heads/master": commitId,
+		"refs/tags/v0.0.0":  tagId,
+		"refs/custom/ref":   commitId,
+	} {
+		ref, err := mirror.References.Lookup(name)
+		checkFatal(t, err)
+		if !ref.Target().Equal(id) {
+			t.Errorf("%s = %v in the mirror, want %v", name, ref.Target(), id)
+		}
+		ref.Free()
+	}
+
+	config, err := mirror.Config()
+	checkFatal(t, err)
+	defer config.Free()
+	isMirror, err := config.LookupBool("remote.origin.mirror")
+	checkFatal(t, err)
+	if !isMirror {
+		t.Error("remote.origin.mirror is not set")
+	}
+	fetchspec, err := config.LookupString("remote.origin.fetch")
+	checkFatal(t, err)
+	if fetchspec != "+refs/*:refs/*" {
+		t.Errorf("remote.origin.fetch = %q, want +refs/*:refs/*", fetchspec)
+	}
+}
+
+func TestCloneSingleBranchNoTags(t *testing.T) {
+	t.Parallel()
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	commitId, _ := seedTestRepo(t, repo)
+	commit, err := repo.LookupCommit(commitId)
+	checkFatal(t, err)
+	defer commit.Free()
+	createTestTag(t, repo, commit)
+	branch, err := repo.CreateBranch("feature", commit, false)
+	checkFatal(t, err)
+	defer branch.Free()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	clone, err := Clone(repo.Path(), path, &CloneOptions{Bare: true, SingleBranch: true, NoTags: true})
+	checkFatal(t, err)
+	defer cleanupTestRepo(t, clone)
+
+	ref, err := clone.References.Lookup("refs/remotes/origin/master")
+	checkFatal(t, err)
+	ref.Free()
+	for _, name := range []string{"refs/remotes/origin/feature", "refs/tags/v0.0.0"} {
+		if ref, err := clone.References.Lookup(name); err == nil {
+			ref.Free()
+			t.Errorf("the clone has %s", name)
+		}
+	}
+
+	config, err := clone.Config()
+	checkFatal(t, err)
+	defer config.Free()
+	fetchspec, err := config.LookupString("remote.origin.fetch")
+	checkFatal(t, err)
+	if fetchspec != "+refs/heads/master:refs/remotes/origin/master" {
+		t.Errorf("remote.origin.fetch = %q", fetchspec)
+	}
+	tagopt, err := config.LookupString("remote.origin.tagopt")
+	checkFatal(t, err)
+	if tagopt != "--no-tags" {
+		t.Errorf("remote.origin.tagopt = %q, want --no-tags", tagopt)
+	}
+}
+
+func TestCloneSingleBranchDefaultBranch(t *testing.T) {
+	t.Parallel()
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstCommit, _ := seedTestRepo(t, serverRepo)
+	commit, err := serverRepo.LookupCommit(firstCommit)
+	checkFatal(t, err)
+	defer commit.Free()
+	branch, err := serverRepo.CreateBranch("feature", commit, false)
+	checkFatal(t, err)
+	defer branch.Free()
+	secondCommit, _ := updateReadme(t, serverRepo, "second commit")
+
+	daemon := startTestGitDaemon(t, serverRepo)
+	defer daemon.listener.Close()
+	registeredSmartTransport, err := RegisterManagedGitTransport("gitsinglebranch")
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+	url := fmt.Sprintf("gitsinglebranch://%s/repo.git", daemon.listener.Addr())
+
+	// The default branch is learned from the connection of the fetch.
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	clone, err := Clone(url, path, &CloneOptions{SingleBranch: true})
+	checkFatal(t, err)
+	defer cleanupTestRepo(t, clone)
+	if len(daemon.requests) != 1 {
+		t.Errorf("the clone made %d connections, want 1: %q", len(daemon.requests), daemon.requests)
+	}
+	head, err := clone.Head()
+	checkFatal(t, err)
+	defer head.Free()
+	if head.Name() != "refs/heads/master" || !head.Target().Equal(secondCommit) {
+		t.Errorf("HEAD = %s at %v, want refs/heads/master at %v", head.Name(), head.Target(), secondCommit)
+	}
+	if ref, err := clone.References.Lookup("refs/remotes/origin/feature"); err == nil {
+		ref.Free()
+		t.Error("the clone has refs/remotes/origin/feature")
+	}
+	if _, err := os.Stat(filepath.Join(path, "README")); err != nil {
+		t.Errorf("the default branch was not checked out: %v", err)
+	}
+
+	// With a detached HEAD that no branch points to, the first branch is
+	// cloned.
+	checkFatal(t, serverRepo.SetHeadDetached(secondCommit))
+	master, err := serverRepo.References.Lookup("refs/heads/master")
+	checkFatal(t, err)
+	defer master.Free()
+	rewound, err := master.SetTarget(firstCommit, "rewind")
+	checkFatal(t, err)
+	defer rewound.Free()
+	path, err = ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	detached, err := Clone(url, path, &CloneOptions{Bare: true, SingleBranch: true})
+	checkFatal(t, err)
+	defer cleanupTestRepo(t, detached)
+	head, err = detached.Head()
+	checkFatal(t, err)
+	defer head.Free()
+	if head.Name() != "refs/heads/feature" || !head.Target().Equal(firstCommit) {
+		t.Errorf("HEAD = %s at %v, want refs/heads/feature at %v", head.Name(), head.Target(), firstCommit)
+	}
+}
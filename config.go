@@ -6,6 +6,7 @@ package git
 import "C"
 import (
 	"runtime"
+	"sort"
 	"unsafe"
 )
 
@@ -466,3 +467,30 @@ func OpenDefault() (*Config, error) {
 
 	return config, nil
 }
+
+// readConfigEntries returns the entries whose names match regexp, ordered
+// from the least to the most specific configuration level, so that later
+// entries take precedence as in git.
+func readConfigEntries(config *Config, regexp string) ([]*ConfigEntry, error) {
+	iter, err := config.NewIteratorGlob(regexp)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+
+	var entries []*ConfigEntry
+	for {
+		entry, err := iter.Next()
+		if IsErrorCode(err, ErrorCodeIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Level < entries[j].Level
+	})
+	return entries, nil
+}
@@ -0,0 +1,559 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// CredentialDescription describes a credential in the terms of git's
+// credential helper protocol.
+type CredentialDescription struct {
+	// Protocol is the protocol of the remote, such as "https".
+	Protocol string
+	// Host is the host of the remote, including the port if one was given.
+	Host string
+	// Path is the path of the repository on the remote. For HTTP remotes,
+	// it is only set if credential.useHttpPath is enabled.
+	Path     string
+	Username string
+	Password string
+}
+
+// CredentialBackend stores and retrieves credentials on behalf of a
+// CredentialHelper.
+type CredentialBackend interface {
+	// Get fills in the username and password of desc, if it knows them.
+	Get(desc *CredentialDescription) error
+	// Store records a credential that has been accepted by the remote.
+	Store(desc CredentialDescription) error
+	// Erase forgets a credential that has been rejected by the remote.
+	Erase(desc CredentialDescription) error
+}
+
+// CredentialHelper provides credentials through the credential helpers
+// configured in a repository, following git's credential.helper and
+// credential.<url>.* settings. When it is set as the
+// RemoteCallbacks.CredentialHelper of a fetch, push or clone, the operation
+// tells it whether the credential was accepted, so that the helpers can
+// store or erase it; operations that run at the same time keep track of
+// their credentials separately. Its CredentialsCallback method can also be used as the
+// RemoteCallbacks.CredentialsCallback of other operations, whose result
+// should then be passed to Complete.
+type CredentialHelper struct {
+	// Backends are consulted after the configured helpers, in order.
+	Backends []CredentialBackend
+
+	entries []*ConfigEntry
+	// operation is set on the helper that an operation uses in place of
+	// the one in its callbacks.
+	operation bool
+
+	mu sync.Mutex
+	// pending is the credential that was last handed out, along with the
+	// backends that need to hear whether it was accepted.
+	pending         *CredentialDescription
+	pendingBackends []CredentialBackend
+}
+
+// NewCredentialHelper creates a credential helper that uses the helpers
+// configured in config. The configuration is read immediately.
+func NewCredentialHelper(config *Config) (*CredentialHelper, error) {
+	entries, err := readConfigEntries(config, `^credential\.`)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialHelper{entries: entries}, nil
+}
+
+// credentialSettings are the credential.* settings that apply to a URL.
+type credentialSettings struct {
+	helpers     []string
+	username    string
+	useHttpPath bool
+}
+
+// settingsForURL returns the settings that apply to rawURL. As in git, the
+// username in rawURL is not part of the URL that the credential.<url>.*
+// keys are matched against: a key whose URL has a username only applies to
+// URLs with the same username. The username in rawURL takes precedence over
+// credential.username.
+func (h *CredentialHelper) settingsForURL(rawURL string) credentialSettings {
+	var settings credentialSettings
+	rawURL, username := splitURLUsername(rawURL)
+	for _, entry := range h.entries {
+		name := strings.TrimPrefix(entry.Name, "credential.")
+		key := name
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			pattern, patternUsername := splitURLUsername(name[:i])
+			if patternUsername != "" && patternUsername != username {
+				continue
+			}
+			if !httpConfigURLMatches(pattern, rawURL) {
+				continue
+			}
+			key = name[i+1:]
+		}
+
+		switch key {
+		case "helper":
+			// As in git, an empty value resets the list of helpers.
+			if entry.Value == "" {
+				settings.helpers = nil
+			} else {
+				settings.helpers = append(settings.helpers, entry.Value)
+			}
+		case "username":
+			settings.username = entry.Value
+		case "usehttppath":
+			settings.useHttpPath = parseConfigBool(entry.Value)
+		}
+	}
+	if username != "" {
+		settings.username = username
+	}
+	return settings
+}
+
+// splitURLUsername removes the user information from rawURL, and returns
+// the username that it held.
+func splitURLUsername(rawURL string) (string, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL, ""
+	}
+	username := u.User.Username()
+	u.User = nil
+	return u.String(), username
+}
+
+// parseConfigBool parses a boolean value the way git does.
+func parseConfigBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1", "":
+		return true
+	}
+	return false
+}
+
+// CredentialsCallback asks the helpers for a username and password for the
+// URL. A callback for a URL whose credential is still pending means that the
+// remote has rejected it, so it is erased before asking again.
+func (h *CredentialHelper) CredentialsCallback(rawURL string, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+	if allowedTypes&CredentialTypeUserpassPlaintext == 0 {
+		return nil, &GitError{Message: "credential helpers only provide passwords", Class: ErrorClassNet, Code: ErrorCodePassthrough}
+	}
+
+	settings := h.settingsForURL(rawURL)
+	desc, err := newCredentialDescription(rawURL, settings.useHttpPath)
+	if err != nil {
+		return nil, err
+	}
+	desc.Username = usernameFromURL
+	if desc.Username == "" {
+		desc.Username = settings.username
+	}
+	if err := desc.check(); err != nil {
+		return nil, err
+	}
+
+	var backends []CredentialBackend
+	for _, helper := range settings.helpers {
+		backends = append(backends, NewCredentialHelperCommand(helper))
+	}
+	backends = append(backends, h.Backends...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pending != nil && h.pending.Protocol == desc.Protocol && h.pending.Host == desc.Host && h.pending.Path == desc.Path {
+		if err := h.reject(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, backend := range backends {
+		if err := backend.Get(desc); err != nil {
+			return nil, err
+		}
+		if desc.Username != "" && desc.Password != "" {
+			break
+		}
+	}
+	if desc.Password == "" {
+		return nil, &GitError{Message: "no credential helper provided a password for " + rawURL, Class: ErrorClassNet, Code: ErrorCodePassthrough}
+	}
+
+	h.pending = desc
+	h.pendingBackends = backends
+	return NewCredentialUserpassPlaintext(desc.Username, desc.Password)
+}
+
+// Approve tells the helpers that the credential that was last handed out has
+// been accepted, so that they can store it.
+func (h *CredentialHelper) Approve() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pending == nil {
+		return nil
+	}
+	var firstErr error
+	for _, backend := range h.pendingBackends {
+		if err := backend.Store(*h.pending); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	h.pending = nil
+	h.pendingBackends = nil
+	return firstErr
+}
+
+// Reject tells the helpers that the credential that was last handed out has
+// been rejected, so that they can erase it.
+func (h *CredentialHelper) Reject() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reject()
+}
+
+func (h *CredentialHelper) reject() error {
+	if h.pending == nil {
+		return nil
+	}
+	var firstErr error
+	for _, backend := range h.pendingBackends {
+		if err := backend.Erase(*h.pending); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	h.pending = nil
+	h.pendingBackends = nil
+	return firstErr
+}
+
+// Complete approves or rejects the pending credential according to the
+// result of the operation that used it: it is approved if err is nil and
+// rejected if it is an authentication error. The operation's error is
+// returned unchanged unless approving or rejecting fails.
+func (h *CredentialHelper) Complete(err error) error {
+	var helperErr error
+	if err == nil {
+		helperErr = h.Approve()
+	} else if IsErrorCode(err, ErrorCodeAuth) {
+		helperErr = h.Reject()
+	}
+	if err != nil {
+		return err
+	}
+	return helperErr
+}
+
+// beginOperation returns the helper that an operation uses in place of h.
+// It shares the configuration and the backends of h, but keeps its own
+// pending credential, so that operations that run at the same time with the
+// same helper do not store or erase each other's credentials. If h already
+// is the helper of an operation, such as that of the clone that runs a
+// fetch, it is returned with started set to false, and the operation that
+// began it completes it.
+func (h *CredentialHelper) beginOperation() (op *CredentialHelper, started bool) {
+	if h == nil || h.operation {
+		return h, false
+	}
+	return &CredentialHelper{Backends: h.Backends, entries: h.entries, operation: true}, true
+}
+
+// completeOperation approves or rejects the pending credential according to
+// the result of an operation that used the helper. As in git, the failures
+// of the helpers do not make the operation fail.
+func (h *CredentialHelper) completeOperation(err error) {
+	if h == nil {
+		return
+	}
+	h.Complete(err)
+}
+
+// fields returns the keys and values of desc, in the order in which they
+// are written to the helpers.
+func (desc *CredentialDescription) fields() [][2]string {
+	return [][2]string{
+		{"protocol", desc.Protocol},
+		{"host", desc.Host},
+		{"path", desc.Path},
+		{"username", desc.Username},
+		{"password", desc.Password},
+	}
+}
+
+// check refuses descriptions that cannot be written in the key=value form,
+// such as one for a URL with an encoded newline, which could otherwise
+// smuggle lines for another host to the helpers.
+func (desc *CredentialDescription) check() error {
+	for _, field := range desc.fields() {
+		if strings.ContainsAny(field[1], "\n\x00") {
+			return &GitError{Message: "credential " + field[0] + " contains a newline or NUL byte", Class: ErrorClassNet, Code: ErrorCodeInvalid}
+		}
+	}
+	return nil
+}
+
+func newCredentialDescription(rawURL string, useHttpPath bool) (*CredentialDescription, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &CredentialDescription{
+		Protocol: u.Scheme,
+		Host:     u.Host,
+	}
+	if useHttpPath || (u.Scheme != "http" && u.Scheme != "https") {
+		desc.Path = strings.TrimPrefix(u.Path, "/")
+	}
+	return desc, nil
+}
+
+// credentialHelperCommand runs a git credential helper.
+type credentialHelperCommand struct {
+	helper string
+	// shell is the command of a helper that is run with the shell.
+	shell string
+	// args are the program and the arguments of a helper that is run
+	// directly.
+	args []string
+}
+
+// NewCredentialHelperCommand creates a backend that runs a helper as
+// configured in credential.helper: a name such as "store" runs
+// "git credential-store", an absolute path runs that program and a value
+// starting with "!" is run as a shell command. Names and paths may be
+// followed by arguments, separated by spaces. The action (get, store or
+// erase) is appended to the command, and the credential is exchanged with it
+// using git's key=value protocol.
+func NewCredentialHelperCommand(helper string) CredentialBackend {
+	c := &credentialHelperCommand{helper: helper}
+	fields := strings.Fields(helper)
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		c.shell = helper[1:]
+	case filepath.IsAbs(helper):
+		c.args = fields
+	case len(fields) > 0:
+		c.args = append([]string{"git", "credential-" + fields[0]}, fields[1:]...)
+	}
+	return c
+}
+
+func (c *credentialHelperCommand) run(action string, desc CredentialDescription) ([]byte, error) {
+	var input bytes.Buffer
+	if err := writeCredentialDescription(&input, desc); err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	switch {
+	case c.shell != "":
+		cmd = exec.Command("sh", "-c", c.shell+" "+action)
+	case len(c.args) > 0:
+		cmd = exec.Command(c.args[0], append(c.args[1:len(c.args):len(c.args)], action)...)
+	default:
+		return nil, fmt.Errorf("credential helper %q is empty", c.helper)
+	}
+	cmd.Stdin = &input
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed: %v", c.helper, err)
+	}
+	return output, nil
+}
+
+func (c *credentialHelperCommand) Get(desc *CredentialDescription) error {
+	output, err := c.run("get", *desc)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		switch key {
+		case "username":
+			desc.Username = value
+		case "password":
+			desc.Password = value
+		case "quit":
+			if parseConfigBool(value) {
+				return &GitError{Message: "credential helper " + c.helper + " told us to quit", Class: ErrorClassNet, Code: ErrorCodeAuth}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *credentialHelperCommand) Store(desc CredentialDescription) error {
+	_, err := c.run("store", desc)
+	return err
+}
+
+func (c *credentialHelperCommand) Erase(desc CredentialDescription) error {
+	_, err := c.run("erase", desc)
+	return err
+}
+
+// writeCredentialDescription writes the non-empty fields of desc in the
+// key=value form, terminated by a blank line.
+func writeCredentialDescription(buf *bytes.Buffer, desc CredentialDescription) error {
+	if err := desc.check(); err != nil {
+		return err
+	}
+	for _, field := range desc.fields() {
+		if field[1] != "" {
+			fmt.Fprintf(buf, "%s=%s\n", field[0], field[1])
+		}
+	}
+	buf.WriteString("\n")
+	return nil
+}
+
+// netrcCredentialBackend reads credentials from a .netrc file.
+type netrcCredentialBackend struct {
+	path string
+}
+
+// NewNetrcCredentialBackend creates a read-only backend for the .netrc file
+// at path. If path is empty, the file named by the NETRC environment
+// variable is used, or else .netrc (_netrc on Windows) in the home
+// directory.
+func NewNetrcCredentialBackend(path string) CredentialBackend {
+	return &netrcCredentialBackend{path: path}
+}
+
+func (n *netrcCredentialBackend) filename() (string, error) {
+	if n.path != "" {
+		return n.path, nil
+	}
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc"), nil
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// netrcEntry is a machine or default entry of a .netrc file.
+type netrcEntry struct {
+	machine   string
+	isDefault bool
+	login     string
+	password  string
+}
+
+func (n *netrcCredentialBackend) Get(desc *CredentialDescription) error {
+	filename, err := n.filename()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hostname := (&url.URL{Host: desc.Host}).Hostname()
+
+	for _, entry := range parseNetrc(string(data)) {
+		if !entry.isDefault && entry.machine != desc.Host && entry.machine != hostname {
+			continue
+		}
+		if desc.Username != "" && entry.login != "" && entry.login != desc.Username {
+			continue
+		}
+		if entry.password == "" {
+			continue
+		}
+		if desc.Username == "" {
+			desc.Username = entry.login
+		}
+		desc.Password = entry.password
+		return nil
+	}
+	return nil
+}
+
+func (n *netrcCredentialBackend) Store(desc CredentialDescription) error {
+	return nil
+}
+
+func (n *netrcCredentialBackend) Erase(desc CredentialDescription) error {
+	return nil
+}
+
+// parseNetrc parses the entries of a .netrc file. Macro definitions are
+// skipped.
+func parseNetrc(data string) []netrcEntry {
+	var entries []netrcEntry
+	current := -1
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			if strings.HasPrefix(fields[j], "#") {
+				break
+			}
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+
+			switch fields[j] {
+			case "machine":
+				entries = append(entries, netrcEntry{machine: next()})
+				current = len(entries) - 1
+			case "default":
+				entries = append(entries, netrcEntry{isDefault: true})
+				current = len(entries) - 1
+			case "login":
+				if current >= 0 {
+					entries[current].login = next()
+				}
+			case "password":
+				if current >= 0 {
+					entries[current].password = next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// The macro runs until the next blank line.
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return entries
+}
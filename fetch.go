@@ -0,0 +1,338 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FetchedRefStatus tells how a fetch changed a local ref.
+type FetchedRefStatus int
+
+const (
+	// FetchedRefNew means that the fetch created the ref.
+	FetchedRefNew FetchedRefStatus = iota
+	// FetchedRefDeleted means that the fetch pruned the ref.
+	FetchedRefDeleted
+	// FetchedRefFastForward means that the new value of the ref descends
+	// from the old one.
+	FetchedRefFastForward
+	// FetchedRefForced means that the new value of the ref does not
+	// descend from the old one.
+	FetchedRefForced
+)
+
+// FetchedRef is the update of a local ref by a fetch.
+type FetchedRef struct {
+	// Name is the name of the local ref.
+	Name string
+	// OldId is the value of the ref before the fetch. It is zero if the
+	// ref did not exist.
+	OldId *Oid
+	// NewId is the value of the ref after the fetch. It is zero if the
+	// ref was pruned.
+	NewId *Oid
+	// Status tells how the ref changed.
+	Status FetchedRefStatus
+	// Refspec is the refspec whose destination matched the ref. It is
+	// empty for the tags that the fetch followed automatically.
+	Refspec string
+}
+
+// FetchResult describes what a fetch changed.
+type FetchResult struct {
+	// Refs are the local refs that the fetch created, updated or pruned,
+	// in the order in which it did so.
+	Refs []FetchedRef
+	// Stats are the totals of the transfer, including the number of bytes
+	// received.
+	Stats TransferProgress
+}
+
+// fetchState collects the outcome of a fetch from the callbacks.
+type fetchState struct {
+	mu    sync.Mutex
+	refs  []FetchedRef
+	stats TransferProgress
+}
+
+// updateTip records the update of a local ref.
+func (f *fetchState) updateTip(refname string, oldId, newId *Oid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs = append(f.refs, FetchedRef{Name: refname, OldId: oldId, NewId: newId})
+}
+
+func (f *fetchState) setStats(stats TransferProgress) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats = stats
+}
+
+// result classifies the updates of the fetch into repo, and finds the
+// refspecs that matched them.
+func (f *fetchState) result(repo *Repository, refspecs []string) *FetchResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var parsed []*Refspec
+	for _, refspec := range refspecs {
+		spec, err := ParseRefspec(refspec, true)
+		if err != nil {
+			// Short refspecs such as a bare branch name have no
+			// destination to match.
+			continue
+		}
+		defer spec.Free()
+		parsed = append(parsed, spec)
+	}
+
+	result := &FetchResult{
+		Refs:  make([]FetchedRef, 0, len(f.refs)),
+		Stats: f.stats,
+	}
+	for _, ref := range f.refs {
+		switch {
+		case ref.OldId.IsZero():
+			ref.Status = FetchedRefNew
+		case ref.NewId.IsZero():
+			ref.Status = FetchedRefDeleted
+		default:
+			// Refs that do not point to commits, such as annotated tags,
+			// cannot fast-forward.
+			ref.Status = FetchedRefForced
+			if repo != nil {
+				descendant, err := repo.DescendantOf(ref.NewId, ref.OldId)
+				if err == nil && descendant {
+					ref.Status = FetchedRefFastForward
+				}
+			}
+		}
+		for _, spec := range parsed {
+			if spec.Dst() != "" && spec.DstMatches(ref.Name) {
+				ref.Refspec = spec.String()
+				break
+			}
+		}
+		result.Refs = append(result.Refs, ref)
+	}
+	return result
+}
+
+// FetchObjects fetches the objects ids and their history from the remote,
+// without updating any ref but FETCH_HEAD. The server must accept wants of
+// objects that it does not advertise, which git servers do with
+// uploadpack.allowReachableSHA1InWant or uploadpack.allowTipSHA1InWant.
+// If it does not advertise either, FetchObjects fails before asking for
+// the objects.
+func (o *Remote) FetchObjects(ids []*Oid, opts *FetchOptions) error {
+	return o.FetchObjectsContext(context.Background(), ids, opts)
+}
+
+// FetchObjectsContext fetches objects like FetchObjects, but aborts the
+// operation as soon as ctx is done. In that case the error returned is
+// ctx.Err().
+func (o *Remote) FetchObjectsContext(ctx context.Context, ids []*Oid, opts *FetchOptions) error {
+	if len(ids) == 0 {
+		return errors.New("no object to fetch")
+	}
+	refspecs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		refspecs = append(refspecs, id.String())
+	}
+	_, err := o.fetch(ctx, refspecs, opts, "")
+	return err
+}
+
+// FetchPack fetches from the remote like FetchWithResult, but writes the
+// pack it receives to sink instead of the object database of the
+// repository, and leaves the refs of the repository alone. The pack holds
+// all the objects that the repository lacks, without deltas against
+// objects it has, so it can be checked and then admitted with an
+// OdbWritepack or an Indexer, or relayed to another server. Nothing is
+// written if the repository is up to date. The result describes the
+// updates of the refs that the fetch would have made.
+func (o *Remote) FetchPack(refspecs []string, opts *FetchOptions, sink io.Writer) (*FetchResult, error) {
+	return o.FetchPackContext(context.Background(), refspecs, opts, sink)
+}
+
+// FetchPackContext fetches a pack like FetchPack, but aborts the operation
+// as soon as ctx is done. In that case the error returned is ctx.Err().
+func (o *Remote) FetchPackContext(ctx context.Context, refspecs []string, opts *FetchOptions, sink io.Writer) (*FetchResult, error) {
+	if opts == nil {
+		opts = defaultFetchOptions()
+	}
+	if opts.Depth != 0 || !opts.ShallowSince.IsZero() || len(opts.ShallowExclude) > 0 || opts.Unshallow {
+		return nil, errors.New("a pack cannot be fetched into a sink with a shallow fetch")
+	}
+	repo := o.owner()
+	if repo == nil {
+		return nil, errors.New("the remote does not belong to a repository")
+	}
+	isShallow, err := repo.IsShallow()
+	if err != nil {
+		return nil, err
+	}
+	if isShallow {
+		return nil, ErrShallowRepository
+	}
+	if len(refspecs) == 0 {
+		if refspecs, err = o.FetchRefspecs(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The objects are fetched into a staging repository that shares the
+	// objects and the configuration of repo and has copies of its refs, so
+	// that the fetch is the same. Its pack is then handed to the sink.
+	dir, err := ioutil.TempDir("", "git2go-fetch-pack-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	staging, err := newStagingRepository(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer staging.Free()
+
+	remote, err := o.remoteIn(repo, staging)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Free()
+
+	stagingOpts := *opts
+	stagingOpts.UpdateFetchhead = false
+	result, err := remote.fetch(ctx, refspecs, &stagingOpts, "")
+	if err != nil {
+		return nil, err
+	}
+
+	packs, err := filepath.Glob(filepath.Join(staging.Path(), "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	switch len(packs) {
+	case 0:
+		return result, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("the fetch produced %d packs", len(packs))
+	}
+
+	pack, err := os.Open(packs[0])
+	if err != nil {
+		return nil, err
+	}
+	defer pack.Close()
+	if _, err := io.Copy(sink, pack); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// newStagingRepository creates a bare repository in dir that borrows the
+// objects of repo and has copies of its direct refs.
+func newStagingRepository(repo *Repository, dir string) (*Repository, error) {
+	staging, err := newBorrowingRepository(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyDirectReferences(repo, staging); err != nil {
+		staging.Free()
+		return nil, err
+	}
+	return staging, nil
+}
+
+// remoteIn returns a remote of tmp, a temporary repository that stands in
+// for repo, that fetches like o. tmp is given the configuration of repo,
+// so that the settings of the remote, and the http, url, protocol, proxy
+// and credential settings, apply as they do to o.
+func (o *Remote) remoteIn(repo, tmp *Repository) (*Remote, error) {
+	config, err := repo.Config()
+	if err != nil {
+		return nil, err
+	}
+	defer config.Free()
+	if err := tmp.SetConfig(config); err != nil {
+		return nil, err
+	}
+
+	if o.Name() == "" {
+		return tmp.Remotes.CreateAnonymous(o.Url())
+	}
+	remote, err := tmp.Remotes.Lookup(o.Name())
+	if IsErrorCode(err, ErrorCodeNotFound) {
+		return tmp.Remotes.CreateAnonymous(o.Url())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote.Url() != o.Url() {
+		if err := remote.SetInstanceUrl(o.Url()); err != nil {
+			remote.Free()
+			return nil, err
+		}
+	}
+	return remote, nil
+}
+
+// newBorrowingRepository creates a bare repository in dir that borrows the
+// objects of repo through its alternates.
+func newBorrowingRepository(repo *Repository, dir string) (*Repository, error) {
+	borrowing, err := InitRepository(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := filepath.Abs(filepath.Join(repo.Path(), "objects"))
+	if err != nil {
+		borrowing.Free()
+		return nil, err
+	}
+	alternates := filepath.Join(borrowing.Path(), "objects", "info", "alternates")
+	if err := ioutil.WriteFile(alternates, []byte(objects+"\n"), 0644); err != nil {
+		borrowing.Free()
+		return nil, err
+	}
+	return borrowing, nil
+}
+
+// copyDirectReferences creates in dst the refs of src that point directly
+// to objects.
+func copyDirectReferences(src, dst *Repository) error {
+	iter, err := src.NewReferenceIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Free()
+
+	for {
+		ref, err := iter.Next()
+		if IsErrorCode(err, ErrorCodeIterOver) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ref.Type() == ReferenceOid {
+			var created *Reference
+			created, err = dst.References.Create(ref.Name(), ref.Target(), true, "")
+			if err == nil {
+				created.Free()
+			}
+		}
+		ref.Free()
+		if err != nil {
+			return err
+		}
+	}
+}
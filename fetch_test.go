@@ -0,0 +1,222 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFetchWithResult(t *testing.T) {
+	t.Parallel()
+	remoteRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, remoteRepo)
+	firstCommit, _ := seedTestRepo(t, remoteRepo)
+
+	commit, err := remoteRepo.LookupCommit(firstCommit)
+	checkFatal(t, err)
+	defer commit.Free()
+	branch, err := remoteRepo.CreateBranch("doomed", commit, false)
+	checkFatal(t, err)
+	defer branch.Free()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+	repo, result, err := CloneWithResult(fmt.Sprintf("file://%s", remoteRepo.Workdir()), path, &CloneOptions{Bare: true})
+	checkFatal(t, err)
+	defer repo.Free()
+
+	refs := make(map[string]FetchedRef)
+	for _, ref := range result.Refs {
+		refs[ref.Name] = ref
+	}
+	master := refs["refs/remotes/origin/master"]
+	if master.Status != FetchedRefNew || !master.OldId.IsZero() || !master.NewId.Equal(firstCommit) ||
+		master.Refspec != "+refs/heads/*:refs/remotes/origin/*" {
+		t.Errorf("unexpected clone result for master: %+v", master)
+	}
+
+	remote, err := repo.Remotes.Lookup("origin")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	// A fast-forward of master, and the deletion of a pruned branch.
+	secondCommit, _ := updateReadme(t, remoteRepo, "second commit")
+	checkFatal(t, branch.Delete())
+	result, err = remote.FetchWithResult(nil, &FetchOptions{Prune: FetchPruneOn}, "")
+	checkFatal(t, err)
+	refs = make(map[string]FetchedRef)
+	for _, ref := range result.Refs {
+		refs[ref.Name] = ref
+	}
+	master = refs["refs/remotes/origin/master"]
+	if master.Status != FetchedRefFastForward || !master.OldId.Equal(firstCommit) || !master.NewId.Equal(secondCommit) {
+		t.Errorf("unexpected fetch result for master: %+v", master)
+	}
+	if doomed := refs["refs/remotes/origin/doomed"]; doomed.Status != FetchedRefDeleted || !doomed.NewId.IsZero() {
+		t.Errorf("unexpected fetch result for the pruned branch: %+v", doomed)
+	}
+	if result.Stats.TotalObjects == 0 || result.Stats.ReceivedObjects != result.Stats.TotalObjects {
+		t.Errorf("the fetch did not report its totals: %+v", result.Stats)
+	}
+
+	// A forced update of master.
+	masterRef, err := remoteRepo.References.Lookup("refs/heads/master")
+	checkFatal(t, err)
+	defer masterRef.Free()
+	rewound, err := masterRef.SetTarget(firstCommit, "rewind")
+	checkFatal(t, err)
+	defer rewound.Free()
+	result, err = remote.FetchWithResult(nil, nil, "")
+	checkFatal(t, err)
+	if len(result.Refs) != 1 || result.Refs[0].Status != FetchedRefForced || !result.Refs[0].NewId.Equal(firstCommit) {
+		t.Errorf("unexpected fetch result: %+v", result.Refs)
+	}
+}
+
+func TestFetchObjects(t *testing.T) {
+	t.Parallel()
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstCommit, _ := seedTestRepo(t, serverRepo)
+	secondCommit, _ := updateReadme(t, serverRepo, "second commit")
+
+	daemon := startTestGitDaemon(t, serverRepo)
+	defer daemon.listener.Close()
+	registeredSmartTransport, err := RegisterManagedGitTransport("gitobjects")
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", fmt.Sprintf("gitobjects://%s/repo.git", daemon.listener.Addr()))
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkFatal(t, remote.FetchObjects([]*Oid{firstCommit}, nil))
+
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	if !odb.Exists(firstCommit) || odb.Exists(secondCommit) {
+		t.Error("the fetch did not get exactly the wanted commit")
+	}
+	if ref, err := repo.References.Lookup("refs/remotes/origin/master"); err == nil {
+		ref.Free()
+		t.Error("fetching an object updated a ref")
+	}
+}
+
+func TestFetchObjectsNotAllowed(t *testing.T) {
+	t.Parallel()
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstCommit, _ := seedTestRepo(t, serverRepo)
+	updateReadme(t, serverRepo, "second commit")
+
+	// Without uploadpack.allowReachableSHA1InWant, git http-backend
+	// advertises neither capability.
+	server := httptest.NewServer(newTestHTTPBackend(t, serverRepo))
+	defer server.Close()
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	if err := remote.FetchObjects([]*Oid{firstCommit}, nil); err != errObjectIdsNotAllowed {
+		t.Errorf("FetchObjects() = %v, want %v", err, errObjectIdsNotAllowed)
+	}
+}
+
+func TestFetchPack(t *testing.T) {
+	t.Parallel()
+	remoteRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, remoteRepo)
+	firstCommit, _ := seedTestRepo(t, remoteRepo)
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", fmt.Sprintf("file://%s", remoteRepo.Workdir()))
+	checkFatal(t, err)
+	defer remote.Free()
+	checkFatal(t, remote.Fetch(nil, nil, ""))
+
+	secondCommit, _ := updateReadme(t, remoteRepo, "second commit")
+	var pack bytes.Buffer
+	result, err := remote.FetchPack(nil, nil, &pack)
+	checkFatal(t, err)
+	if !bytes.HasPrefix(pack.Bytes(), []byte("PACK")) {
+		t.Fatalf("the sink did not receive a pack: %q", pack.Bytes())
+	}
+	if len(result.Refs) != 1 || result.Refs[0].Name != "refs/remotes/origin/master" ||
+		result.Refs[0].Status != FetchedRefFastForward || !result.Refs[0].OldId.Equal(firstCommit) {
+		t.Errorf("unexpected result: %+v", result.Refs)
+	}
+
+	// Neither the objects nor the refs of the repository changed.
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	if odb.Exists(secondCommit) {
+		t.Error("the pack was written to the repository")
+	}
+	ref, err := repo.References.Lookup("refs/remotes/origin/master")
+	checkFatal(t, err)
+	defer ref.Free()
+	if !ref.Target().Equal(firstCommit) {
+		t.Errorf("refs/remotes/origin/master = %v, want %v", ref.Target(), firstCommit)
+	}
+
+	// The pack can then be admitted.
+	writepack, err := odb.NewWritePack(nil)
+	checkFatal(t, err)
+	defer writepack.Free()
+	_, err = writepack.Write(pack.Bytes())
+	checkFatal(t, err)
+	checkFatal(t, writepack.Commit())
+	if !odb.Exists(secondCommit) {
+		t.Error("the admitted pack does not have the new commit")
+	}
+}
+
+func TestFetchPackKeepsConfiguration(t *testing.T) {
+	t.Parallel()
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	seedTestRepo(t, serverRepo)
+
+	// The server only answers the requests that carry the extra header of
+	// the configuration.
+	backend := newTestHTTPBackend(t, serverRepo)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "missing token", http.StatusForbidden)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	config, err := repo.Config()
+	checkFatal(t, err)
+	defer config.Free()
+	checkFatal(t, config.SetString("http.extraheader", "X-Token: secret"))
+	remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	var pack bytes.Buffer
+	_, err = remote.FetchPack(nil, nil, &pack)
+	checkFatal(t, err)
+	if !bytes.HasPrefix(pack.Bytes(), []byte("PACK")) {
+		t.Fatalf("the sink did not receive a pack: %q", pack.Bytes())
+	}
+}
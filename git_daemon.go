@@ -0,0 +1,275 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultGitDaemonPort is the port of git daemon.
+const defaultGitDaemonPort = 9418
+
+// RegisterManagedGitTransport registers a Go-native implementation of the
+// git:// transport, which speaks the protocol of git daemon over TCP.
+// libgit2 has its own implementation of it, which registering the "git"
+// protocol replaces.
+//
+// Connections go through the SOCKS5 or HTTP proxy of the proxy options of
+// an operation. With ProxyTypeAuto, the proxy is taken from the ALL_PROXY
+// environment variable. The NO_PROXY environment variable is honored.
+//
+// If Shutdown or ReInit are called, make sure that the smart transports are
+// freed before it.
+func RegisterManagedGitTransport(protocol string) (*RegisteredSmartTransport, error) {
+	return RegisterManagedGitTransportWithOptions(protocol, nil)
+}
+
+// ManagedGitTransportOptions are the options for the Go-native
+// implementation of the git:// transport.
+type ManagedGitTransportOptions struct {
+	// ProtocolVersion is the version of the git protocol requested from the
+	// server when fetching. It is requested through an extra parameter of
+	// the initial request, which older servers ignore.
+	ProtocolVersion ProtocolVersion
+
+	// ExtraParameters are additional parameters of the initial request, in
+	// the key=value form. The parameter that requests the protocol version
+	// is added by the transport.
+	ExtraParameters []string
+}
+
+// RegisterManagedGitTransportWithOptions registers a Go-native
+// implementation of the git:// transport like RegisterManagedGitTransport,
+// configured with the provided options.
+func RegisterManagedGitTransportWithOptions(protocol string, opts *ManagedGitTransportOptions) (*RegisteredSmartTransport, error) {
+	return NewRegisteredSmartTransport(protocol, false, newGitSmartSubtransportFactory(opts))
+}
+
+func newGitSmartSubtransportFactory(opts *ManagedGitTransportOptions) SmartSubtransportCallback {
+	if opts == nil {
+		opts = &ManagedGitTransportOptions{}
+	}
+
+	return func(remote *Remote, transport *Transport) (SmartSubtransport, error) {
+		proxy, err := newManagedProxy(remote, transport, DefaultManagedHTTPMaxAuthAttempts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &gitSmartSubtransport{
+			remote:          remote,
+			transport:       transport,
+			protocolVersion: resolveProtocolVersion(opts.ProtocolVersion, remote),
+			extraParameters: opts.ExtraParameters,
+			proxy:           proxy,
+		}, nil
+	}
+}
+
+type gitSmartSubtransport struct {
+	remote          *Remote
+	transport       *Transport
+	protocolVersion ProtocolVersion
+	extraParameters []string
+	proxy           *managedProxy
+	// protocolV2 is set once the server has announced protocol v2.
+	protocolV2 *protocolV2Session
+
+	lastAction    SmartServiceAction
+	conn          net.Conn
+	stopWatching  chan struct{}
+	currentStream SmartSubtransportStream
+}
+
+func (t *gitSmartSubtransport) Action(urlString string, action SmartServiceAction) (SmartSubtransportStream, error) {
+	var service string
+	var detectVersion bool
+	switch action {
+	case SmartServiceActionUploadpackLs, SmartServiceActionUploadpack:
+		if t.currentStream != nil {
+			if t.lastAction == SmartServiceActionUploadpackLs {
+				return t.currentStream, nil
+			}
+			t.Close()
+		}
+		service = "git-upload-pack"
+		detectVersion = t.protocolVersion != ProtocolVersionV0
+
+	case SmartServiceActionReceivepackLs, SmartServiceActionReceivepack:
+		if t.currentStream != nil {
+			if t.lastAction == SmartServiceActionReceivepackLs {
+				return t.currentStream, nil
+			}
+			t.Close()
+		}
+		service = "git-receive-pack"
+
+	default:
+		return nil, fmt.Errorf("unexpected action: %v", action)
+	}
+
+	host, port, repoPath, err := parseGitDaemonURL(urlString)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	virtualHost := host
+	if strings.Contains(virtualHost, ":") {
+		virtualHost = "[" + virtualHost + "]"
+	}
+	if port != defaultGitDaemonPort {
+		virtualHost += ":" + strconv.Itoa(port)
+	}
+
+	extraParameters := t.extraParameters
+	if detectVersion {
+		extraParameters = append([]string{t.protocolVersion.gitProtocolParameter()}, extraParameters...)
+	}
+
+	ctx := t.transport.Context()
+	t.conn, err = t.proxy.dialContext(ctx, "git", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.closeOnDone(ctx)
+
+	request := gitDaemonRequest(service, repoPath, virtualHost, extraParameters)
+	if err := encodePktLine(t.conn, request); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	t.lastAction = action
+	t.currentStream = &gitSmartSubtransportStream{owner: t}
+	if detectVersion {
+		t.currentStream = newVersionDetectingStream(t.currentStream, func(capabilities map[string]string, r *bufio.Reader, serviceHeader bool) *protocolV2Session {
+			session := newProtocolV2Session(&gitProtocolV2Conn{owner: t, r: r}, capabilities, serviceHeader, t.transport.fetchRefPrefixes)
+			t.setProtocolV2(session)
+			return session
+		})
+	}
+
+	return t.currentStream, nil
+}
+
+// parseGitDaemonURL returns the host, port and path of a
+// git://host[:port]/path URL. As with git, the path of
+// git://host/~user/path is relative to the home directory of user.
+func parseGitDaemonURL(rawURL string) (string, int, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if u.Hostname() == "" {
+		return "", 0, "", fmt.Errorf("invalid git URL %q: missing host", rawURL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		return "", 0, "", fmt.Errorf("invalid git URL %q: missing path", rawURL)
+	}
+
+	port := defaultGitDaemonPort
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", 0, "", fmt.Errorf("invalid git URL %q: invalid port %q", rawURL, p)
+		}
+	}
+
+	repoPath := u.Path
+	if strings.HasPrefix(repoPath, "/~") {
+		repoPath = repoPath[1:]
+	}
+	return u.Hostname(), port, repoPath, nil
+}
+
+// gitDaemonRequest returns the payload of the initial request to git
+// daemon, which names the service, the repository and the virtual host,
+// followed by the extra parameters, each terminated by a NUL byte.
+func gitDaemonRequest(service, repoPath, host string, extraParameters []string) []byte {
+	request := service + " " + repoPath + "\x00host=" + host + "\x00"
+	if len(extraParameters) > 0 {
+		request += "\x00"
+		for _, parameter := range extraParameters {
+			request += parameter + "\x00"
+		}
+	}
+	return []byte(request)
+}
+
+// closeOnDone closes the connection once ctx is done, which interrupts any
+// pending read or write, until the subtransport is closed.
+func (t *gitSmartSubtransport) closeOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	t.stopWatching = stop
+	conn := t.conn
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+}
+
+// setProtocolV2 records the protocol v2 session of the connection, which
+// also lets the remote list refs through it.
+func (t *gitSmartSubtransport) setProtocolV2(session *protocolV2Session) {
+	t.remote.setProtocolV2Connection(t.protocolV2, session)
+	t.protocolV2 = session
+}
+
+func (t *gitSmartSubtransport) Close() error {
+	t.setProtocolV2(nil)
+	t.currentStream = nil
+	if t.stopWatching != nil {
+		close(t.stopWatching)
+		t.stopWatching = nil
+	}
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return nil
+}
+
+func (t *gitSmartSubtransport) Free() {
+}
+
+type gitSmartSubtransportStream struct {
+	owner *gitSmartSubtransport
+}
+
+func (stream *gitSmartSubtransportStream) Read(buf []byte) (int, error) {
+	return stream.owner.conn.Read(buf)
+}
+
+func (stream *gitSmartSubtransportStream) Write(buf []byte) (int, error) {
+	return stream.owner.conn.Write(buf)
+}
+
+func (stream *gitSmartSubtransportStream) Free() {
+}
+
+// gitProtocolV2Conn sends protocol v2 commands over the connection of the
+// subtransport, whose responses are read from r.
+type gitProtocolV2Conn struct {
+	owner *gitSmartSubtransport
+	r     *bufio.Reader
+}
+
+func (c *gitProtocolV2Conn) roundTrip(request []byte) (*bufio.Reader, io.Closer, error) {
+	if _, err := c.owner.conn.Write(request); err != nil {
+		return nil, nil, err
+	}
+	return c.r, ioutil.NopCloser(nil), nil
+}
@@ -0,0 +1,188 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseGitDaemonURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		url      string
+		host     string
+		port     int
+		repoPath string
+		invalid  bool
+	}{
+		{url: "git://example.com/repo.git", host: "example.com", port: 9418, repoPath: "/repo.git"},
+		{url: "git://example.com:1234/org/repo.git", host: "example.com", port: 1234, repoPath: "/org/repo.git"},
+		{url: "git://[::1]:1234/repo.git", host: "::1", port: 1234, repoPath: "/repo.git"},
+		{url: "git://example.com/~user/repo.git", host: "example.com", port: 9418, repoPath: "~user/repo.git"},
+		{url: "git://example.com/with%20space.git", host: "example.com", port: 9418, repoPath: "/with space.git"},
+		{url: "git://example.com/", invalid: true},
+		{url: "git:///repo.git", invalid: true},
+		{url: "git://example.com:0/repo.git", invalid: true},
+	}
+	for _, tt := range tests {
+		host, port, repoPath, err := parseGitDaemonURL(tt.url)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseGitDaemonURL(%q) succeeded, want an error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGitDaemonURL(%q) failed: %v", tt.url, err)
+			continue
+		}
+		if host != tt.host || port != tt.port || repoPath != tt.repoPath {
+			t.Errorf("parseGitDaemonURL(%q) = %q, %d, %q, want %q, %d, %q", tt.url, host, port, repoPath, tt.host, tt.port, tt.repoPath)
+		}
+	}
+
+	request := gitDaemonRequest("git-upload-pack", "/repo.git", "example.com", []string{"version=2", "object-format=sha1"})
+	if want := "git-upload-pack /repo.git\x00host=example.com\x00\x00version=2\x00object-format=sha1\x00"; string(request) != want {
+		t.Errorf("gitDaemonRequest() = %q, want %q", request, want)
+	}
+}
+
+// testGitDaemon serves a repository with git upload-pack and git
+// receive-pack in the manner of git daemon, and records the requests it
+// receives.
+type testGitDaemon struct {
+	listener net.Listener
+	repo     *Repository
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func startTestGitDaemon(t *testing.T, repo *Repository) *testGitDaemon {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	checkFatal(t, err)
+	daemon := &testGitDaemon{listener: listener, repo: repo}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go daemon.serve(t, conn)
+		}
+	}()
+	return daemon
+}
+
+func (d *testGitDaemon) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	r := newPktLineReader(conn)
+	payload, _, err := r.ReadPktLine()
+	if err != nil {
+		t.Errorf("failed to read the request: %v", err)
+		return
+	}
+	request := string(payload)
+	d.mu.Lock()
+	d.requests = append(d.requests, request)
+	d.mu.Unlock()
+
+	// Like git daemon, run the service without passing it the extra
+	// parameters of the request, so that it only speaks protocol v0.
+	var service string
+	switch {
+	case strings.HasPrefix(request, "git-upload-pack "):
+		service = "upload-pack"
+	case strings.HasPrefix(request, "git-receive-pack "):
+		service = "receive-pack"
+	default:
+		encodePktLine(conn, []byte("ERR unknown service\n"))
+		return
+	}
+	cmd := exec.Command("git",
+		"-c", "uploadpack.allowReachableSHA1InWant=true",
+		service, d.repo.Path())
+	cmd.Stdout = conn
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Errorf("failed to serve %q: %v", request, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		t.Errorf("failed to serve %q: %v", request, err)
+		return
+	}
+	go func() {
+		io.Copy(stdin, r.r)
+		stdin.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("failed to serve %q: %v: %s", request, err, stderr.String())
+	}
+}
+
+func (d *testGitDaemon) takeRequests() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	requests := d.requests
+	d.requests = nil
+	return requests
+}
+
+func TestManagedGitTransport(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	daemon := startTestGitDaemon(t, serverRepo)
+	defer daemon.listener.Close()
+	addr := daemon.listener.Addr().String()
+
+	registeredSmartTransport, err := RegisterManagedGitTransportWithOptions("gitd", &ManagedGitTransportOptions{
+		ProtocolVersion: ProtocolVersionV2,
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	commitID, _ := seedTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", fmt.Sprintf("gitd://%s/repo.git", addr))
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkFatal(t, remote.Push([]string{"refs/heads/master:refs/heads/pushed"}, nil))
+	ref, err := serverRepo.References.Lookup("refs/heads/pushed")
+	checkFatal(t, err)
+	if !ref.Target().Equal(commitID) {
+		t.Errorf("pushed ref = %v, want %v", ref.Target(), commitID)
+	}
+	ref.Free()
+
+	// The server only speaks protocol v0, which the client falls back to.
+	checkFatal(t, remote.Fetch([]string{"+refs/heads/*:refs/remotes/origin/*"}, nil, ""))
+	ref, err = repo.References.Lookup("refs/remotes/origin/pushed")
+	checkFatal(t, err)
+	if !ref.Target().Equal(commitID) {
+		t.Errorf("fetched ref = %v, want %v", ref.Target(), commitID)
+	}
+	ref.Free()
+
+	requests := daemon.takeRequests()
+	want := []string{
+		"git-receive-pack /repo.git\x00host=" + addr + "\x00",
+		"git-upload-pack /repo.git\x00host=" + addr + "\x00\x00version=2\x00",
+	}
+	if len(requests) < 2 || requests[0] != want[0] || requests[len(requests)-1] != want[1] {
+		t.Errorf("unexpected requests %q, want %q", requests, want)
+	}
+}
@@ -66,3 +66,13 @@ func (v *HandleList) Get(handle unsafe.Pointer) interface{} {
 
 	return ptr
 }
+
+// lookup retrieves the pointer from the given handle, reporting whether the
+// handle is still being tracked.
+func (v *HandleList) lookup(handle unsafe.Pointer) (interface{}, bool) {
+	v.RLock()
+	defer v.RUnlock()
+
+	ptr, ok := v.handles[handle]
+	return ptr, ok
+}
@@ -1,11 +1,17 @@
 package git
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 )
 
@@ -13,10 +19,60 @@ import (
 // HTTP/S transport that doesn't rely on any system libraries (e.g.
 // libopenssl/libmbedtls).
 //
+// Requests go through the HTTP or SOCKS5 proxy of the proxy options of an
+// operation. With ProxyTypeAuto, the proxy is taken from the
+// remote.<name>.proxy or http.proxy configuration, or else from the
+// HTTPS_PROXY, HTTP_PROXY and ALL_PROXY environment variables. The NO_PROXY
+// environment variable is honored.
+//
 // If Shutdown or ReInit are called, make sure that the smart transports are
 // freed before it.
 func RegisterManagedHTTPTransport(protocol string) (*RegisteredSmartTransport, error) {
-	return NewRegisteredSmartTransport(protocol, true, httpSmartSubtransportFactory)
+	return RegisterManagedHTTPTransportWithOptions(protocol, nil)
+}
+
+// ManagedHTTPTransportOptions are the options for the Go-native
+// implementation of the HTTP/S transport.
+type ManagedHTTPTransportOptions struct {
+	// RoundTripper performs every request made by the transport. This allows
+	// using custom CA pools, client certificates, timeouts or instrumentation.
+	// The proxy options of the remote are not applied to it. If nil, an
+	// http.Transport that honors the proxy options of the remote is used.
+	//
+	// The certificate check callback of an operation is called during the
+	// TLS handshake, before any request is sent, and can accept a
+	// certificate that could not be verified. This needs the round tripper
+	// to be an *http.Transport without a custom TLS dialer, and Go 1.15 or
+	// later. Otherwise, the round tripper verifies the certificates itself,
+	// and the callback only sees the certificate of the first response.
+	RoundTripper http.RoundTripper
+
+	// ProtocolVersion is the version of the git protocol requested from the
+	// server when fetching. With ProtocolVersionV2, the server only
+	// advertises the refs that the fetch refspecs can match.
+	ProtocolVersion ProtocolVersion
+
+	// MaxAuthAttempts is the number of times the credentials callback is
+	// asked for new credentials after the server rejected a request. Once
+	// they are exhausted, the operation fails with an error for which
+	// IsErrorCode(err, ErrorCodeAuth) is true. If zero,
+	// DefaultManagedHTTPMaxAuthAttempts is used.
+	//
+	// The credentials that a server accepts are sent with the later requests
+	// of the same operation to the same scheme and host, until the server
+	// rejects them. Other operations ask their own credentials callback.
+	MaxAuthAttempts int
+}
+
+// DefaultManagedHTTPMaxAuthAttempts is the default number of times the
+// managed HTTP transport asks for credentials for a single request.
+const DefaultManagedHTTPMaxAuthAttempts = 3
+
+// RegisterManagedHTTPTransportWithOptions registers a Go-native
+// implementation of an HTTP/S transport like RegisterManagedHTTPTransport,
+// configured with the provided options.
+func RegisterManagedHTTPTransportWithOptions(protocol string, opts *ManagedHTTPTransportOptions) (*RegisteredSmartTransport, error) {
+	return NewRegisteredSmartTransport(protocol, true, newHTTPSmartSubtransportFactory(opts))
 }
 
 func registerManagedHTTP() error {
@@ -27,7 +83,7 @@ func registerManagedHTTP() error {
 		if _, ok := globalRegisteredSmartTransports.transports[protocol]; ok {
 			continue
 		}
-		managed, err := newRegisteredSmartTransport(protocol, true, httpSmartSubtransportFactory, true)
+		managed, err := newRegisteredSmartTransport(protocol, true, newHTTPSmartSubtransportFactory(nil), true)
 		if err != nil {
 			return fmt.Errorf("failed to register transport for %q: %v", protocol, err)
 		}
@@ -36,42 +92,273 @@ func registerManagedHTTP() error {
 	return nil
 }
 
-func httpSmartSubtransportFactory(remote *Remote, transport *Transport) (SmartSubtransport, error) {
-	var proxyFn func(*http.Request) (*url.URL, error)
-	remoteConnectOpts, err := transport.SmartRemoteConnectOptions()
-	if err != nil {
-		return nil, err
+func newHTTPSmartSubtransportFactory(opts *ManagedHTTPTransportOptions) SmartSubtransportCallback {
+	if opts == nil {
+		opts = &ManagedHTTPTransportOptions{}
 	}
-	switch remoteConnectOpts.ProxyOptions.Type {
-	case ProxyTypeNone:
-		proxyFn = nil
-	case ProxyTypeAuto:
-		proxyFn = http.ProxyFromEnvironment
-	case ProxyTypeSpecified:
-		parsedUrl, err := url.Parse(remoteConnectOpts.ProxyOptions.Url)
+	return func(remote *Remote, transport *Transport) (SmartSubtransport, error) {
+		maxAuthAttempts := opts.MaxAuthAttempts
+		if maxAuthAttempts <= 0 {
+			maxAuthAttempts = DefaultManagedHTTPMaxAuthAttempts
+		}
+
+		var proxy *managedProxy
+		roundTripper := opts.RoundTripper
+		if roundTripper == nil {
+			var err error
+			proxy, err = newManagedProxy(remote, transport, maxAuthAttempts)
+			if err != nil {
+				return nil, err
+			}
+			roundTripper = &http.Transport{
+				Proxy:       proxy.httpProxy,
+				DialContext: proxy.httpDialContext,
+			}
+		}
+
+		extraHeaders, err := readHTTPExtraHeaders(remote)
 		if err != nil {
 			return nil, err
 		}
 
-		proxyFn = http.ProxyURL(parsedUrl)
+		// libgit2 can create several subtransports for one operation, so
+		// the accepted credentials are kept with its callbacks. They are not
+		// shared with other operations, whose own callbacks are asked.
+		auths := &httpAuthCache{}
+		if data := transport.remoteCallbacksData(); data != nil {
+			auths = &data.httpAuths
+		}
+
+		subtransport := &httpSmartSubtransport{
+			remote:          remote,
+			transport:       transport,
+			proxy:           proxy,
+			extraHeaders:    extraHeaders,
+			protocolVersion: resolveProtocolVersion(opts.ProtocolVersion, remote),
+			maxAuthAttempts: maxAuthAttempts,
+			auths:           auths,
+		}
+		subtransport.client = &http.Client{
+			Transport: subtransport.checkCertificatesInHandshake(roundTripper),
+		}
+		return subtransport, nil
+	}
+}
+
+// readHTTPExtraHeaders reads the http.extraHeader and http.<url>.extraHeader
+// entries from the configuration of the repository that owns the remote,
+// ordered from the least to the most specific configuration level.
+func readHTTPExtraHeaders(remote *Remote) ([]*ConfigEntry, error) {
+	if remote == nil {
+		return nil, nil
+	}
+	config, err := remote.repositoryConfig()
+	if err != nil || config == nil {
+		return nil, err
+	}
+	defer config.Free()
+
+	return readConfigEntries(config, `^http\..*extraheader$`)
+}
+
+// httpExtraHeadersForURL returns the configured extra headers that apply to
+// rawURL. As in git, an empty value resets the list of headers.
+func httpExtraHeadersForURL(entries []*ConfigEntry, rawURL string) []string {
+	var headers []string
+	for _, entry := range entries {
+		urlPattern := strings.TrimSuffix(strings.TrimPrefix(entry.Name, "http."), "extraheader")
+		urlPattern = strings.TrimSuffix(urlPattern, ".")
+		if urlPattern != "" && !httpConfigURLMatches(urlPattern, rawURL) {
+			continue
+		}
+		if entry.Value == "" {
+			headers = nil
+			continue
+		}
+		headers = append(headers, entry.Value)
+	}
+	return headers
+}
+
+// httpConfigURLMatches reports whether the url in a http.<url>.* configuration
+// key applies to rawURL, which is the case when it is a prefix of it that
+// ends at a path component boundary.
+func httpConfigURLMatches(pattern, rawURL string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.HasPrefix(rawURL, pattern) {
+		return false
 	}
+	rest := rawURL[len(pattern):]
+	return rest == "" || rest[0] == '/'
+}
+
+// hasMediaType reports whether the Content-Type of header is mediaType,
+// whatever its parameters, such as a charset.
+func hasMediaType(header http.Header, mediaType string) bool {
+	t, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && t == mediaType
+}
 
-	return &httpSmartSubtransport{
-		transport: transport,
-		client: &http.Client{
-			Transport: &http.Transport{
-				Proxy: proxyFn,
-			},
-		},
-	}, nil
+// setHTTPHeaders adds headers in the "Name: value" form to header.
+func setHTTPHeaders(header http.Header, headers []string) error {
+	for _, h := range headers {
+		i := strings.IndexByte(h, ':')
+		if i <= 0 {
+			return fmt.Errorf("invalid HTTP header %q", h)
+		}
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return nil
 }
 
 type httpSmartSubtransport struct {
+	remote    *Remote
 	transport *Transport
 	client    *http.Client
+	// proxy is the proxy of the default round tripper, if it is used.
+	proxy           *managedProxy
+	extraHeaders    []*ConfigEntry
+	protocolVersion ProtocolVersion
+	// certificateMu serializes the certificate checks of the connections,
+	// which can be made from several goroutines, and guards
+	// certificateChecked.
+	certificateMu sync.Mutex
+	// checkResponseCertificates is set when the certificates cannot be
+	// checked during the TLS handshake, and are checked once, on the first
+	// response, instead.
+	checkResponseCertificates bool
+	certificateChecked        bool
+	// protocolV2 is set once the server has announced protocol v2.
+	protocolV2 *protocolV2Session
+	// dumb is set once the server has turned out to serve the repository
+	// as plain files.
+	dumb *dumbHTTPSession
+
+	maxAuthAttempts int
+	// auths holds the credentials that the servers have accepted, which
+	// are shared by the subtransports of the operation.
+	auths *httpAuthCache
+}
+
+// httpBasicAuth are credentials for HTTP basic authentication.
+type httpBasicAuth struct {
+	userName string
+	password string
+}
+
+// httpAuthCache holds the credentials that servers have accepted, by scheme
+// and host.
+type httpAuthCache struct {
+	mu    sync.Mutex
+	auths map[string]*httpBasicAuth
+}
+
+// httpAuthCacheKey returns the key of the credentials for the server of u.
+func httpAuthCacheKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func (c *httpAuthCache) get(key string) *httpBasicAuth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.auths[key]
+}
+
+func (c *httpAuthCache) set(key string, auth *httpBasicAuth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auths == nil {
+		c.auths = make(map[string]*httpBasicAuth)
+	}
+	c.auths[key] = auth
+}
+
+// forget drops the credentials of key if they are the ones that the server
+// has just rejected.
+func (c *httpAuthCache) forget(key string, auth *httpBasicAuth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auths[key] == auth {
+		delete(c.auths, key)
+	}
+}
+
+// httpPostBufferSize is the size up to which the body of a POST request is
+// kept in memory, so that the request can be sent again after the server
+// asked for credentials. Larger bodies are streamed once a small probe
+// request has settled the credentials, as git does with http.postBuffer.
+const httpPostBufferSize = 1024 * 1024
+
+// readHTTPRequestBody reads the start of a request body, up to limit bytes,
+// and reports whether there is more to it.
+func readHTTPRequestBody(r io.Reader, limit int) ([]byte, bool, error) {
+	buf := make([]byte, limit)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		return buf, true, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return buf[:n], false, nil
+	default:
+		return nil, false, err
+	}
 }
 
 func (t *httpSmartSubtransport) Action(url string, action SmartServiceAction) (SmartSubtransportStream, error) {
+	if action == SmartServiceActionUploadpack {
+		if t.protocolV2 != nil {
+			return t.protocolV2.newStream(false), nil
+		}
+		if t.dumb != nil {
+			return newEmulatedUploadPackStream(t.dumb, false), nil
+		}
+	}
+
+	req, err := t.newRequest(url, action)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := newManagedHttpStream(t, req)
+	if req.Method == "POST" {
+		stream.recvReply.Add(1)
+		stream.sendRequestBackground()
+	}
+
+	if action == SmartServiceActionUploadpackLs {
+		t.dumb = nil
+
+		// The response needs to be inspected to tell whether the server
+		// speaks the smart protocol at all.
+		stream.recvReply.Add(1)
+		if err := stream.sendRequest(); err != nil {
+			return nil, err
+		}
+		if !hasMediaType(stream.resp.Header, "application/x-git-upload-pack-advertisement") {
+			defer stream.Free()
+			t.dumb, err = newDumbHTTPSession(t, url, stream.resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			return newEmulatedUploadPackStream(t.dumb, true), nil
+		}
+	}
+
+	if action == SmartServiceActionUploadpackLs && t.protocolVersion != ProtocolVersionV0 {
+		t.setProtocolV2(nil)
+		return newVersionDetectingStream(stream, func(capabilities map[string]string, r *bufio.Reader, serviceHeader bool) *protocolV2Session {
+			session := newProtocolV2Session(&httpProtocolV2Conn{owner: t, url: url}, capabilities, serviceHeader, t.transport.fetchRefPrefixes)
+			t.setProtocolV2(session)
+			return session
+		}), nil
+	}
+
+	return stream, nil
+}
+
+// newRequest creates the request for the action, with the headers that
+// every request of the transport carries.
+func (t *httpSmartSubtransport) newRequest(url string, action SmartServiceAction) (*http.Request, error) {
 	var req *http.Request
 	var err error
 	switch action {
@@ -89,7 +376,7 @@ func (t *httpSmartSubtransport) Action(url string, action SmartServiceAction) (S
 		req, err = http.NewRequest("GET", url+"/info/refs?service=git-receive-pack", nil)
 
 	case SmartServiceActionReceivepack:
-		req, err = http.NewRequest("POST", url+"/info/refs?service=git-upload-pack", nil)
+		req, err = http.NewRequest("POST", url+"/git-receive-pack", nil)
 		if err != nil {
 			break
 		}
@@ -103,25 +390,154 @@ func (t *httpSmartSubtransport) Action(url string, action SmartServiceAction) (S
 		return nil, err
 	}
 
+	if action == SmartServiceActionUploadpackLs || action == SmartServiceActionUploadpack {
+		if parameter := t.protocolVersion.gitProtocolParameter(); parameter != "" {
+			req.Header.Set("Git-Protocol", parameter)
+		}
+	}
+
+	return t.prepareRequest(req, url)
+}
+
+// prepareRequest sets up a request to the repository at url with the
+// context of the operation and the headers that every request carries.
+func (t *httpSmartSubtransport) prepareRequest(req *http.Request, url string) (*http.Request, error) {
+	// Tie the request to the context of the operation, so that canceling it
+	// also tears down a request that is in flight.
+	req = req.WithContext(t.transport.Context())
 	req.Header.Set("User-Agent", "git/2.0 (git2go)")
 
-	stream := newManagedHttpStream(t, req)
-	if req.Method == "POST" {
-		stream.recvReply.Add(1)
-		stream.sendRequestBackground()
+	remoteConnectOpts, err := t.transport.SmartRemoteConnectOptions()
+	if err != nil {
+		return nil, err
+	}
+	if err := setHTTPHeaders(req.Header, httpExtraHeadersForURL(t.extraHeaders, url)); err != nil {
+		return nil, err
+	}
+	if err := setHTTPHeaders(req.Header, remoteConnectOpts.Headers); err != nil {
+		return nil, err
 	}
 
-	return stream, nil
+	return req, nil
+}
+
+// setProtocolV2 records the protocol v2 session of the connection, which
+// also lets the remote list refs through it.
+func (t *httpSmartSubtransport) setProtocolV2(session *protocolV2Session) {
+	t.remote.setProtocolV2Connection(t.protocolV2, session)
+	t.protocolV2 = session
+}
+
+// requestProxyCredentials asks for new credentials after the HTTP proxy
+// rejected a request, and reports whether the request can be retried with
+// them. It returns an error if the proxy cannot be authenticated to.
+func (t *httpSmartSubtransport) requestProxyCredentials() (bool, error) {
+	if t.proxy == nil {
+		return false, nil
+	}
+	proxyURL := t.proxy.lastHTTPProxy()
+	if proxyURL == nil {
+		return false, nil
+	}
+	if err := t.proxy.requestCredentials(proxyURL); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// certificateCheck passes the leaf certificate presented by the server to
+// the certificate check callback, and returns its verdict, which is an
+// error for which IsErrorCode(err, ErrorCodePassthrough) is true if there
+// is no callback. The intermediate certificates of the chain are not passed
+// to the callback.
+func (t *httpSmartSubtransport) certificateCheck(state *tls.ConnectionState, valid bool, hostname string) error {
+	t.certificateMu.Lock()
+	defer t.certificateMu.Unlock()
+
+	cert := &Certificate{
+		Kind: CertificateX509,
+		X509: state.PeerCertificates[0],
+	}
+	return t.transport.SmartCertificateCheck(cert, valid, hostname)
+}
+
+// responseCertificateCheck checks the certificate of the first response,
+// when the round tripper did its TLS handshake on its own. The certificate
+// is considered valid if the round tripper was able to verify its chain.
+func (t *httpSmartSubtransport) responseCertificateCheck(state *tls.ConnectionState, hostname string) error {
+	t.certificateMu.Lock()
+	checked := t.certificateChecked
+	t.certificateMu.Unlock()
+	if checked || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	err := t.certificateCheck(state, len(state.VerifiedChains) > 0, hostname)
+	if err != nil && !IsErrorCode(err, ErrorCodePassthrough) {
+		return err
+	}
+
+	t.certificateMu.Lock()
+	t.certificateChecked = true
+	t.certificateMu.Unlock()
+	return nil
 }
 
 func (t *httpSmartSubtransport) Close() error {
+	t.setProtocolV2(nil)
+	t.dumb = nil
 	return nil
 }
 
 func (t *httpSmartSubtransport) Free() {
+	t.setProtocolV2(nil)
+	t.dumb = nil
 	t.client = nil
 }
 
+// httpProtocolV2Conn sends every protocol v2 command in its own POST request,
+// as in the stateless protocol.
+type httpProtocolV2Conn struct {
+	owner *httpSmartSubtransport
+	url   string
+}
+
+func (c *httpProtocolV2Conn) roundTrip(request []byte) (*bufio.Reader, io.Closer, error) {
+	req, err := c.owner.newRequest(c.url, SmartServiceActionUploadpack)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream := newManagedHttpStream(c.owner, req)
+	stream.recvReply.Add(1)
+	stream.sendRequestBackground()
+	if _, err := stream.Write(request); err != nil {
+		stream.Free()
+		return nil, nil, err
+	}
+	return bufio.NewReaderSize(stream, pktLineMaxLength), smartSubtransportStreamCloser{stream}, nil
+}
+
+// smartSubtransportStreamCloser frees a stream when it is closed.
+type smartSubtransportStreamCloser struct {
+	stream SmartSubtransportStream
+}
+
+func (c smartSubtransportStreamCloser) Close() error {
+	c.stream.Free()
+	return nil
+}
+
+// httpStatusError is returned for responses with an unexpected status.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("Unhandled HTTP error %s", e.Status)
+}
+
 type httpSmartSubtransportStream struct {
 	owner       *httpSmartSubtransport
 	req         *http.Request
@@ -180,6 +596,10 @@ func (self *httpSmartSubtransportStream) Free() {
 func (self *httpSmartSubtransportStream) sendRequestBackground() {
 	go func() {
 		self.httpError = self.sendRequest()
+		if self.httpError != nil {
+			// Unblock any writer that is waiting for the body to be read.
+			self.reader.CloseWithError(self.httpError)
+		}
 	}()
 	self.sentRequest = true
 }
@@ -188,56 +608,147 @@ func (self *httpSmartSubtransportStream) sendRequest() error {
 	defer self.recvReply.Done()
 	self.resp = nil
 
+	var newBody func() (io.Reader, int64, error)
+	if self.req.Method == "POST" {
+		prefix, more, err := readHTTPRequestBody(self.reader, httpPostBufferSize)
+		if err != nil {
+			return err
+		}
+		if !more {
+			newBody = func() (io.Reader, int64, error) {
+				return bytes.NewReader(prefix), int64(len(prefix)), nil
+			}
+		} else {
+			// The body cannot be sent twice, so the credentials are
+			// settled by a request that only carries a flush-pkt.
+			probe, err := self.do(func() (io.Reader, int64, error) {
+				return bytes.NewReader(pktFlush), int64(len(pktFlush)), nil
+			})
+			if err != nil {
+				return err
+			}
+			io.Copy(ioutil.Discard, probe.Body)
+			probe.Body.Close()
+
+			sent := false
+			newBody = func() (io.Reader, int64, error) {
+				if sent {
+					return nil, 0, errors.New("the request body is too large to be sent again")
+				}
+				sent = true
+				return io.MultiReader(bytes.NewReader(prefix), self.reader), -1, nil
+			}
+		}
+	}
+
+	resp, err := self.do(newBody)
+	if err != nil {
+		return err
+	}
+	self.sentRequest = true
+	self.resp = resp
+	return nil
+}
+
+// do sends the request of the stream, with a body from newBody if it is a
+// POST request, until the server accepts it or the credentials are
+// exhausted.
+func (self *httpSmartSubtransportStream) do(newBody func() (io.Reader, int64, error)) (*http.Response, error) {
 	var resp *http.Response
 	var err error
-	var userName string
-	var password string
+	authKey := httpAuthCacheKey(self.req.URL)
+	auth := self.owner.auths.get(authKey)
+	attempts := 0
 	for {
-		req := &http.Request{
+		req := (&http.Request{
 			Method: self.req.Method,
 			URL:    self.req.URL,
 			Header: self.req.Header,
-		}
-		if req.Method == "POST" {
-			req.Body = self.reader
-			req.ContentLength = -1
+		}).WithContext(self.req.Context())
+		if newBody != nil {
+			body, length, err := newBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = ioutil.NopCloser(body)
+			req.ContentLength = length
 		}
 
-		if userName != "" && password != "" {
-			req.SetBasicAuth(userName, password)
+		if auth != nil {
+			req.SetBasicAuth(auth.userName, auth.password)
 		}
-		resp, err = http.DefaultClient.Do(req)
+		resp, err = self.owner.client.Do(req)
 		if err != nil {
-			return err
+			// A proxy that rejects a CONNECT request only surfaces as an
+			// error.
+			if !isProxyAuthError(err) {
+				return nil, err
+			}
+			retry, authErr := self.owner.requestProxyCredentials()
+			if authErr != nil {
+				return nil, authErr
+			}
+			if !retry {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.TLS != nil && self.owner.checkResponseCertificates {
+			if err := self.owner.responseCertificateCheck(resp.TLS, req.URL.Hostname()); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
 		}
 
 		if resp.StatusCode == http.StatusOK {
-			break
+			if auth != nil {
+				self.owner.auths.set(authKey, auth)
+			}
+			return resp, nil
 		}
 
 		if resp.StatusCode == http.StatusUnauthorized {
 			resp.Body.Close()
 
+			if auth != nil {
+				self.owner.auths.forget(authKey, auth)
+			}
+			if attempts >= self.owner.maxAuthAttempts {
+				return nil, &GitError{
+					Message: fmt.Sprintf("authentication failed for '%s://%s%s' after %d attempts", req.URL.Scheme, req.URL.Host, req.URL.Path, attempts),
+					Class:   ErrorClassNet,
+					Code:    ErrorCodeAuth,
+				}
+			}
+			attempts++
+
 			cred, err := self.owner.transport.SmartCredentials("", CredentialTypeUserpassPlaintext)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			defer cred.Free()
-
-			userName, password, err = cred.GetUserpassPlaintext()
+			userName, password, err := cred.GetUserpassPlaintext()
+			cred.Free()
 			if err != nil {
-				return err
+				return nil, err
 			}
+			auth = &httpBasicAuth{userName: userName, password: password}
 
 			continue
 		}
 
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			if retry, err := self.owner.requestProxyCredentials(); retry {
+				resp.Body.Close()
+				continue
+			} else if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+
 		// Any other error we treat as a hard error and punt back to the caller
 		resp.Body.Close()
-		return fmt.Errorf("Unhandled HTTP error %s", resp.Status)
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-
-	self.sentRequest = true
-	self.resp = resp
-	return nil
 }
@@ -0,0 +1,573 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dumbHTTPSession fetches from a repository that is served as plain files,
+// answering the upload-pack requests of libgit2 on its behalf.
+//
+// The objects are downloaded straight into the object database of the
+// repository that is being fetched into: loose objects one by one and packs
+// through an Indexer. libgit2 then only receives a small packfile with the
+// objects it asked for.
+type dumbHTTPSession struct {
+	owner *httpSmartSubtransport
+	url   string
+	refs  []advertisedRef
+
+	negotiation fetchNegotiation
+	// packs are the packs listed in objects/info/packs, read on demand.
+	packs       []*dumbHTTPPack
+	packsListed bool
+}
+
+// dumbHTTPPack is a pack of the remote repository.
+type dumbHTTPPack struct {
+	name string
+	// objects are the objects in the pack, read from its index on demand.
+	objects    map[Oid]bool
+	downloaded bool
+}
+
+// newDumbHTTPSession creates a session for the repository at url, whose
+// info/refs file is read from infoRefs.
+func newDumbHTTPSession(owner *httpSmartSubtransport, url string, infoRefs io.Reader) (*dumbHTTPSession, error) {
+	s := &dumbHTTPSession{
+		owner: owner,
+		url:   url,
+	}
+	s.negotiation.reset()
+
+	refs, err := parseDumbInfoRefs(infoRefs)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := s.readHead(refs)
+	if err != nil {
+		return nil, err
+	}
+	if head != nil {
+		refs = append([]advertisedRef{*head}, refs...)
+	}
+	s.refs = refs
+
+	return s, nil
+}
+
+// parseDumbInfoRefs parses the info/refs file generated by git
+// update-server-info, in which peeled tags follow the tag as "^{}" entries.
+func parseDumbInfoRefs(r io.Reader) ([]advertisedRef, error) {
+	var refs []advertisedRef
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid info/refs line %q", line)
+		}
+		if _, err := NewOid(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid info/refs line %q", line)
+		}
+
+		if strings.HasSuffix(fields[1], "^{}") {
+			if len(refs) == 0 || refs[len(refs)-1].name != strings.TrimSuffix(fields[1], "^{}") {
+				return nil, fmt.Errorf("peeled ref without its tag in info/refs: %q", line)
+			}
+			refs[len(refs)-1].peeled = fields[0]
+			continue
+		}
+		refs = append(refs, advertisedRef{id: fields[0], name: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// readHead reads the HEAD of the remote repository, which is not listed in
+// info/refs. It returns nil if the remote has no usable HEAD.
+func (s *dumbHTTPSession) readHead(refs []advertisedRef) (*advertisedRef, error) {
+	data, err := s.get("HEAD")
+	if isHTTPNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(content, "ref: ") {
+		if _, err := NewOid(content); err != nil {
+			return nil, nil
+		}
+		return &advertisedRef{id: content, name: "HEAD"}, nil
+	}
+
+	target := strings.TrimPrefix(content, "ref: ")
+	for _, ref := range refs {
+		if ref.name == target {
+			return &advertisedRef{id: ref.id, name: "HEAD", symrefTarget: target}, nil
+		}
+	}
+	// HEAD points to an unborn branch.
+	return nil, nil
+}
+
+// get downloads the file at path, relative to the repository.
+func (s *dumbHTTPSession) get(path string) ([]byte, error) {
+	body, err := s.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// open starts downloading the file at path, relative to the repository.
+func (s *dumbHTTPSession) open(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.url+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err = s.owner.prepareRequest(req, s.url)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := newManagedHttpStream(s.owner, req)
+	stream.recvReply.Add(1)
+	if err := stream.sendRequest(); err != nil {
+		return nil, err
+	}
+	return stream.resp.Body, nil
+}
+
+// isHTTPNotFound reports whether err is caused by a missing file.
+func isHTTPNotFound(err error) bool {
+	var statusErr *httpStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+func (s *dumbHTTPSession) advertisement() ([]byte, error) {
+	return buildAdvertisement(true, s.refs), nil
+}
+
+func (s *dumbHTTPSession) fetchNegotiation() *fetchNegotiation {
+	return &s.negotiation
+}
+
+// acknowledge acknowledges no have: the objects are walked from the wants
+// on the client side, which skips those that the repository has.
+func (s *dumbHTTPSession) acknowledge(haves []string) ([]string, error) {
+	return nil, nil
+}
+
+func (s *dumbHTTPSession) fetch() (io.Reader, error) {
+	sideband := false
+	for _, capability := range s.negotiation.capabilities {
+		if capability == "side-band-64k" {
+			sideband = true
+		}
+	}
+
+	var wants []*Oid
+	for _, want := range s.negotiation.wants {
+		id, err := NewOid(want)
+		if err != nil {
+			return nil, err
+		}
+		wants = append(wants, id)
+	}
+	s.negotiation.reset()
+
+	repo := s.owner.remote.owner()
+	if repo == nil {
+		return nil, errors.New("fetching over dumb HTTP requires a repository")
+	}
+	defer repo.Free()
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+
+	w := &dumbHTTPWalker{
+		session:    s,
+		repo:       repo,
+		odb:        odb,
+		downloaded: make(map[Oid]bool),
+	}
+	if err := w.walk(wants); err != nil {
+		return nil, err
+	}
+
+	pack, err := buildPackfile(odb, wants)
+	if err != nil {
+		return nil, err
+	}
+
+	response := appendPktLine(nil, "NAK\n")
+	if !sideband {
+		return bytes.NewReader(append(response, pack...)), nil
+	}
+	const maxChunk = pktLineMaxLength - 5
+	for len(pack) > 0 {
+		chunk := pack
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		response = appendPktLine(response, "\x01"+string(chunk))
+		pack = pack[len(chunk):]
+	}
+	response = append(response, pktFlush...)
+	return bytes.NewReader(response), nil
+}
+
+// listPacks reads objects/info/packs, once.
+func (s *dumbHTTPSession) listPacks() error {
+	if s.packsListed {
+		return nil
+	}
+
+	data, err := s.get("objects/info/packs")
+	if err != nil && !isHTTPNotFound(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "P" {
+			continue
+		}
+		name := fields[1]
+		if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".pack") {
+			continue
+		}
+		s.packs = append(s.packs, &dumbHTTPPack{name: strings.TrimSuffix(name, ".pack")})
+	}
+
+	s.packsListed = true
+	return nil
+}
+
+// readPackIndex downloads the index of the pack to learn which objects it
+// contains.
+func (s *dumbHTTPSession) readPackIndex(pack *dumbHTTPPack) error {
+	data, err := s.get("objects/pack/" + pack.name + ".idx")
+	if err != nil {
+		return err
+	}
+	ids, err := parsePackIndex(data)
+	if err != nil {
+		return fmt.Errorf("invalid index for %s: %v", pack.name, err)
+	}
+
+	pack.objects = make(map[Oid]bool, len(ids))
+	for _, id := range ids {
+		pack.objects[id] = true
+	}
+	return nil
+}
+
+// parsePackIndex returns the ids of the objects listed in a version 1 or 2
+// pack index.
+func parsePackIndex(data []byte) ([]Oid, error) {
+	const fanoutSize = 256 * 4
+
+	var entrySize, idOffset int
+	fanout := data
+	if bytes.HasPrefix(data, []byte("\377tOc")) {
+		if len(data) < 8 || binary.BigEndian.Uint32(data[4:8]) != 2 {
+			return nil, errors.New("unsupported version")
+		}
+		fanout = data[8:]
+		entrySize = 20
+	} else {
+		entrySize = 24
+		idOffset = 4
+	}
+	if len(fanout) < fanoutSize {
+		return nil, errors.New("truncated fanout table")
+	}
+
+	count := int(binary.BigEndian.Uint32(fanout[fanoutSize-4 : fanoutSize]))
+	entries := fanout[fanoutSize:]
+	if len(entries)/entrySize < count {
+		return nil, errors.New("truncated object table")
+	}
+
+	ids := make([]Oid, count)
+	for i := range ids {
+		copy(ids[i][:], entries[i*entrySize+idOffset:])
+	}
+	return ids, nil
+}
+
+// downloadPack downloads the pack and indexes it into the object database.
+func (s *dumbHTTPSession) downloadPack(pack *dumbHTTPPack, repo *Repository, odb *Odb) error {
+	body, err := s.open("objects/pack/" + pack.name + ".pack")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	indexer, err := NewIndexer(filepath.Join(repo.Path(), "objects", "pack"), odb, nil)
+	if err != nil {
+		return err
+	}
+	defer indexer.Free()
+
+	if _, err := io.Copy(indexer, body); err != nil {
+		return err
+	}
+	if _, err := indexer.Commit(); err != nil {
+		return err
+	}
+
+	pack.downloaded = true
+	return odb.Refresh()
+}
+
+// dumbHTTPWalker walks the object graph from the wanted objects, downloading
+// the objects that are missing from the object database.
+type dumbHTTPWalker struct {
+	session *dumbHTTPSession
+	repo    *Repository
+	odb     *Odb
+	// downloaded are the objects that were downloaded during this fetch.
+	// Objects that were already present are assumed to be complete, so the
+	// walk stops at them.
+	downloaded map[Oid]bool
+}
+
+func (w *dumbHTTPWalker) walk(wants []*Oid) error {
+	queue := append([]*Oid(nil), wants...)
+	visited := make(map[Oid]bool)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[*id] {
+			continue
+		}
+		visited[*id] = true
+
+		if !w.downloaded[*id] {
+			if w.odb.Exists(id) {
+				continue
+			}
+			if err := w.download(id); err != nil {
+				return err
+			}
+		}
+
+		links, err := w.links(id)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, links...)
+	}
+	return nil
+}
+
+// download fetches the object, either as a loose object or as part of one
+// of the packs of the remote.
+func (w *dumbHTTPWalker) download(id *Oid) error {
+	hex := id.String()
+	data, err := w.session.get("objects/" + hex[:2] + "/" + hex[2:])
+	if err == nil {
+		return w.writeLooseObject(id, data)
+	}
+	if !isHTTPNotFound(err) {
+		return err
+	}
+
+	if err := w.session.listPacks(); err != nil {
+		return err
+	}
+	for _, pack := range w.session.packs {
+		if pack.downloaded {
+			continue
+		}
+		if pack.objects == nil {
+			if err := w.session.readPackIndex(pack); err != nil {
+				return err
+			}
+		}
+		if !pack.objects[*id] {
+			continue
+		}
+
+		if err := w.session.downloadPack(pack, w.repo, w.odb); err != nil {
+			return err
+		}
+		for object := range pack.objects {
+			w.downloaded[object] = true
+		}
+		return nil
+	}
+
+	return fmt.Errorf("object %s is missing from the remote repository", hex)
+}
+
+// writeLooseObject writes the zlib-compressed loose object to the object
+// database.
+func (w *dumbHTTPWalker) writeLooseObject(id *Oid, data []byte) error {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid loose object %s: %v", id, err)
+	}
+	defer zr.Close()
+	inflated, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("invalid loose object %s: %v", id, err)
+	}
+
+	nul := bytes.IndexByte(inflated, 0)
+	if nul < 0 {
+		return fmt.Errorf("invalid loose object %s: missing header", id)
+	}
+	header := strings.Fields(string(inflated[:nul]))
+	content := inflated[nul+1:]
+	if len(header) != 2 {
+		return fmt.Errorf("invalid loose object %s: malformed header", id)
+	}
+	if size, err := strconv.Atoi(header[1]); err != nil || size != len(content) {
+		return fmt.Errorf("invalid loose object %s: size mismatch", id)
+	}
+
+	var otype ObjectType
+	switch header[0] {
+	case "commit":
+		otype = ObjectCommit
+	case "tree":
+		otype = ObjectTree
+	case "blob":
+		otype = ObjectBlob
+	case "tag":
+		otype = ObjectTag
+	default:
+		return fmt.Errorf("invalid loose object %s: unknown type %q", id, header[0])
+	}
+
+	written, err := w.odb.Write(content, otype)
+	if err != nil {
+		return err
+	}
+	if !written.Equal(id) {
+		return fmt.Errorf("loose object %s has the wrong id %s", id, written)
+	}
+
+	w.downloaded[*id] = true
+	return nil
+}
+
+// links returns the objects that the object refers to. Submodule commits are
+// not part of the repository and are skipped.
+func (w *dumbHTTPWalker) links(id *Oid) ([]*Oid, error) {
+	obj, err := w.repo.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Free()
+
+	var links []*Oid
+	switch obj.Type() {
+	case ObjectCommit:
+		commit, err := obj.AsCommit()
+		if err != nil {
+			return nil, err
+		}
+		defer commit.Free()
+
+		links = append(links, commit.TreeId())
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			links = append(links, commit.ParentId(i))
+		}
+
+	case ObjectTree:
+		tree, err := obj.AsTree()
+		if err != nil {
+			return nil, err
+		}
+		defer tree.Free()
+
+		for i := uint64(0); i < tree.EntryCount(); i++ {
+			entry := tree.EntryByIndex(i)
+			if entry.Type != ObjectCommit {
+				links = append(links, entry.Id)
+			}
+		}
+
+	case ObjectTag:
+		tag, err := obj.AsTag()
+		if err != nil {
+			return nil, err
+		}
+		defer tag.Free()
+
+		links = append(links, tag.TargetId())
+	}
+	return links, nil
+}
+
+// buildPackfile builds a version 2 packfile that holds the objects, without
+// any deltas.
+func buildPackfile(odb *Odb, ids []*Oid) ([]byte, error) {
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(len(ids)))
+
+	for _, id := range ids {
+		obj, err := odb.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		otype := obj.Type()
+		data := obj.Data()
+
+		// The header holds the type and the size, in little-endian groups of
+		// seven bits after the first four.
+		size := uint64(len(data))
+		header := byte(otype)<<4 | byte(size&0x0f)
+		size >>= 4
+		for size > 0 {
+			pack.WriteByte(header | 0x80)
+			header = byte(size & 0x7f)
+			size >>= 7
+		}
+		pack.WriteByte(header)
+
+		zw := zlib.NewWriter(&pack)
+		_, err = zw.Write(data)
+		obj.Free()
+		if err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+	return pack.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDumbServerInfo writes the files that git update-server-info generates
+// for a repository that only has a master branch.
+func writeDumbServerInfo(t *testing.T, repo *Repository, master *Oid) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Join(repo.Path(), "info"), 0755)
+	checkFatal(t, err)
+	err = ioutil.WriteFile(filepath.Join(repo.Path(), "info", "refs"), []byte(master.String()+"\trefs/heads/master\n"), 0644)
+	checkFatal(t, err)
+
+	matches, err := filepath.Glob(filepath.Join(repo.Path(), "objects", "pack", "pack-*.pack"))
+	checkFatal(t, err)
+	var packs strings.Builder
+	for _, match := range matches {
+		packs.WriteString("P " + filepath.Base(match) + "\n")
+	}
+	err = os.MkdirAll(filepath.Join(repo.Path(), "objects", "info"), 0755)
+	checkFatal(t, err)
+	err = ioutil.WriteFile(filepath.Join(repo.Path(), "objects", "info", "packs"), []byte(packs.String()), 0644)
+	checkFatal(t, err)
+}
+
+func TestManagedHTTPDumbFetch(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstCommitID, _ := seedTestRepo(t, serverRepo)
+	writeDumbServerInfo(t, serverRepo, firstCommitID)
+
+	server := httptest.NewTLSServer(http.StripPrefix("/repo.git", http.FileServer(http.Dir(serverRepo.Path()))))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("dumb", &ManagedHTTPTransportOptions{
+		RoundTripper: &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "dumb"+server.URL[len("https"):]+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkRemoteMaster := func(expected *Oid) {
+		t.Helper()
+
+		ref, err := repo.References.Lookup("refs/remotes/origin/master")
+		checkFatal(t, err)
+		defer ref.Free()
+		if !ref.Target().Equal(expected) {
+			t.Fatalf("refs/remotes/origin/master = %v, want %v", ref.Target(), expected)
+		}
+
+		commit, err := repo.LookupCommit(expected)
+		checkFatal(t, err)
+		defer commit.Free()
+		tree, err := commit.Tree()
+		checkFatal(t, err)
+		defer tree.Free()
+		if tree.EntryByName("README") == nil {
+			t.Fatalf("the tree of %v was not fetched", expected)
+		}
+	}
+
+	// The first fetch downloads loose objects.
+	err = remote.Fetch(nil, nil, "")
+	checkFatal(t, err)
+	checkRemoteMaster(firstCommitID)
+
+	// The second one needs to download a pack, as the new objects are no
+	// longer available as loose objects.
+	secondCommitID, _ := updateReadme(t, serverRepo, "dumb")
+	packbuilder, err := serverRepo.NewPackbuilder()
+	checkFatal(t, err)
+	defer packbuilder.Free()
+	err = packbuilder.InsertCommit(secondCommitID)
+	checkFatal(t, err)
+	err = packbuilder.WriteToFile(filepath.Join(serverRepo.Path(), "objects", "pack"), 0644)
+	checkFatal(t, err)
+
+	looseObjectDirs, err := filepath.Glob(filepath.Join(serverRepo.Path(), "objects", "[0-9a-f][0-9a-f]"))
+	checkFatal(t, err)
+	for _, dir := range looseObjectDirs {
+		checkFatal(t, os.RemoveAll(dir))
+	}
+	writeDumbServerInfo(t, serverRepo, secondCommitID)
+
+	err = remote.Fetch(nil, nil, "")
+	checkFatal(t, err)
+	checkRemoteMaster(secondCommitID)
+}
@@ -0,0 +1,442 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const testUploadPackAdvertisement = "" +
+	"001e# service=git-upload-pack\n" +
+	"0000005d0000000000000000000000000000000000000000 HEAD\x00symref=HEAD:refs/heads/master agent=libgit\n" +
+	"003f0000000000000000000000000000000000000000 refs/heads/master\n" +
+	"0000"
+
+// schemeRewritingRoundTripper sends every request over https, which allows
+// registering the managed HTTP transport under a test-only protocol.
+type schemeRewritingRoundTripper struct {
+	underlying http.RoundTripper
+}
+
+func (rt *schemeRewritingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Scheme = "https"
+	return rt.underlying.RoundTrip(rewritten)
+}
+
+// newTestHTTPBackend returns a handler that serves repo at /repo.git with
+// git http-backend, which also gets the variables of env.
+func newTestHTTPBackend(t *testing.T, repo *Repository, env ...string) http.Handler {
+	gitPath, err := exec.LookPath("git")
+	checkFatal(t, err)
+	return &cgi.Handler{
+		Path:       gitPath,
+		Root:       "/repo.git",
+		Args:       []string{"http-backend"},
+		Env:        append([]string{"GIT_PROJECT_ROOT=" + repo.Path(), "GIT_HTTP_EXPORT_ALL=1"}, env...),
+		InheritEnv: []string{"PATH", "HOME"},
+	}
+}
+
+func TestManagedHTTPRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/info/refs" || r.URL.Query().Get("service") != "git-upload-pack" {
+			http.NotFound(w, r)
+			return
+		}
+		// Only the media type tells the smart protocol apart.
+		w.Header().Set("Content-Type", "Application/x-git-upload-pack-advertisement; charset=utf-8")
+		io.WriteString(w, testUploadPackAdvertisement)
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("roundtripper", &ManagedHTTPTransportOptions{
+		RoundTripper: &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "roundtripper"+server.URL[len("https"):]+"/repo")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	certificateCheckCallbackCalled := false
+	err = remote.ConnectFetch(&RemoteCallbacks{
+		CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+			if cert.Kind != CertificateX509 {
+				t.Errorf("certificate kind = %v, want %v", cert.Kind, CertificateX509)
+			}
+			if !bytes.Equal(cert.X509.Raw, server.Certificate().Raw) {
+				t.Errorf("certificate does not match the one from the server")
+			}
+			if !valid {
+				t.Errorf("expected the certificate to be valid")
+			}
+			certificateCheckCallbackCalled = true
+			return nil
+		},
+	}, nil, nil)
+	checkFatal(t, err)
+
+	if !certificateCheckCallbackCalled {
+		t.Fatalf("CertificateCheckCallback was not called")
+	}
+
+	remoteHeads, err := remote.Ls()
+	checkFatal(t, err)
+
+	expectedRemoteHeads := []RemoteHead{
+		{&Oid{}, "HEAD"},
+		{&Oid{}, "refs/heads/master"},
+	}
+	if !reflect.DeepEqual(expectedRemoteHeads, remoteHeads) {
+		t.Errorf("mismatched remote heads. expected %v, got %v", expectedRemoteHeads, remoteHeads)
+	}
+}
+
+func TestManagedHTTPHeaders(t *testing.T) {
+	t.Parallel()
+
+	var receivedHeaders http.Header
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		io.WriteString(w, testUploadPackAdvertisement)
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("headers", &ManagedHTTPTransportOptions{
+		RoundTripper: &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	config, err := repo.Config()
+	checkFatal(t, err)
+	defer config.Free()
+
+	remoteURL := "headers" + server.URL[len("https"):] + "/repo"
+	err = config.SetString("http.extraheader", "Authorization: Bearer secret")
+	checkFatal(t, err)
+	err = config.SetString("http."+remoteURL+".extraheader", "X-Scoped: yes")
+	checkFatal(t, err)
+	err = config.SetString("http.headers://elsewhere/.extraheader", "X-Unrelated: yes")
+	checkFatal(t, err)
+
+	remote, err := repo.Remotes.Create("origin", remoteURL)
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.ConnectFetch(nil, nil, []string{"X-Request-ID: 42"})
+	checkFatal(t, err)
+
+	for name, want := range map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Scoped":      "yes",
+		"X-Request-Id":  "42",
+		"X-Unrelated":   "",
+	} {
+		if got := receivedHeaders.Get(name); got != want {
+			t.Errorf("header %q = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestManagedHTTPAuthentication(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+	writeDumbServerInfo(t, serverRepo, commitID)
+
+	var requests, authorizedRequests int32
+	fileServer := http.StripPrefix("/repo.git", http.FileServer(http.Dir(serverRepo.Path())))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if userName, password, ok := r.BasicAuth(); !ok || userName != "user" || password != "good" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&authorizedRequests, 1)
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("auth", &ManagedHTTPTransportOptions{
+		RoundTripper:    &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+		MaxAuthAttempts: 2,
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "auth"+server.URL[len("https"):]+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	fetchWithPassword := func(password string) (int, error) {
+		credentialsCallbackCalls := 0
+		err := remote.Fetch(nil, &FetchOptions{
+			RemoteCallbacks: RemoteCallbacks{
+				CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+					credentialsCallbackCalls++
+					return NewCredentialUserpassPlaintext("user", password)
+				},
+			},
+		}, "")
+		return credentialsCallbackCalls, err
+	}
+
+	calls, err := fetchWithPassword("bad")
+	if !IsErrorCode(err, ErrorCodeAuth) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("credentials callback called %d times, want 2", calls)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	calls, err = fetchWithPassword("good")
+	checkFatal(t, err)
+	if calls != 1 {
+		t.Errorf("credentials callback called %d times, want 1", calls)
+	}
+	if unauthorized := atomic.LoadInt32(&requests) - atomic.LoadInt32(&authorizedRequests); unauthorized != 1 {
+		t.Errorf("%d requests were rejected, want only the first one", unauthorized)
+	}
+	if authorized := atomic.LoadInt32(&authorizedRequests); authorized < 2 {
+		t.Errorf("expected several authorized requests, got %d", authorized)
+	}
+
+	// A later operation does not get the credentials that were accepted for
+	// another one, and asks its own callback.
+	atomic.StoreInt32(&authorizedRequests, 0)
+	calls, err = fetchWithPassword("bad")
+	if !IsErrorCode(err, ErrorCodeAuth) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("credentials callback called %d times, want 2", calls)
+	}
+	if authorized := atomic.LoadInt32(&authorizedRequests); authorized != 0 {
+		t.Errorf("%d requests were authorized with the credentials of another operation", authorized)
+	}
+}
+
+func TestManagedHTTPAuthenticationRetriesPost(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+
+	// Only the POST requests need credentials, and the first one is
+	// rejected after the server read its whole body.
+	handler := newTestHTTPBackend(t, serverRepo)
+	var rejectedPosts int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if userName, password, ok := r.BasicAuth(); !ok || userName != "user" || password != "good" {
+				ioutil.ReadAll(r.Body)
+				atomic.AddInt32(&rejectedPosts, 1)
+				w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("authpost", &ManagedHTTPTransportOptions{
+		RoundTripper: &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", "authpost"+server.URL[len("https"):]+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialUserpassPlaintext("user", "good")
+			},
+		},
+	}, "")
+	checkFatal(t, err)
+	if rejected := atomic.LoadInt32(&rejectedPosts); rejected != 1 {
+		t.Errorf("%d POST requests were rejected, want 1", rejected)
+	}
+
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	if !odb.Exists(commitID) {
+		t.Error("the retried request did not fetch the commit")
+	}
+}
+
+func TestManagedHTTPAuthenticationProbesLargePost(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	seedTestRepo(t, serverRepo)
+
+	// git http-backend only accepts pushes from authenticated users.
+	handler := newTestHTTPBackend(t, serverRepo, "REMOTE_USER=user")
+	var rejectedPostSizes []int
+	var mu sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if userName, password, ok := r.BasicAuth(); !ok || userName != "user" || password != "good" {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				rejectedPostSizes = append(rejectedPostSizes, len(body))
+				mu.Unlock()
+				w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("authprobe", &ManagedHTTPTransportOptions{
+		RoundTripper: &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	seedTestRepo(t, repo)
+	// A pack that is larger than what the transport keeps in memory.
+	content := make([]byte, 2*httpPostBufferSize)
+	_, err = rand.Read(content)
+	checkFatal(t, err)
+	commitID, _ := updateReadme(t, repo, hex.EncodeToString(content))
+
+	remote, err := repo.Remotes.Create("origin", "authprobe"+server.URL[len("https"):]+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.Push([]string{"refs/heads/master:refs/heads/pushed"}, &PushOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialUserpassPlaintext("user", "good")
+			},
+		},
+	})
+	checkFatal(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(rejectedPostSizes) != 1 || rejectedPostSizes[0] != len(pktFlush) {
+		t.Errorf("rejected POST requests had bodies of %v bytes, want a single probe", rejectedPostSizes)
+	}
+	ref, err := serverRepo.References.Lookup("refs/heads/pushed")
+	checkFatal(t, err)
+	defer ref.Free()
+	if !ref.Target().Equal(commitID) {
+		t.Errorf("pushed ref = %v, want %v", ref.Target(), commitID)
+	}
+}
+
+func TestManagedHTTPCertificateCheckInHandshake(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+
+	var requests int32
+	handler := newTestHTTPBackend(t, serverRepo)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	// The certificate of the test server is self-signed, so it cannot be
+	// verified, and rejecting it must keep every request from being sent.
+	var checks int32
+	err = remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				atomic.AddInt32(&checks, 1)
+				if valid {
+					t.Error("the self-signed certificate was reported as valid")
+				}
+				if !bytes.Equal(cert.X509.Raw, server.Certificate().Raw) {
+					t.Error("certificate does not match the one from the server")
+				}
+				return errors.New("untrusted certificate")
+			},
+		},
+	}, "")
+	if err == nil {
+		t.Fatal("the fetch succeeded with a rejected certificate")
+	}
+	if atomic.LoadInt32(&checks) == 0 {
+		t.Error("CertificateCheckCallback was not called")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("the server received %d requests, want none", n)
+	}
+
+	// The callback can accept a certificate that could not be verified.
+	err = remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				return nil
+			},
+		},
+	}, "")
+	checkFatal(t, err)
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	if !odb.Exists(commitID) {
+		t.Error("the fetch did not get the commit")
+	}
+
+	// Without a callback, the certificate must be verifiable.
+	if err := remote.Fetch(nil, nil, ""); err == nil {
+		t.Error("the fetch succeeded without a way to verify the certificate")
+	}
+}
@@ -0,0 +1,80 @@
+//go:build go1.15
+// +build go1.15
+
+package git
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// checkCertificatesInHandshake returns a round tripper that passes the
+// certificate of the server to the certificate check callback during the
+// TLS handshake, before any request is sent. This is only possible when the
+// round tripper is an *http.Transport that does its own TLS handshakes.
+// Other round trippers are returned as they are, and the callback then sees
+// the certificate once a response arrives.
+func (t *httpSmartSubtransport) checkCertificatesInHandshake(roundTripper http.RoundTripper) http.RoundTripper {
+	base, ok := roundTripper.(*http.Transport)
+	if !ok || base.DialTLS != nil || base.DialTLSContext != nil {
+		t.checkResponseCertificates = true
+		return roundTripper
+	}
+
+	transport := base.Clone()
+	transport.TLSClientConfig = t.handshakeTLSConfig(base.TLSClientConfig)
+	return transport
+}
+
+// handshakeTLSConfig returns a copy of base that verifies the certificate
+// of the server as base would, and then lets the certificate check callback
+// accept or reject it.
+func (t *httpSmartSubtransport) handshakeTLSConfig(base *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	roots := config.RootCAs
+	skipVerify := config.InsecureSkipVerify
+	verifyConnection := config.VerifyConnection
+
+	// The chain is verified below, so that an invalid certificate reaches
+	// the callback instead of failing the handshake.
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("the server did not present a certificate")
+		}
+		verifyErr := verifyServerCertificate(&state, roots)
+		if err := t.certificateCheck(&state, verifyErr == nil, state.ServerName); err != nil {
+			if !IsErrorCode(err, ErrorCodePassthrough) {
+				return err
+			}
+			if verifyErr != nil && !skipVerify {
+				return verifyErr
+			}
+		}
+		if verifyConnection != nil {
+			return verifyConnection(state)
+		}
+		return nil
+	}
+	return config
+}
+
+// verifyServerCertificate verifies the chain of the certificate that the
+// server presented in state, and that it is valid for the server name.
+func verifyServerCertificate(state *tls.ConnectionState, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
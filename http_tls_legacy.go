@@ -0,0 +1,16 @@
+//go:build !go1.15
+// +build !go1.15
+
+package git
+
+import (
+	"net/http"
+)
+
+// checkCertificatesInHandshake returns roundTripper as it is: before Go
+// 1.15, the TLS handshake cannot call back into the transport, so the
+// certificate check callback sees the certificate once a response arrives.
+func (t *httpSmartSubtransport) checkCertificatesInHandshake(roundTripper http.RoundTripper) http.RoundTripper {
+	t.checkResponseCertificates = true
+	return roundTripper
+}
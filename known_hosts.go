@@ -0,0 +1,256 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsPolicy controls what a known_hosts certificate check does with
+// hosts that do not appear in any of the files. Hosts whose key does not
+// match the recorded one, and keys that are marked as @revoked, are always
+// rejected.
+type KnownHostsPolicy int
+
+const (
+	// KnownHostsStrict rejects hosts that are not present in the files.
+	KnownHostsStrict KnownHostsPolicy = iota
+	// KnownHostsAcceptNew accepts hosts that are not present in the files
+	// and remembers their keys for as long as the callback is in use, but
+	// does not modify the files.
+	KnownHostsAcceptNew
+	// KnownHostsAppend accepts hosts that are not present in the files and
+	// appends their keys to the first file.
+	KnownHostsAppend
+)
+
+// KnownHostsOptions configures NewKnownHostsCertificateCheckCallback.
+type KnownHostsOptions struct {
+	// Files are the OpenSSH known_hosts files to check against. If empty,
+	// ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts are used. Files that
+	// do not exist are ignored.
+	Files []string
+
+	// Policy controls how hosts that are not present in the files are
+	// handled.
+	Policy KnownHostsPolicy
+
+	// HashHostnames makes KnownHostsAppend record hashed hostnames, like
+	// OpenSSH's HashKnownHosts option.
+	HashHostnames bool
+}
+
+type knownHostsChecker struct {
+	files         []string
+	policy        KnownHostsPolicy
+	hashHostnames bool
+
+	mu sync.Mutex
+	// accepted holds the keys of the new hosts accepted by
+	// KnownHostsAcceptNew, indexed by normalized address.
+	accepted map[string][]byte
+}
+
+// NewKnownHostsCertificateCheckCallback creates a CertificateCheckCallback
+// that verifies SSH host keys against OpenSSH known_hosts files. Hashed
+// hostnames, non-standard ports written as [host]:port, and the
+// @cert-authority and @revoked markers are supported. Certificates that are
+// not SSH host keys are accepted if libgit2 considers them valid.
+//
+// The files are read again on every check, so changes made to them while
+// the callback is in use are taken into account.
+func NewKnownHostsCertificateCheckCallback(opts *KnownHostsOptions) (CertificateCheckCallback, error) {
+	if opts == nil {
+		opts = &KnownHostsOptions{}
+	}
+	files := opts.Files
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		files = []string{
+			filepath.Join(home, ".ssh", "known_hosts"),
+			"/etc/ssh/ssh_known_hosts",
+		}
+	}
+	switch opts.Policy {
+	case KnownHostsStrict, KnownHostsAcceptNew, KnownHostsAppend:
+	default:
+		return nil, fmt.Errorf("invalid known_hosts policy %d", opts.Policy)
+	}
+
+	c := &knownHostsChecker{
+		files:         files,
+		policy:        opts.Policy,
+		hashHostnames: opts.HashHostnames,
+		accepted:      make(map[string][]byte),
+	}
+	return c.check, nil
+}
+
+// knownHostsAddr is the net.Addr handed to the knownhosts package, which
+// prefers the hostname but still needs a well-formed remote address.
+type knownHostsAddr string
+
+func (a knownHostsAddr) Network() string { return "tcp" }
+func (a knownHostsAddr) String() string  { return string(a) }
+
+// knownHostsAddress turns the hostname given to a certificate check into a
+// host:port pair. The managed SSH transport includes the port, but libgit2's
+// own transport only passes the hostname.
+func knownHostsAddress(hostname string) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	if len(hostname) > 1 && hostname[0] == '[' && hostname[len(hostname)-1] == ']' {
+		hostname = hostname[1 : len(hostname)-1]
+	}
+	return net.JoinHostPort(hostname, "22")
+}
+
+func (c *knownHostsChecker) check(cert *Certificate, valid bool, hostname string) error {
+	if cert.Kind != CertificateHostkey {
+		if !valid {
+			return &GitError{Message: "the server certificate is not valid", Class: ErrorClassNet, Code: ErrorCodeCertificate}
+		}
+		return nil
+	}
+
+	key := cert.Hostkey.SSHPublicKey
+	if key == nil {
+		if cert.Hostkey.Kind&HostkeyRaw == 0 {
+			return &GitError{Message: "the host key of " + hostname + " is not available", Class: ErrorClassSSH, Code: ErrorCodeCertificate}
+		}
+		var err error
+		key, err = ssh.ParsePublicKey(cert.Hostkey.Hostkey)
+		if err != nil {
+			return err
+		}
+	}
+
+	address := knownHostsAddress(hostname)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	callback, err := c.load()
+	if err != nil {
+		return err
+	}
+	err = callback(address, knownHostsAddr(address), key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &revokedErr):
+		return &GitError{
+			Message: fmt.Sprintf("the host key of %s is revoked (%s:%d)", hostname, revokedErr.Revoked.Filename, revokedErr.Revoked.Line),
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeCertificate,
+		}
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		want := keyErr.Want[0]
+		return &GitError{
+			Message: fmt.Sprintf("the host key of %s does not match the one in %s:%d", hostname, want.Filename, want.Line),
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeCertificate,
+		}
+	case errors.As(err, &keyErr):
+		return c.checkNewHost(address, key)
+	default:
+		return &GitError{
+			Message: fmt.Sprintf("failed to verify the host key of %s: %v", hostname, err),
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeCertificate,
+		}
+	}
+}
+
+// load parses the files that exist.
+func (c *knownHostsChecker) load() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range c.files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		files = append(files, file)
+	}
+	return knownhosts.New(files...)
+}
+
+// checkNewHost applies the policy to a host that is not present in any of
+// the files.
+func (c *knownHostsChecker) checkNewHost(address string, key ssh.PublicKey) error {
+	normalized := knownhosts.Normalize(address)
+	if _, ok := key.(*ssh.Certificate); ok {
+		return &GitError{
+			Message: "the host certificate of " + normalized + " is not signed by a known certificate authority",
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeCertificate,
+		}
+	}
+
+	switch c.policy {
+	case KnownHostsAcceptNew:
+		if accepted, ok := c.accepted[normalized]; ok && !bytes.Equal(accepted, key.Marshal()) {
+			return &GitError{
+				Message: "the host key of " + normalized + " changed since it was first accepted",
+				Class:   ErrorClassSSH,
+				Code:    ErrorCodeCertificate,
+			}
+		}
+		c.accepted[normalized] = key.Marshal()
+		return nil
+
+	case KnownHostsAppend:
+		return c.appendHost(normalized, key)
+
+	default:
+		return &GitError{
+			Message: "no host key is known for " + normalized,
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeCertificate,
+		}
+	}
+}
+
+func (c *knownHostsChecker) appendHost(normalized string, key ssh.PublicKey) error {
+	file := c.files[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	line := knownhosts.Line([]string{normalized}, key)
+	if c.hashHostnames {
+		line = knownhosts.HashHostname(normalized) + line[len(normalized):]
+	}
+	// Do not glue the new entry to a last line that lacks its newline.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if r, err := os.Open(file); err == nil {
+			if _, err := r.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+				line = "\n" + line
+			}
+			r.Close()
+		}
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,133 @@
+package git
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	checkFatal(t, err)
+	return signer
+}
+
+func hostkeyCertificate(key ssh.PublicKey) *Certificate {
+	return &Certificate{
+		Kind: CertificateHostkey,
+		Hostkey: HostkeyCertificate{
+			Kind:         HostkeyRaw,
+			Hostkey:      key.Marshal(),
+			SSHPublicKey: key,
+		},
+	}
+}
+
+func TestKnownHostsCertificateCheck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	known := newTestHostKey(t).PublicKey()
+	other := newTestHostKey(t).PublicKey()
+	revoked := newTestHostKey(t).PublicKey()
+	authority := newTestHostKey(t)
+
+	hostCert := &ssh.Certificate{
+		Key:             newTestHostKey(t).PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"signed.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	checkFatal(t, hostCert.SignCert(rand.Reader, authority))
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	err = ioutil.WriteFile(knownHostsPath, []byte(strings.Join([]string{
+		"# comment",
+		knownhosts.HashHostname("[example.com]:2222") + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(known))),
+		"@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(revoked))),
+		"@cert-authority *.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(authority.PublicKey()))),
+		"",
+	}, "\n")), 0644)
+	checkFatal(t, err)
+
+	callback, err := NewKnownHostsCertificateCheckCallback(&KnownHostsOptions{
+		Files: []string{knownHostsPath, filepath.Join(dir, "missing")},
+	})
+	checkFatal(t, err)
+
+	for _, test := range []struct {
+		name     string
+		key      ssh.PublicKey
+		hostname string
+		ok       bool
+	}{
+		{"hashed host with port", known, "example.com:2222", true},
+		{"mismatched key", other, "example.com:2222", false},
+		{"different port", known, "example.com:22", false},
+		{"unknown host", known, "example.org", false},
+		{"revoked key", revoked, "example.org:22", false},
+		{"host certificate", hostCert, "signed.example.com:22", true},
+		{"host certificate for another host", hostCert, "other.example.com:22", false},
+	} {
+		err := callback(hostkeyCertificate(test.key), false, test.hostname)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !test.ok && !IsErrorCode(err, ErrorCodeCertificate) {
+			t.Errorf("%s: expected a certificate error, got %v", test.name, err)
+		}
+	}
+
+	// Accepting new hosts remembers them without touching the file.
+	callback, err = NewKnownHostsCertificateCheckCallback(&KnownHostsOptions{
+		Files:  []string{knownHostsPath},
+		Policy: KnownHostsAcceptNew,
+	})
+	checkFatal(t, err)
+	checkFatal(t, callback(hostkeyCertificate(known), false, "example.org"))
+	checkFatal(t, callback(hostkeyCertificate(known), false, "example.org:22"))
+	if err := callback(hostkeyCertificate(other), false, "example.org"); !IsErrorCode(err, ErrorCodeCertificate) {
+		t.Errorf("expected a certificate error for a changed key, got %v", err)
+	}
+	if err := callback(hostkeyCertificate(other), false, "example.com:2222"); !IsErrorCode(err, ErrorCodeCertificate) {
+		t.Errorf("expected a certificate error for a mismatched key, got %v", err)
+	}
+
+	// Appending records new hosts in the first file.
+	appendPath := filepath.Join(dir, "ssh", "known_hosts")
+	callback, err = NewKnownHostsCertificateCheckCallback(&KnownHostsOptions{
+		Files:         []string{appendPath, knownHostsPath},
+		Policy:        KnownHostsAppend,
+		HashHostnames: true,
+	})
+	checkFatal(t, err)
+	checkFatal(t, callback(hostkeyCertificate(other), false, "[::1]:2222"))
+
+	contents, err := ioutil.ReadFile(appendPath)
+	checkFatal(t, err)
+	if !strings.HasPrefix(string(contents), "|1|") || strings.Contains(string(contents), "::1") {
+		t.Errorf("expected a hashed entry, got %q", contents)
+	}
+
+	callback, err = NewKnownHostsCertificateCheckCallback(&KnownHostsOptions{
+		Files: []string{appendPath},
+	})
+	checkFatal(t, err)
+	checkFatal(t, callback(hostkeyCertificate(other), false, "[::1]:2222"))
+	if err := callback(hostkeyCertificate(known), false, "[::1]:2222"); !IsErrorCode(err, ErrorCodeCertificate) {
+		t.Errorf("expected a certificate error for a mismatched key, got %v", err)
+	}
+}
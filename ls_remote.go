@@ -0,0 +1,156 @@
+package git
+
+/*
+#include <git2.h>
+*/
+import "C"
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// ListRemoteOptions are the options of ListRemote.
+type ListRemoteOptions struct {
+	// Callbacks to use for the connection.
+	RemoteCallbacks RemoteCallbacks
+
+	// Proxy options to use for the connection.
+	ProxyOptions ProxyOptions
+
+	// Headers are extra HTTP headers to use for the connection.
+	Headers []string
+}
+
+// RemoteRef is a ref that ListRemote found on a remote repository.
+type RemoteRef struct {
+	Id   *Oid
+	Name string
+	// SymrefTarget is the ref that the ref points to if the server
+	// advertised it as a symbolic ref, such as refs/heads/main for HEAD.
+	SymrefTarget string
+	// PeeledId is the object that an annotated tag points to, or nil for
+	// the other refs.
+	PeeledId *Oid
+}
+
+func newRemoteRefFromC(ptr *C.git_remote_head) RemoteRef {
+	ref := RemoteRef{
+		Id:   newOidFromC(&ptr.oid),
+		Name: C.GoString(ptr.name),
+	}
+	if ptr.symref_target != nil {
+		ref.SymrefTarget = C.GoString(ptr.symref_target)
+	}
+	return ref
+}
+
+// ListRemote lists the refs that the repository at url advertises, like git
+// ls-remote, without a local repository. The symbolic refs that the server
+// advertises, such as HEAD, have their SymrefTarget set, and the annotated
+// tags have their PeeledId set.
+func ListRemote(url string, opts *ListRemoteOptions) ([]RemoteRef, error) {
+	return ListRemoteContext(context.Background(), url, opts)
+}
+
+// ListRemoteContext lists the refs of a remote repository like ListRemote,
+// but aborts the operation as soon as ctx is done. In that case the error
+// returned is ctx.Err().
+func ListRemoteContext(ctx context.Context, url string, opts *ListRemoteOptions) ([]RemoteRef, error) {
+	if opts == nil {
+		opts = &ListRemoteOptions{}
+	}
+
+	remote, err := createDetachedRemote(url)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.freeDetached()
+
+	if err := remote.ConnectContext(ctx, ConnectDirectionFetch, &opts.RemoteCallbacks, &opts.ProxyOptions, opts.Headers); err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	refs, err := remote.lsRefs()
+	if err != nil {
+		return nil, err
+	}
+	return foldPeeledRemoteRefs(refs), nil
+}
+
+// lsRefs returns the refs advertised by the connected remote, with their
+// symbolic targets.
+func (o *Remote) lsRefs() ([]RemoteRef, error) {
+	var heads **C.git_remote_head
+	var length C.size_t
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ret := C.git_remote_ls(&heads, &length, o.ptr)
+	if ret != 0 {
+		return nil, MakeGitError(ret)
+	}
+
+	size := int(length)
+	refs := make([]RemoteRef, 0, size)
+	if size == 0 {
+		return refs, nil
+	}
+	hdr := reflect.SliceHeader{
+		Data: uintptr(unsafe.Pointer(heads)),
+		Len:  size,
+		Cap:  size,
+	}
+	for _, head := range *(*[]*C.git_remote_head)(unsafe.Pointer(&hdr)) {
+		refs = append(refs, newRemoteRefFromC(head))
+	}
+	runtime.KeepAlive(o)
+	return refs, nil
+}
+
+// createDetachedRemote creates a remote for url that does not belong to any
+// repository. It is tracked so that the managed transports find it.
+func createDetachedRemote(url string) (*Remote, error) {
+	remote := &Remote{}
+
+	curl := C.CString(url)
+	defer C.free(unsafe.Pointer(curl))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ret := C.git_remote_create_detached(&remote.ptr, curl)
+	if ret < 0 {
+		return nil, MakeGitError(ret)
+	}
+	remotePointers.track(remote)
+	return remote, nil
+}
+
+// freeDetached releases a remote created by createDetachedRemote.
+func (o *Remote) freeDetached() {
+	remotePointers.untrack(o)
+	o.free()
+}
+
+// foldPeeledRemoteRefs folds the "^{}" entries of refs, which hold the
+// peeled values of annotated tags, into the entries of the tags.
+func foldPeeledRemoteRefs(refs []RemoteRef) []RemoteRef {
+	folded := make([]RemoteRef, 0, len(refs))
+	index := make(map[string]int, len(refs))
+	for _, ref := range refs {
+		if name := strings.TrimSuffix(ref.Name, "^{}"); name != ref.Name {
+			if i, ok := index[name]; ok {
+				folded[i].PeeledId = ref.Id
+				continue
+			}
+		}
+		index[ref.Name] = len(folded)
+		folded = append(folded, ref)
+	}
+	return folded
+}
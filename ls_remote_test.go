@@ -0,0 +1,72 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestListRemote(t *testing.T) {
+	t.Parallel()
+	remoteRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, remoteRepo)
+	commitId, _ := seedTestRepo(t, remoteRepo)
+	commit, err := remoteRepo.LookupCommit(commitId)
+	checkFatal(t, err)
+	defer commit.Free()
+	tagId := createTestTag(t, remoteRepo, commit)
+
+	heads, err := ListRemote(fmt.Sprintf("file://%s", remoteRepo.Workdir()), nil)
+	checkFatal(t, err)
+
+	byName := make(map[string]RemoteRef)
+	for _, head := range heads {
+		if strings.HasSuffix(head.Name, "^{}") {
+			t.Errorf("unexpected peeled entry %s", head.Name)
+		}
+		byName[head.Name] = head
+	}
+	if head := byName["HEAD"]; head.SymrefTarget != "refs/heads/master" || !head.Id.Equal(commitId) {
+		t.Errorf("unexpected HEAD: %+v", head)
+	}
+	if tag := byName["refs/tags/v0.0.0"]; !tag.Id.Equal(tagId) || tag.PeeledId == nil || !tag.PeeledId.Equal(commitId) {
+		t.Errorf("unexpected tag: %+v", tag)
+	}
+	if master := byName["refs/heads/master"]; !master.Id.Equal(commitId) || master.PeeledId != nil {
+		t.Errorf("unexpected master: %+v", master)
+	}
+}
+
+func TestRemoteSetHeadAuto(t *testing.T) {
+	t.Parallel()
+	remoteRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, remoteRepo)
+	seedTestRepo(t, remoteRepo)
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", fmt.Sprintf("file://%s", remoteRepo.Workdir()))
+	checkFatal(t, err)
+	defer remote.Free()
+	checkFatal(t, remote.Fetch(nil, nil, ""))
+
+	checkFatal(t, remote.ConnectFetch(nil, nil, nil))
+	defer remote.Disconnect()
+	branch, err := remote.DefaultBranch()
+	checkFatal(t, err)
+	if branch != "refs/heads/master" {
+		t.Errorf("DefaultBranch() = %q, want refs/heads/master", branch)
+	}
+
+	target, err := remote.SetHeadAuto()
+	checkFatal(t, err)
+	if target != "refs/remotes/origin/master" {
+		t.Errorf("SetHeadAuto() = %q, want refs/remotes/origin/master", target)
+	}
+	head, err := repo.References.Lookup("refs/remotes/origin/HEAD")
+	checkFatal(t, err)
+	defer head.Free()
+	if head.SymbolicTarget() != "refs/remotes/origin/master" {
+		t.Errorf("refs/remotes/origin/HEAD points to %q", head.SymbolicTarget())
+	}
+}
@@ -6,6 +6,7 @@ package git
 #include <stdlib.h>
 
 extern int _go_git_packbuilder_foreach(git_packbuilder *pb, void *payload);
+extern int _go_git_packbuilder_set_callbacks(git_packbuilder *pb, void *payload);
 */
 import "C"
 import (
@@ -19,8 +20,16 @@ type Packbuilder struct {
 	doNotCompare
 	ptr *C.git_packbuilder
 	r   *Repository
+	// progressHandle tracks the data of the progress callback, if any.
+	progressHandle unsafe.Pointer
 }
 
+// The stages that a PackbuilderProgressCallback reports.
+const (
+	PackbuilderAddingObjects int32 = C.GIT_PACKBUILDER_ADDING_OBJECTS
+	PackbuilderDeltafication int32 = C.GIT_PACKBUILDER_DELTAFICATION
+)
+
 func (repo *Repository) NewPackbuilder() (*Packbuilder, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -42,6 +51,42 @@ func newPackbuilderFromC(ptr *C.git_packbuilder, r *Repository) *Packbuilder {
 func (pb *Packbuilder) Free() {
 	runtime.SetFinalizer(pb, nil)
 	C.git_packbuilder_free(pb.ptr)
+	if pb.progressHandle != nil {
+		pointerHandles.Untrack(pb.progressHandle)
+		pb.progressHandle = nil
+	}
+}
+
+// SetCallbacks sets the callback that reports the progress of the
+// packbuilder as it adds objects and computes deltas. The stage is either
+// PackbuilderAddingObjects or PackbuilderDeltafication. Returning an error
+// from the callback aborts the operation in progress. A nil callback
+// removes it.
+func (pb *Packbuilder) SetCallbacks(progress PackbuilderProgressCallback) error {
+	var handle unsafe.Pointer
+	if progress != nil {
+		handle = pointerHandles.Track(&remoteCallbacksData{
+			callbacks: &RemoteCallbacks{PackProgressCallback: progress},
+		})
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ret := C._go_git_packbuilder_set_callbacks(pb.ptr, handle)
+	runtime.KeepAlive(pb)
+	if ret < 0 {
+		if handle != nil {
+			pointerHandles.Untrack(handle)
+		}
+		return MakeGitError(ret)
+	}
+
+	if pb.progressHandle != nil {
+		pointerHandles.Untrack(pb.progressHandle)
+	}
+	pb.progressHandle = handle
+	return nil
 }
 
 func (pb *Packbuilder) Insert(id *Oid, name string) error {
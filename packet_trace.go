@@ -0,0 +1,281 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PacketDirection tells whether a traced packet was sent to the server or
+// received from it.
+type PacketDirection int
+
+const (
+	PacketDirectionSent PacketDirection = iota
+	PacketDirectionReceived
+)
+
+// PacketKind identifies what a traced packet carries.
+type PacketKind int
+
+const (
+	// PacketKindData is a pkt-line with a payload, such as a ref
+	// advertisement line, a want, a have, an ACK or a NAK.
+	PacketKindData PacketKind = iota
+	// PacketKindSideband is a pkt-line on a sideband channel, whose number
+	// is in Band.
+	PacketKindSideband
+	// PacketKindFlush is the flush-pkt (0000), which ends a message.
+	PacketKindFlush
+	// PacketKindDelim is the delim-pkt (0001) of protocol v2.
+	PacketKindDelim
+	// PacketKindResponseEnd is the response-end-pkt (0002) of protocol v2.
+	PacketKindResponseEnd
+	// PacketKindRaw is data that is not framed in pkt-lines, such as a pack
+	// that is sent or received without a sideband.
+	PacketKindRaw
+	// PacketKindStreamEnd is reported once a stream is freed. It carries
+	// no payload, only the totals of the stream.
+	PacketKindStreamEnd
+)
+
+// TracedPacket is a packet that libgit2 exchanged with a smart subtransport
+// stream.
+type TracedPacket struct {
+	URL       string
+	Action    SmartServiceAction
+	Direction PacketDirection
+	Kind      PacketKind
+	// Payload is the content of a pkt-line without its length, and without
+	// the channel byte for sideband packets, or the data of a raw packet.
+	// It is only valid during the call to the callback.
+	Payload []byte
+	// Band is the sideband channel of a sideband packet: 1 for pack data,
+	// 2 for progress messages and 3 for fatal errors.
+	Band int
+	// Length is the number of bytes of the packet, including its length
+	// prefix and channel byte.
+	Length int
+	// Elapsed is the time since the stream was opened.
+	Elapsed time.Duration
+
+	// BytesSent, BytesReceived, PacketsSent and PacketsReceived are the
+	// totals of the stream, including this packet.
+	BytesSent       int64
+	BytesReceived   int64
+	PacketsSent     int
+	PacketsReceived int
+}
+
+// String formats the packet in the manner of GIT_TRACE_PACKET.
+func (p *TracedPacket) String() string {
+	direction := ">"
+	if p.Direction == PacketDirectionReceived {
+		direction = "<"
+	}
+	service := "fetch"
+	if p.Action == SmartServiceActionReceivepackLs || p.Action == SmartServiceActionReceivepack {
+		service = "push"
+	}
+	prefix := fmt.Sprintf("packet: %12s%s ", service, direction)
+
+	switch p.Kind {
+	case PacketKindFlush:
+		return prefix + "0000"
+	case PacketKindDelim:
+		return prefix + "0001"
+	case PacketKindResponseEnd:
+		return prefix + "0002"
+	case PacketKindSideband:
+		if p.Band == 1 {
+			return prefix + fmt.Sprintf("[band 1: %d bytes of pack data]", len(p.Payload))
+		}
+		return prefix + fmt.Sprintf("[band %d] %s", p.Band, quotePacketPayload(p.Payload))
+	case PacketKindRaw:
+		return prefix + fmt.Sprintf("[%d bytes of raw data]", len(p.Payload))
+	case PacketKindStreamEnd:
+		return fmt.Sprintf("packet: %12s  end of stream after %v: %d bytes in %d packets sent, %d bytes in %d packets received",
+			service, p.Elapsed, p.BytesSent, p.PacketsSent, p.BytesReceived, p.PacketsReceived)
+	default:
+		return prefix + quotePacketPayload(p.Payload)
+	}
+}
+
+// quotePacketPayload returns a pkt-line payload as text, without its
+// trailing newline, and with non-printable bytes escaped.
+func quotePacketPayload(payload []byte) string {
+	payload = bytes.TrimSuffix(payload, []byte("\n"))
+	var b bytes.Buffer
+	for _, c := range payload {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\%o`, c)
+		}
+	}
+	return b.String()
+}
+
+// PacketTraceCallback is called for every packet exchanged on a smart
+// subtransport stream. It is called from the goroutine of the operation,
+// which it blocks.
+//
+// The packets are those of the protocol v0 stream that libgit2 reads and
+// writes. When the server is spoken to in protocol v2 or over dumb HTTP, the
+// transport emulates that stream, so the traced packets are the emulated
+// ones rather than those that went over the network.
+type PacketTraceCallback func(packet *TracedPacket)
+
+// NewPacketTraceWriter returns a PacketTraceCallback that writes every
+// packet to w, one per line, in the format of GIT_TRACE_PACKET.
+func NewPacketTraceWriter(w io.Writer) PacketTraceCallback {
+	var mu sync.Mutex
+	return func(packet *TracedPacket) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintln(w, packet.String())
+	}
+}
+
+// packetTracer decodes the data of a stream into packets for the trace
+// callbacks.
+type packetTracer struct {
+	callbacks []PacketTraceCallback
+	url       string
+	action    SmartServiceAction
+	start     time.Time
+
+	sent     packetTraceDecoder
+	received packetTraceDecoder
+
+	bytesSent       int64
+	bytesReceived   int64
+	packetsSent     int
+	packetsReceived int
+}
+
+// packetTraceDecoder splits one direction of a stream into pkt-lines. Once
+// the data stops looking like pkt-lines, the rest of it is raw data.
+type packetTraceDecoder struct {
+	pending []byte
+	raw     bool
+}
+
+func newPacketTracer(url string, action SmartServiceAction, callbacks ...PacketTraceCallback) *packetTracer {
+	var active []PacketTraceCallback
+	for _, callback := range callbacks {
+		if callback != nil {
+			active = append(active, callback)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return &packetTracer{
+		callbacks: active,
+		url:       url,
+		action:    action,
+		start:     time.Now(),
+	}
+}
+
+// setAction records the action a stream is reused for.
+func (t *packetTracer) setAction(action SmartServiceAction) {
+	t.action = action
+}
+
+func (t *packetTracer) trace(data []byte, direction PacketDirection) {
+	decoder := &t.sent
+	if direction == PacketDirectionReceived {
+		decoder = &t.received
+	}
+	decoder.decode(data, func(kind PacketKind, payload []byte, length int) {
+		packet := &TracedPacket{
+			URL:       t.url,
+			Action:    t.action,
+			Direction: direction,
+			Kind:      kind,
+			Payload:   payload,
+			Length:    length,
+		}
+		if kind == PacketKindData && direction == PacketDirectionReceived && len(payload) > 0 && payload[0] >= 1 && payload[0] <= 3 {
+			// Textual pkt-lines never start with a control character, so
+			// this is a sideband packet.
+			packet.Kind = PacketKindSideband
+			packet.Band = int(payload[0])
+			packet.Payload = payload[1:]
+		}
+		if direction == PacketDirectionSent {
+			t.bytesSent += int64(length)
+			t.packetsSent++
+		} else {
+			t.bytesReceived += int64(length)
+			t.packetsReceived++
+		}
+		t.emit(packet)
+	})
+}
+
+// end reports the totals of the stream.
+func (t *packetTracer) end() {
+	t.emit(&TracedPacket{
+		URL:    t.url,
+		Action: t.action,
+		Kind:   PacketKindStreamEnd,
+	})
+}
+
+func (t *packetTracer) emit(packet *TracedPacket) {
+	packet.Elapsed = time.Since(t.start)
+	packet.BytesSent = t.bytesSent
+	packet.BytesReceived = t.bytesReceived
+	packet.PacketsSent = t.packetsSent
+	packet.PacketsReceived = t.packetsReceived
+	for _, callback := range t.callbacks {
+		callback(packet)
+	}
+}
+
+// decode splits data, along with what was left over from the previous
+// call, into packets. Incomplete pkt-lines are kept for the next call.
+func (d *packetTraceDecoder) decode(data []byte, emit func(kind PacketKind, payload []byte, length int)) {
+	if d.raw {
+		emit(PacketKindRaw, data, len(data))
+		return
+	}
+
+	buf := append(d.pending, data...)
+	for len(buf) >= 4 {
+		length, err := strconv.ParseUint(string(buf[:4]), 16, 16)
+		if err != nil || length == 3 || length > pktLineMaxLength {
+			d.raw = true
+			d.pending = nil
+			emit(PacketKindRaw, buf, len(buf))
+			return
+		}
+		switch length {
+		case 0:
+			emit(PacketKindFlush, nil, 4)
+		case 1:
+			emit(PacketKindDelim, nil, 4)
+		case 2:
+			emit(PacketKindResponseEnd, nil, 4)
+		default:
+			if len(buf) < int(length) {
+				d.pending = append([]byte(nil), buf...)
+				return
+			}
+			emit(PacketKindData, buf[4:length], int(length))
+			buf = buf[length:]
+			continue
+		}
+		buf = buf[4:]
+	}
+	d.pending = append([]byte(nil), buf...)
+}
@@ -0,0 +1,164 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPacketTraceDecoder(t *testing.T) {
+	t.Parallel()
+
+	var packets []TracedPacket
+	tracer := newPacketTracer("ssh://example.com/repo.git", SmartServiceActionUploadpack, func(packet *TracedPacket) {
+		copied := *packet
+		copied.Payload = append([]byte(nil), packet.Payload...)
+		packets = append(packets, copied)
+	})
+
+	// Pkt-lines can be split across reads and writes.
+	request := appendPktLine(nil, "want 0123456789012345678901234567890123456789 side-band-64k\n")
+	request = append(request, pktFlush...)
+	request = appendPktLine(request, "done\n")
+	tracer.trace(request[:10], PacketDirectionSent)
+	tracer.trace(request[10:], PacketDirectionSent)
+
+	response := appendPktLine(nil, "NAK\n")
+	response = appendPktLine(response, "\x02Counting objects: 3, done.\n")
+	response = appendPktLine(response, "\x01PACK")
+	response = append(response, pktFlush...)
+	tracer.trace(response, PacketDirectionReceived)
+
+	// Data that is not framed in pkt-lines is passed through as is.
+	tracer.trace([]byte("PACK\x00\x00\x00\x02"), PacketDirectionSent)
+	tracer.trace([]byte("0004"), PacketDirectionSent)
+	tracer.end()
+
+	expected := []struct {
+		direction PacketDirection
+		kind      PacketKind
+		band      int
+		payload   string
+	}{
+		{PacketDirectionSent, PacketKindData, 0, "want 0123456789012345678901234567890123456789 side-band-64k\n"},
+		{PacketDirectionSent, PacketKindFlush, 0, ""},
+		{PacketDirectionSent, PacketKindData, 0, "done\n"},
+		{PacketDirectionReceived, PacketKindData, 0, "NAK\n"},
+		{PacketDirectionReceived, PacketKindSideband, 2, "Counting objects: 3, done.\n"},
+		{PacketDirectionReceived, PacketKindSideband, 1, "PACK"},
+		{PacketDirectionReceived, PacketKindFlush, 0, ""},
+		{PacketDirectionSent, PacketKindRaw, 0, "PACK\x00\x00\x00\x02"},
+		{PacketDirectionSent, PacketKindRaw, 0, "0004"},
+		{PacketDirectionSent, PacketKindStreamEnd, 0, ""},
+	}
+	if len(packets) != len(expected) {
+		t.Fatalf("traced %d packets, want %d: %+v", len(packets), len(expected), packets)
+	}
+	for i, e := range expected {
+		p := packets[i]
+		if p.Kind != e.kind || p.Band != e.band || string(p.Payload) != e.payload {
+			t.Errorf("packet %d = %v band %d %q, want %v band %d %q", i, p.Kind, p.Band, p.Payload, e.kind, e.band, e.payload)
+		}
+		if p.Kind != PacketKindStreamEnd && p.Direction != e.direction {
+			t.Errorf("packet %d was traced in direction %v, want %v", i, p.Direction, e.direction)
+		}
+	}
+
+	end := packets[len(packets)-1]
+	if end.BytesSent != int64(len(request)+12) || end.BytesReceived != int64(len(response)) {
+		t.Errorf("stream totals are %d bytes sent and %d received, want %d and %d", end.BytesSent, end.BytesReceived, len(request)+12, len(response))
+	}
+	if end.PacketsSent != 5 || end.PacketsReceived != 4 {
+		t.Errorf("stream totals are %d packets sent and %d received, want 5 and 4", end.PacketsSent, end.PacketsReceived)
+	}
+
+	if s := packets[0].String(); s != "packet:        fetch> want 0123456789012345678901234567890123456789 side-band-64k" {
+		t.Errorf("unexpected formatting of a want: %q", s)
+	}
+	if s := packets[4].String(); s != "packet:        fetch< [band 2] Counting objects: 3, done." {
+		t.Errorf("unexpected formatting of a progress message: %q", s)
+	}
+}
+
+func TestManagedSSHPacketTrace(t *testing.T) {
+	t.Parallel()
+
+	hostPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	checkFatal(t, err)
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	checkFatal(t, err)
+
+	listener := startSSHServer(t, hostSigner, []ssh.PublicKey{signer.PublicKey()})
+	defer listener.Close()
+
+	registeredSmartTransport, err := RegisterManagedSSHTransport("sshtrace")
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	var transportTrace bytes.Buffer
+	registeredSmartTransport.SetPacketTraceCallback(NewPacketTraceWriter(&transportTrace))
+
+	var mu sync.Mutex
+	var sentWants, receivedNaks, sidebandPackets int
+	var ends []TracedPacket
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create(
+		"origin",
+		fmt.Sprintf("sshtrace://%s/TestGitRepository", listener.Addr().String()),
+	)
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				return nil
+			},
+			CredentialsCallback: func(url, username string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialSSHKeyFromSigner("testuser", signer)
+			},
+			PacketTraceCallback: func(packet *TracedPacket) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case packet.Kind == PacketKindData && packet.Direction == PacketDirectionSent && bytes.HasPrefix(packet.Payload, []byte("want ")):
+					sentWants++
+				case packet.Kind == PacketKindData && packet.Direction == PacketDirectionReceived && bytes.HasPrefix(packet.Payload, []byte("NAK")):
+					receivedNaks++
+				case packet.Kind == PacketKindSideband:
+					sidebandPackets++
+				case packet.Kind == PacketKindStreamEnd:
+					ends = append(ends, *packet)
+				}
+			},
+		},
+	}, "")
+	checkFatal(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sentWants == 0 || receivedNaks == 0 || sidebandPackets == 0 {
+		t.Errorf("traced %d wants, %d NAKs and %d sideband packets, want some of each", sentWants, receivedNaks, sidebandPackets)
+	}
+	if len(ends) == 0 {
+		t.Fatal("the end of the stream was not traced")
+	}
+	if end := ends[len(ends)-1]; end.BytesSent == 0 || end.BytesReceived == 0 || end.Elapsed <= 0 {
+		t.Errorf("unexpected stream totals: %+v", end)
+	}
+	if !strings.Contains(transportTrace.String(), "fetch> want ") {
+		t.Errorf("the transport trace callback did not see the wants:\n%s", transportTrace.String())
+	}
+}
@@ -0,0 +1,137 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// pktLineMaxLength is the maximum length of a pkt-line, including its
+// four-byte length prefix.
+const pktLineMaxLength = 65520
+
+// pktLineType identifies the special pkt-lines that have no payload.
+type pktLineType int
+
+const (
+	// pktLineData is a regular pkt-line that carries a payload.
+	pktLineData pktLineType = iota
+	// pktLineFlush is the flush-pkt (0000), which ends a message.
+	pktLineFlush
+	// pktLineDelim is the delim-pkt (0001), which separates sections of a
+	// protocol v2 message.
+	pktLineDelim
+	// pktLineResponseEnd is the response-end-pkt (0002), which ends a
+	// protocol v2 response in stateless connections.
+	pktLineResponseEnd
+)
+
+// The sideband channels of a response.
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+)
+
+var (
+	pktFlush       = []byte("0000")
+	pktDelim       = []byte("0001")
+	pktResponseEnd = []byte("0002")
+
+	errInvalidPktLine = errors.New("invalid pkt-line")
+)
+
+// pktLineReader reads pkt-lines from an underlying reader.
+type pktLineReader struct {
+	r *bufio.Reader
+	// raw, if not nil, receives a copy of every byte consumed from r.
+	raw io.Writer
+}
+
+func newPktLineReader(r io.Reader) *pktLineReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, pktLineMaxLength)
+	}
+	return &pktLineReader{r: br}
+}
+
+// ReadPktLine reads the next pkt-line. The returned payload is only valid
+// until the next call.
+func (r *pktLineReader) ReadPktLine() ([]byte, pktLineType, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errInvalidPktLine
+		}
+		return nil, pktLineData, err
+	}
+	if r.raw != nil {
+		r.raw.Write(header[:])
+	}
+
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, pktLineData, errInvalidPktLine
+	}
+	switch length {
+	case 0:
+		return nil, pktLineFlush, nil
+	case 1:
+		return nil, pktLineDelim, nil
+	case 2:
+		return nil, pktLineResponseEnd, nil
+	case 3:
+		return nil, pktLineData, errInvalidPktLine
+	}
+	if length > pktLineMaxLength {
+		return nil, pktLineData, errInvalidPktLine
+	}
+
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, pktLineData, errInvalidPktLine
+	}
+	if r.raw != nil {
+		r.raw.Write(payload)
+	}
+	return payload, pktLineData, nil
+}
+
+// appendPktLine appends payload to buf as a single pkt-line.
+func appendPktLine(buf []byte, payload string) []byte {
+	buf = append(buf, fmt.Sprintf("%04x", len(payload)+4)...)
+	return append(buf, payload...)
+}
+
+// encodePktLine writes payload to w as a single pkt-line.
+func encodePktLine(w io.Writer, payload []byte) error {
+	if len(payload)+4 > pktLineMaxLength {
+		return fmt.Errorf("pkt-line payload too long: %d bytes", len(payload))
+	}
+	if _, err := fmt.Fprintf(w, "%04x", len(payload)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// pktLineText returns the payload of a textual pkt-line without its trailing
+// newline.
+func pktLineText(payload []byte) string {
+	return string(bytes.TrimSuffix(payload, []byte("\n")))
+}
+
+// capabilitySet returns the set of the capabilities in list, which are
+// separated by spaces.
+func capabilitySet(list string) map[string]bool {
+	capabilities := make(map[string]bool)
+	for _, capability := range strings.Fields(list) {
+		capabilities[capability] = true
+	}
+	return capabilities
+}
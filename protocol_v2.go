@@ -0,0 +1,581 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ProtocolVersion is the version of the git wire protocol that the managed
+// transports request from the server.
+type ProtocolVersion int
+
+const (
+	// ProtocolVersionDefault uses the protocol.version setting of the
+	// repository, or protocol version 0 if it is not set.
+	ProtocolVersionDefault ProtocolVersion = iota
+	// ProtocolVersionV0 is the original protocol, where the server sends its
+	// full ref advertisement upon connecting.
+	ProtocolVersionV0
+	// ProtocolVersionV1 is protocol version 0 with an additional version line.
+	ProtocolVersionV1
+	// ProtocolVersionV2 is the command-based protocol, in which the client
+	// asks for the refs it is interested in with ls-refs.
+	ProtocolVersionV2
+)
+
+// resolveProtocolVersion returns the protocol version that should be used
+// for the remote.
+func resolveProtocolVersion(version ProtocolVersion, remote *Remote) ProtocolVersion {
+	if version != ProtocolVersionDefault {
+		return version
+	}
+	if remote == nil {
+		return ProtocolVersionV0
+	}
+	config, err := remote.repositoryConfig()
+	if err != nil || config == nil {
+		return ProtocolVersionV0
+	}
+	defer config.Free()
+
+	configured, err := config.LookupInt32("protocol.version")
+	if err != nil {
+		return ProtocolVersionV0
+	}
+	switch configured {
+	case 1:
+		return ProtocolVersionV1
+	case 2:
+		return ProtocolVersionV2
+	}
+	return ProtocolVersionV0
+}
+
+// gitProtocolParameter returns the value for the Git-Protocol HTTP header
+// and the GIT_PROTOCOL environment variable that requests this version, or
+// the empty string for protocol version 0.
+func (v ProtocolVersion) gitProtocolParameter() string {
+	switch v {
+	case ProtocolVersionV1:
+		return "version=1"
+	case ProtocolVersionV2:
+		return "version=2"
+	}
+	return ""
+}
+
+// readAdvertisement reads the beginning of the server's response to the
+// initial request of the upload-pack service. If the server speaks protocol
+// v2, its capabilities are returned. Otherwise the returned reader yields the
+// protocol v0 ref advertisement, without any "version 1" line. serviceHeader
+// reports whether the response started with a smart HTTP service header.
+func readAdvertisement(r *bufio.Reader) (capabilities map[string]string, v0 io.Reader, serviceHeader bool, err error) {
+	var consumed bytes.Buffer
+	pr := &pktLineReader{r: r, raw: &consumed}
+
+	payload, typ, err := pr.ReadPktLine()
+	if err == io.EOF {
+		return nil, r, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var header []byte
+	if typ == pktLineData && bytes.HasPrefix(payload, []byte("# service=")) {
+		serviceHeader = true
+		if _, typ, err = pr.ReadPktLine(); err != nil {
+			return nil, nil, false, err
+		}
+		if typ != pktLineFlush {
+			return nil, nil, false, errors.New("missing flush after the service header")
+		}
+		header = append(header, consumed.Bytes()...)
+		consumed.Reset()
+
+		payload, typ, err = pr.ReadPktLine()
+		if err == io.EOF {
+			return nil, bytes.NewReader(header), serviceHeader, nil
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if typ == pktLineData {
+		switch pktLineText(payload) {
+		case "version 2":
+			pr.raw = nil
+			capabilities = make(map[string]string)
+			for {
+				payload, typ, err := pr.ReadPktLine()
+				if err != nil {
+					return nil, nil, false, err
+				}
+				if typ != pktLineData {
+					break
+				}
+				key, value := splitCapability(pktLineText(payload))
+				capabilities[key] = value
+			}
+			return capabilities, nil, serviceHeader, nil
+
+		case "version 1":
+			return nil, io.MultiReader(bytes.NewReader(header), r), serviceHeader, nil
+		}
+	}
+
+	return nil, io.MultiReader(bytes.NewReader(header), bytes.NewReader(consumed.Bytes()), r), serviceHeader, nil
+}
+
+// splitCapability splits a "key=value" capability.
+func splitCapability(capability string) (string, string) {
+	if i := strings.IndexByte(capability, '='); i >= 0 {
+		return capability[:i], capability[i+1:]
+	}
+	return capability, ""
+}
+
+// protocolV2Conn sends protocol v2 commands to the server.
+type protocolV2Conn interface {
+	// roundTrip sends request, which must be a complete command, and returns
+	// a reader for the response. The closer must be closed once the response
+	// has been consumed.
+	roundTrip(request []byte) (*bufio.Reader, io.Closer, error)
+}
+
+// protocolV2Session translates between the protocol v0 exchange that libgit2
+// performs and the protocol v2 commands understood by the server.
+type protocolV2Session struct {
+	conn          protocolV2Conn
+	capabilities  map[string]string
+	serviceHeader bool
+	// refPrefixes returns the prefixes of the refs that the ref advertisement
+	// should be limited to. A nil result lists every ref.
+	refPrefixes func() []string
+
+	negotiation fetchNegotiation
+	// ready is the response in which the server announced that it was
+	// ready to send the packfile, which follows the acknowledgments.
+	ready *protocolV2FetchResponse
+}
+
+func newProtocolV2Session(conn protocolV2Conn, capabilities map[string]string, serviceHeader bool, refPrefixes func() []string) *protocolV2Session {
+	s := &protocolV2Session{
+		conn:          conn,
+		capabilities:  capabilities,
+		serviceHeader: serviceHeader,
+		refPrefixes:   refPrefixes,
+	}
+	s.negotiation.reset()
+	return s
+}
+
+// commandRequest starts a request for the command, including the
+// capabilities that every command carries.
+func (s *protocolV2Session) commandRequest(command string) []byte {
+	request := appendPktLine(nil, "command="+command+"\n")
+	if _, ok := s.capabilities["agent"]; ok {
+		request = appendPktLine(request, "agent="+managedTransportAgent+"\n")
+	}
+	if _, ok := s.capabilities["object-format"]; ok {
+		request = appendPktLine(request, "object-format=sha1\n")
+	}
+	return append(request, pktDelim...)
+}
+
+// lsRefs lists the refs of the server which start with any of the prefixes,
+// or all of them if there are none.
+func (s *protocolV2Session) lsRefs(prefixes []string) ([]advertisedRef, error) {
+	if _, ok := s.capabilities["ls-refs"]; !ok {
+		return nil, errors.New("server does not support ls-refs")
+	}
+
+	request := s.commandRequest("ls-refs")
+	request = appendPktLine(request, "symrefs\n")
+	request = appendPktLine(request, "peel\n")
+	for _, prefix := range prefixes {
+		request = appendPktLine(request, "ref-prefix "+prefix+"\n")
+	}
+	request = append(request, pktFlush...)
+
+	response, closer, err := s.conn.roundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var refs []advertisedRef
+	pr := &pktLineReader{r: response}
+	for {
+		payload, typ, err := pr.ReadPktLine()
+		if err == io.EOF {
+			return nil, errors.New("unexpected end of the ls-refs response")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ != pktLineData {
+			return refs, nil
+		}
+
+		line := pktLineText(payload)
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, fmt.Errorf("remote error: %s", line[len("ERR "):])
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid ls-refs line %q", line)
+		}
+		if fields[0] == "unborn" {
+			continue
+		}
+		ref := advertisedRef{id: fields[0], name: fields[1]}
+		for _, attribute := range fields[2:] {
+			switch {
+			case strings.HasPrefix(attribute, "symref-target:"):
+				ref.symrefTarget = attribute[len("symref-target:"):]
+			case strings.HasPrefix(attribute, "peeled:"):
+				ref.peeled = attribute[len("peeled:"):]
+			}
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// newStream creates a stream that presents the session to libgit2. If
+// advertise is set, the stream starts with the ref advertisement.
+func (s *protocolV2Session) newStream(advertise bool) *emulatedUploadPackStream {
+	return newEmulatedUploadPackStream(s, advertise)
+}
+
+func (s *protocolV2Session) advertisement() ([]byte, error) {
+	var prefixes []string
+	if s.refPrefixes != nil {
+		prefixes = s.refPrefixes()
+	}
+	refs, err := s.lsRefs(prefixes)
+	if err != nil {
+		return nil, err
+	}
+	return buildAdvertisement(s.serviceHeader, refs), nil
+}
+
+func (s *protocolV2Session) fetchNegotiation() *fetchNegotiation {
+	return &s.negotiation
+}
+
+// fetchRequest builds a fetch command with the negotiation state
+// accumulated so far and haves. If done is set, the server sends the
+// packfile; otherwise it only sends its acknowledgments.
+func (s *protocolV2Session) fetchRequest(haves []string, done bool) []byte {
+	request := s.commandRequest("fetch")
+	for _, argument := range s.negotiation.capabilities {
+		switch argument {
+		case "thin-pack", "ofs-delta", "include-tag", "no-progress":
+			request = appendPktLine(request, argument+"\n")
+		}
+	}
+	for _, want := range s.negotiation.wants {
+		request = appendPktLine(request, "want "+want+"\n")
+	}
+	for _, line := range s.negotiation.shallow {
+		request = appendPktLine(request, line+"\n")
+	}
+	for _, have := range haves {
+		request = appendPktLine(request, "have "+have+"\n")
+	}
+	if done {
+		request = appendPktLine(request, "done\n")
+	}
+	return append(request, pktFlush...)
+}
+
+// acknowledge sends a negotiation round to the server, and returns the haves
+// that it acknowledged. If the server is ready, the packfile that follows is
+// kept for the end of the negotiation.
+func (s *protocolV2Session) acknowledge(haves []string) ([]string, error) {
+	response, closer, err := s.conn.roundTrip(s.fetchRequest(haves, false))
+	if err != nil {
+		return nil, err
+	}
+
+	var acks []string
+	ready := false
+	pr := &pktLineReader{r: response}
+	for {
+		payload, typ, err := pr.ReadPktLine()
+		if err == io.EOF {
+			err = errors.New("unexpected end of the acknowledgments")
+		}
+		if err != nil {
+			closer.Close()
+			return nil, err
+		}
+
+		switch typ {
+		case pktLineFlush, pktLineResponseEnd:
+			closer.Close()
+			return acks, nil
+		case pktLineDelim:
+			if !ready {
+				closer.Close()
+				return nil, errors.New("unexpected section after the acknowledgments")
+			}
+			s.ready = &protocolV2FetchResponse{
+				r:       pr,
+				closer:  closer,
+				shallow: len(s.negotiation.shallow) > 0,
+			}
+			return acks, nil
+		}
+
+		line := pktLineText(payload)
+		switch {
+		case strings.HasPrefix(line, "ACK "):
+			acks = append(acks, strings.TrimSpace(line[len("ACK "):]))
+		case line == "ready":
+			ready = true
+		case strings.HasPrefix(line, "ERR "):
+			closer.Close()
+			return nil, fmt.Errorf("remote error: %s", line[len("ERR "):])
+		}
+	}
+}
+
+// fetch sends the fetch command with the negotiation state accumulated so
+// far, and returns the response translated to protocol v0.
+func (s *protocolV2Session) fetch() (io.Reader, error) {
+	if s.ready != nil {
+		// The server already sent the packfile.
+		response := s.ready
+		s.ready = nil
+		s.negotiation.reset()
+		return response, nil
+	}
+
+	request := s.fetchRequest(s.negotiation.haves(), true)
+	shallow := len(s.negotiation.shallow) > 0
+	s.negotiation.reset()
+
+	response, closer, err := s.conn.roundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	return &protocolV2FetchResponse{
+		r:       &pktLineReader{r: response},
+		closer:  closer,
+		shallow: shallow,
+	}, nil
+}
+
+// protocolV2FetchResponse translates the response to the fetch command into
+// the protocol v0 form: the shallow-info section of a shallow fetch,
+// terminated by a flush, then the sideband-multiplexed packfile, terminated
+// by a flush.
+type protocolV2FetchResponse struct {
+	r          *pktLineReader
+	closer     io.Closer
+	shallow    bool
+	pending    []byte
+	inPackfile bool
+	done       bool
+}
+
+func (f *protocolV2FetchResponse) Read(buf []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			f.finish()
+			return 0, err
+		}
+	}
+
+	n := copy(buf, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *protocolV2FetchResponse) next() error {
+	payload, typ, err := f.r.ReadPktLine()
+	if err == io.EOF {
+		return errors.New("unexpected end of the fetch response")
+	}
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case pktLineFlush, pktLineResponseEnd:
+		f.pending = append(f.pending, pktFlush...)
+		f.finish()
+		return nil
+	case pktLineDelim:
+		return nil
+	}
+
+	if f.inPackfile {
+		f.pending = appendPktLine(f.pending, string(payload))
+		return nil
+	}
+
+	line := pktLineText(payload)
+	switch {
+	case line == "packfile":
+		if f.shallow {
+			f.pending = append(f.pending, pktFlush...)
+		}
+		// libgit2 expects the final acknowledgment before the packfile.
+		f.pending = appendPktLine(f.pending, "NAK\n")
+		f.inPackfile = true
+	case f.shallow && (strings.HasPrefix(line, "shallow ") || strings.HasPrefix(line, "unshallow ")):
+		f.pending = appendPktLine(f.pending, line+"\n")
+	case strings.HasPrefix(line, "ERR "):
+		return fmt.Errorf("remote error: %s", line[len("ERR "):])
+	}
+	return nil
+}
+
+func (f *protocolV2FetchResponse) finish() {
+	if !f.done {
+		f.done = true
+		f.closer.Close()
+	}
+}
+
+func (f *protocolV2FetchResponse) Close() error {
+	f.finish()
+	return nil
+}
+
+// versionDetectingStream carries the server's response to the initial
+// request of the upload-pack service, and switches to protocol v2 if that
+// is what the server speaks.
+type versionDetectingStream struct {
+	underlying SmartSubtransportStream
+	r          *bufio.Reader
+	// startV2 is called to set up the protocol v2 session once the server
+	// has announced it.
+	startV2 func(capabilities map[string]string, r *bufio.Reader, serviceHeader bool) *protocolV2Session
+
+	v0 io.Reader
+	v2 *emulatedUploadPackStream
+}
+
+func newVersionDetectingStream(
+	underlying SmartSubtransportStream,
+	startV2 func(capabilities map[string]string, r *bufio.Reader, serviceHeader bool) *protocolV2Session,
+) *versionDetectingStream {
+	return &versionDetectingStream{
+		underlying: underlying,
+		r:          bufio.NewReaderSize(underlying, pktLineMaxLength),
+		startV2:    startV2,
+	}
+}
+
+func (s *versionDetectingStream) Read(buf []byte) (int, error) {
+	if s.v0 == nil && s.v2 == nil {
+		capabilities, v0, serviceHeader, err := readAdvertisement(s.r)
+		if err != nil {
+			return 0, err
+		}
+		if capabilities != nil {
+			s.v2 = s.startV2(capabilities, s.r, serviceHeader).newStream(true)
+		} else {
+			s.v0 = v0
+		}
+	}
+
+	if s.v2 != nil {
+		return s.v2.Read(buf)
+	}
+	return s.v0.Read(buf)
+}
+
+func (s *versionDetectingStream) Write(buf []byte) (int, error) {
+	if s.v2 != nil {
+		return s.v2.Write(buf)
+	}
+	return s.underlying.Write(buf)
+}
+
+func (s *versionDetectingStream) Free() {
+	if s.v2 != nil {
+		s.v2.Free()
+	}
+	s.underlying.Free()
+}
+
+// fetchRefPrefixes returns the ref prefixes that a fetch of refspecs needs
+// the server to advertise. A nil result means that every ref is needed.
+func fetchRefPrefixes(refspecs []string, downloadTags DownloadTags) []string {
+	var prefixes []string
+	objectIds := false
+	for _, refspec := range refspecs {
+		refspec = strings.TrimPrefix(refspec, "+")
+		if strings.HasPrefix(refspec, "^") {
+			continue
+		}
+		src := refspec
+		if i := strings.IndexByte(refspec, ':'); i >= 0 {
+			src = refspec[:i]
+		}
+		if src == "" {
+			continue
+		}
+		if isObjectIdString(src) {
+			// Objects wanted by id are not refs to list.
+			objectIds = true
+			continue
+		}
+		if i := strings.IndexByte(src, '*'); i >= 0 {
+			prefixes = append(prefixes, src[:i])
+			continue
+		}
+		prefixes = append(prefixes, expandRefPrefixes(src)...)
+	}
+	if len(prefixes) == 0 && !objectIds {
+		return nil
+	}
+
+	prefixes = append(prefixes, "HEAD")
+	if downloadTags != DownloadTagsNone {
+		prefixes = append(prefixes, "refs/tags/")
+	}
+	return prefixes
+}
+
+// isObjectIdString tells whether s is the hexadecimal form of an object id.
+func isObjectIdString(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isHexDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandRefPrefixes returns the refs that a possibly abbreviated name can
+// refer to, following the same rules as git rev-parse.
+func expandRefPrefixes(name string) []string {
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") {
+		return []string{name}
+	}
+	return []string{
+		name,
+		"refs/" + name,
+		"refs/tags/" + name,
+		"refs/heads/" + name,
+		"refs/remotes/" + name,
+		"refs/remotes/" + name + "/HEAD",
+	}
+}
@@ -0,0 +1,437 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testProtocolV2Capabilities = "" +
+		"000eversion 2\n" +
+		"0013agent=git/2.40\n" +
+		"000cls-refs\n" +
+		"0012fetch=shallow\n" +
+		"0000"
+
+	testCommitID = "1111111111111111111111111111111111111111"
+	testTagID    = "2222222222222222222222222222222222222222"
+)
+
+// fakeProtocolV2Conn records the requests it receives and replies with the
+// next canned response.
+type fakeProtocolV2Conn struct {
+	requests  []string
+	responses []string
+}
+
+func (c *fakeProtocolV2Conn) roundTrip(request []byte) (*bufio.Reader, io.Closer, error) {
+	c.requests = append(c.requests, string(request))
+	response := c.responses[0]
+	c.responses = c.responses[1:]
+	return bufio.NewReader(strings.NewReader(response)), ioutil.NopCloser(nil), nil
+}
+
+func pktLines(lines ...string) string {
+	var buf []byte
+	for _, line := range lines {
+		switch line {
+		case "0000", "0001", "0002":
+			buf = append(buf, line...)
+		default:
+			buf = appendPktLine(buf, line)
+		}
+	}
+	return string(buf)
+}
+
+func TestReadAdvertisement(t *testing.T) {
+	t.Parallel()
+
+	capabilities, v0, serviceHeader, err := readAdvertisement(bufio.NewReader(strings.NewReader(
+		"001e# service=git-upload-pack\n0000" + testProtocolV2Capabilities,
+	)))
+	checkFatal(t, err)
+	if v0 != nil || !serviceHeader {
+		t.Errorf("expected a protocol v2 advertisement with a service header")
+	}
+	expectedCapabilities := map[string]string{"agent": "git/2.40", "ls-refs": "", "fetch": "shallow"}
+	if !reflect.DeepEqual(expectedCapabilities, capabilities) {
+		t.Errorf("capabilities = %v, want %v", capabilities, expectedCapabilities)
+	}
+
+	for name, test := range map[string]struct {
+		advertisement string
+		expected      string
+	}{
+		"v0": {
+			advertisement: testUploadPackAdvertisement,
+			expected:      testUploadPackAdvertisement,
+		},
+		"v1": {
+			advertisement: "001e# service=git-upload-pack\n0000000eversion 1\n" + testUploadPackAdvertisement[len("001e# service=git-upload-pack\n0000"):],
+			expected:      testUploadPackAdvertisement,
+		},
+	} {
+		capabilities, v0, _, err := readAdvertisement(bufio.NewReader(strings.NewReader(test.advertisement)))
+		checkFatal(t, err)
+		if capabilities != nil {
+			t.Errorf("%s: unexpected protocol v2 capabilities %v", name, capabilities)
+			continue
+		}
+		got, err := ioutil.ReadAll(v0)
+		checkFatal(t, err)
+		if string(got) != test.expected {
+			t.Errorf("%s: advertisement = %q, want %q", name, got, test.expected)
+		}
+	}
+}
+
+func TestProtocolV2LsRefs(t *testing.T) {
+	t.Parallel()
+
+	conn := &fakeProtocolV2Conn{
+		responses: []string{pktLines(
+			testCommitID+" HEAD symref-target:refs/heads/main\n",
+			testCommitID+" refs/heads/main\n",
+			testTagID+" refs/tags/v1 peeled:"+testCommitID+"\n",
+			"0000",
+		)},
+	}
+	session := newProtocolV2Session(conn, map[string]string{"agent": "git/2.40", "ls-refs": ""}, true, func() []string {
+		return []string{"refs/heads/", "refs/tags/"}
+	})
+
+	advertisement, err := ioutil.ReadAll(session.newStream(true))
+	checkFatal(t, err)
+
+	expectedRequest := pktLines(
+		"command=ls-refs\n",
+		"agent="+managedTransportAgent+"\n",
+		"0001",
+		"symrefs\n",
+		"peel\n",
+		"ref-prefix refs/heads/\n",
+		"ref-prefix refs/tags/\n",
+		"0000",
+	)
+	if len(conn.requests) != 1 || conn.requests[0] != expectedRequest {
+		t.Errorf("requests = %q, want %q", conn.requests, expectedRequest)
+	}
+
+	expectedAdvertisement := pktLines(
+		"# service=git-upload-pack\n",
+		"0000",
+		testCommitID+" HEAD\x00"+protocolV0Capabilities+" symref=HEAD:refs/heads/main\n",
+		testCommitID+" refs/heads/main\n",
+		testTagID+" refs/tags/v1\n",
+		testCommitID+" refs/tags/v1^{}\n",
+		"0000",
+	)
+	if string(advertisement) != expectedAdvertisement {
+		t.Errorf("advertisement = %q, want %q", advertisement, expectedAdvertisement)
+	}
+}
+
+func TestProtocolV2Fetch(t *testing.T) {
+	t.Parallel()
+
+	conn := &fakeProtocolV2Conn{
+		responses: []string{
+			pktLines(
+				"acknowledgments\n",
+				"NAK\n",
+				"0000",
+			),
+			pktLines(
+				"acknowledgments\n",
+				"ACK "+testTagID+"\n",
+				"0000",
+			),
+			pktLines(
+				"packfile\n",
+				"\x02Counting objects\n",
+				"\x01PACK",
+				"0000",
+			),
+		},
+	}
+	session := newProtocolV2Session(conn, map[string]string{"fetch": ""}, false, nil)
+
+	// Stateless negotiation rounds, which are acknowledged by the server.
+	stream := session.newStream(false)
+	io.WriteString(stream, pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git2go\n",
+		"0000",
+		"have "+testCommitID+"\n",
+		"0000",
+	))
+	reply, err := ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if string(reply) != pktLines("NAK\n") {
+		t.Errorf("negotiation reply = %q, want NAK", reply)
+	}
+
+	stream = session.newStream(false)
+	io.WriteString(stream, pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git2go\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"0000",
+	))
+	reply, err = ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if expected := pktLines("ACK "+testTagID+" common\n", "NAK\n"); string(reply) != expected {
+		t.Errorf("negotiation reply = %q, want %q", reply, expected)
+	}
+
+	stream = session.newStream(false)
+	io.WriteString(stream, pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git2go\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"done\n",
+	))
+	reply, err = ioutil.ReadAll(stream)
+	checkFatal(t, err)
+
+	// Only the acknowledged have is sent again.
+	expectedRequests := []string{
+		pktLines(
+			"command=fetch\n",
+			"0001",
+			"thin-pack\n",
+			"ofs-delta\n",
+			"want "+testCommitID+"\n",
+			"have "+testCommitID+"\n",
+			"0000",
+		),
+		pktLines(
+			"command=fetch\n",
+			"0001",
+			"thin-pack\n",
+			"ofs-delta\n",
+			"want "+testCommitID+"\n",
+			"have "+testTagID+"\n",
+			"0000",
+		),
+		pktLines(
+			"command=fetch\n",
+			"0001",
+			"thin-pack\n",
+			"ofs-delta\n",
+			"want "+testCommitID+"\n",
+			"have "+testTagID+"\n",
+			"done\n",
+			"0000",
+		),
+	}
+	if !reflect.DeepEqual(conn.requests, expectedRequests) {
+		t.Errorf("requests = %q, want %q", conn.requests, expectedRequests)
+	}
+
+	expectedReply := pktLines(
+		"NAK\n",
+		"\x02Counting objects\n",
+		"\x01PACK",
+		"0000",
+	)
+	if string(reply) != expectedReply {
+		t.Errorf("reply = %q, want %q", reply, expectedReply)
+	}
+}
+
+func TestProtocolV2FetchReady(t *testing.T) {
+	t.Parallel()
+
+	// The server is ready after the first round, and sends the packfile
+	// right away.
+	conn := &fakeProtocolV2Conn{
+		responses: []string{pktLines(
+			"acknowledgments\n",
+			"ACK "+testTagID+"\n",
+			"ready\n",
+			"0001",
+			"packfile\n",
+			"\x01PACK",
+			"0000",
+		)},
+	}
+	session := newProtocolV2Session(conn, map[string]string{"fetch": ""}, false, nil)
+
+	stream := session.newStream(false)
+	io.WriteString(stream, pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k agent=git2go\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"0000",
+	))
+	reply, err := ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if expected := pktLines("ACK "+testTagID+" common\n", "NAK\n"); string(reply) != expected {
+		t.Errorf("negotiation reply = %q, want %q", reply, expected)
+	}
+
+	stream = session.newStream(false)
+	io.WriteString(stream, pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k agent=git2go\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"done\n",
+	))
+	reply, err = ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if len(conn.requests) != 1 {
+		t.Errorf("%d requests were sent, want 1", len(conn.requests))
+	}
+	if expected := pktLines("NAK\n", "\x01PACK", "0000"); string(reply) != expected {
+		t.Errorf("reply = %q, want %q", reply, expected)
+	}
+}
+
+func TestFetchRefPrefixes(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		refspecs     []string
+		downloadTags DownloadTags
+		expected     []string
+	}{
+		{
+			refspecs: []string{"+refs/heads/*:refs/remotes/origin/*"},
+			expected: []string{"refs/heads/", "HEAD", "refs/tags/"},
+		},
+		{
+			refspecs:     []string{"refs/heads/main:refs/remotes/origin/main", "^refs/heads/skip"},
+			downloadTags: DownloadTagsNone,
+			expected:     []string{"refs/heads/main", "HEAD"},
+		},
+		{
+			refspecs:     []string{"main"},
+			downloadTags: DownloadTagsNone,
+			expected: []string{
+				"main",
+				"refs/main",
+				"refs/tags/main",
+				"refs/heads/main",
+				"refs/remotes/main",
+				"refs/remotes/main/HEAD",
+				"HEAD",
+			},
+		},
+		{
+			refspecs:     []string{testCommitID, testTagID + ":refs/heads/pinned"},
+			downloadTags: DownloadTagsNone,
+			expected:     []string{"HEAD"},
+		},
+		{
+			refspecs: nil,
+			expected: nil,
+		},
+	} {
+		got := fetchRefPrefixes(test.refspecs, test.downloadTags)
+		if !reflect.DeepEqual(test.expected, got) {
+			t.Errorf("fetchRefPrefixes(%q) = %q, want %q", test.refspecs, got, test.expected)
+		}
+	}
+}
+
+func TestManagedHTTPProtocolV2Ls(t *testing.T) {
+	t.Parallel()
+
+	var lsRefsRequests []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Git-Protocol") != "version=2" {
+			t.Errorf("Git-Protocol = %q, want version=2", r.Header.Get("Git-Protocol"))
+		}
+		switch r.URL.Path {
+		case "/repo/info/refs":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			io.WriteString(w, "001e# service=git-upload-pack\n0000"+testProtocolV2Capabilities)
+
+		case "/repo/git-upload-pack":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			lsRefsRequests = append(lsRefsRequests, string(body))
+
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			if bytes.Contains(body, []byte("ref-prefix refs/heads/main\n")) {
+				io.WriteString(w, pktLines(testCommitID+" refs/heads/main\n", "0000"))
+				return
+			}
+			io.WriteString(w, pktLines(
+				testCommitID+" HEAD symref-target:refs/heads/main\n",
+				testCommitID+" refs/heads/main\n",
+				testCommitID+" refs/heads/other\n",
+				"0000",
+			))
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registeredSmartTransport, err := RegisterManagedHTTPTransportWithOptions("protocolv2", &ManagedHTTPTransportOptions{
+		RoundTripper:    &schemeRewritingRoundTripper{underlying: server.Client().Transport},
+		ProtocolVersion: ProtocolVersionV2,
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "protocolv2"+server.URL[len("https"):]+"/repo")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.ConnectFetch(nil, nil, nil)
+	checkFatal(t, err)
+
+	remoteHeads, err := remote.Ls()
+	checkFatal(t, err)
+	if len(remoteHeads) != 3 {
+		t.Errorf("expected the full listing, got %v", remoteHeads)
+	}
+
+	remoteHeads, err = remote.Ls("refs/heads/main")
+	checkFatal(t, err)
+
+	commitID, err := NewOid(testCommitID)
+	checkFatal(t, err)
+	expectedRemoteHeads := []RemoteHead{{commitID, "refs/heads/main"}}
+	if !reflect.DeepEqual(expectedRemoteHeads, remoteHeads) {
+		t.Errorf("mismatched remote heads. expected %v, got %v", expectedRemoteHeads, remoteHeads)
+	}
+	if len(lsRefsRequests) != 2 || !strings.Contains(lsRefsRequests[1], "ref-prefix refs/heads/main\n") {
+		t.Errorf("filter was not sent to the server: %q", lsRefsRequests)
+	}
+
+	// A filter that may match in the middle of the names is applied to
+	// the full listing, as with protocol v0.
+	remoteHeads, err = remote.Ls("main", "refs/heads/")
+	checkFatal(t, err)
+	expectedRemoteHeads = []RemoteHead{{commitID, "refs/heads/main"}, {commitID, "refs/heads/other"}}
+	if !reflect.DeepEqual(expectedRemoteHeads, remoteHeads) {
+		t.Errorf("mismatched remote heads. expected %v, got %v", expectedRemoteHeads, remoteHeads)
+	}
+	remoteHeads, err = remote.Ls("ain")
+	checkFatal(t, err)
+	expectedRemoteHeads = []RemoteHead{{commitID, "refs/heads/main"}}
+	if !reflect.DeepEqual(expectedRemoteHeads, remoteHeads) {
+		t.Errorf("mismatched remote heads. expected %v, got %v", expectedRemoteHeads, remoteHeads)
+	}
+	if len(lsRefsRequests) != 4 || strings.Contains(lsRefsRequests[2], "ref-prefix") || strings.Contains(lsRefsRequests[3], "ref-prefix") {
+		t.Errorf("unexpected ref prefixes: %q", lsRefsRequests)
+	}
+}
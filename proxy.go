@@ -0,0 +1,601 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// managedProxy connects the managed transports through the proxy that the
+// proxy options of an operation select, and keeps the credentials that the
+// proxy accepted.
+type managedProxy struct {
+	opts ProxyOptions
+	// configured is the proxy of the git configuration, which takes
+	// precedence over the environment for HTTP with ProxyTypeAuto.
+	configured  string
+	maxAttempts int
+
+	mu       sync.Mutex
+	auth     *url.Userinfo
+	attempts int
+	// socks holds the SOCKS proxies that the HTTP transport selected for
+	// the addresses it is about to connect to.
+	socks map[string]*url.URL
+	// last is the HTTP proxy that the HTTP transport selected last.
+	last *url.URL
+}
+
+func newManagedProxy(remote *Remote, transport *Transport, maxAttempts int) (*managedProxy, error) {
+	remoteConnectOpts, err := transport.SmartRemoteConnectOptions()
+	if err != nil {
+		return nil, err
+	}
+	p := &managedProxy{
+		opts:        remoteConnectOpts.ProxyOptions,
+		maxAttempts: maxAttempts,
+	}
+	if p.opts.Type == ProxyTypeAuto {
+		p.configured, err = readProxyConfig(remote)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// readProxyConfig reads the remote.<name>.proxy and http.proxy entries from
+// the configuration of the repository that owns the remote.
+func readProxyConfig(remote *Remote) (string, error) {
+	if remote == nil {
+		return "", nil
+	}
+	config, err := remote.repositoryConfig()
+	if err != nil || config == nil {
+		return "", err
+	}
+	defer config.Free()
+
+	var names []string
+	if name := remote.Name(); name != "" {
+		names = append(names, "remote."+name+".proxy")
+	}
+	names = append(names, "http.proxy")
+	for _, name := range names {
+		value, err := config.LookupString(name)
+		if err == nil && value != "" {
+			return value, nil
+		}
+		if err != nil && !IsErrorCode(err, ErrorCodeNotFound) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// proxyURL returns the proxy through which addr, a host:port pair, is
+// reached for a URL of the given scheme, or nil for a direct connection.
+func (p *managedProxy) proxyURL(scheme, addr string) (*url.URL, error) {
+	var rawURL string
+	switch p.opts.Type {
+	case ProxyTypeSpecified:
+		rawURL = p.opts.Url
+	case ProxyTypeAuto:
+		if scheme == "http" || scheme == "https" {
+			rawURL = p.configured
+		}
+		if rawURL == "" {
+			rawURL = proxyFromEnvironment(scheme)
+		}
+	}
+	if rawURL == "" || noProxy(os.Getenv("no_proxy")+","+os.Getenv("NO_PROXY"), addr) {
+		return nil, nil
+	}
+	return parseProxyURL(rawURL)
+}
+
+// proxyFromEnvironment returns the proxy that the environment configures for
+// a scheme. As in curl, ALL_PROXY applies when there is no proxy for the
+// scheme itself, which is the only one that applies to SSH.
+func proxyFromEnvironment(scheme string) string {
+	var names []string
+	switch scheme {
+	case "https":
+		names = []string{"https_proxy", "HTTPS_PROXY"}
+	case "http":
+		names = []string{"http_proxy", "HTTP_PROXY"}
+	}
+	names = append(names, "all_proxy", "ALL_PROXY")
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseProxyURL parses the URL of a proxy, which defaults to the http
+// scheme.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", rawURL)
+	}
+	return u, nil
+}
+
+// noProxy reports whether addr, a host:port pair, is excluded from proxying
+// by the comma-separated rules of a no_proxy variable. A rule is either *,
+// a domain that also matches its subdomains, an IP address or a CIDR block,
+// optionally followed by a port.
+func noProxy(rules, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+		if rule == "*" {
+			return true
+		}
+		if _, block, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && block.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, p, err := net.SplitHostPort(rule); err == nil {
+			if p != port {
+				continue
+			}
+			rule = h
+		} else if strings.HasPrefix(rule, "[") && strings.HasSuffix(rule, "]") {
+			rule = rule[1 : len(rule)-1]
+		}
+		if ruleIP := net.ParseIP(rule); ruleIP != nil {
+			if ip != nil && ip.Equal(ruleIP) {
+				return true
+			}
+			continue
+		}
+		rule = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(rule, "*"), "."), ".")
+		if host == rule || strings.HasSuffix(host, "."+rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns the credentials for proxyURL: the ones that the
+// credentials callback provided last, or else the ones of the URL.
+func (p *managedProxy) credentials(proxyURL *url.URL) *url.Userinfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.auth != nil {
+		return p.auth
+	}
+	return proxyURL.User
+}
+
+// requestCredentials asks the credentials callback for new credentials after
+// proxyURL rejected the current ones.
+func (p *managedProxy) requestCredentials(proxyURL *url.URL) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	redacted := proxyURL.Scheme + "://" + proxyURL.Host
+	if p.opts.CredentialsCallback == nil {
+		return &GitError{
+			Message: fmt.Sprintf("proxy authentication required for '%s'", redacted),
+			Class:   ErrorClassNet,
+			Code:    ErrorCodeAuth,
+		}
+	}
+	if p.attempts >= p.maxAttempts {
+		return &GitError{
+			Message: fmt.Sprintf("proxy authentication failed for '%s' after %d attempts", redacted, p.attempts),
+			Class:   ErrorClassNet,
+			Code:    ErrorCodeAuth,
+		}
+	}
+	p.attempts++
+
+	username := ""
+	if proxyURL.User != nil {
+		username = proxyURL.User.Username()
+	}
+	cred, err := p.opts.CredentialsCallback(redacted, username, CredentialTypeUserpassPlaintext)
+	if err != nil {
+		return err
+	}
+	if cred == nil {
+		return errors.New("no credentials were provided for the proxy")
+	}
+	defer cred.Free()
+	username, password, err := cred.GetUserpassPlaintext()
+	if err != nil {
+		return err
+	}
+	p.auth = url.UserPassword(username, password)
+	return nil
+}
+
+// httpProxy is the Proxy function of the http.Transport of the HTTP
+// transport. SOCKS proxies are remembered for httpDialContext instead.
+func (p *managedProxy) httpProxy(req *http.Request) (*url.URL, error) {
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		if req.URL.Scheme == "https" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	proxyURL, err := p.proxyURL(req.URL.Scheme, addr)
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		if p.socks == nil {
+			p.socks = make(map[string]*url.URL)
+		}
+		p.socks[addr] = proxyURL
+		return nil, nil
+	}
+	p.last = proxyURL
+
+	withAuth := *proxyURL
+	if p.auth != nil {
+		withAuth.User = p.auth
+	}
+	return &withAuth, nil
+}
+
+// httpDialContext is the DialContext function of the http.Transport of the
+// HTTP transport, which goes through the SOCKS proxy httpProxy selected for
+// addr, if any.
+func (p *managedProxy) httpDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	p.mu.Lock()
+	proxyURL := p.socks[addr]
+	p.mu.Unlock()
+
+	if proxyURL == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return p.dialSOCKS5(ctx, proxyURL, addr)
+}
+
+// lastHTTPProxy returns the HTTP proxy that the HTTP transport used last.
+func (p *managedProxy) lastHTTPProxy() *url.URL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// isProxyAuthError reports whether err is the error of an http.Transport
+// whose CONNECT request was rejected for a lack of proxy credentials.
+func isProxyAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), http.StatusText(http.StatusProxyAuthRequired))
+}
+
+// dialContext connects to addr through the proxy that applies to the given
+// scheme, or directly if there is none.
+func (p *managedProxy) dialContext(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	proxyURL, err := p.proxyURL(scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return p.dialSOCKS5(ctx, proxyURL, addr)
+	default:
+		return p.dialHTTPConnect(ctx, proxyURL, addr)
+	}
+}
+
+// dialProxy connects to the proxy itself.
+func dialProxy(ctx context.Context, proxyURL *url.URL) (net.Conn, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		switch proxyURL.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// dialHTTPConnect opens a tunnel to addr with a CONNECT request to an HTTP
+// proxy, asking for new credentials as long as the proxy rejects them.
+func (p *managedProxy) dialHTTPConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	for {
+		conn, err := dialProxy(ctx, proxyURL)
+		if err != nil {
+			return nil, err
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if auth := p.credentials(proxyURL); auth != nil {
+			password, _ := auth.Password()
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.Username()+":"+password)))
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			conn.SetDeadline(time.Time{})
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, r: br}, nil
+			}
+			return conn, nil
+		case http.StatusProxyAuthRequired:
+			conn.Close()
+			if err := p.requestCredentials(proxyURL); err != nil {
+				return nil, err
+			}
+		default:
+			conn.Close()
+			return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+		}
+	}
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SOCKS5 constants, from RFC 1928 and RFC 1929.
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5PasswordVersion  = 0x01
+	socks5CommandConnect   = 0x01
+	socks5AddressIPv4      = 0x01
+	socks5AddressDomain    = 0x03
+	socks5AddressIPv6      = 0x04
+)
+
+var socks5Replies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy. With the socks5
+// scheme, host names are resolved locally, and with socks5h, by the proxy.
+func (p *managedProxy) dialSOCKS5(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && proxyURL.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addrs[0].IP
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				ip = a.IP
+				break
+			}
+		}
+	}
+
+	for {
+		conn, err := dialProxy(ctx, proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		retry, err := p.socks5Handshake(conn, proxyURL, host, ip, uint16(port))
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			return conn, nil
+		}
+		conn.Close()
+		if !retry {
+			return nil, err
+		}
+		if err := p.requestCredentials(proxyURL); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// socks5Handshake asks the proxy conn is connected to for a connection to
+// the host, or to ip if it is not nil. It reports whether the handshake
+// failed because the proxy rejected the credentials.
+func (p *managedProxy) socks5Handshake(conn net.Conn, proxyURL *url.URL, host string, ip net.IP, port uint16) (bool, error) {
+	auth := p.credentials(proxyURL)
+	methods := []byte{socks5AuthNone}
+	if auth != nil || p.opts.CredentialsCallback != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return false, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return false, err
+	}
+	if reply[0] != socks5Version {
+		return false, fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if auth == nil {
+			// The proxy requires credentials that the URL does not have.
+			return true, errors.New("SOCKS proxy requires credentials")
+		}
+		username := auth.Username()
+		password, _ := auth.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return false, errors.New("SOCKS credentials are too long")
+		}
+		request := []byte{socks5PasswordVersion, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return false, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return false, err
+		}
+		if reply[1] != 0 {
+			return true, errors.New("SOCKS proxy rejected the credentials")
+		}
+	case socks5AuthNoAcceptable:
+		return false, errors.New("no acceptable SOCKS authentication method")
+	default:
+		return false, fmt.Errorf("unexpected SOCKS authentication method %d", reply[1])
+	}
+
+	request := []byte{socks5Version, socks5CommandConnect, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddressIPv4)
+		request = append(request, ip4...)
+	} else if ip != nil {
+		request = append(request, socks5AddressIPv6)
+		request = append(request, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return false, fmt.Errorf("host name %q is too long", host)
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return false, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return false, err
+	}
+	if header[1] != 0 {
+		message := fmt.Sprintf("unknown SOCKS error %d", header[1])
+		if int(header[1]) < len(socks5Replies) {
+			message = socks5Replies[header[1]]
+		}
+		return false, fmt.Errorf("SOCKS proxy could not connect to %s: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), message)
+	}
+
+	// Skip the bound address.
+	var length int
+	switch header[3] {
+	case socks5AddressIPv4:
+		length = net.IPv4len
+	case socks5AddressIPv6:
+		length = net.IPv6len
+	case socks5AddressDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return false, err
+		}
+		length = int(n[0])
+	default:
+		return false, fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, length+2)); err != nil {
+		return false, err
+	}
+	return false, nil
+}
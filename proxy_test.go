@@ -0,0 +1,497 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testProxy is an in-process HTTP and SOCKS5 proxy that requires
+// credentials if username is set, and records the addresses it connects to.
+type testProxy struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+	// rejected is the number of times credentials were refused.
+	rejected int
+}
+
+func startTestProxy(t *testing.T, username, password string) *testProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	checkFatal(t, err)
+	p := &testProxy{
+		listener: listener,
+		username: username,
+		password: password,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *testProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *testProxy) record(target string, rejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rejected {
+		p.rejected++
+	} else {
+		p.targets = append(p.targets, target)
+	}
+}
+
+func (p *testProxy) stats() ([]string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...), p.rejected
+}
+
+func (p *testProxy) authorized(username, password string) bool {
+	return p.username == "" || (username == p.username && password == p.password)
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == socks5Version {
+		p.serveSOCKS5(conn, br)
+	} else {
+		p.serveHTTP(conn, br)
+	}
+}
+
+func (p *testProxy) serveHTTP(conn net.Conn, br *bufio.Reader) {
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		username, password := "", ""
+		if auth := req.Header.Get("Proxy-Authorization"); strings.HasPrefix(auth, "Basic ") {
+			decoded, _ := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+			credentials := strings.SplitN(string(decoded), ":", 2)
+			if len(credentials) == 2 {
+				username, password = credentials[0], credentials[1]
+			}
+		}
+		if !p.authorized(username, password) {
+			p.record("", true)
+			io.Copy(ioutil.Discard, req.Body)
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n")
+			continue
+		}
+
+		if req.Method == "CONNECT" {
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			defer target.Close()
+			p.record(req.Host, false)
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(target, br)
+			io.Copy(conn, target)
+			return
+		}
+
+		p.record(req.URL.Host, false)
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Authorization")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *testProxy) serveSOCKS5(conn net.Conn, br *bufio.Reader) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+
+	method := byte(socks5AuthNone)
+	if p.username != "" {
+		method = socks5AuthPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		p.record("", true)
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	readString := func() string {
+		var length [1]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return ""
+		}
+		s := make([]byte, length[0])
+		io.ReadFull(br, s)
+		return string(s)
+	}
+	if method == socks5AuthPassword {
+		var version [1]byte
+		if _, err := io.ReadFull(br, version[:]); err != nil {
+			return
+		}
+		username := readString()
+		password := readString()
+		if !p.authorized(username, password) {
+			p.record("", true)
+			conn.Write([]byte{socks5PasswordVersion, 1})
+			return
+		}
+		conn.Write([]byte{socks5PasswordVersion, 0})
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(br, request[:]); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socks5AddressDomain:
+		host = readString()
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{socks5Version, 5, 0, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	p.record(addr, false)
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, br)
+	io.Copy(conn, target)
+}
+
+func TestNoProxy(t *testing.T) {
+	t.Parallel()
+
+	const rules = "internal.example.com, .corp, *.lan, 10.0.0.0/8, 192.168.1.1, [::1], example.org:8080"
+	for _, test := range []struct {
+		addr     string
+		expected bool
+	}{
+		{"internal.example.com:443", true},
+		{"git.internal.example.com:22", true},
+		{"example.com:443", false},
+		{"notinternal.example.com:443", false},
+		{"corp:443", true},
+		{"git.corp:443", true},
+		{"host.LAN:80", true},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3:22", false},
+		{"192.168.1.1:80", true},
+		{"[::1]:22", true},
+		{"example.org:8080", true},
+		{"example.org:443", false},
+	} {
+		if actual := noProxy(rules, test.addr); actual != test.expected {
+			t.Errorf("noProxy(%q) = %v, want %v", test.addr, actual, test.expected)
+		}
+	}
+	if !noProxy("*", "example.com:443") {
+		t.Error("* should match every host")
+	}
+	if noProxy("", "example.com:443") {
+		t.Error("empty rules should not match")
+	}
+}
+
+func TestManagedProxyDial(t *testing.T) {
+	t.Parallel()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	checkFatal(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, err := net.SplitHostPort(target.Addr().String())
+	checkFatal(t, err)
+
+	proxy := startTestProxy(t, "proxyuser", "secret")
+	defer proxy.Close()
+
+	for _, test := range []struct {
+		name     string
+		proxyURL string
+		// password is the one that the credentials callback provides.
+		password string
+		addr     string
+		target   string
+		rejected int
+		// callbacks is the number of times the credentials callback is
+		// called. A SOCKS proxy asks for credentials before rejecting them.
+		callbacks int
+	}{
+		{"http with userinfo", "http://proxyuser:secret@" + proxy.Addr(), "", "127.0.0.1:" + port, "127.0.0.1:" + port, 0, 0},
+		{"http with callback", "http://" + proxy.Addr(), "secret", "127.0.0.1:" + port, "127.0.0.1:" + port, 1, 1},
+		{"http with rejected userinfo", "http://proxyuser:wrong@" + proxy.Addr(), "secret", "127.0.0.1:" + port, "127.0.0.1:" + port, 1, 1},
+		{"socks5 with userinfo", "socks5://proxyuser:secret@" + proxy.Addr(), "", "localhost:" + port, "127.0.0.1:" + port, 0, 0},
+		{"socks5h with callback", "socks5h://" + proxy.Addr(), "secret", "localhost:" + port, "localhost:" + port, 0, 1},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			callbackCalls := 0
+			p := &managedProxy{
+				opts: ProxyOptions{
+					Type: ProxyTypeSpecified,
+					Url:  test.proxyURL,
+					CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+						callbackCalls++
+						if test.password == "" {
+							return nil, fmt.Errorf("unexpected credentials request for %s", url)
+						}
+						return NewCredentialUserpassPlaintext("proxyuser", test.password)
+					},
+				},
+				maxAttempts: 2,
+			}
+
+			proxy.mu.Lock()
+			proxy.targets, proxy.rejected = nil, 0
+			proxy.mu.Unlock()
+			conn, err := p.dialContext(context.Background(), "ssh", test.addr)
+			checkFatal(t, err)
+			defer conn.Close()
+
+			_, err = io.WriteString(conn, "ping")
+			checkFatal(t, err)
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(conn, reply)
+			checkFatal(t, err)
+			if string(reply) != "ping" {
+				t.Errorf("got %q through the proxy, want %q", reply, "ping")
+			}
+
+			targets, rejected := proxy.stats()
+			if len(targets) != 1 || targets[0] != test.target {
+				t.Errorf("the proxy connected to %v, want %s", targets, test.target)
+			}
+			if rejected != test.rejected {
+				t.Errorf("the proxy rejected %d credentials, want %d", rejected, test.rejected)
+			}
+			if callbackCalls != test.callbacks {
+				t.Errorf("credentials callback called %d times, want %d", callbackCalls, test.callbacks)
+			}
+		})
+	}
+
+	// Without valid credentials, dialing fails with an authentication error
+	// once the attempts are exhausted.
+	p := &managedProxy{
+		opts: ProxyOptions{
+			Type: ProxyTypeSpecified,
+			Url:  "socks5://" + proxy.Addr(),
+			CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialUserpassPlaintext("proxyuser", "wrong")
+			},
+		},
+		maxAttempts: 2,
+	}
+	if _, err := p.dialContext(context.Background(), "ssh", "127.0.0.1:"+port); !IsErrorCode(err, ErrorCodeAuth) {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestManagedHTTPProxy(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+	writeDumbServerInfo(t, serverRepo, commitID)
+
+	server := httptest.NewServer(http.StripPrefix("/repo.git", http.FileServer(http.Dir(serverRepo.Path()))))
+	defer server.Close()
+
+	proxy := startTestProxy(t, "proxyuser", "secret")
+	defer proxy.Close()
+
+	fetch := func(proxyURL string, callback CredentialsCallback) error {
+		repo := createTestRepo(t)
+		defer cleanupTestRepo(t, repo)
+
+		remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+		checkFatal(t, err)
+		defer remote.Free()
+
+		return remote.Fetch(nil, &FetchOptions{
+			ProxyOptions: ProxyOptions{
+				Type:                ProxyTypeSpecified,
+				Url:                 proxyURL,
+				CredentialsCallback: callback,
+			},
+		}, "")
+	}
+
+	err := fetch("http://proxyuser:secret@"+proxy.Addr(), nil)
+	checkFatal(t, err)
+	targets, _ := proxy.stats()
+	if len(targets) == 0 {
+		t.Error("the fetch did not go through the HTTP proxy")
+	}
+
+	callbackCalls := 0
+	err = fetch("socks5h://"+proxy.Addr(), func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+		callbackCalls++
+		return NewCredentialUserpassPlaintext("proxyuser", "secret")
+	})
+	checkFatal(t, err)
+	if callbackCalls != 1 {
+		t.Errorf("proxy credentials callback called %d times, want 1", callbackCalls)
+	}
+
+	err = fetch("http://proxyuser:wrong@"+proxy.Addr(), nil)
+	if !IsErrorCode(err, ErrorCodeAuth) {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestManagedSSHProxy(t *testing.T) {
+	t.Parallel()
+
+	hostPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	checkFatal(t, err)
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	checkFatal(t, err)
+
+	listener := startSSHServer(t, hostSigner, []ssh.PublicKey{signer.PublicKey()})
+	defer listener.Close()
+
+	proxy := startTestProxy(t, "proxyuser", "secret")
+	defer proxy.Close()
+
+	for _, proxyOpts := range []ProxyOptions{
+		{
+			Type: ProxyTypeSpecified,
+			Url:  "http://" + proxy.Addr(),
+			CredentialsCallback: func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialUserpassPlaintext("proxyuser", "secret")
+			},
+		},
+		{
+			Type: ProxyTypeSpecified,
+			Url:  "socks5://proxyuser:secret@" + proxy.Addr(),
+		},
+	} {
+		proxy.mu.Lock()
+		proxy.targets = nil
+		proxy.mu.Unlock()
+
+		repo := createTestRepo(t)
+		defer cleanupTestRepo(t, repo)
+
+		remote, err := repo.Remotes.Create(
+			"origin",
+			fmt.Sprintf("ssh://%s/TestGitRepository", listener.Addr().String()),
+		)
+		checkFatal(t, err)
+		defer remote.Free()
+
+		err = remote.Fetch(nil, &FetchOptions{
+			RemoteCallbacks: RemoteCallbacks{
+				CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+					return nil
+				},
+				CredentialsCallback: func(url, username string, allowedTypes CredentialType) (*Credential, error) {
+					return NewCredentialSSHKeyFromSigner("testuser", signer)
+				},
+			},
+			ProxyOptions: proxyOpts,
+		}, "")
+		checkFatal(t, err)
+
+		targets, _ := proxy.stats()
+		if len(targets) != 1 || targets[0] != listener.Addr().String() {
+			t.Errorf("%s: the proxy connected to %v, want %s", proxyOpts.Url, targets, listener.Addr())
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PushStatus is the outcome of the update of a remote ref by a push.
+type PushStatus int
+
+const (
+	// PushStatusOk means that the server updated the ref.
+	PushStatusOk PushStatus = iota
+	// PushStatusRejected means that the server refused the update, for a
+	// reason other than the ones below.
+	PushStatusRejected
+	// PushStatusRejectedNonFastForward means that the server refused an
+	// update that is not a fast-forward.
+	PushStatusRejectedNonFastForward
+	// PushStatusRejectedStale means that the ref did not have the value
+	// that the push expected, such as the one given in
+	// PushOptions.ExpectedOldIds.
+	PushStatusRejectedStale
+	// PushStatusRejectedAtomic means that the update was refused because
+	// another update of an atomic push was.
+	PushStatusRejectedAtomic
+)
+
+// PushUpdate is the update of a remote ref that a push is about to send.
+type PushUpdate struct {
+	// Source is the local ref that is pushed. It is empty for deletions.
+	Source string
+	// Destination is the name of the remote ref.
+	Destination string
+	// OldId is the value of the remote ref that the server advertised
+	// before the push. It is zero if the ref did not exist.
+	OldId *Oid
+	// NewId is the value that is pushed. It is zero for deletions.
+	NewId *Oid
+}
+
+// PushResult is the outcome of the update of a remote ref by a push.
+type PushResult struct {
+	PushUpdate
+	// Status tells whether the server updated the ref.
+	Status PushStatus
+	// Message is the reason the server gave for refusing the update.
+	Message string
+}
+
+// Rejected tells whether the server refused the update.
+func (r *PushResult) Rejected() bool {
+	return r.Status != PushStatusOk
+}
+
+// pushStatusFromMessage classifies the reason a server gave for refusing an
+// update, in the words of git-receive-pack.
+func pushStatusFromMessage(message string) PushStatus {
+	switch {
+	case message == "":
+		return PushStatusOk
+	case strings.Contains(message, "non-fast-forward"), strings.Contains(message, "fetch first"):
+		return PushStatusRejectedNonFastForward
+	case strings.HasPrefix(message, "atomic "):
+		return PushStatusRejectedAtomic
+	}
+	return PushStatusRejected
+}
+
+// pushState is the state of a push, which the callbacks and the managed
+// transports share.
+type pushState struct {
+	pushOptions    []string
+	atomic         bool
+	expectedOldIds map[string]*Oid
+
+	mu sync.Mutex
+	// managed is set once a managed transport carries the push.
+	managed bool
+	// capabilities are the receive-pack capabilities of the server, or nil
+	// if they have not been advertised yet.
+	capabilities map[string]bool
+	results      []*PushResult
+}
+
+func newPushState(opts *PushOptions) *pushState {
+	return &pushState{
+		pushOptions:    opts.RemotePushOptions,
+		atomic:         opts.Atomic,
+		expectedOldIds: opts.ExpectedOldIds,
+	}
+}
+
+// needsManagedTransport tells whether the push asks for features that only
+// the managed transports implement.
+func (p *pushState) needsManagedTransport() bool {
+	return len(p.pushOptions) > 0 || p.atomic || len(p.expectedOldIds) > 0
+}
+
+func (p *pushState) setManaged() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.managed = true
+}
+
+// errPushRejected aborts a push in which no update is left to send.
+var errPushRejected = errors.New("every update of the push was rejected")
+
+// negotiate records the updates that libgit2 is about to send. Like git
+// push --force-with-lease, it rejects the updates of the refs whose
+// advertised value is not the expected one, so that they are not sent.
+// If no update is left, or if the push is atomic, it returns
+// errPushRejected and nothing is sent.
+func (p *pushState) negotiate(updates []PushUpdate) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.needsManagedTransport() && !p.managed {
+		return errors.New("push options, atomic pushes and expected old values need a managed transport")
+	}
+	p.results = make([]*PushResult, 0, len(updates))
+	stale := 0
+	for _, update := range updates {
+		result := &PushResult{PushUpdate: update}
+		if expected, ok := p.expectedOldIds[update.Destination]; ok {
+			if expected == nil {
+				expected = &Oid{}
+			}
+			advertised := update.OldId
+			if advertised == nil {
+				advertised = &Oid{}
+			}
+			if !expected.Equal(advertised) {
+				result.Status = PushStatusRejectedStale
+				result.Message = "stale info"
+				stale++
+			}
+		}
+		p.results = append(p.results, result)
+	}
+	if stale == 0 {
+		return nil
+	}
+	if p.atomic {
+		for _, result := range p.results {
+			if result.Status == PushStatusOk {
+				result.Status = PushStatusRejectedAtomic
+				result.Message = "atomic push failed"
+			}
+		}
+	}
+	if p.atomic || stale == len(p.results) {
+		return errPushRejected
+	}
+	return nil
+}
+
+// rejected tells whether the update of refname was rejected before the
+// push.
+func (p *pushState) rejected(refname string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, result := range p.results {
+		if result.Destination == refname {
+			return result.Status != PushStatusOk
+		}
+	}
+	return false
+}
+
+// setStatus records the status that the server reported for refname.
+func (p *pushState) setStatus(refname, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, result := range p.results {
+		if result.Destination == refname {
+			result.Status = pushStatusFromMessage(message)
+			result.Message = message
+			return
+		}
+	}
+	p.results = append(p.results, &PushResult{
+		PushUpdate: PushUpdate{Destination: refname},
+		Status:     pushStatusFromMessage(message),
+		Message:    message,
+	})
+}
+
+// pushResults returns the outcome of the updates.
+func (p *pushState) pushResults() []PushResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	results := make([]PushResult, 0, len(p.results))
+	for _, result := range p.results {
+		results = append(results, *result)
+	}
+	return results
+}
+
+func (p *pushState) setCapabilities(capabilities map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capabilities = capabilities
+}
+
+// checkCapabilities fails if the server did not advertise the capabilities
+// that the push needs.
+func (p *pushState) checkCapabilities() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.capabilities == nil {
+		return nil
+	}
+	if p.atomic && !p.capabilities["atomic"] {
+		return errors.New("the receiving end does not support atomic pushes")
+	}
+	if len(p.pushOptions) > 0 && !p.capabilities["push-options"] {
+		return errors.New("the receiving end does not support push options")
+	}
+	return nil
+}
+
+// requestCapabilities returns the capabilities to add to the first command.
+func (p *pushState) requestCapabilities() string {
+	var capabilities string
+	if p.atomic {
+		capabilities += " atomic"
+	}
+	if len(p.pushOptions) > 0 {
+		capabilities += " push-options"
+	}
+	return capabilities
+}
+
+// splitCommand splits an update command of libgit2, "<old> <new> <ref>",
+// possibly followed by a NUL byte and capabilities.
+func splitCommand(line string) (command, refname, capabilities string) {
+	command = strings.TrimSuffix(line, "\n")
+	if i := strings.IndexByte(command, 0); i >= 0 {
+		command, capabilities = command[:i], command[i+1:]
+	}
+	if fields := strings.SplitN(command, " ", 3); len(fields) == 3 {
+		refname = fields[2]
+	}
+	return command, refname, capabilities
+}
+
+// rewriteCommand returns the update command to send. The first one carries
+// the capabilities, with the ones that libgit2 does not request.
+func (p *pushState) rewriteCommand(command, capabilities string, first bool) string {
+	if first {
+		capabilities = strings.TrimSpace(capabilities + p.requestCapabilities())
+		if capabilities != "" {
+			command += "\x00" + capabilities
+		}
+	}
+	return command + "\n"
+}
+
+// pushStream adds what libgit2 does not know about to the receive-pack
+// requests that it writes to a stream: the atomic and push-options
+// capabilities and the push options. It leaves out the commands of the
+// updates that negotiate rejected. It reads the capabilities of the server from the ref advertisement.
+type pushStream struct {
+	underlying SmartSubtransportStream
+	push       *pushState
+	r          *bufio.Reader
+
+	// advertising is set while the ref advertisement is being read.
+	advertising bool
+	// request holds the commands written so far, until the flush-pkt that
+	// ends them. The pack that follows is passed on as it is.
+	request bytes.Buffer
+	// capabilities are the ones that libgit2 requested with its first
+	// command, which may be left out.
+	capabilities string
+	commands     int
+	commandsDone bool
+}
+
+func newPushStream(underlying SmartSubtransportStream, push *pushState, advertise bool) *pushStream {
+	return &pushStream{
+		underlying:  underlying,
+		push:        push,
+		r:           bufio.NewReaderSize(underlying, pktLineMaxLength),
+		advertising: advertise,
+	}
+}
+
+func (s *pushStream) Read(buf []byte) (int, error) {
+	if s.advertising {
+		s.readCapabilities()
+	}
+	return s.r.Read(buf)
+}
+
+// readCapabilities looks for the capabilities in the first line of the ref
+// advertisement, after the smart HTTP service header if there is one,
+// without consuming anything.
+func (s *pushStream) readCapabilities() {
+	s.advertising = false
+	for offset := 0; ; {
+		header, err := s.r.Peek(offset + 4)
+		if err != nil {
+			return
+		}
+		length, err := strconv.ParseUint(string(header[offset:]), 16, 16)
+		if err != nil || length > pktLineMaxLength {
+			return
+		}
+		if length < 4 {
+			offset += 4
+			continue
+		}
+		line, err := s.r.Peek(offset + int(length))
+		if err != nil {
+			return
+		}
+		payload := line[offset+4:]
+		if i := bytes.IndexByte(payload, 0); i >= 0 {
+			s.push.setCapabilities(capabilitySet(pktLineText(payload[i+1:])))
+			return
+		}
+		if !bytes.HasPrefix(payload, []byte("# service=")) {
+			return
+		}
+		offset += int(length)
+	}
+}
+
+func (s *pushStream) Write(buf []byte) (int, error) {
+	if s.commandsDone {
+		return s.underlying.Write(buf)
+	}
+	s.request.Write(buf)
+
+	var out []byte
+	for !s.commandsDone {
+		payload, typ, ok, err := nextBufferedPktLine(&s.request)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+
+		switch typ {
+		case pktLineFlush:
+			// The flush-pkt that ends the commands is followed by the
+			// push options, and then by the pack.
+			s.commandsDone = true
+			out = append(out, pktFlush...)
+			out = s.appendPushOptions(out)
+		case pktLineDelim:
+			out = append(out, pktDelim...)
+		case pktLineResponseEnd:
+			out = append(out, pktResponseEnd...)
+		default:
+			command, refname, capabilities := splitCommand(string(payload))
+			if capabilities != "" {
+				s.capabilities = capabilities
+			}
+			if s.push.rejected(refname) {
+				continue
+			}
+			if s.commands == 0 {
+				if err := s.push.checkCapabilities(); err != nil {
+					return 0, err
+				}
+			}
+			out = appendPktLine(out, s.push.rewriteCommand(command, s.capabilities, s.commands == 0))
+			s.commands++
+		}
+	}
+	if s.commandsDone {
+		out = append(out, s.request.Next(s.request.Len())...)
+	}
+
+	if len(out) > 0 {
+		if _, err := s.underlying.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// appendPushOptions appends the push options that follow the commands.
+func (s *pushStream) appendPushOptions(out []byte) []byte {
+	if len(s.push.pushOptions) == 0 || s.commands == 0 {
+		return out
+	}
+	for _, option := range s.push.pushOptions {
+		out = appendPktLine(out, option+"\n")
+	}
+	return append(out, pktFlush...)
+}
+
+func (s *pushStream) Free() {
+}
+
+// PushMirror makes the refs of the remote the same as the refs of the
+// repository, like git push --mirror: every ref under refs/ is force
+// pushed, and the remote refs that the repository does not have are
+// deleted. Symbolic refs are skipped.
+func (o *Remote) PushMirror(opts *PushOptions) ([]PushResult, error) {
+	return o.PushMirrorContext(context.Background(), opts)
+}
+
+// PushMirrorContext performs a mirror push like PushMirror, but aborts it
+// as soon as ctx is done. In that case the error returned is ctx.Err().
+func (o *Remote) PushMirrorContext(ctx context.Context, opts *PushOptions) ([]PushResult, error) {
+	if opts == nil {
+		opts = defaultPushOptions()
+	}
+	refspecs, err := o.mirrorRefspecs(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(refspecs) == 0 {
+		return []PushResult{}, nil
+	}
+	return o.push(ctx, refspecs, opts)
+}
+
+// mirrorRefspecs returns the refspecs of a mirror push: one that forces
+// each local ref, and one that deletes each remote ref that the repository
+// does not have.
+func (o *Remote) mirrorRefspecs(ctx context.Context, opts *PushOptions) ([]string, error) {
+	repo := o.owner()
+	if repo == nil {
+		return nil, errors.New("the remote does not belong to a repository")
+	}
+
+	local := make(map[string]bool)
+	var refspecs []string
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	for {
+		ref, err := iter.Next()
+		if IsErrorCode(err, ErrorCodeIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := ref.Name()
+		if ref.Type() == ReferenceOid && strings.HasPrefix(name, "refs/") {
+			local[name] = true
+			refspecs = append(refspecs, "+"+name+":"+name)
+		}
+		ref.Free()
+	}
+
+	if err := o.ConnectContext(ctx, ConnectDirectionPush, &opts.RemoteCallbacks, &opts.ProxyOptions, opts.Headers); err != nil {
+		return nil, err
+	}
+	heads, err := o.Ls()
+	o.Disconnect()
+	if err != nil {
+		return nil, err
+	}
+	for _, head := range heads {
+		if strings.HasPrefix(head.Name, "refs/") && !strings.HasSuffix(head.Name, "^{}") && !local[head.Name] {
+			refspecs = append(refspecs, ":"+head.Name)
+		}
+	}
+	return refspecs, nil
+}
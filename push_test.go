@@ -1,6 +1,9 @@
 package git
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"testing"
 )
 
@@ -16,10 +19,30 @@ func TestRemotePush(t *testing.T) {
 	checkFatal(t, err)
 	defer remote.Free()
 
-	seedTestRepo(t, localRepo)
+	commitId, _ := seedTestRepo(t, localRepo)
 
-	err = remote.Push([]string{"refs/heads/master"}, nil)
+	var directions []ConnectDirection
+	var negotiated []PushUpdate
+	err = remote.Push([]string{"refs/heads/master"}, &PushOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			RemoteReadyCallback: func(remote *Remote, direction ConnectDirection) error {
+				directions = append(directions, direction)
+				return nil
+			},
+			PushNegotiationCallback: func(updates []PushUpdate) error {
+				negotiated = append(negotiated, updates...)
+				return nil
+			},
+		},
+	})
 	checkFatal(t, err)
+	if len(directions) != 1 || directions[0] != ConnectDirectionPush {
+		t.Errorf("remote ready directions = %v, want [%v]", directions, ConnectDirectionPush)
+	}
+	if len(negotiated) != 1 || negotiated[0].Source != "refs/heads/master" || negotiated[0].Destination != "refs/heads/master" ||
+		!negotiated[0].OldId.IsZero() || !negotiated[0].NewId.Equal(commitId) {
+		t.Errorf("unexpected negotiated updates: %+v", negotiated)
+	}
 
 	ref, err := localRepo.References.Lookup("refs/remotes/test_push/master")
 	checkFatal(t, err)
@@ -28,4 +51,242 @@ func TestRemotePush(t *testing.T) {
 	ref, err = repo.References.Lookup("refs/heads/master")
 	checkFatal(t, err)
 	defer ref.Free()
+
+	// The negotiation callback vetoes the push of a new commit.
+	secondId, _ := updateReadme(t, localRepo, "second commit")
+	vetoErr := errors.New("pre-push hook declined")
+	err = remote.Push([]string{"refs/heads/master"}, &PushOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			PushNegotiationCallback: func(updates []PushUpdate) error {
+				return vetoErr
+			},
+		},
+	})
+	if err != vetoErr {
+		t.Errorf("Push() = %v, want %v", err, vetoErr)
+	}
+	ref, err = repo.References.Lookup("refs/heads/master")
+	checkFatal(t, err)
+	defer ref.Free()
+	if ref.Target().Equal(secondId) {
+		t.Error("the vetoed push updated the remote")
+	}
+
+	// The ready callback redirects the push to another repository.
+	otherRepo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, otherRepo)
+	err = remote.Push([]string{"refs/heads/master"}, &PushOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			RemoteReadyCallback: func(remote *Remote, direction ConnectDirection) error {
+				return remote.SetInstancePushUrl(otherRepo.Path())
+			},
+		},
+	})
+	checkFatal(t, err)
+	ref, err = otherRepo.References.Lookup("refs/heads/master")
+	checkFatal(t, err)
+	defer ref.Free()
+	if !ref.Target().Equal(secondId) {
+		t.Errorf("master = %v in the other repository, want %v", ref.Target(), secondId)
+	}
+}
+
+func TestPushStream(t *testing.T) {
+	t.Parallel()
+
+	push := newPushState(&PushOptions{
+		RemotePushOptions: []string{"ci.skip"},
+		Atomic:            true,
+		ExpectedOldIds:    map[string]*Oid{"refs/heads/feature": nil},
+	})
+	push.setManaged()
+	advertisement := pktLines(
+		"# service=git-receive-pack\n",
+		"0000",
+		testCommitID+" refs/heads/master\x00report-status atomic push-options\n",
+		"0000",
+	)
+	underlying := &fakeSubtransportStream{response: bytes.NewReader([]byte(advertisement))}
+	stream := newPushStream(underlying, push, true)
+
+	response, err := ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if string(response) != advertisement {
+		t.Errorf("advertisement = %q, want %q", response, advertisement)
+	}
+	if !push.capabilities["atomic"] || !push.capabilities["push-options"] {
+		t.Errorf("capabilities = %v, want atomic and push-options", push.capabilities)
+	}
+
+	zero := "0000000000000000000000000000000000000000"
+	request := pktLines(
+		testTagID+" "+testCommitID+" refs/heads/master\x00report-status\n",
+		zero+" "+testCommitID+" refs/heads/feature\n",
+		"0000",
+	) + "PACK"
+	for i := 0; i < len(request); i += 7 {
+		end := i + 7
+		if end > len(request) {
+			end = len(request)
+		}
+		n, err := stream.Write([]byte(request[i:end]))
+		checkFatal(t, err)
+		if n != end-i {
+			t.Fatalf("Write() = %d, want %d", n, end-i)
+		}
+	}
+
+	expectedRequest := pktLines(
+		testTagID+" "+testCommitID+" refs/heads/master\x00report-status atomic push-options\n",
+		zero+" "+testCommitID+" refs/heads/feature\n",
+		"0000",
+		"ci.skip\n",
+		"0000",
+	) + "PACK"
+	if underlying.written.String() != expectedRequest {
+		t.Errorf("request = %q, want %q", underlying.written.String(), expectedRequest)
+	}
+}
+
+func TestPushStateStaleLeases(t *testing.T) {
+	t.Parallel()
+
+	commitId, err := NewOid(testCommitID)
+	checkFatal(t, err)
+	tagId, err := NewOid(testTagID)
+	checkFatal(t, err)
+	updates := []PushUpdate{
+		{Source: "refs/heads/master", Destination: "refs/heads/master", OldId: tagId, NewId: commitId},
+		{Source: "refs/heads/master", Destination: "refs/heads/feature", OldId: &Oid{}, NewId: commitId},
+	}
+
+	// The stale update is left out, and the next command carries the
+	// capabilities.
+	push := newPushState(&PushOptions{
+		ExpectedOldIds: map[string]*Oid{"refs/heads/master": commitId, "refs/heads/feature": nil},
+	})
+	push.setManaged()
+	checkFatal(t, push.negotiate(updates))
+	underlying := &fakeSubtransportStream{}
+	stream := newPushStream(underlying, push, false)
+	_, err = stream.Write([]byte(pktLines(
+		testTagID+" "+testCommitID+" refs/heads/master\x00report-status\n",
+		"0000000000000000000000000000000000000000 "+testCommitID+" refs/heads/feature\n",
+		"0000",
+	) + "PACK"))
+	checkFatal(t, err)
+	expectedRequest := pktLines(
+		"0000000000000000000000000000000000000000 "+testCommitID+" refs/heads/feature\x00report-status\n",
+		"0000",
+	) + "PACK"
+	if underlying.written.String() != expectedRequest {
+		t.Errorf("request = %q, want %q", underlying.written.String(), expectedRequest)
+	}
+	results := push.pushResults()
+	if len(results) != 2 || results[0].Status != PushStatusRejectedStale || results[1].Status != PushStatusOk {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	// Nothing is sent when the push is atomic.
+	push = newPushState(&PushOptions{
+		Atomic:         true,
+		ExpectedOldIds: map[string]*Oid{"refs/heads/master": commitId},
+	})
+	push.setManaged()
+	if err := push.negotiate(updates); err != errPushRejected {
+		t.Errorf("negotiate() = %v, want %v", err, errPushRejected)
+	}
+	results = push.pushResults()
+	if len(results) != 2 || results[0].Status != PushStatusRejectedStale || results[1].Status != PushStatusRejectedAtomic {
+		t.Errorf("unexpected results: %+v", results)
+	}
+}
+
+func TestPushStatusFromMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		message string
+		status  PushStatus
+	}{
+		{"", PushStatusOk},
+		{"non-fast-forward", PushStatusRejectedNonFastForward},
+		{"fetch first", PushStatusRejectedNonFastForward},
+		{"atomic push failure", PushStatusRejectedAtomic},
+		{"refs/heads/master is protected", PushStatusRejected},
+	}
+	for _, test := range tests {
+		if status := pushStatusFromMessage(test.message); status != test.status {
+			t.Errorf("pushStatusFromMessage(%q) = %v, want %v", test.message, status, test.status)
+		}
+	}
+}
+
+func TestPushOptionsNeedManagedTransport(t *testing.T) {
+	t.Parallel()
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	localRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, localRepo)
+	seedTestRepo(t, localRepo)
+
+	remote, err := localRepo.Remotes.Create("origin", repo.Path())
+	checkFatal(t, err)
+	defer remote.Free()
+
+	if err := remote.Push([]string{"refs/heads/master"}, &PushOptions{Atomic: true}); err == nil {
+		t.Error("an atomic push through the local transport succeeded")
+	}
+}
+
+func TestRemotePushMirror(t *testing.T) {
+	t.Parallel()
+	repo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	localRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, localRepo)
+	commitId, _ := seedTestRepo(t, localRepo)
+
+	remote, err := localRepo.Remotes.Create("mirror", repo.Path())
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkFatal(t, remote.Push([]string{"refs/heads/master:refs/heads/stale"}, nil))
+
+	commit, err := localRepo.LookupCommit(commitId)
+	checkFatal(t, err)
+	defer commit.Free()
+	branch, err := localRepo.CreateBranch("feature", commit, false)
+	checkFatal(t, err)
+	defer branch.Free()
+
+	results, err := remote.PushMirror(nil)
+	checkFatal(t, err)
+	destinations := make(map[string]PushResult)
+	for _, result := range results {
+		destinations[result.Destination] = result
+	}
+	for _, name := range []string{"refs/heads/master", "refs/heads/feature", "refs/heads/stale"} {
+		if result, ok := destinations[name]; !ok || result.Rejected() {
+			t.Errorf("unexpected result for %s: %+v", name, result)
+		}
+	}
+	if !destinations["refs/heads/stale"].NewId.IsZero() {
+		t.Errorf("refs/heads/stale was not deleted: %+v", destinations["refs/heads/stale"])
+	}
+
+	for _, name := range []string{"refs/heads/master", "refs/heads/feature"} {
+		ref, err := repo.References.Lookup(name)
+		checkFatal(t, err)
+		if !ref.Target().Equal(commitId) {
+			t.Errorf("%s = %v, want %v", name, ref.Target(), commitId)
+		}
+		ref.Free()
+	}
+	if ref, err := repo.References.Lookup("refs/heads/stale"); err == nil {
+		ref.Free()
+		t.Error("refs/heads/stale still exists on the remote")
+	}
 }
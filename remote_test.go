@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
@@ -17,6 +22,7 @@ import (
 
 	"github.com/google/shlex"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestListRemotes(t *testing.T) {
@@ -301,6 +307,15 @@ func startSSHServer(t *testing.T, hostKey ssh.Signer, authorizedKeys []ssh.Publi
 			return nil, fmt.Errorf("unknown public key for %q", c.User())
 		},
 	}
+	return startSSHServerWithConfig(t, hostKey, config)
+}
+
+// startSSHServerWithConfig starts a server that authenticates its clients
+// as configured by config, and then runs git-upload-pack or git-receive-pack
+// for every session they open.
+func startSSHServerWithConfig(t *testing.T, hostKey ssh.Signer, config *ssh.ServerConfig) net.Listener {
+	t.Helper()
+
 	config.AddHostKey(hostKey)
 
 	listener, err := net.Listen("tcp", "localhost:0")
@@ -309,138 +324,146 @@ func startSSHServer(t *testing.T, hostKey ssh.Signer, authorizedKeys []ssh.Publi
 	}
 
 	go func() {
-		nConn, err := listener.Accept()
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+		for {
+			nConn, err := listener.Accept()
+			if err != nil {
+				if !strings.Contains(err.Error(), "use of closed network connection") {
+					t.Logf("Failed to accept incoming connection: %v", err)
+				}
 				return
 			}
-			t.Logf("Failed to accept incoming connection: %v", err)
-			return
+			go serveSSHConnection(t, nConn, config)
 		}
-		defer nConn.Close()
+	}()
+	return listener
+}
 
-		conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
-		if err != nil {
-			t.Logf("failed to handshake: %+v, %+v", conn, err)
-			return
-		}
+func serveSSHConnection(t *testing.T, nConn net.Conn, config *ssh.ServerConfig) {
+	defer nConn.Close()
 
-		// The incoming Request channel must be serviced.
-		go func() {
-			for newRequest := range reqs {
-				t.Logf("new request %v", newRequest)
-			}
-		}()
-
-		// Service only the first channel request
-		newChannel := <-chans
-		defer func() {
-			for newChannel := range chans {
-				t.Logf("new channel %v", newChannel)
-				newChannel.Reject(ssh.UnknownChannelType, "server closing")
-			}
-		}()
-
-		// Channels have a type, depending on the application level
-		// protocol intended. In the case of a shell, the type is
-		// "session" and ServerShell may be used to present a simple
-		// terminal interface.
-		if newChannel.ChannelType() != "session" {
-			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			return
-		}
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			t.Logf("Could not accept channel: %v", err)
-			return
-		}
-		defer channel.Close()
-
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "exec" request.
-		req := <-requests
-		if req.Type != "exec" {
-			req.Reply(false, nil)
-			return
-		}
-		// RFC 4254 Section 6.5.
-		var payload struct {
-			Command string
-		}
-		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-			t.Logf("invalid payload on channel %v: %v", channel, err)
-			req.Reply(false, nil)
-			return
-		}
-		args, err := shlex.Split(payload.Command)
-		if err != nil {
-			t.Logf("invalid command on channel %v: %v", channel, err)
-			req.Reply(false, nil)
-			return
-		}
-		if len(args) < 2 || (args[0] != "git-upload-pack" && args[0] != "git-receive-pack") {
-			t.Logf("invalid command (%v) on channel %v: %v", args, channel, err)
-			req.Reply(false, nil)
-			return
-		}
-		req.Reply(true, nil)
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+	if err != nil {
+		t.Logf("failed to handshake: %+v, %+v", conn, err)
+		return
+	}
 
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				t.Logf("draining request %v", req)
-			}
-		}(requests)
-
-		// The first parameter is the (absolute) path of the repository.
-		args[1] = "./testdata" + args[1]
-
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdin = channel
-		var wg sync.WaitGroup
-		stdoutPipe, err := newChannelPipe(t, channel, &wg)
-		if err != nil {
-			t.Logf("Failed to create stdout pipe: %v", err)
-			return
-		}
-		cmd.Stdout = stdoutPipe
-		stderrPipe, err := newChannelPipe(t, channel.Stderr(), &wg)
-		if err != nil {
-			t.Logf("Failed to create stderr pipe: %v", err)
-			return
+	// The incoming Request channel must be serviced.
+	go func() {
+		for newRequest := range reqs {
+			t.Logf("new request %v", newRequest)
 		}
-		cmd.Stderr = stderrPipe
+	}()
 
-		go func() {
-			wg.Wait()
-			channel.CloseWrite()
-		}()
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		wg.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer wg.Done()
+			serveSSHChannel(t, newChannel)
+		}(newChannel)
+	}
+	wg.Wait()
+}
 
-		err = cmd.Start()
-		if err != nil {
-			t.Logf("Failed to start %v: %v", args, err)
-			return
+func serveSSHChannel(t *testing.T, newChannel ssh.NewChannel) {
+	// Channels have a type, depending on the application level
+	// protocol intended. In the case of a shell, the type is
+	// "session" and ServerShell may be used to present a simple
+	// terminal interface.
+	if newChannel.ChannelType() != "session" {
+		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		t.Logf("Could not accept channel: %v", err)
+		return
+	}
+	defer channel.Close()
+
+	// Sessions have out-of-band requests such as "shell",
+	// "pty-req" and "env".  Here we handle only the
+	// "exec" request.
+	req := <-requests
+	if req.Type != "exec" {
+		req.Reply(false, nil)
+		return
+	}
+	// RFC 4254 Section 6.5.
+	var payload struct {
+		Command string
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		t.Logf("invalid payload on channel %v: %v", channel, err)
+		req.Reply(false, nil)
+		return
+	}
+	args, err := shlex.Split(payload.Command)
+	if err != nil {
+		t.Logf("invalid command on channel %v: %v", channel, err)
+		req.Reply(false, nil)
+		return
+	}
+	if len(args) < 2 || (args[0] != "git-upload-pack" && args[0] != "git-receive-pack") {
+		t.Logf("invalid command (%v) on channel %v: %v", args, channel, err)
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+
+	go func(in <-chan *ssh.Request) {
+		for req := range in {
+			t.Logf("draining request %v", req)
 		}
+	}(requests)
 
-		// Once the process has started, we need to close the write end of the
-		// pipes from this process so that we can know when the child has done
-		// writing to it.
-		stdoutPipe.Close()
-		stderrPipe.Close()
+	// The first parameter is the (absolute) path of the repository.
+	args[1] = "./testdata" + args[1]
 
-		timer := time.AfterFunc(5*time.Second, func() {
-			t.Log("process timed out, terminating")
-			cmd.Process.Kill()
-		})
-		defer timer.Stop()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = channel
+	var wg sync.WaitGroup
+	stdoutPipe, err := newChannelPipe(t, channel, &wg)
+	if err != nil {
+		t.Logf("Failed to create stdout pipe: %v", err)
+		return
+	}
+	cmd.Stdout = stdoutPipe
+	stderrPipe, err := newChannelPipe(t, channel.Stderr(), &wg)
+	if err != nil {
+		t.Logf("Failed to create stderr pipe: %v", err)
+		return
+	}
+	cmd.Stderr = stderrPipe
 
-		err = cmd.Wait()
-		if err != nil {
-			t.Logf("Failed to run %v: %v", args, err)
-			return
-		}
+	go func() {
+		wg.Wait()
+		channel.CloseWrite()
 	}()
-	return listener
+
+	err = cmd.Start()
+	if err != nil {
+		t.Logf("Failed to start %v: %v", args, err)
+		return
+	}
+
+	// Once the process has started, we need to close the write end of the
+	// pipes from this process so that we can know when the child has done
+	// writing to it.
+	stdoutPipe.Close()
+	stderrPipe.Close()
+
+	timer := time.AfterFunc(5*time.Second, func() {
+		t.Log("process timed out, terminating")
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+
+	err = cmd.Wait()
+	if err != nil {
+		t.Logf("Failed to run %v: %v", args, err)
+		return
+	}
 }
 
 func TestRemoteSSH(t *testing.T) {
@@ -519,3 +542,240 @@ func TestRemoteSSH(t *testing.T) {
 		t.Error("Expected remote heads")
 	}
 }
+
+// fetchOverSSH fetches from the repository served by listener, with the
+// provided credentials callback.
+func fetchOverSSH(t *testing.T, listener net.Listener, credentialsCallback CredentialsCallback) error {
+	t.Helper()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create(
+		"origin",
+		fmt.Sprintf("ssh://%s/TestGitRepository", listener.Addr().String()),
+	)
+	checkFatal(t, err)
+	defer remote.Free()
+
+	return remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				return nil
+			},
+			CredentialsCallback: credentialsCallback,
+		},
+	}, "")
+}
+
+func TestRemoteSSHAuthentication(t *testing.T) {
+	t.Parallel()
+	const username = "testuser"
+	const password = "secret"
+
+	generateSigner := func() (*rsa.PrivateKey, ssh.Signer) {
+		privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		checkFatal(t, err)
+		signer, err := ssh.NewSignerFromKey(privKey)
+		checkFatal(t, err)
+		return privKey, signer
+	}
+	_, hostSigner := generateSigner()
+	userPrivKey, userSigner := generateSigner()
+	_, otherSigner := generateSigner()
+	_, authoritySigner := generateSigner()
+
+	dir, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	// The private key is stored next to an OpenSSH certificate for it.
+	keyPath := filepath.Join(dir, "id_rsa")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(userPrivKey),
+	}), 0600)
+	checkFatal(t, err)
+	userCert := &ssh.Certificate{
+		Key:             userSigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{username},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	checkFatal(t, userCert.SignCert(rand.Reader, authoritySigner))
+	err = ioutil.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(userCert), 0644)
+	checkFatal(t, err)
+
+	publicKeyCallback := func(authorizedKey ssh.PublicKey) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != username || !bytes.Equal(pubKey.Marshal(), authorizedKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
+			}
+			return nil, nil
+		}
+	}
+	certChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), authoritySigner.PublicKey().Marshal())
+		},
+	}
+
+	for _, test := range []struct {
+		name          string
+		config        *ssh.ServerConfig
+		credentials   func(calls int, allowedTypes CredentialType) (*Credential, error)
+		expectedCalls int
+		expectedCode  ErrorCode
+	}{
+		{
+			name:   "certificate",
+			config: &ssh.ServerConfig{PublicKeyCallback: certChecker.Authenticate},
+			credentials: func(calls int, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialSSHKey(username, "", keyPath, "")
+			},
+			expectedCalls: 1,
+		},
+		{
+			name:   "several identities",
+			config: &ssh.ServerConfig{PublicKeyCallback: publicKeyCallback(userSigner.PublicKey())},
+			credentials: func(calls int, allowedTypes CredentialType) (*Credential, error) {
+				if calls == 1 {
+					return NewCredentialSSHKeyFromSigner(username, otherSigner)
+				}
+				return NewCredentialSSHKeyFromSigner(username, userSigner)
+			},
+			expectedCalls: 2,
+		},
+		{
+			name:   "rejected identities",
+			config: &ssh.ServerConfig{PublicKeyCallback: publicKeyCallback(userSigner.PublicKey())},
+			credentials: func(calls int, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialSSHKeyFromSigner(username, otherSigner)
+			},
+			expectedCalls: DefaultManagedSSHMaxAuthAttempts,
+			expectedCode:  ErrorCodeAuth,
+		},
+		{
+			name: "password",
+			config: &ssh.ServerConfig{
+				PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+					if c.User() != username || string(pass) != password {
+						return nil, errors.New("wrong password")
+					}
+					return nil, nil
+				},
+			},
+			credentials: func(calls int, allowedTypes CredentialType) (*Credential, error) {
+				if allowedTypes&CredentialTypeUserpassPlaintext == 0 {
+					return nil, fmt.Errorf("unexpected credential types %v", allowedTypes)
+				}
+				return NewCredentialUserpassPlaintext(username, password)
+			},
+			expectedCalls: 1,
+		},
+		{
+			name: "keyboard-interactive",
+			config: &ssh.ServerConfig{
+				KeyboardInteractiveCallback: func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+					if err != nil {
+						return nil, err
+					}
+					if len(answers) != 1 || answers[0] != password {
+						return nil, errors.New("wrong password")
+					}
+					return nil, nil
+				},
+			},
+			credentials: func(calls int, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialUserpassPlaintext(username, password)
+			},
+			expectedCalls: 1,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			listener := startSSHServerWithConfig(t, hostSigner, test.config)
+			defer listener.Close()
+
+			calls := 0
+			err := fetchOverSSH(t, listener, func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+				calls++
+				return test.credentials(calls, allowedTypes)
+			})
+			if test.expectedCode != 0 {
+				if !IsErrorCode(err, test.expectedCode) {
+					t.Errorf("expected error code %v, got %v", test.expectedCode, err)
+				}
+			} else {
+				checkFatal(t, err)
+			}
+			if calls != test.expectedCalls {
+				t.Errorf("credentials callback called %d times, want %d", calls, test.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestRemoteSSHAgent(t *testing.T) {
+	// This test changes SSH_AUTH_SOCK, so it cannot run in parallel.
+	if runtime.GOOS == "windows" {
+		t.Skip("the test agent listens on a unix socket")
+	}
+	const username = "testuser"
+
+	hostPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	checkFatal(t, err)
+
+	// The agent holds two identities, and the server only accepts the
+	// second one.
+	keyring := agent.NewKeyring()
+	var signer ssh.Signer
+	for i := 0; i < 2; i++ {
+		privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		checkFatal(t, err)
+		checkFatal(t, keyring.Add(agent.AddedKey{PrivateKey: privKey}))
+		signer, err = ssh.NewSignerFromKey(privKey)
+		checkFatal(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	agentListener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	checkFatal(t, err)
+	defer agentListener.Close()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	oldSocket, hadSocket := os.LookupEnv("SSH_AUTH_SOCK")
+	checkFatal(t, os.Setenv("SSH_AUTH_SOCK", agentListener.Addr().String()))
+	defer func() {
+		if hadSocket {
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	}()
+
+	listener := startSSHServer(t, hostSigner, []ssh.PublicKey{signer.PublicKey()})
+	defer listener.Close()
+
+	err = fetchOverSSH(t, listener, func(url, usernameFromURL string, allowedTypes CredentialType) (*Credential, error) {
+		return NewCredentialSSHKeyFromAgent(username)
+	})
+	checkFatal(t, err)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+func checkFatal(t *testing.T, err error) {
+	if err == nil {
+		return
+	}
+
+	// The failure happens at wherever we were called, not here
+	_, file, line, ok := runtime.Caller(1)
+	if !ok {
+		t.Fatalf("Unable to get caller")
+	}
+	t.Fatalf("Fail at %v:%v; %v", file, line, err)
+}
+
+func cleanupTestRepo(t *testing.T, r *git.Repository) {
+	var err error
+	if r.IsBare() {
+		err = os.RemoveAll(r.Path())
+	} else {
+		err = os.RemoveAll(r.Workdir())
+	}
+	checkFatal(t, err)
+
+	r.Free()
+}
+
+func createTestRepo(t *testing.T) *git.Repository {
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	repo, err := git.InitRepository(path, false)
+	checkFatal(t, err)
+
+	err = ioutil.WriteFile(path+"/README", []byte("foo\n"), 0644)
+	checkFatal(t, err)
+
+	return repo
+}
+
+func createBareTestRepo(t *testing.T) *git.Repository {
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	repo, err := git.InitRepository(path, true)
+	checkFatal(t, err)
+
+	return repo
+}
+
+// seedTestRepo commits the README of repo on HEAD.
+func seedTestRepo(t *testing.T, repo *git.Repository) (*git.Oid, *git.Oid) {
+	return commitReadme(t, repo)
+}
+
+// updateReadme writes content to the README of repo and commits it on top
+// of HEAD.
+func updateReadme(t *testing.T, repo *git.Repository, content string) (*git.Oid, *git.Oid) {
+	err := ioutil.WriteFile(path.Join(path.Dir(path.Dir(repo.Path())), "README"), []byte(content), 0644)
+	checkFatal(t, err)
+
+	head, err := repo.Head()
+	checkFatal(t, err)
+	defer head.Free()
+	parent, err := repo.LookupCommit(head.Target())
+	checkFatal(t, err)
+	defer parent.Free()
+
+	return commitReadme(t, repo, parent)
+}
+
+func commitReadme(t *testing.T, repo *git.Repository, parents ...*git.Commit) (*git.Oid, *git.Oid) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	checkFatal(t, err)
+	sig := &git.Signature{
+		Name:  "Rand Om Hacker",
+		Email: "random@hacker.com",
+		When:  time.Date(2013, 03, 06, 14, 30, 0, 0, loc),
+	}
+
+	idx, err := repo.Index()
+	checkFatal(t, err)
+	defer idx.Free()
+	checkFatal(t, idx.AddByPath("README"))
+	checkFatal(t, idx.Write())
+	treeId, err := idx.WriteTree()
+	checkFatal(t, err)
+
+	tree, err := repo.LookupTree(treeId)
+	checkFatal(t, err)
+	defer tree.Free()
+	commitId, err := repo.CreateCommit("HEAD", sig, sig, "This is a commit\n", tree, parents...)
+	checkFatal(t, err)
+
+	return commitId, treeId
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// The services that a SmartHTTPHandler serves.
+const (
+	SmartHTTPServiceUploadPack  = "git-upload-pack"
+	SmartHTTPServiceReceivePack = "git-receive-pack"
+)
+
+// SmartHTTPHandler is an http.Handler that serves repositories over the
+// smart HTTP protocol, in the manner of git-http-backend. It serves the
+// following requests, where the repository path is the part of the URL
+// path before them:
+//
+//	GET  <repository>/info/refs?service=git-upload-pack
+//	GET  <repository>/info/refs?service=git-receive-pack
+//	POST <repository>/git-upload-pack
+//	POST <repository>/git-receive-pack
+//
+// Request bodies may be compressed with gzip, and responses are streamed
+// with chunked encoding. Fetches are served by ServeUploadPack and pushes
+// by ServeReceivePack. The dumb HTTP protocol is not served.
+type SmartHTTPHandler struct {
+	// ResolveRepository opens the repository at the given path of a
+	// request. The path is cleaned and starts with a slash. Returning an
+	// error for which git.IsErrorCode(err, git.ErrorCodeNotFound) is true
+	// answers with 404 Not Found. The handler frees the repository once
+	// the request has been served.
+	ResolveRepository func(r *http.Request, repoPath string) (*git.Repository, error)
+
+	// Authorize, if set, is called before a request for the given service
+	// is served. Returning an error denies the request, with 403 Forbidden
+	// unless the error is a *SmartHTTPError.
+	Authorize func(r *http.Request, repoPath, service string) error
+
+	// ReceivePack enables pushes, which are denied with 403 Forbidden
+	// otherwise.
+	ReceivePack bool
+
+	// ReceivePackOptions are the options of the pushes. The StatelessRPC
+	// and AdvertiseRefs fields are set by the handler.
+	ReceivePackOptions ReceivePackOptions
+}
+
+// SmartHTTPError is an error that the hooks of a SmartHTTPHandler can
+// return to answer with a specific status.
+type SmartHTTPError struct {
+	StatusCode int
+	Message    string
+	// Header holds headers to add to the response, such as
+	// WWW-Authenticate for 401 Unauthorized.
+	Header http.Header
+}
+
+func (e *SmartHTTPError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.StatusCode)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *SmartHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := r.URL.Path
+	var repoPath, service string
+	advertise := false
+	switch {
+	case strings.HasSuffix(urlPath, "/info/refs"):
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		repoPath = strings.TrimSuffix(urlPath, "/info/refs")
+		service = r.URL.Query().Get("service")
+		if service != SmartHTTPServiceUploadPack && service != SmartHTTPServiceReceivePack {
+			http.Error(w, "dumb HTTP protocol not supported", http.StatusForbidden)
+			return
+		}
+		advertise = true
+
+	case strings.HasSuffix(urlPath, "/"+SmartHTTPServiceUploadPack), strings.HasSuffix(urlPath, "/"+SmartHTTPServiceReceivePack):
+		if r.Method != http.MethodPost {
+			h.methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		service = path.Base(urlPath)
+		repoPath = strings.TrimSuffix(urlPath, "/"+service)
+		if !hasMediaType(r.Header, "application/x-"+service+"-request") {
+			http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	repoPath = path.Clean("/" + repoPath)
+
+	if service == SmartHTTPServiceReceivePack && !h.ReceivePack {
+		http.Error(w, "pushes are not allowed", http.StatusForbidden)
+		return
+	}
+	if h.Authorize != nil {
+		if err := h.Authorize(r, repoPath, service); err != nil {
+			h.error(w, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	if h.ResolveRepository == nil {
+		http.NotFound(w, r)
+		return
+	}
+	repo, err := h.ResolveRepository(r, repoPath)
+	if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.error(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer repo.Free()
+
+	if advertise {
+		h.serveAdvertisement(w, r, repo, service)
+	} else {
+		h.serveRPC(w, r, repo, service)
+	}
+}
+
+// serveAdvertisement answers the info/refs request of service.
+func (h *SmartHTTPHandler) serveAdvertisement(w http.ResponseWriter, r *http.Request, repo *git.Repository, service string) {
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	out := newFlushWriter(w)
+	if err := writePktLinef(out, "# service=%s\n", service); err != nil {
+		return
+	}
+	if _, err := out.Write(pktFlush); err != nil {
+		return
+	}
+	if service == SmartHTTPServiceUploadPack {
+		ServeUploadPack(r.Context(), repo, http.NoBody, out, &UploadPackOptions{AdvertiseRefs: true})
+	} else {
+		opts := h.ReceivePackOptions
+		opts.AdvertiseRefs = true
+		ServeReceivePack(r.Context(), repo, http.NoBody, out, &opts)
+	}
+}
+
+// serveRPC answers the POST request of service.
+func (h *SmartHTTPHandler) serveRPC(w http.ResponseWriter, r *http.Request, repo *git.Repository, service string) {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	case "", "identity":
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/x-"+service+"-result")
+	w.WriteHeader(http.StatusOK)
+
+	// Errors are reported to the client within the protocol.
+	out := newFlushWriter(w)
+	if service == SmartHTTPServiceUploadPack {
+		ServeUploadPack(r.Context(), repo, body, out, &UploadPackOptions{StatelessRPC: true})
+	} else {
+		opts := h.ReceivePackOptions
+		opts.StatelessRPC = true
+		opts.AdvertiseRefs = false
+		ServeReceivePack(r.Context(), repo, body, out, &opts)
+	}
+}
+
+func (h *SmartHTTPHandler) methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// error answers with the status of err if it is a *SmartHTTPError, or
+// with status otherwise.
+func (h *SmartHTTPHandler) error(w http.ResponseWriter, err error, status int) {
+	if httpErr, ok := err.(*SmartHTTPError); ok {
+		for key, values := range httpErr.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		http.Error(w, httpErr.Error(), httpErr.StatusCode)
+		return
+	}
+	if status == http.StatusInternalServerError {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// hasMediaType reports whether the Content-Type of header is mediaType,
+// whatever its parameters, such as a charset.
+func hasMediaType(header http.Header, mediaType string) bool {
+	t, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && t == mediaType
+}
+
+// setNoCacheHeaders prevents caching of a response, as git-http-backend
+// does.
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// flushWriter flushes the response after every write, so that progress
+// reaches the client as it is made.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (f *flushWriter) Write(data []byte) (int, error) {
+	n, err := f.w.Write(data)
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+func TestSmartHTTPHandler(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+
+	var authorizedPushes int
+	server := httptest.NewServer(&SmartHTTPHandler{
+		ResolveRepository: func(r *http.Request, repoPath string) (*git.Repository, error) {
+			if repoPath != "/repo.git" {
+				return nil, &git.GitError{Message: "no repository at " + repoPath, Class: git.ErrorClassRepository, Code: git.ErrorCodeNotFound}
+			}
+			return git.OpenRepository(serverRepo.Path())
+		},
+		Authorize: func(r *http.Request, repoPath, service string) error {
+			if service != SmartHTTPServiceReceivePack {
+				return nil
+			}
+			if userName, password, ok := r.BasicAuth(); !ok || userName != "user" || password != "good" {
+				return &SmartHTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Header:     http.Header{"WWW-Authenticate": {`Basic realm="git"`}},
+				}
+			}
+			authorizedPushes++
+			return nil
+		},
+		ReceivePack: true,
+	})
+	defer server.Close()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+
+	repo, err := git.Clone(server.URL+"/repo.git", path, &git.CloneOptions{})
+	checkFatal(t, err)
+	defer repo.Free()
+
+	head, err := repo.Head()
+	checkFatal(t, err)
+	if !head.Target().Equal(commitID) {
+		t.Errorf("cloned HEAD = %v, want %v", head.Target(), commitID)
+	}
+	head.Free()
+
+	pushedID, _ := updateReadme(t, repo, "pushed over HTTP")
+	remote, err := repo.Remotes.Lookup("origin")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.Push([]string{"refs/heads/master:refs/heads/pushed"}, &git.PushOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			CredentialsCallback: func(url, usernameFromURL string, allowedTypes git.CredentialType) (*git.Credential, error) {
+				return git.NewCredentialUserpassPlaintext("user", "good")
+			},
+			PushUpdateReferenceCallback: func(refname, status string) error {
+				if status != "" {
+					return fmt.Errorf("%s was rejected: %s", refname, status)
+				}
+				return nil
+			},
+		},
+	})
+	checkFatal(t, err)
+	if authorizedPushes == 0 {
+		t.Error("the push was not authorized")
+	}
+
+	ref, err := serverRepo.References.Lookup("refs/heads/pushed")
+	checkFatal(t, err)
+	defer ref.Free()
+	if !ref.Target().Equal(pushedID) {
+		t.Errorf("pushed ref = %v, want %v", ref.Target(), pushedID)
+	}
+
+	resp, err := http.Get(server.URL + "/missing.git/info/refs?service=git-upload-pack")
+	checkFatal(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing repository answered with %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// A request with a gzip body, without sideband.
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	request := appendPktLine(nil, "want "+commitID.String()+"\n")
+	request = append(request, pktFlush...)
+	request = appendPktLine(request, "done\n")
+	zw.Write(request)
+	checkFatal(t, zw.Close())
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/repo.git/git-upload-pack", &body)
+	checkFatal(t, err)
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	checkFatal(t, err)
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(resp.Body)
+	checkFatal(t, err)
+	if resp.Header.Get("Content-Type") != "application/x-git-upload-pack-result" {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if !bytes.HasPrefix(response, []byte("0008NAK\nPACK")) {
+		t.Errorf("unexpected upload-pack response: %.12q", response)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pktLineMaxLength is the maximum length of a pkt-line, including its
+// four-byte length prefix.
+const pktLineMaxLength = 65520
+
+// pktLineType identifies the special pkt-lines that have no payload.
+type pktLineType int
+
+const (
+	// pktLineData is a regular pkt-line that carries a payload.
+	pktLineData pktLineType = iota
+	// pktLineFlush is the flush-pkt (0000), which ends a message.
+	pktLineFlush
+	// pktLineDelim is the delim-pkt (0001) of protocol v2.
+	pktLineDelim
+	// pktLineResponseEnd is the response-end-pkt (0002) of protocol v2.
+	pktLineResponseEnd
+)
+
+var (
+	pktFlush = []byte("0000")
+
+	errInvalidPktLine = errors.New("invalid pkt-line")
+)
+
+// pktLineReader reads pkt-lines from an underlying reader.
+type pktLineReader struct {
+	r *bufio.Reader
+}
+
+func newPktLineReader(r io.Reader) *pktLineReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, pktLineMaxLength)
+	}
+	return &pktLineReader{r: br}
+}
+
+// ReadPktLine reads the next pkt-line. The returned payload is only valid
+// until the next call.
+func (r *pktLineReader) ReadPktLine() ([]byte, pktLineType, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errInvalidPktLine
+		}
+		return nil, pktLineData, err
+	}
+
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, pktLineData, errInvalidPktLine
+	}
+	switch length {
+	case 0:
+		return nil, pktLineFlush, nil
+	case 1:
+		return nil, pktLineDelim, nil
+	case 2:
+		return nil, pktLineResponseEnd, nil
+	case 3:
+		return nil, pktLineData, errInvalidPktLine
+	}
+	if length > pktLineMaxLength {
+		return nil, pktLineData, errInvalidPktLine
+	}
+
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, pktLineData, errInvalidPktLine
+	}
+	return payload, pktLineData, nil
+}
+
+// appendPktLine appends payload to buf as a single pkt-line.
+func appendPktLine(buf []byte, payload string) []byte {
+	buf = append(buf, fmt.Sprintf("%04x", len(payload)+4)...)
+	return append(buf, payload...)
+}
+
+// encodePktLine writes payload to w as a single pkt-line.
+func encodePktLine(w io.Writer, payload []byte) error {
+	if len(payload)+4 > pktLineMaxLength {
+		return fmt.Errorf("pkt-line payload too long: %d bytes", len(payload))
+	}
+	if _, err := fmt.Fprintf(w, "%04x", len(payload)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// pktLineText returns the payload of a textual pkt-line without its trailing
+// newline.
+func pktLineText(payload []byte) string {
+	return string(bytes.TrimSuffix(payload, []byte("\n")))
+}
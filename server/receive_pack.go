@@ -0,0 +1,640 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// ReceivePackOptions are the options of ServeReceivePack.
+type ReceivePackOptions struct {
+	// StatelessRPC serves a single request of a stateless connection, such
+	// as the body of a smart HTTP POST request. The ref advertisement is
+	// not sent.
+	StatelessRPC bool
+	// AdvertiseRefs only sends the ref advertisement, as for the info/refs
+	// request of smart HTTP.
+	AdvertiseRefs bool
+
+	// DenyNonFastForwards rejects the updates that are not fast-forwards,
+	// like receive.denyNonFastForwards.
+	DenyNonFastForwards bool
+	// DenyDeletes rejects the deletion of references, like
+	// receive.denyDeletes.
+	DenyDeletes bool
+	// AdvertisePushOptions accepts the push options of the clients, like
+	// receive.advertisePushOptions. The hooks find them in
+	// ReferenceUpdate.PushOptions.
+	AdvertisePushOptions bool
+
+	// PreReceiveHook, if set, is called with all the updates of a push,
+	// once the pack has been received and before any reference is updated.
+	PreReceiveHook PreReceiveHook
+	// UpdateHook, if set, is called for every update before its reference
+	// is updated.
+	UpdateHook UpdateHook
+}
+
+// ReferenceUpdate is the update of a reference that a client pushes.
+type ReferenceUpdate struct {
+	Name string
+	// OldId is the value the client expects the reference to have. It is
+	// zero if the client creates the reference.
+	OldId *git.Oid
+	// NewId is the value the client sets the reference to. It is zero if
+	// the client deletes the reference.
+	NewId *git.Oid
+	// PushOptions are the push options that the client sent along with
+	// the updates, if ReceivePackOptions.AdvertisePushOptions is set.
+	PushOptions []string
+}
+
+// IsCreate tells whether the update creates the reference.
+func (u *ReferenceUpdate) IsCreate() bool {
+	return u.OldId.IsZero()
+}
+
+// IsDelete tells whether the update deletes the reference.
+func (u *ReferenceUpdate) IsDelete() bool {
+	return u.NewId.IsZero()
+}
+
+// PreReceiveHook is called with all the updates of a push before they are
+// applied. Returning an error rejects the whole push, with the error
+// message as the reason reported to the client.
+type PreReceiveHook func(updates []*ReferenceUpdate) error
+
+// UpdateHook is called with a single update of a push before it is
+// applied. Returning an error rejects that update, with the error message
+// as the reason reported to the client.
+type UpdateHook func(update *ReferenceUpdate) error
+
+// ServeReceivePack serves a push into repo, in the manner of
+// git-receive-pack: it advertises the references of repo, reads the
+// updates the client asks for and the pack of their objects, runs the
+// hooks and updates the references, and reports the status of every
+// update to the client. The client's request is read from r and the
+// response is written to w.
+func ServeReceivePack(ctx context.Context, repo *git.Repository, r io.Reader, w io.Writer, opts *ReceivePackOptions) error {
+	if opts == nil {
+		opts = &ReceivePackOptions{}
+	}
+
+	s := &receivePackSession{
+		ctx:  ctx,
+		repo: repo,
+		r:    newPktLineReader(r),
+		w:    w,
+		opts: opts,
+	}
+	return s.serve()
+}
+
+// receivePackCommand is an update requested by the client, along with its
+// outcome.
+type receivePackCommand struct {
+	update *ReferenceUpdate
+	// err is the reason the update was rejected, if it was.
+	err error
+}
+
+// receivePackSession is the state of a single ServeReceivePack call.
+type receivePackSession struct {
+	ctx  context.Context
+	repo *git.Repository
+	r    *pktLineReader
+	w    io.Writer
+	opts *ReceivePackOptions
+
+	capabilities map[string]bool
+	commands     []*receivePackCommand
+}
+
+func (s *receivePackSession) serve() error {
+	if s.opts.AdvertiseRefs || !s.opts.StatelessRPC {
+		refs, err := listServerRefs(s.repo, false, false)
+		if err != nil {
+			return err
+		}
+		capabilities := receivePackCapabilities
+		if s.opts.AdvertisePushOptions {
+			capabilities += " push-options"
+		}
+		if err := writeServerAdvertisement(s.w, refs, capabilities); err != nil {
+			return err
+		}
+		if s.opts.AdvertiseRefs {
+			return nil
+		}
+	}
+
+	if err := s.readCommands(); err != nil {
+		return err
+	}
+	if len(s.commands) == 0 {
+		return nil
+	}
+
+	needPack := false
+	for _, command := range s.commands {
+		if !command.update.IsDelete() {
+			needPack = true
+		}
+	}
+	var unpackErr error
+	if needPack {
+		unpackErr = s.receivePack()
+	}
+	if unpackErr != nil {
+		for _, command := range s.commands {
+			command.err = errors.New("unpacker error")
+		}
+	} else {
+		s.updateReferences()
+	}
+
+	if err := s.report(unpackErr); err != nil {
+		return err
+	}
+	return unpackErr
+}
+
+// readCommands reads the update commands of the client, up to the
+// flush-pkt that ends them. A client that disconnects or sends a flush-pkt
+// right away does not update anything.
+func (s *receivePackSession) readCommands() error {
+	for {
+		payload, typ, err := s.r.ReadPktLine()
+		if err == io.EOF && len(s.commands) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if typ == pktLineFlush {
+			if len(s.commands) > 0 && s.capabilities["push-options"] {
+				return s.readPushOptions()
+			}
+			return nil
+		}
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+
+		line := pktLineText(payload)
+		if len(s.commands) == 0 {
+			capabilities := ""
+			if i := strings.IndexByte(line, 0); i >= 0 {
+				line, capabilities = line[:i], line[i+1:]
+			}
+			s.capabilities = serverCapabilities(capabilities)
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("receive-pack: protocol error, expected old/new/ref, got '%s'", line)
+		}
+		oldID, err := git.NewOid(fields[0])
+		if err != nil {
+			return fmt.Errorf("receive-pack: protocol error, expected old/new/ref, got '%s'", line)
+		}
+		newID, err := git.NewOid(fields[1])
+		if err != nil {
+			return fmt.Errorf("receive-pack: protocol error, expected old/new/ref, got '%s'", line)
+		}
+		s.commands = append(s.commands, &receivePackCommand{
+			update: &ReferenceUpdate{Name: fields[2], OldId: oldID, NewId: newID},
+		})
+	}
+}
+
+// readPushOptions reads the push options that follow the commands, up to
+// the flush-pkt that ends them, and hands them to every update.
+func (s *receivePackSession) readPushOptions() error {
+	if !s.opts.AdvertisePushOptions {
+		return errors.New("receive-pack: the client sent push options that were not advertised")
+	}
+	var options []string
+	for {
+		payload, typ, err := s.r.ReadPktLine()
+		if err != nil {
+			return err
+		}
+		if typ == pktLineFlush {
+			break
+		}
+		options = append(options, pktLineText(payload))
+	}
+	for _, command := range s.commands {
+		command.update.PushOptions = options
+	}
+	return nil
+}
+
+// receivePack reads the pack that follows the commands and indexes it into
+// the repository.
+func (s *receivePackSession) receivePack() error {
+	var header [12]byte
+	if _, err := io.ReadFull(s.r.r, header[:]); err != nil {
+		return fmt.Errorf("unable to read pack header: %v", err)
+	}
+	objects, err := parsePackHeader(header[:])
+	if err != nil {
+		return err
+	}
+	if objects == 0 {
+		// An empty pack, sent when the updates only point to objects the
+		// repository already has, is not worth indexing.
+		return scanPackStream(s.r.r, objects, ioutil.Discard)
+	}
+
+	odb, err := s.repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+
+	indexer, err := git.NewIndexer(filepath.Join(s.repo.Path(), "objects", "pack"), odb, func(stats git.TransferProgress) error {
+		return s.ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	defer indexer.Free()
+
+	if _, err := indexer.Write(header[:]); err != nil {
+		return err
+	}
+	if err := scanPackStream(s.r.r, objects, indexer); err != nil {
+		return err
+	}
+	if _, err := indexer.Commit(); err != nil {
+		return err
+	}
+	return odb.Refresh()
+}
+
+// parsePackHeader checks the header of a pack and returns the number of
+// objects it holds.
+func parsePackHeader(header []byte) (uint32, error) {
+	if len(header) != 12 || !bytes.Equal(header[:4], []byte("PACK")) {
+		return 0, errors.New("invalid pack signature")
+	}
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != 2 && version != 3 {
+		return 0, fmt.Errorf("unsupported pack version %d", version)
+	}
+	return binary.BigEndian.Uint32(header[8:12]), nil
+}
+
+// The types of the entries of a pack.
+const (
+	packObjectOfsDelta = 6
+	packObjectRefDelta = 7
+)
+
+// scanPackStream reads the entries and the trailer of a pack whose header
+// has already been read, copying every byte to w. It decompresses the
+// entries to find where the pack ends, so that it never reads past it.
+func scanPackStream(r *bufio.Reader, objects uint32, w io.Writer) error {
+	scanner := &packStreamScanner{r: r, w: w}
+	var inflater io.ReadCloser
+	for i := uint32(0); i < objects; i++ {
+		c, err := scanner.ReadByte()
+		if err != nil {
+			return scanner.unexpected(err)
+		}
+		otype := (c >> 4) & 7
+		for c&0x80 != 0 {
+			if c, err = scanner.ReadByte(); err != nil {
+				return scanner.unexpected(err)
+			}
+		}
+
+		switch otype {
+		case byte(git.ObjectCommit), byte(git.ObjectTree), byte(git.ObjectBlob), byte(git.ObjectTag):
+		case packObjectOfsDelta:
+			c, err = scanner.ReadByte()
+			for err == nil && c&0x80 != 0 {
+				c, err = scanner.ReadByte()
+			}
+			if err != nil {
+				return scanner.unexpected(err)
+			}
+		case packObjectRefDelta:
+			var base [20]byte
+			if _, err := io.ReadFull(scanner, base[:]); err != nil {
+				return scanner.unexpected(err)
+			}
+		default:
+			return fmt.Errorf("invalid type %d of pack object %d", otype, i)
+		}
+
+		if inflater == nil {
+			inflater, err = zlib.NewReader(scanner)
+		} else {
+			err = inflater.(zlib.Resetter).Reset(scanner, nil)
+		}
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, inflater)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to inflate pack object %d: %v", i, err)
+		}
+	}
+
+	var trailer [20]byte
+	if _, err := io.ReadFull(scanner, trailer[:]); err != nil {
+		return scanner.unexpected(err)
+	}
+	return scanner.flush()
+}
+
+// packStreamScanner reads from a buffered reader byte by byte, as the zlib
+// decompressor does for readers that implement io.ByteReader, and copies
+// what it reads to w in batches.
+type packStreamScanner struct {
+	r   *bufio.Reader
+	w   io.Writer
+	buf []byte
+}
+
+// packStreamBatchSize is the amount of data that packStreamScanner
+// accumulates before passing it on.
+const packStreamBatchSize = 64 * 1024
+
+func (p *packStreamScanner) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p.buf = append(p.buf, c)
+	if len(p.buf) >= packStreamBatchSize {
+		if err := p.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return c, nil
+}
+
+func (p *packStreamScanner) Read(data []byte) (int, error) {
+	n, err := p.r.Read(data)
+	p.buf = append(p.buf, data[:n]...)
+	if len(p.buf) >= packStreamBatchSize {
+		if err := p.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// flush passes the accumulated data on to w.
+func (p *packStreamScanner) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.w.Write(p.buf)
+	p.buf = p.buf[:0]
+	return err
+}
+
+// unexpected describes an error while reading the pack.
+func (p *packStreamScanner) unexpected(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("unable to read pack: %v", err)
+}
+
+// updateReferences checks the commands, runs the hooks and applies the
+// commands that are allowed.
+func (s *receivePackSession) updateReferences() {
+	updates := make([]*ReferenceUpdate, len(s.commands))
+	for i, command := range s.commands {
+		updates[i] = command.update
+		command.err = s.checkCommand(command.update)
+	}
+
+	if s.opts.PreReceiveHook != nil && s.pendingCommands() > 0 {
+		if err := s.opts.PreReceiveHook(updates); err != nil {
+			s.rejectPending(fmt.Errorf("pre-receive hook declined: %v", err))
+			return
+		}
+	}
+
+	atomic := s.capabilities["atomic"]
+	if atomic && s.pendingCommands() != len(s.commands) {
+		s.rejectPending(errors.New("atomic push failure"))
+		return
+	}
+
+	if s.opts.UpdateHook != nil {
+		for _, command := range s.commands {
+			if command.err != nil {
+				continue
+			}
+			if err := s.opts.UpdateHook(command.update); err != nil {
+				command.err = fmt.Errorf("hook declined: %v", err)
+			}
+		}
+		if atomic && s.pendingCommands() != len(s.commands) {
+			s.rejectPending(errors.New("atomic push failure"))
+			return
+		}
+	}
+
+	var applied []*receivePackCommand
+	for _, command := range s.commands {
+		if command.err != nil {
+			continue
+		}
+		if err := s.ctx.Err(); err != nil {
+			command.err = err
+		} else {
+			command.err = s.applyUpdate(command.update)
+		}
+		if command.err == nil {
+			applied = append(applied, command)
+			continue
+		}
+		if atomic {
+			// Undo what was already applied, as far as possible.
+			for _, done := range applied {
+				s.applyUpdate(&ReferenceUpdate{
+					Name:  done.update.Name,
+					OldId: done.update.NewId,
+					NewId: done.update.OldId,
+				})
+				done.err = errors.New("atomic transaction failed")
+			}
+			s.rejectPending(errors.New("atomic transaction failed"))
+			return
+		}
+	}
+}
+
+// pendingCommands returns the number of commands that were not rejected.
+func (s *receivePackSession) pendingCommands() int {
+	pending := 0
+	for _, command := range s.commands {
+		if command.err == nil {
+			pending++
+		}
+	}
+	return pending
+}
+
+// rejectPending rejects the commands that were not rejected yet with err.
+func (s *receivePackSession) rejectPending(err error) {
+	for _, command := range s.commands {
+		if command.err == nil {
+			command.err = err
+		}
+	}
+}
+
+// checkCommand tells why update cannot be applied, if it cannot.
+func (s *receivePackSession) checkCommand(update *ReferenceUpdate) error {
+	valid, err := git.ReferenceNameIsValid(update.Name)
+	if err != nil {
+		return err
+	}
+	if !valid || !strings.HasPrefix(update.Name, "refs/") {
+		return errors.New("funny refname")
+	}
+	if update.IsDelete() && s.opts.DenyDeletes {
+		return errors.New("deletion prohibited")
+	}
+
+	current := &git.Oid{}
+	ref, err := s.repo.References.Lookup(update.Name)
+	if err == nil {
+		if ref.Type() == git.ReferenceOid {
+			current = ref.Target()
+		}
+		ref.Free()
+	} else if !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+		return err
+	}
+	if !current.Equal(update.OldId) {
+		if update.IsDelete() {
+			return errors.New("failed to delete")
+		}
+		return errors.New("failed to update ref")
+	}
+	if update.IsDelete() {
+		if update.IsCreate() {
+			return errors.New("deleting a non-existent ref")
+		}
+		return nil
+	}
+
+	odb, err := s.repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+	if !odb.Exists(update.NewId) {
+		return errors.New("missing necessary objects")
+	}
+
+	if s.opts.DenyNonFastForwards && !update.IsCreate() {
+		fastForward := false
+		_, oldType, err := odb.ReadHeader(update.OldId)
+		if err != nil {
+			return err
+		}
+		_, newType, err := odb.ReadHeader(update.NewId)
+		if err != nil {
+			return err
+		}
+		if oldType == git.ObjectCommit && newType == git.ObjectCommit {
+			fastForward, err = s.repo.DescendantOf(update.NewId, update.OldId)
+			if err != nil {
+				return err
+			}
+		}
+		if !fastForward {
+			return errors.New("non-fast-forward")
+		}
+	}
+	return nil
+}
+
+// applyUpdate updates the reference of update, which must still have its
+// old value.
+func (s *receivePackSession) applyUpdate(update *ReferenceUpdate) error {
+	const message = "push"
+	if update.IsCreate() {
+		ref, err := s.repo.References.Create(update.Name, update.NewId, false, message)
+		if err != nil {
+			return err
+		}
+		ref.Free()
+		return nil
+	}
+
+	ref, err := s.repo.References.Lookup(update.Name)
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+	if update.IsDelete() {
+		return ref.Delete()
+	}
+	updated, err := ref.SetTarget(update.NewId, message)
+	if err != nil {
+		return err
+	}
+	updated.Free()
+	return nil
+}
+
+// report sends the status of the unpacking and of every command to the
+// client, if it asked for report-status.
+func (s *receivePackSession) report(unpackErr error) error {
+	if !s.capabilities["report-status"] {
+		return nil
+	}
+
+	var status bytes.Buffer
+	if unpackErr != nil {
+		writePktLinef(&status, "unpack %s\n", reportReason(unpackErr))
+	} else {
+		writePktLinef(&status, "unpack ok\n")
+	}
+	for _, command := range s.commands {
+		if command.err != nil {
+			writePktLinef(&status, "ng %s %s\n", command.update.Name, reportReason(command.err))
+		} else {
+			writePktLinef(&status, "ok %s\n", command.update.Name)
+		}
+	}
+	status.Write(pktFlush)
+
+	if !s.capabilities["side-band-64k"] {
+		_, err := s.w.Write(status.Bytes())
+		return err
+	}
+	band := &sidebandWriter{w: s.w, band: sidebandData, maxLength: pktLineMaxLength}
+	if _, err := band.Write(status.Bytes()); err != nil {
+		return err
+	}
+	_, err := s.w.Write(pktFlush)
+	return err
+}
+
+// reportReason returns the message of err on a single line.
+func reportReason(err error) string {
+	return strings.Replace(err.Error(), "\n", " ", -1)
+}
@@ -0,0 +1,185 @@
+// Package server serves git repositories over the smart protocol. It
+// implements git-upload-pack and git-receive-pack on top of the repositories
+// of git2go, and offers them over smart HTTP and SSH.
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// serverAgent is the agent that the servers announce to their clients.
+const serverAgent = "git2go"
+
+// uploadPackCapabilities are the capabilities that ServeUploadPack
+// advertises.
+const uploadPackCapabilities = "multi_ack_detailed side-band side-band-64k ofs-delta thin-pack no-progress include-tag shallow deepen-since deepen-not allow-reachable-sha1-in-want agent=" + serverAgent
+
+// receivePackCapabilities are the capabilities that ServeReceivePack
+// advertises.
+const receivePackCapabilities = "report-status delete-refs side-band-64k ofs-delta atomic agent=" + serverAgent
+
+// The sideband channels of a server response.
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+)
+
+// advertisedRef is a reference that a server advertises.
+type advertisedRef struct {
+	id           string
+	name         string
+	symrefTarget string
+	peeled       string
+}
+
+// listServerRefs returns the references of repo in the order a server
+// advertises them: HEAD first, if it can be resolved and includeHead is
+// set, then the other references sorted by name. Annotated tags carry
+// their peeled value if peelTags is set.
+func listServerRefs(repo *git.Repository, includeHead, peelTags bool) ([]advertisedRef, error) {
+	var refs []advertisedRef
+
+	if includeHead {
+		head, err := repo.References.Lookup("HEAD")
+		if err == nil {
+			target := ""
+			if head.Type() == git.ReferenceSymbolic {
+				target = head.SymbolicTarget()
+			}
+			resolved, err := head.Resolve()
+			head.Free()
+			if err == nil {
+				refs = append(refs, advertisedRef{
+					id:           resolved.Target().String(),
+					name:         "HEAD",
+					symrefTarget: target,
+				})
+				resolved.Free()
+			} else if !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+				return nil, err
+			}
+		} else if !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+			return nil, err
+		}
+	}
+
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+
+	var others []advertisedRef
+	for {
+		ref, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ref.Type() != git.ReferenceOid {
+			// Symbolic references other than HEAD are not advertised,
+			// their targets are.
+			ref.Free()
+			continue
+		}
+		advertised := advertisedRef{
+			id:   ref.Target().String(),
+			name: ref.Name(),
+		}
+		if peelTags && strings.HasPrefix(advertised.name, "refs/tags/") {
+			peeled, err := ref.Peel(git.ObjectAny)
+			if err == nil {
+				if !peeled.Id().Equal(ref.Target()) {
+					advertised.peeled = peeled.Id().String()
+				}
+				peeled.Free()
+			}
+		}
+		ref.Free()
+		others = append(others, advertised)
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].name < others[j].name
+	})
+	return append(refs, others...), nil
+}
+
+// writeServerAdvertisement writes the ref advertisement of a server with
+// the given capabilities.
+func writeServerAdvertisement(w io.Writer, refs []advertisedRef, capabilities string) error {
+	_, err := w.Write(appendRefAdvertisement(nil, refs, capabilities))
+	return err
+}
+
+// appendRefAdvertisement appends the protocol v0 advertisement of refs to
+// buf, with capabilities and the symrefs of refs on its first line.
+func appendRefAdvertisement(buf []byte, refs []advertisedRef, capabilities string) []byte {
+	for _, ref := range refs {
+		if ref.symrefTarget != "" {
+			capabilities += " symref=" + ref.name + ":" + ref.symrefTarget
+		}
+	}
+
+	if len(refs) == 0 {
+		buf = appendPktLine(buf, (&git.Oid{}).String()+" capabilities^{}\x00"+capabilities+"\n")
+	}
+	for i, ref := range refs {
+		line := ref.id + " " + ref.name
+		if i == 0 {
+			line += "\x00" + capabilities
+		}
+		buf = appendPktLine(buf, line+"\n")
+		if ref.peeled != "" {
+			buf = appendPktLine(buf, ref.peeled+" "+ref.name+"^{}\n")
+		}
+	}
+	return append(buf, pktFlush...)
+}
+
+// writePktLinef writes a formatted textual pkt-line.
+func writePktLinef(w io.Writer, format string, args ...interface{}) error {
+	return encodePktLine(w, []byte(fmt.Sprintf(format, args...)))
+}
+
+// sidebandWriter writes data as pkt-lines on a sideband channel.
+type sidebandWriter struct {
+	w    io.Writer
+	band byte
+	// maxLength is the maximum length of a pkt-line, which depends on
+	// whether the client asked for side-band or side-band-64k.
+	maxLength int
+}
+
+func (s *sidebandWriter) Write(data []byte) (int, error) {
+	maxChunk := s.maxLength - 5
+	written := 0
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err := encodePktLine(s.w, append([]byte{s.band}, chunk...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
+
+// serverCapabilities returns the set of capabilities a client asked for.
+func serverCapabilities(list string) map[string]bool {
+	capabilities := make(map[string]bool)
+	for _, capability := range strings.Fields(list) {
+		capabilities[capability] = true
+	}
+	return capabilities
+}
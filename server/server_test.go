@@ -0,0 +1,549 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// serverTestPipe is an unbounded in-memory pipe, so that the server never
+// blocks on a client that is still writing, as with a socket buffer.
+type serverTestPipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error
+	closed bool
+}
+
+func newServerTestPipe() *serverTestPipe {
+	p := &serverTestPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *serverTestPipe) Read(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		return 0, io.EOF
+	}
+	return p.buf.Read(data)
+}
+
+func (p *serverTestPipe) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.cond.Broadcast()
+	return p.buf.Write(data)
+}
+
+func (p *serverTestPipe) CloseWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.err = err
+	p.cond.Broadcast()
+}
+
+// serverTestStream connects the client to a server goroutine.
+type serverTestStream struct {
+	toServer   *serverTestPipe
+	fromServer *serverTestPipe
+	done       chan error
+}
+
+func newServerTestStream(serve func(r io.Reader, w io.Writer) error) *serverTestStream {
+	s := &serverTestStream{
+		toServer:   newServerTestPipe(),
+		fromServer: newServerTestPipe(),
+		done:       make(chan error, 1),
+	}
+	go func() {
+		err := serve(s.toServer, s.fromServer)
+		s.fromServer.CloseWithError(err)
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *serverTestStream) Read(data []byte) (int, error) {
+	return s.fromServer.Read(data)
+}
+
+func (s *serverTestStream) Write(data []byte) (int, error) {
+	return s.toServer.Write(data)
+}
+
+func (s *serverTestStream) Free() {
+}
+
+// close hangs up and returns the error of the server.
+func (s *serverTestStream) close() error {
+	s.toServer.CloseWithError(nil)
+	return <-s.done
+}
+
+// serverTestSubtransport serves the actions of the client from a
+// repository, in the manner of a stateful transport such as SSH.
+type serverTestSubtransport struct {
+	server *serverTestServer
+
+	stream     *serverTestStream
+	lastAction git.SmartServiceAction
+}
+
+func (t *serverTestSubtransport) Action(url string, action git.SmartServiceAction) (git.SmartSubtransportStream, error) {
+	if t.stream != nil {
+		if (action == git.SmartServiceActionUploadpack && t.lastAction == git.SmartServiceActionUploadpackLs) ||
+			(action == git.SmartServiceActionReceivepack && t.lastAction == git.SmartServiceActionReceivepackLs) {
+			t.lastAction = action
+			return t.stream, nil
+		}
+		t.Close()
+	}
+
+	ctx := context.Background()
+	repo := t.server.repo
+	switch action {
+	case git.SmartServiceActionUploadpackLs, git.SmartServiceActionUploadpack:
+		t.stream = newServerTestStream(func(r io.Reader, w io.Writer) error {
+			return ServeUploadPack(ctx, repo, r, w, nil)
+		})
+	case git.SmartServiceActionReceivepackLs, git.SmartServiceActionReceivepack:
+		opts := t.server.receiveOptions
+		t.stream = newServerTestStream(func(r io.Reader, w io.Writer) error {
+			return ServeReceivePack(ctx, repo, r, w, &opts)
+		})
+	default:
+		return nil, fmt.Errorf("unexpected action: %v", action)
+	}
+	t.lastAction = action
+	return t.stream, nil
+}
+
+func (t *serverTestSubtransport) Close() error {
+	if t.stream == nil {
+		return nil
+	}
+	err := t.stream.close()
+	t.stream = nil
+	t.server.recordError(err)
+	return nil
+}
+
+func (t *serverTestSubtransport) Free() {
+	t.Close()
+}
+
+// serverTestServer serves a repository through a registered transport.
+type serverTestServer struct {
+	repo           *git.Repository
+	receiveOptions ReceivePackOptions
+	transport      *git.RegisteredSmartTransport
+
+	mu     sync.Mutex
+	errors []error
+}
+
+func startTestServer(t *testing.T, name string, repo *git.Repository) *serverTestServer {
+	server := &serverTestServer{repo: repo}
+	transport, err := git.NewRegisteredSmartTransport(name, false, func(remote *git.Remote, transport *git.Transport) (git.SmartSubtransport, error) {
+		return &serverTestSubtransport{server: server}, nil
+	})
+	checkFatal(t, err)
+	server.transport = transport
+	return server
+}
+
+func (s *serverTestServer) recordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, err)
+}
+
+// takeErrors returns the errors of the server so far.
+func (s *serverTestServer) takeErrors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errors := s.errors
+	s.errors = nil
+	return errors
+}
+
+func (s *serverTestServer) stop(t *testing.T) {
+	checkFatal(t, s.transport.Free())
+}
+
+func TestServeUploadPack(t *testing.T) {
+	t.Parallel()
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstCommit, _ := seedTestRepo(t, serverRepo)
+
+	commit, err := serverRepo.LookupCommit(firstCommit)
+	checkFatal(t, err)
+	defer commit.Free()
+	tag, err := serverRepo.Tags.Create("v1.0", commit, commit.Author(), "Release 1.0")
+	checkFatal(t, err)
+
+	server := startTestServer(t, "serveupload", serverRepo)
+	defer server.stop(t)
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+
+	repo, err := git.Clone("serveupload://server/repo", path, &git.CloneOptions{})
+	checkFatal(t, err)
+	defer repo.Free()
+
+	head, err := repo.Head()
+	checkFatal(t, err)
+	if !head.Target().Equal(firstCommit) {
+		t.Errorf("cloned HEAD = %v, want %v", head.Target(), firstCommit)
+	}
+	head.Free()
+
+	tagRef, err := repo.References.Lookup("refs/tags/v1.0")
+	checkFatal(t, err)
+	if !tagRef.Target().Equal(tag) {
+		t.Errorf("cloned tag = %v, want %v", tagRef.Target(), tag)
+	}
+	tagRef.Free()
+
+	// Fetching again negotiates the commits the clone already has.
+	secondCommit, _ := updateReadme(t, serverRepo, "second commit")
+
+	remote, err := repo.Remotes.Lookup("origin")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	var progress strings.Builder
+	err = remote.Fetch(nil, &git.FetchOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			SidebandProgressCallback: func(str string) error {
+				progress.WriteString(str)
+				return nil
+			},
+		},
+	}, "")
+	checkFatal(t, err)
+
+	ref, err := repo.References.Lookup("refs/remotes/origin/master")
+	checkFatal(t, err)
+	defer ref.Free()
+	if !ref.Target().Equal(secondCommit) {
+		t.Errorf("fetched origin/master = %v, want %v", ref.Target(), secondCommit)
+	}
+	if !strings.Contains(progress.String(), "Counting objects") {
+		t.Errorf("no progress was reported: %q", progress.String())
+	}
+
+	for _, err := range server.takeErrors() {
+		t.Errorf("server error: %v", err)
+	}
+}
+
+func TestServeReceivePack(t *testing.T) {
+	t.Parallel()
+	serverRepo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+
+	server := startTestServer(t, "servereceive", serverRepo)
+	defer server.stop(t)
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	firstCommit, _ := seedTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "servereceive://server/repo")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	push := func(refspecs ...string) map[string]string {
+		statuses := make(map[string]string)
+		err := remote.Push(refspecs, &git.PushOptions{
+			RemoteCallbacks: git.RemoteCallbacks{
+				PushUpdateReferenceCallback: func(refname, status string) error {
+					statuses[refname] = status
+					return nil
+				},
+			},
+		})
+		checkFatal(t, err)
+		for _, err := range server.takeErrors() {
+			t.Errorf("server error: %v", err)
+		}
+		return statuses
+	}
+	checkServerRef := func(name string, want *git.Oid) {
+		t.Helper()
+		ref, err := serverRepo.References.Lookup(name)
+		if want == nil {
+			if !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+				t.Errorf("%s exists on the server, want it deleted", name)
+			}
+			return
+		}
+		checkFatal(t, err)
+		defer ref.Free()
+		if !ref.Target().Equal(want) {
+			t.Errorf("%s = %v on the server, want %v", name, ref.Target(), want)
+		}
+	}
+
+	var preReceived []*ReferenceUpdate
+	server.receiveOptions = ReceivePackOptions{
+		PreReceiveHook: func(updates []*ReferenceUpdate) error {
+			preReceived = append(preReceived, updates...)
+			return nil
+		},
+	}
+	statuses := push("refs/heads/master:refs/heads/master", "refs/heads/master:refs/heads/feature")
+	if statuses["refs/heads/master"] != "" || statuses["refs/heads/feature"] != "" {
+		t.Errorf("unexpected push statuses: %v", statuses)
+	}
+	checkServerRef("refs/heads/master", firstCommit)
+	checkServerRef("refs/heads/feature", firstCommit)
+	if len(preReceived) != 2 || !preReceived[0].IsCreate() || !preReceived[0].NewId.Equal(firstCommit) {
+		t.Errorf("unexpected updates in the pre-receive hook: %+v", preReceived)
+	}
+
+	// A fast-forward.
+	secondCommit, _ := updateReadme(t, repo, "second commit")
+	push("refs/heads/master:refs/heads/master")
+	checkServerRef("refs/heads/master", secondCommit)
+
+	// The update hook rejects a single reference.
+	server.receiveOptions = ReceivePackOptions{
+		UpdateHook: func(update *ReferenceUpdate) error {
+			if update.Name == "refs/heads/protected" {
+				return fmt.Errorf("%s is protected", update.Name)
+			}
+			return nil
+		},
+	}
+	statuses = push("refs/heads/master:refs/heads/protected", "refs/heads/master:refs/heads/feature")
+	if !strings.Contains(statuses["refs/heads/protected"], "is protected") || statuses["refs/heads/feature"] != "" {
+		t.Errorf("unexpected push statuses: %v", statuses)
+	}
+	checkServerRef("refs/heads/protected", nil)
+	checkServerRef("refs/heads/feature", secondCommit)
+
+	// A forced update that is not a fast-forward.
+	commit, err := repo.LookupCommit(firstCommit)
+	checkFatal(t, err)
+	defer commit.Free()
+	branch, err := repo.CreateBranch("old", commit, false)
+	checkFatal(t, err)
+	branch.Free()
+	server.receiveOptions = ReceivePackOptions{DenyNonFastForwards: true}
+	statuses = push("+refs/heads/old:refs/heads/master")
+	if statuses["refs/heads/master"] != "non-fast-forward" {
+		t.Errorf("unexpected push statuses: %v", statuses)
+	}
+	checkServerRef("refs/heads/master", secondCommit)
+
+	// A deletion.
+	server.receiveOptions = ReceivePackOptions{}
+	push(":refs/heads/feature")
+	checkServerRef("refs/heads/feature", nil)
+}
+
+func TestScanPackStream(t *testing.T) {
+	t.Parallel()
+
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(3))
+	writeEntry := func(header []byte, data []byte) {
+		pack.Write(header)
+		zw := zlib.NewWriter(&pack)
+		zw.Write(data)
+		zw.Close()
+	}
+	// A blob whose size takes two bytes, an offset delta and a reference
+	// delta.
+	writeEntry([]byte{0xbc, 0x01}, bytes.Repeat([]byte("blob "), 6))
+	writeEntry([]byte{0x64, 0x80, 0x10}, []byte("delta"))
+	writeEntry(append([]byte{0x74}, bytes.Repeat([]byte{0xab}, 20)...), []byte("delta"))
+	pack.Write(bytes.Repeat([]byte{0xcd}, 20))
+
+	const trailing = "0000more"
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(pack.Bytes()), strings.NewReader(trailing)))
+
+	var header [12]byte
+	_, err := io.ReadFull(r, header[:])
+	checkFatal(t, err)
+	objects, err := parsePackHeader(header[:])
+	checkFatal(t, err)
+	if objects != 3 {
+		t.Fatalf("parsePackHeader() = %d objects, want 3", objects)
+	}
+
+	var copied bytes.Buffer
+	checkFatal(t, scanPackStream(r, objects, &copied))
+	if !bytes.Equal(copied.Bytes(), pack.Bytes()[12:]) {
+		t.Errorf("scanPackStream() copied %d bytes, want %d", copied.Len(), pack.Len()-12)
+	}
+	rest, err := ioutil.ReadAll(r)
+	checkFatal(t, err)
+	if string(rest) != trailing {
+		t.Errorf("scanPackStream() left %q, want %q", rest, trailing)
+	}
+
+	truncated := bufio.NewReader(bytes.NewReader(pack.Bytes()[12 : pack.Len()-30]))
+	if err := scanPackStream(truncated, objects, ioutil.Discard); err == nil {
+		t.Error("scanPackStream() of a truncated pack succeeded")
+	}
+}
+
+func TestServeReceivePackPushResults(t *testing.T) {
+	t.Parallel()
+	serverRepo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+
+	server := startTestServer(t, "pushresults", serverRepo)
+	defer server.stop(t)
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	firstCommit, _ := seedTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "pushresults://server/repo")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkServerRef := func(name string, want *git.Oid) {
+		t.Helper()
+		ref, err := serverRepo.References.Lookup(name)
+		if want == nil {
+			if !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+				t.Errorf("%s exists on the server, want it missing", name)
+			}
+			return
+		}
+		checkFatal(t, err)
+		defer ref.Free()
+		if !ref.Target().Equal(want) {
+			t.Errorf("%s = %v on the server, want %v", name, ref.Target(), want)
+		}
+	}
+
+	var pushOptions []string
+	server.receiveOptions = ReceivePackOptions{
+		AdvertisePushOptions: true,
+		PreReceiveHook: func(updates []*ReferenceUpdate) error {
+			pushOptions = updates[0].PushOptions
+			return nil
+		},
+	}
+	results, err := remote.PushWithResults([]string{"refs/heads/master:refs/heads/master"}, &git.PushOptions{
+		RemotePushOptions: []string{"ci.skip", "merge_request.create"},
+	})
+	checkFatal(t, err)
+	if len(results) != 1 || results[0].Rejected() || results[0].Destination != "refs/heads/master" ||
+		!results[0].OldId.IsZero() || !results[0].NewId.Equal(firstCommit) {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	if !reflect.DeepEqual(pushOptions, []string{"ci.skip", "merge_request.create"}) {
+		t.Errorf("push options = %q", pushOptions)
+	}
+	checkServerRef("refs/heads/master", firstCommit)
+
+	// A lease on a value that master was not advertised with is rejected
+	// before anything is sent.
+	secondCommit, _ := updateReadme(t, repo, "second commit")
+	received := false
+	server.receiveOptions = ReceivePackOptions{
+		PreReceiveHook: func(updates []*ReferenceUpdate) error {
+			received = true
+			return nil
+		},
+	}
+	results, err = remote.PushWithResults([]string{"+refs/heads/master:refs/heads/master"}, &git.PushOptions{
+		ExpectedOldIds: map[string]*git.Oid{"refs/heads/master": secondCommit},
+	})
+	checkFatal(t, err)
+	if len(results) != 1 || results[0].Status != git.PushStatusRejectedStale ||
+		!results[0].OldId.Equal(firstCommit) {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	if received {
+		t.Error("the server received the update of a stale lease")
+	}
+	checkServerRef("refs/heads/master", firstCommit)
+
+	// A ref that changes on the server after the advertisement.
+	results, err = remote.PushWithResults([]string{"refs/heads/master:refs/heads/master"}, &git.PushOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			PushNegotiationCallback: func(updates []git.PushUpdate) error {
+				ref, err := serverRepo.References.Lookup("refs/heads/master")
+				if err != nil {
+					return err
+				}
+				defer ref.Free()
+				return ref.Delete()
+			},
+		},
+	})
+	checkFatal(t, err)
+	if len(results) != 1 || results[0].Status != git.PushStatusRejected || results[0].Message != "failed to update ref" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	checkServerRef("refs/heads/master", nil)
+
+	// An atomic push in which one update is rejected.
+	server.receiveOptions = ReceivePackOptions{
+		UpdateHook: func(update *ReferenceUpdate) error {
+			if update.Name == "refs/heads/protected" {
+				return fmt.Errorf("%s is protected", update.Name)
+			}
+			return nil
+		},
+	}
+	results, err = remote.PushWithResults([]string{
+		"refs/heads/master:refs/heads/master",
+		"refs/heads/master:refs/heads/protected",
+	}, &git.PushOptions{Atomic: true})
+	checkFatal(t, err)
+	statuses := make(map[string]git.PushStatus)
+	for _, result := range results {
+		statuses[result.Destination] = result.Status
+	}
+	if statuses["refs/heads/protected"] != git.PushStatusRejected || statuses["refs/heads/master"] != git.PushStatusRejectedAtomic {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	checkServerRef("refs/heads/master", nil)
+	checkServerRef("refs/heads/protected", nil)
+
+	for _, err := range server.takeErrors() {
+		t.Errorf("server error: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	git "github.com/libgit2/git2go/v34"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer serves repositories over SSH, for clients that run
+// "git-upload-pack '<path>'" to fetch and "git-receive-pack '<path>'" to
+// push. Fetches are served by ServeUploadPack and pushes by
+// ServeReceivePack, without running git.
+type SSHServer struct {
+	// HostKeys are the keys the server identifies itself with. At least
+	// one is required.
+	HostKeys []ssh.Signer
+
+	// AuthorizePublicKey decides whether a client may log in as the user
+	// of conn with key, as the PublicKeyCallback of ssh.ServerConfig does.
+	// The permissions it returns are available to the other hooks through
+	// the Permissions of the connection. Without it, no client can log in.
+	AuthorizePublicKey func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+
+	// ResolveRepository opens the repository at the given path of a
+	// command. The path is cleaned and starts with a slash. The server
+	// frees the repository once the command has been served.
+	ResolveRepository func(conn *ssh.ServerConn, repoPath string) (*git.Repository, error)
+
+	// Authorize, if set, is called before a command runs the given
+	// service, which is either "git-upload-pack" or "git-receive-pack".
+	// Returning an error denies the command, and its message is sent to
+	// the client.
+	Authorize func(conn *ssh.ServerConn, repoPath, service string) error
+
+	// ReceivePackOptions are the options of the pushes. The StatelessRPC
+	// and AdvertiseRefs fields are ignored.
+	ReceivePackOptions ReceivePackOptions
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// ErrSSHServerClosed is returned by SSHServer.Serve once Close has been
+// called.
+var ErrSSHServerClosed = errors.New("ssh: server closed")
+
+// Serve accepts connections on l and serves each of them in its own
+// goroutine. It always returns a non-nil error, which is
+// ErrSSHServerClosed once Close has been called.
+func (s *SSHServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSSHServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrSSHServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes the listeners of the server. The connections that are being
+// served are not interrupted.
+func (s *SSHServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ServeConn performs the SSH handshake on conn and serves the commands of
+// its sessions, until the client disconnects. It closes conn.
+func (s *SSHServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: s.AuthorizePublicKey,
+	}
+	if config.PublicKeyCallback == nil {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("public key authentication is not configured")
+		}
+	}
+	for _, key := range s.HostKeys {
+		config.AddHostKey(key)
+	}
+
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return err
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	var wg sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(serverConn, channel, requests)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// serveSession serves the exec request of a session channel.
+func (s *SSHServer) serveSession(conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			// Variables such as GIT_PROTOCOL are accepted, but the server
+			// only speaks protocol v0.
+			req.Reply(true, nil)
+
+		case "exec":
+			// RFC 4254 Section 6.5.
+			var payload struct {
+				Command string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			status := uint32(0)
+			if err := s.runCommand(conn, channel, payload.Command); err != nil {
+				fmt.Fprintf(channel.Stderr(), "fatal: %v\n", err)
+				status = 1
+			}
+			channel.CloseWrite()
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runCommand serves a git-upload-pack or git-receive-pack command on
+// channel.
+func (s *SSHServer) runCommand(conn *ssh.ServerConn, channel ssh.Channel, command string) error {
+	service, repoPath, err := parseSSHGitCommand(command)
+	if err != nil {
+		return err
+	}
+
+	if s.Authorize != nil {
+		if err := s.Authorize(conn, repoPath, service); err != nil {
+			return err
+		}
+	}
+	if s.ResolveRepository == nil {
+		return fmt.Errorf("'%s' does not appear to be a git repository", repoPath)
+	}
+	repo, err := s.ResolveRepository(conn, repoPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if service == "git-upload-pack" {
+		return ServeUploadPack(ctx, repo, channel, channel, nil)
+	}
+	opts := s.ReceivePackOptions
+	opts.StatelessRPC = false
+	opts.AdvertiseRefs = false
+	return ServeReceivePack(ctx, repo, channel, channel, &opts)
+}
+
+// parseSSHGitCommand splits a command such as "git-upload-pack '/repo.git'"
+// into its service and cleaned repository path.
+func parseSSHGitCommand(command string) (string, string, error) {
+	command = strings.TrimSpace(command)
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		for _, prefix := range []string{service + " ", "git " + strings.TrimPrefix(service, "git-") + " "} {
+			if !strings.HasPrefix(command, prefix) {
+				continue
+			}
+			repoPath, err := sshUnquote(strings.TrimSpace(strings.TrimPrefix(command, prefix)))
+			if err != nil {
+				return "", "", err
+			}
+			if repoPath == "" {
+				return "", "", fmt.Errorf("invalid command: %q", command)
+			}
+			return service, path.Clean("/" + repoPath), nil
+		}
+	}
+	return "", "", fmt.Errorf("unsupported command: %q", command)
+}
+
+// sshUnquote undoes the quoting of sshQuote, as git does for the argument
+// of the commands it runs over SSH. An argument without quotes is taken as
+// it is.
+func sshUnquote(s string) (string, error) {
+	if !strings.HasPrefix(s, "'") {
+		if strings.ContainsAny(s, " '\\") {
+			return "", fmt.Errorf("invalid quoting: %s", s)
+		}
+		return s, nil
+	}
+
+	var result strings.Builder
+	for len(s) > 0 {
+		switch s[0] {
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated quote: %s", s)
+			}
+			result.WriteString(s[1 : end+1])
+			s = s[end+2:]
+		case '\\':
+			if len(s) < 2 || (s[1] != '\'' && s[1] != '!') {
+				return "", fmt.Errorf("invalid escape: %s", s)
+			}
+			result.WriteByte(s[1])
+			s = s[2:]
+		default:
+			return "", fmt.Errorf("invalid quoting: %s", s)
+		}
+	}
+	return result.String(), nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	git "github.com/libgit2/git2go/v34"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHGitCommand(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		command  string
+		service  string
+		repoPath string
+		invalid  bool
+	}{
+		{command: "git-upload-pack '/repo.git'", service: "git-upload-pack", repoPath: "/repo.git"},
+		{command: "git-receive-pack 'org/repo.git'", service: "git-receive-pack", repoPath: "/org/repo.git"},
+		{command: "git upload-pack '/repo.git'", service: "git-upload-pack", repoPath: "/repo.git"},
+		{command: "git-upload-pack /repo.git", service: "git-upload-pack", repoPath: "/repo.git"},
+		{command: "git-upload-pack '/it'\\''s'\\!'.git'", service: "git-upload-pack", repoPath: "/it's!.git"},
+		{command: "git-upload-pack '/../../etc'", service: "git-upload-pack", repoPath: "/etc"},
+		{command: "git-upload-pack '/with space.git'", service: "git-upload-pack", repoPath: "/with space.git"},
+		{command: "git-upload-pack '/repo.git", invalid: true},
+		{command: "git-upload-pack /a b", invalid: true},
+		{command: "git-upload-pack ''", invalid: true},
+		{command: "sh -c 'rm -rf /'", invalid: true},
+	}
+	for _, tt := range tests {
+		service, repoPath, err := parseSSHGitCommand(tt.command)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseSSHGitCommand(%q) = %q, %q, want an error", tt.command, service, repoPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSSHGitCommand(%q) failed: %v", tt.command, err)
+			continue
+		}
+		if service != tt.service || repoPath != tt.repoPath {
+			t.Errorf("parseSSHGitCommand(%q) = %q, %q, want %q, %q", tt.command, service, repoPath, tt.service, tt.repoPath)
+		}
+	}
+}
+
+func TestSSHServer(t *testing.T) {
+	t.Parallel()
+
+	hostPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	checkFatal(t, err)
+	writerPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	writerSigner, err := ssh.NewSignerFromKey(writerPrivKey)
+	checkFatal(t, err)
+	readerPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	readerSigner, err := ssh.NewSignerFromKey(readerPrivKey)
+	checkFatal(t, err)
+
+	serverRepo := createBareTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+
+	server := &SSHServer{
+		HostKeys: []ssh.Signer{hostSigner},
+		AuthorizePublicKey: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			switch {
+			case bytes.Equal(key.Marshal(), writerSigner.PublicKey().Marshal()):
+				return &ssh.Permissions{Extensions: map[string]string{"access": "write"}}, nil
+			case bytes.Equal(key.Marshal(), readerSigner.PublicKey().Marshal()):
+				return &ssh.Permissions{Extensions: map[string]string{"access": "read"}}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", conn.User())
+		},
+		ResolveRepository: func(conn *ssh.ServerConn, repoPath string) (*git.Repository, error) {
+			if repoPath != "/repo.git" {
+				return nil, fmt.Errorf("'%s' does not appear to be a git repository", repoPath)
+			}
+			return git.OpenRepository(serverRepo.Path())
+		},
+		Authorize: func(conn *ssh.ServerConn, repoPath, service string) error {
+			if service == "git-receive-pack" && conn.Permissions.Extensions["access"] != "write" {
+				return errors.New("read-only access")
+			}
+			return nil
+		},
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	checkFatal(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	defer func() {
+		checkFatal(t, server.Close())
+		if err := <-served; err != ErrSSHServerClosed {
+			t.Errorf("Serve() = %v, want %v", err, ErrSSHServerClosed)
+		}
+	}()
+
+	registeredSmartTransport, err := git.RegisterManagedSSHTransport("sshserve")
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	url := fmt.Sprintf("sshserve://git@%s/repo.git", listener.Addr().String())
+	callbacks := func(signer ssh.Signer) git.RemoteCallbacks {
+		return git.RemoteCallbacks{
+			CertificateCheckCallback: func(cert *git.Certificate, valid bool, hostname string) error {
+				if !bytes.Equal(cert.Hostkey.SSHPublicKey.Marshal(), hostSigner.PublicKey().Marshal()) {
+					return errors.New("unexpected host key")
+				}
+				return nil
+			},
+			CredentialsCallback: func(url, username string, allowedTypes git.CredentialType) (*git.Credential, error) {
+				return git.NewCredentialSSHKeyFromSigner(username, signer)
+			},
+		}
+	}
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	commitID, _ := seedTestRepo(t, repo)
+	remote, err := repo.Remotes.Create("origin", url)
+	checkFatal(t, err)
+	defer remote.Free()
+
+	// A reader cannot push.
+	err = remote.Push([]string{"refs/heads/master"}, &git.PushOptions{RemoteCallbacks: callbacks(readerSigner)})
+	if err == nil {
+		t.Fatal("a push with read-only access succeeded")
+	}
+
+	err = remote.Push([]string{"refs/heads/master"}, &git.PushOptions{RemoteCallbacks: callbacks(writerSigner)})
+	checkFatal(t, err)
+	ref, err := serverRepo.References.Lookup("refs/heads/master")
+	checkFatal(t, err)
+	if !ref.Target().Equal(commitID) {
+		t.Errorf("pushed master = %v, want %v", ref.Target(), commitID)
+	}
+	ref.Free()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+	clone, err := git.Clone(url, path, &git.CloneOptions{
+		FetchOptions: git.FetchOptions{RemoteCallbacks: callbacks(readerSigner)},
+	})
+	checkFatal(t, err)
+	defer clone.Free()
+
+	head, err := clone.Head()
+	checkFatal(t, err)
+	defer head.Free()
+	if !head.Target().Equal(commitID) {
+		t.Errorf("cloned HEAD = %v, want %v", head.Target(), commitID)
+	}
+}
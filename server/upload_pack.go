@@ -0,0 +1,869 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// UploadPackOptions are the options of ServeUploadPack.
+type UploadPackOptions struct {
+	// StatelessRPC serves a single request of a stateless connection, such
+	// as the body of a smart HTTP POST request. The ref advertisement is
+	// not sent, and the negotiation stops after answering one round of
+	// haves.
+	StatelessRPC bool
+	// AdvertiseRefs only sends the ref advertisement, as for the info/refs
+	// request of smart HTTP.
+	AdvertiseRefs bool
+}
+
+// ServeUploadPack serves a fetch from repo, in the manner of
+// git-upload-pack: it advertises the references of repo, negotiates the
+// common commits with the client and sends it a pack of the missing
+// objects. The client's request is read from r and the response is written
+// to w.
+func ServeUploadPack(ctx context.Context, repo *git.Repository, r io.Reader, w io.Writer, opts *UploadPackOptions) error {
+	if opts == nil {
+		opts = &UploadPackOptions{}
+	}
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+
+	s := &uploadPackSession{
+		ctx:  ctx,
+		repo: repo,
+		odb:  odb,
+		r:    newPktLineReader(r),
+		w:    w,
+		opts: opts,
+	}
+	return s.serve()
+}
+
+// uploadPackSession is the state of a single ServeUploadPack call.
+type uploadPackSession struct {
+	ctx  context.Context
+	repo *git.Repository
+	odb  *git.Odb
+	r    *pktLineReader
+	w    io.Writer
+	opts *UploadPackOptions
+
+	refs         []advertisedRef
+	capabilities map[string]bool
+	wants        []*git.Oid
+
+	// clientShallow holds the shallow roots of the client, and depth,
+	// deepenSince and deepenNot its requests to limit the history.
+	clientShallow []*git.Oid
+	depth         int
+	deepenSince   int64
+	deepenNot     []string
+	// shallowCommits, if not nil, holds the commits of a shallow fetch.
+	shallowCommits map[git.Oid]bool
+
+	// common holds the haves of the client that the repository has, in
+	// the order they were received.
+	common     []*git.Oid
+	commonSeen map[git.Oid]bool
+	// satisfied holds the wants that have a common commit as an ancestor,
+	// and checked is the number of common commits they were checked
+	// against.
+	satisfied map[git.Oid]bool
+	checked   int
+
+	// packStarted is set once the pack is being sent, after which errors
+	// can only be reported on the sideband.
+	packStarted bool
+}
+
+func (s *uploadPackSession) serve() error {
+	refs, err := listServerRefs(s.repo, true, true)
+	if err != nil {
+		return err
+	}
+	s.refs = refs
+
+	if s.opts.AdvertiseRefs || !s.opts.StatelessRPC {
+		if err := writeServerAdvertisement(s.w, s.refs, uploadPackCapabilities); err != nil {
+			return err
+		}
+		if s.opts.AdvertiseRefs {
+			return nil
+		}
+	}
+
+	if err := s.readWants(); err != nil {
+		return s.fail(err)
+	}
+	if len(s.wants) == 0 {
+		return nil
+	}
+	if len(s.clientShallow) > 0 || s.isDeepening() {
+		if err := s.sendShallowInfo(); err != nil {
+			return s.fail(err)
+		}
+	}
+
+	done, err := s.negotiate()
+	if err != nil {
+		return s.fail(err)
+	}
+	if !done {
+		return nil
+	}
+
+	if err := s.sendPack(); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// fail reports err to the client, in an ERR pkt-line before the pack has
+// started, or on the error sideband after, and returns it.
+func (s *uploadPackSession) fail(err error) error {
+	message := strings.Replace(err.Error(), "\n", " ", -1)
+	if !s.packStarted {
+		writePktLinef(s.w, "ERR %s\n", message)
+	} else if sideband := s.sidebandLength(); sideband > 0 {
+		w := &sidebandWriter{w: s.w, band: sidebandError, maxLength: sideband}
+		fmt.Fprintf(w, "%s\n", message)
+	}
+	return err
+}
+
+// sidebandLength returns the maximum length of the sideband pkt-lines, or
+// zero if the client did not ask for a sideband.
+func (s *uploadPackSession) sidebandLength() int {
+	if s.capabilities["side-band-64k"] {
+		return pktLineMaxLength
+	}
+	if s.capabilities["side-band"] {
+		return 1000
+	}
+	return 0
+}
+
+// readWants reads the want lines of the client, up to the flush-pkt that
+// ends them. A client that disconnects or sends a flush-pkt right away does
+// not want anything.
+func (s *uploadPackSession) readWants() error {
+	for {
+		payload, typ, err := s.r.ReadPktLine()
+		if err == io.EOF && len(s.wants) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if typ == pktLineFlush {
+			return nil
+		}
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+
+		line := pktLineText(payload)
+		if len(s.wants) > 0 {
+			handled, err := s.readShallowLine(line)
+			if err != nil {
+				return err
+			}
+			if handled {
+				continue
+			}
+		}
+		if !strings.HasPrefix(line, "want ") {
+			return fmt.Errorf("upload-pack: protocol error, expected to get want, not '%s'", line)
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, "want "), " ", 2)
+		id, err := git.NewOid(fields[0])
+		if err != nil {
+			return fmt.Errorf("upload-pack: protocol error, expected to get object ID, not '%s'", line)
+		}
+		if len(s.wants) == 0 {
+			capabilities := ""
+			if len(fields) > 1 {
+				capabilities = fields[1]
+			}
+			s.capabilities = serverCapabilities(capabilities)
+		}
+		allowed, err := s.isWantAllowed(id)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("upload-pack: not our ref %s", id)
+		}
+		s.wants = append(s.wants, id)
+	}
+}
+
+// readShallowLine handles a line of the client that tells its shallow roots
+// or limits the history of the fetch. It returns false for other lines.
+func (s *uploadPackSession) readShallowLine(line string) (bool, error) {
+	switch {
+	case strings.HasPrefix(line, "shallow "):
+		id, err := git.NewOid(strings.TrimPrefix(line, "shallow "))
+		if err != nil {
+			return false, fmt.Errorf("upload-pack: invalid shallow line: %s", line)
+		}
+		s.clientShallow = append(s.clientShallow, id)
+
+	case strings.HasPrefix(line, "deepen "):
+		depth, err := strconv.Atoi(strings.TrimPrefix(line, "deepen "))
+		if err != nil || depth <= 0 {
+			return false, fmt.Errorf("upload-pack: invalid deepen: %s", line)
+		}
+		s.depth = depth
+
+	case strings.HasPrefix(line, "deepen-since "):
+		since, err := strconv.ParseInt(strings.TrimPrefix(line, "deepen-since "), 10, 64)
+		if err != nil || since <= 0 {
+			return false, fmt.Errorf("upload-pack: invalid deepen-since: %s", line)
+		}
+		s.deepenSince = since
+
+	case strings.HasPrefix(line, "deepen-not "):
+		s.deepenNot = append(s.deepenNot, strings.TrimPrefix(line, "deepen-not "))
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// isDeepening tells whether the client asked to limit the history of the
+// fetch.
+func (s *uploadPackSession) isDeepening() bool {
+	return s.depth > 0 || s.deepenSince > 0 || len(s.deepenNot) > 0
+}
+
+// sendShallowInfo computes the history of a shallow fetch, and tells the
+// client about the commits that become shallow roots and the shallow roots
+// it has that no longer are, in a section that ends with a flush-pkt.
+func (s *uploadPackSession) sendShallowInfo() error {
+	if s.isDeepening() {
+		if s.depth > 0 && (s.deepenSince > 0 || len(s.deepenNot) > 0) {
+			return errors.New("upload-pack: deepen and deepen-since (or deepen-not) cannot be used together")
+		}
+
+		commits, roots, err := s.shallowHistory()
+		if err != nil {
+			return err
+		}
+		s.shallowCommits = commits
+
+		clientShallow := make(map[git.Oid]bool)
+		for _, id := range s.clientShallow {
+			clientShallow[*id] = true
+		}
+		isRoot := make(map[git.Oid]bool)
+		for _, id := range roots {
+			isRoot[*id] = true
+			if clientShallow[*id] {
+				continue
+			}
+			if err := writePktLinef(s.w, "shallow %s\n", id); err != nil {
+				return err
+			}
+		}
+		for _, id := range s.clientShallow {
+			if !commits[*id] || isRoot[*id] {
+				continue
+			}
+			if err := writePktLinef(s.w, "unshallow %s\n", id); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := s.w.Write(pktFlush)
+	return err
+}
+
+// shallowHistory returns the commits of a shallow fetch, which are the
+// wanted commits and their ancestors that are within the requested depth,
+// made after the requested time and not reachable from the excluded refs.
+// The shallow roots are the ones among them with parents that are not.
+func (s *uploadPackSession) shallowHistory() (map[git.Oid]bool, []*git.Oid, error) {
+	excluded, err := s.excludedCommits()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type queued struct {
+		id    *git.Oid
+		depth int
+	}
+	commits := make(map[git.Oid]bool)
+	var queue []queued
+	for _, want := range s.wants {
+		obj, err := s.repo.Lookup(want)
+		if err != nil {
+			return nil, nil, err
+		}
+		peeled, err := obj.Peel(git.ObjectCommit)
+		obj.Free()
+		if err != nil {
+			// Wants that are not commits have no history.
+			continue
+		}
+		id := peeled.Id()
+		peeled.Free()
+		if commits[*id] || excluded[*id] {
+			continue
+		}
+		commits[*id] = true
+		queue = append(queue, queued{id: id, depth: 1})
+	}
+
+	// The commits are visited in breadth-first order, so that they are
+	// reached by their shortest path from a wanted commit.
+	var roots []*git.Oid
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+		if err := s.ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		commit, err := s.repo.LookupCommit(item.id)
+		if err != nil {
+			return nil, nil, err
+		}
+		root := false
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			parent := commit.ParentId(i)
+			if commits[*parent] {
+				continue
+			}
+			include, err := s.isInShallowHistory(parent, item.depth+1, excluded)
+			if err != nil {
+				commit.Free()
+				return nil, nil, err
+			}
+			if !include {
+				root = true
+				continue
+			}
+			commits[*parent] = true
+			queue = append(queue, queued{id: parent, depth: item.depth + 1})
+		}
+		commit.Free()
+		if root {
+			roots = append(roots, item.id)
+		}
+	}
+
+	if len(commits) == 0 {
+		return nil, nil, errors.New("upload-pack: no commits selected for shallow requests")
+	}
+	return commits, roots, nil
+}
+
+// isInShallowHistory tells whether the commit id, at the given distance
+// from a wanted commit, belongs to the history of a shallow fetch.
+func (s *uploadPackSession) isInShallowHistory(id *git.Oid, depth int, excluded map[git.Oid]bool) (bool, error) {
+	if s.depth > 0 && depth > s.depth {
+		return false, nil
+	}
+	if excluded[*id] || !s.odb.Exists(id) {
+		return false, nil
+	}
+	if s.deepenSince > 0 {
+		commit, err := s.repo.LookupCommit(id)
+		if err != nil {
+			return false, err
+		}
+		when := commit.Committer().When
+		commit.Free()
+		if when.Unix() < s.deepenSince {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// excludedCommits returns the commits that are reachable from the refs of
+// the deepen-not requests.
+func (s *uploadPackSession) excludedCommits() (map[git.Oid]bool, error) {
+	excluded := make(map[git.Oid]bool)
+	if len(s.deepenNot) == 0 {
+		return excluded, nil
+	}
+
+	walk, err := s.repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer walk.Free()
+	for _, name := range s.deepenNot {
+		ref, err := s.repo.References.Dwim(name)
+		if err != nil {
+			return nil, fmt.Errorf("upload-pack: unknown ref %s in deepen-not", name)
+		}
+		peeled, err := ref.Peel(git.ObjectCommit)
+		ref.Free()
+		if err != nil {
+			return nil, err
+		}
+		err = walk.Push(peeled.Id())
+		peeled.Free()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = walk.Iterate(func(commit *git.Commit) bool {
+		excluded[*commit.Id()] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return excluded, nil
+}
+
+// isWantAllowed tells whether the client may ask for id: it must be an
+// advertised tip, or a commit that is reachable from one.
+func (s *uploadPackSession) isWantAllowed(id *git.Oid) (bool, error) {
+	hex := id.String()
+	for _, ref := range s.refs {
+		if ref.id == hex || ref.peeled == hex {
+			return true, nil
+		}
+	}
+	if !s.odb.Exists(id) {
+		return false, nil
+	}
+	if _, otype, err := s.odb.ReadHeader(id); err != nil || otype != git.ObjectCommit {
+		return false, err
+	}
+
+	for _, ref := range s.refs {
+		tip := ref.id
+		if ref.peeled != "" {
+			tip = ref.peeled
+		}
+		tipID, err := git.NewOid(tip)
+		if err != nil {
+			return false, err
+		}
+		if _, otype, err := s.odb.ReadHeader(tipID); err != nil || otype != git.ObjectCommit {
+			continue
+		}
+		reachable, err := s.repo.DescendantOf(tipID, id)
+		if err != nil {
+			return false, err
+		}
+		if reachable {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// multiAck returns 2 if the client asked for multi_ack_detailed, 1 if it
+// asked for multi_ack, and 0 otherwise.
+func (s *uploadPackSession) multiAck() int {
+	if s.capabilities["multi_ack_detailed"] {
+		return 2
+	}
+	if s.capabilities["multi_ack"] {
+		return 1
+	}
+	return 0
+}
+
+// negotiate reads the haves of the client and acknowledges the common
+// ones, as git-upload-pack does, until the client is done. It returns
+// false if the client hung up, or if the single round of a stateless
+// request has been answered.
+func (s *uploadPackSession) negotiate() (bool, error) {
+	multiAck := s.multiAck()
+	var gotCommon, gotOther bool
+	var last *git.Oid
+
+	for {
+		payload, typ, err := s.r.ReadPktLine()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := s.ctx.Err(); err != nil {
+			return false, err
+		}
+
+		if typ == pktLineFlush {
+			if multiAck == 2 && gotCommon && !gotOther {
+				ready, err := s.okToGiveUp()
+				if err != nil {
+					return false, err
+				}
+				if ready {
+					if err := writePktLinef(s.w, "ACK %s ready\n", last); err != nil {
+						return false, err
+					}
+				}
+			}
+			if len(s.common) == 0 || multiAck > 0 {
+				if err := writePktLinef(s.w, "NAK\n"); err != nil {
+					return false, err
+				}
+			}
+			if s.opts.StatelessRPC {
+				return false, nil
+			}
+			gotCommon, gotOther = false, false
+			continue
+		}
+
+		line := pktLineText(payload)
+		switch {
+		case strings.HasPrefix(line, "have "):
+			id, err := git.NewOid(strings.TrimPrefix(line, "have "))
+			if err != nil {
+				return false, fmt.Errorf("upload-pack: expected SHA1 object, got '%s'", line)
+			}
+			if s.odb.Exists(id) {
+				s.addCommon(id)
+				gotCommon = true
+				last = id
+				switch {
+				case multiAck == 2:
+					err = writePktLinef(s.w, "ACK %s common\n", id)
+				case multiAck == 1:
+					err = writePktLinef(s.w, "ACK %s continue\n", id)
+				case len(s.common) == 1:
+					err = writePktLinef(s.w, "ACK %s\n", id)
+				}
+			} else {
+				gotOther = true
+				if multiAck > 0 {
+					var ready bool
+					ready, err = s.okToGiveUp()
+					if err == nil && ready {
+						if multiAck == 2 {
+							err = writePktLinef(s.w, "ACK %s ready\n", id)
+						} else {
+							err = writePktLinef(s.w, "ACK %s continue\n", id)
+						}
+					}
+				}
+			}
+			if err != nil {
+				return false, err
+			}
+
+		case line == "done":
+			if len(s.common) > 0 {
+				if multiAck > 0 {
+					return true, writePktLinef(s.w, "ACK %s\n", last)
+				}
+				return true, nil
+			}
+			return true, writePktLinef(s.w, "NAK\n")
+
+		default:
+			return false, fmt.Errorf("upload-pack: expected SHA1 list, got '%s'", line)
+		}
+	}
+}
+
+// addCommon records a have of the client that the repository has.
+func (s *uploadPackSession) addCommon(id *git.Oid) {
+	if s.commonSeen == nil {
+		s.commonSeen = make(map[git.Oid]bool)
+	}
+	if s.commonSeen[*id] {
+		return
+	}
+	s.commonSeen[*id] = true
+	s.common = append(s.common, id)
+}
+
+// okToGiveUp tells whether every wanted commit has a common commit as an
+// ancestor, in which case the client need not send more haves.
+func (s *uploadPackSession) okToGiveUp() (bool, error) {
+	if s.satisfied == nil {
+		s.satisfied = make(map[git.Oid]bool)
+	}
+	fresh := s.common[s.checked:]
+	s.checked = len(s.common)
+
+	ready := true
+	for _, want := range s.wants {
+		if s.satisfied[*want] {
+			continue
+		}
+		if _, otype, err := s.odb.ReadHeader(want); err != nil || otype != git.ObjectCommit {
+			s.satisfied[*want] = true
+			continue
+		}
+		for _, common := range fresh {
+			if _, otype, err := s.odb.ReadHeader(common); err != nil || otype != git.ObjectCommit {
+				continue
+			}
+			base, err := s.repo.MergeBase(want, common)
+			if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			if base.Equal(common) {
+				s.satisfied[*want] = true
+				break
+			}
+		}
+		if !s.satisfied[*want] {
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// newWantWalk returns a walk of the wanted commits that are not reachable
+// from the common ones.
+func (s *uploadPackSession) newWantWalk(commits []*git.Oid) (*git.RevWalk, error) {
+	walk, err := s.repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range commits {
+		if err := walk.Push(id); err != nil {
+			walk.Free()
+			return nil, err
+		}
+	}
+	for _, id := range s.common {
+		if _, otype, err := s.odb.ReadHeader(id); err != nil || otype != git.ObjectCommit {
+			continue
+		}
+		if err := walk.Hide(id); err != nil {
+			walk.Free()
+			return nil, err
+		}
+	}
+	return walk, nil
+}
+
+// sendPack builds the pack of the objects the client is missing and sends
+// it, on the data sideband if the client asked for one.
+func (s *uploadPackSession) sendPack() error {
+	pb, err := s.repo.NewPackbuilder()
+	if err != nil {
+		return err
+	}
+	defer pb.Free()
+
+	sideband := s.sidebandLength()
+	var out io.Writer = s.w
+	var progress io.Writer
+	if sideband > 0 {
+		out = &sidebandWriter{w: s.w, band: sidebandData, maxLength: sideband}
+		if !s.capabilities["no-progress"] {
+			progress = &sidebandWriter{w: s.w, band: sidebandProgress, maxLength: sideband}
+		}
+	}
+	if progress != nil {
+		if err := pb.SetCallbacks(newUploadPackProgress(s.ctx, progress)); err != nil {
+			return err
+		}
+	}
+
+	var commits []*git.Oid
+	for _, want := range s.wants {
+		obj, err := s.repo.Lookup(want)
+		if err != nil {
+			return err
+		}
+		if obj.Type() == git.ObjectTag {
+			if err := pb.Insert(want, ""); err != nil {
+				obj.Free()
+				return err
+			}
+			peeled, err := obj.Peel(git.ObjectAny)
+			obj.Free()
+			if err != nil {
+				return err
+			}
+			obj = peeled
+		}
+		switch obj.Type() {
+		case git.ObjectCommit:
+			commits = append(commits, obj.Id())
+		case git.ObjectTree:
+			err = pb.InsertTree(obj.Id())
+		default:
+			err = pb.Insert(obj.Id(), "")
+		}
+		obj.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	sent := make(map[git.Oid]bool)
+	if len(commits) > 0 && s.shallowCommits != nil {
+		if err := s.insertShallowCommits(pb, commits, sent); err != nil {
+			return err
+		}
+	} else if len(commits) > 0 {
+		if s.capabilities["include-tag"] {
+			walk, err := s.newWantWalk(commits)
+			if err != nil {
+				return err
+			}
+			err = walk.Iterate(func(commit *git.Commit) bool {
+				sent[*commit.Id()] = true
+				return true
+			})
+			walk.Free()
+			if err != nil {
+				return err
+			}
+		}
+
+		walk, err := s.newWantWalk(commits)
+		if err != nil {
+			return err
+		}
+		err = pb.InsertWalk(walk)
+		walk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.capabilities["include-tag"] {
+		for _, ref := range s.refs {
+			if ref.peeled == "" {
+				continue
+			}
+			target, err := git.NewOid(ref.peeled)
+			if err != nil {
+				return err
+			}
+			if !sent[*target] {
+				continue
+			}
+			tag, err := git.NewOid(ref.id)
+			if err != nil {
+				return err
+			}
+			if err := pb.Insert(tag, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	s.packStarted = true
+	if err := pb.Write(out); err != nil {
+		return err
+	}
+	if sideband > 0 {
+		if _, err := s.w.Write(pktFlush); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertShallowCommits inserts the commits of a shallow fetch into pb,
+// except those that are reachable from the common commits, and records
+// them in sent.
+func (s *uploadPackSession) insertShallowCommits(pb *git.Packbuilder, commits []*git.Oid, sent map[git.Oid]bool) error {
+	// The history the client is missing below its own shallow roots would
+	// be hidden by the common commits, so it gets every commit then.
+	if len(s.common) > 0 && len(s.clientShallow) == 0 {
+		walk, err := s.newWantWalk(commits)
+		if err != nil {
+			return err
+		}
+		defer walk.Free()
+		err = walk.Iterate(func(commit *git.Commit) bool {
+			if s.shallowCommits[*commit.Id()] {
+				sent[*commit.Id()] = true
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for id := range s.shallowCommits {
+			sent[id] = true
+		}
+	}
+
+	for id := range sent {
+		id := id
+		if err := pb.InsertCommit(&id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newUploadPackProgress returns a packbuilder callback that writes the
+// progress of the pack generation to w, in the manner of git.
+func newUploadPackProgress(ctx context.Context, w io.Writer) git.PackbuilderProgressCallback {
+	var lastStage int32 = -1
+	var lastPercent uint32
+	var lastUpdate time.Time
+	return func(stage int32, current, total uint32) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		title := "Counting objects"
+		if stage == git.PackbuilderDeltafication {
+			title = "Compressing objects"
+		}
+		if stage != lastStage {
+			lastStage = stage
+			lastPercent = 0
+			lastUpdate = time.Time{}
+		}
+
+		if total == 0 {
+			if current == 0 || time.Since(lastUpdate) < time.Second/10 {
+				return nil
+			}
+			lastUpdate = time.Now()
+			_, err := fmt.Fprintf(w, "%s: %d\r", title, current)
+			return err
+		}
+
+		percent := current * 100 / total
+		if percent == lastPercent && current != total && time.Since(lastUpdate) < time.Second {
+			return nil
+		}
+		lastPercent = percent
+		lastUpdate = time.Now()
+		end := "\r"
+		if current == total {
+			end = ", done.\n"
+		}
+		_, err := fmt.Fprintf(w, "%s: %3d%% (%d/%d)%s", title, percent, current, total, end)
+		return err
+	}
+}
@@ -0,0 +1,559 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrShallowRepository is returned when fetching into a shallow repository
+// without FetchOptions.Unshallow or a limit on the history. libgit2
+// negotiates a fetch by walking the history of the local refs, which fails
+// at the missing parents of the shallow roots.
+var ErrShallowRepository = errors.New("cannot fetch into a shallow repository without unshallowing it")
+
+// ShallowRoots returns the shallow roots of the repository, which are the
+// commits whose parents are missing from its history. It returns an empty
+// list if the repository is not shallow.
+func (v *Repository) ShallowRoots() ([]*Oid, error) {
+	hexes, err := readShallowFile(v.shallowFilePath())
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]*Oid, 0, len(hexes))
+	for _, hex := range hexes {
+		id, err := NewOid(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shallow root %q", hex)
+		}
+		roots = append(roots, id)
+	}
+	return roots, nil
+}
+
+func (v *Repository) shallowFilePath() string {
+	return filepath.Join(v.Path(), "shallow")
+}
+
+// readShallowFile returns the object ids listed in a shallow file, or none if
+// it does not exist.
+func readShallowFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hexes []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			hexes = append(hexes, line)
+		}
+	}
+	return hexes, nil
+}
+
+// writeShallowFile replaces the shallow file at path with the sorted object
+// ids, or removes it if there are none, which makes the repository complete.
+func writeShallowFile(path string, hexes []string) error {
+	if len(hexes) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sort.Strings(hexes)
+	lockPath := path + ".lock"
+	if err := ioutil.WriteFile(lockPath, []byte(strings.Join(hexes, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(lockPath, path); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return nil
+}
+
+// shallowFetch is a fetch that limits the history it downloads, which the
+// managed transports request from the server on behalf of libgit2. It
+// collects the changes to the shallow roots that the server announces.
+type shallowFetch struct {
+	depth   int
+	since   time.Time
+	exclude []string
+	// roots are the shallow roots of the repository that is fetched into,
+	// and haves the tips of its refs, if it is shallow. libgit2 does not
+	// send either, as it fetches into a repository without history.
+	roots []string
+	haves []string
+
+	mu        sync.Mutex
+	shallow   map[string]bool
+	unshallow map[string]bool
+}
+
+// newShallowFetch returns the shallow fetch requested by opts, or nil if it
+// does not limit the history.
+func newShallowFetch(opts *FetchOptions) (*shallowFetch, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	if opts.Depth < 0 {
+		return nil, fmt.Errorf("invalid depth %d", opts.Depth)
+	}
+	if opts.Depth == 0 && opts.ShallowSince.IsZero() && len(opts.ShallowExclude) == 0 {
+		return nil, nil
+	}
+	if opts.Unshallow {
+		return nil, errors.New("Unshallow cannot be combined with Depth, ShallowSince or ShallowExclude")
+	}
+
+	return &shallowFetch{
+		depth:     opts.Depth,
+		since:     opts.ShallowSince,
+		exclude:   opts.ShallowExclude,
+		shallow:   make(map[string]bool),
+		unshallow: make(map[string]bool),
+	}, nil
+}
+
+// capabilities returns the capabilities to add to the first want line.
+func (f *shallowFetch) capabilities() string {
+	var capabilities string
+	if !f.since.IsZero() {
+		capabilities += " deepen-since"
+	}
+	if len(f.exclude) > 0 {
+		capabilities += " deepen-not"
+	}
+	return capabilities
+}
+
+// appendRequest appends the pkt-lines that limit the history to the want
+// lines of a request.
+func (f *shallowFetch) appendRequest(request []byte) []byte {
+	for _, root := range f.roots {
+		request = appendPktLine(request, "shallow "+root+"\n")
+	}
+	if f.depth > 0 {
+		request = appendPktLine(request, "deepen "+strconv.Itoa(f.depth)+"\n")
+	}
+	if !f.since.IsZero() {
+		request = appendPktLine(request, "deepen-since "+strconv.FormatInt(f.since.Unix(), 10)+"\n")
+	}
+	for _, ref := range f.exclude {
+		request = appendPktLine(request, "deepen-not "+ref+"\n")
+	}
+	return request
+}
+
+// record takes note of a "shallow <id>" or "unshallow <id>" line of the
+// server. It returns false if line is neither.
+func (f *shallowFetch) record(line string) (bool, error) {
+	var hex string
+	var add bool
+	switch {
+	case strings.HasPrefix(line, "shallow "):
+		hex, add = line[len("shallow "):], true
+	case strings.HasPrefix(line, "unshallow "):
+		hex = line[len("unshallow "):]
+	default:
+		return false, nil
+	}
+	if _, err := NewOid(hex); err != nil {
+		return false, fmt.Errorf("invalid shallow line %q", line)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if add {
+		f.shallow[hex] = true
+		delete(f.unshallow, hex)
+	} else {
+		f.unshallow[hex] = true
+		delete(f.shallow, hex)
+	}
+	return true, nil
+}
+
+// update applies the changes to the shallow roots that the server announced
+// to the shallow file of repo.
+func (f *shallowFetch) update(repo *Repository) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.shallow) == 0 && len(f.unshallow) == 0 {
+		return nil
+	}
+
+	path := repo.shallowFilePath()
+	hexes, err := readShallowFile(path)
+	if err != nil {
+		return err
+	}
+	roots := make(map[string]bool)
+	for _, hex := range hexes {
+		roots[hex] = !f.unshallow[hex]
+	}
+	for hex := range f.shallow {
+		roots[hex] = true
+	}
+
+	hexes = hexes[:0]
+	for hex, keep := range roots {
+		if keep {
+			hexes = append(hexes, hex)
+		}
+	}
+	return writeShallowFile(path, hexes)
+}
+
+// shallowStream adds the requests of a shallow fetch to the upload-pack
+// requests that libgit2 writes to a stream, and takes the shallow-info
+// sections out of the responses before libgit2 reads them.
+type shallowStream struct {
+	underlying SmartSubtransportStream
+	fetch      *shallowFetch
+	r          *bufio.Reader
+
+	// request holds what libgit2 has written of a pkt-line that is not
+	// complete yet.
+	request bytes.Buffer
+	inWants bool
+	// pending is the number of shallow-info sections that the server has
+	// yet to send.
+	pending  int
+	response []byte
+}
+
+func newShallowStream(underlying SmartSubtransportStream, fetch *shallowFetch) *shallowStream {
+	return &shallowStream{
+		underlying: underlying,
+		fetch:      fetch,
+		r:          bufio.NewReaderSize(underlying, pktLineMaxLength),
+	}
+}
+
+func (s *shallowStream) Write(buf []byte) (int, error) {
+	s.request.Write(buf)
+
+	var out []byte
+	for {
+		payload, typ, ok, err := nextBufferedPktLine(&s.request)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+
+		switch typ {
+		case pktLineFlush:
+			// The flush-pkt that ends the want lines is preceded by the
+			// requests of the shallow fetch, which the server answers
+			// with a shallow-info section.
+			if s.inWants {
+				s.inWants = false
+				out = s.fetch.appendRequest(out)
+				s.pending++
+			}
+			out = append(out, pktFlush...)
+		case pktLineDelim:
+			out = append(out, pktDelim...)
+		case pktLineResponseEnd:
+			out = append(out, pktResponseEnd...)
+		default:
+			line := string(payload)
+			if strings.HasPrefix(line, "want ") && !s.inWants {
+				s.inWants = true
+				line = strings.TrimSuffix(line, "\n") + s.fetch.capabilities() + "\n"
+			}
+			if pktLineText(payload) == "done" {
+				for _, have := range s.fetch.haves {
+					out = appendPktLine(out, "have "+have+"\n")
+				}
+			}
+			out = appendPktLine(out, line)
+		}
+	}
+
+	if len(out) > 0 {
+		if _, err := s.underlying.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+func (s *shallowStream) Read(buf []byte) (int, error) {
+	for len(s.response) == 0 && s.pending > 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(s.response) > 0 {
+		n := copy(buf, s.response)
+		s.response = s.response[n:]
+		return n, nil
+	}
+	return s.r.Read(buf)
+}
+
+// next reads the next pkt-line of the response while a shallow-info
+// section is expected. The lines of the section are recorded, and the
+// others are left for libgit2.
+func (s *shallowStream) next() error {
+	header, err := s.r.Peek(4)
+	if err != nil {
+		// The error is reported by the next read.
+		s.pending = 0
+		return nil
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		// Not a pkt-line: the pack is sent without a sideband.
+		s.pending = 0
+		return nil
+	}
+
+	switch {
+	case length == 0:
+		// The flush-pkt that ends the shallow-info section, which is all
+		// there is of it if the roots do not change.
+		s.pending--
+		_, err = s.r.Discard(4)
+		return err
+	case length < 4:
+		s.response = append(s.response, header...)
+		_, err = s.r.Discard(4)
+		return err
+	case length > pktLineMaxLength:
+		s.pending = 0
+		return nil
+	}
+
+	line, err := s.r.Peek(int(length))
+	if err != nil {
+		s.pending = 0
+		return nil
+	}
+	payload := line[4:]
+	if len(payload) > 0 && payload[0] <= sidebandError {
+		// The sideband of the pack has started, so the server does not
+		// send any more sections.
+		s.pending = 0
+		return nil
+	}
+	recorded, err := s.fetch.record(pktLineText(payload))
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		s.response = append(s.response, line...)
+	}
+	_, err = s.r.Discard(len(line))
+	return err
+}
+
+func (s *shallowStream) Free() {
+}
+
+// unshallow completes the history of repo, which is shallow, with the
+// history of the refs that refspecs fetch from the remote. As libgit2 cannot
+// negotiate from a shallow history, the objects are fetched into a
+// temporary repository that has none but has the configuration of repo,
+// and its packs are moved into repo. The shallow roots whose parents are
+// then all present are removed.
+func (o *Remote) unshallow(ctx context.Context, repo *Repository, refspecs []string, opts *FetchOptions) error {
+	dir, err := ioutil.TempDir(repo.Path(), "unshallow-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := InitRepository(dir, true)
+	if err != nil {
+		return err
+	}
+	defer tmp.Free()
+
+	remote, err := o.remoteIn(repo, tmp)
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+
+	tmpOpts := *opts
+	tmpOpts.Unshallow = false
+	tmpOpts.UpdateFetchhead = false
+	tmpOpts.Prune = FetchNoPrune
+	if err := remote.FetchContext(ctx, refspecs, &tmpOpts, ""); err != nil {
+		return err
+	}
+
+	if err := movePacks(tmp, repo); err != nil {
+		return err
+	}
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+
+	roots, err := repo.ShallowRoots()
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, root := range roots {
+		complete, err := hasParents(repo, odb, root)
+		if err != nil {
+			return err
+		}
+		if !complete {
+			remaining = append(remaining, root.String())
+		}
+	}
+	return writeShallowFile(repo.shallowFilePath(), remaining)
+}
+
+// fetchIntoShallow fetches the objects of a shallow fetch into repo, which
+// is shallow. As libgit2 cannot negotiate from a shallow history, they are
+// fetched into a temporary repository that borrows the objects and the
+// configuration of repo but has no refs, so that libgit2 has no history to
+// walk. The shallow roots of repo and the tips of its refs are sent to the
+// server on its behalf, so that only the missing objects are sent. The
+// packs of the temporary repository are then moved into repo, and the
+// shallow roots are updated. It returns the totals of the transfer.
+func (o *Remote) fetchIntoShallow(ctx context.Context, repo *Repository, refspecs []string, opts *FetchOptions, shallow *shallowFetch) (TransferProgress, error) {
+	roots, err := readShallowFile(repo.shallowFilePath())
+	if err != nil {
+		return TransferProgress{}, err
+	}
+	haves, err := referenceTips(repo)
+	if err != nil {
+		return TransferProgress{}, err
+	}
+	shallow.roots = roots
+	shallow.haves = haves
+
+	dir, err := ioutil.TempDir(repo.Path(), "shallow-")
+	if err != nil {
+		return TransferProgress{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := newBorrowingRepository(repo, dir)
+	if err != nil {
+		return TransferProgress{}, err
+	}
+	defer tmp.Free()
+
+	remote, err := o.remoteIn(repo, tmp)
+	if err != nil {
+		return TransferProgress{}, err
+	}
+	defer remote.Free()
+
+	tmpOpts := *opts
+	tmpOpts.UpdateFetchhead = false
+	tmpOpts.Prune = FetchNoPrune
+	fetch := &fetchState{}
+	if err := remote.download(ctx, refspecs, refspecs, &tmpOpts, "", shallow, fetch); err != nil {
+		return TransferProgress{}, err
+	}
+
+	if err := movePacks(tmp, repo); err != nil {
+		return TransferProgress{}, err
+	}
+	if err := shallow.update(repo); err != nil {
+		return TransferProgress{}, err
+	}
+	return fetch.stats, nil
+}
+
+// referenceTips returns the distinct objects that the direct refs of repo
+// point to.
+func referenceTips(repo *Repository) ([]string, error) {
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+
+	var tips []string
+	seen := make(map[string]bool)
+	for {
+		ref, err := iter.Next()
+		if IsErrorCode(err, ErrorCodeIterOver) {
+			return tips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ref.Type() == ReferenceOid {
+			if tip := ref.Target().String(); !seen[tip] {
+				seen[tip] = true
+				tips = append(tips, tip)
+			}
+		}
+		ref.Free()
+	}
+}
+
+// movePacks moves the packs of src into dst, and makes the object database
+// of dst find them.
+func movePacks(src, dst *Repository) error {
+	packs, err := filepath.Glob(filepath.Join(src.Path(), "objects", "pack", "pack-*"))
+	if err != nil {
+		return err
+	}
+	// A pack is only found through its index, which is moved last.
+	sort.SliceStable(packs, func(i, j int) bool {
+		return !strings.HasSuffix(packs[i], ".idx") && strings.HasSuffix(packs[j], ".idx")
+	})
+	for _, pack := range packs {
+		if err := os.Rename(pack, filepath.Join(dst.Path(), "objects", "pack", filepath.Base(pack))); err != nil {
+			return err
+		}
+	}
+
+	odb, err := dst.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+	return odb.Refresh()
+}
+
+// hasParents tells whether the parents of the commit id are all present in
+// odb.
+func hasParents(repo *Repository, odb *Odb, id *Oid) (bool, error) {
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		return false, err
+	}
+	defer commit.Free()
+
+	for i := uint(0); i < commit.ParentCount(); i++ {
+		if !odb.Exists(commit.ParentId(i)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
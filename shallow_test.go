@@ -0,0 +1,318 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSubtransportStream records what is written to it, and replies with a
+// canned response.
+type fakeSubtransportStream struct {
+	written  bytes.Buffer
+	response *bytes.Reader
+}
+
+func (s *fakeSubtransportStream) Read(buf []byte) (int, error) {
+	return s.response.Read(buf)
+}
+
+func (s *fakeSubtransportStream) Write(buf []byte) (int, error) {
+	return s.written.Write(buf)
+}
+
+func (s *fakeSubtransportStream) Free() {
+}
+
+func TestShallowStream(t *testing.T) {
+	t.Parallel()
+
+	fetch, err := newShallowFetch(&FetchOptions{
+		Depth:          1,
+		ShallowSince:   time.Unix(1500000000, 0),
+		ShallowExclude: []string{"main"},
+	})
+	checkFatal(t, err)
+	underlying := &fakeSubtransportStream{
+		response: bytes.NewReader([]byte(pktLines(
+			"shallow "+testCommitID+"\n",
+			"unshallow "+testTagID+"\n",
+			"0000",
+			"NAK\n",
+			"\x01PACK",
+			"0000",
+		))),
+	}
+	stream := newShallowStream(underlying, fetch)
+
+	// libgit2 may write a pkt-line in several pieces.
+	request := pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k\n",
+		"want "+testTagID+"\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"0000",
+	)
+	for i := 0; i < len(request); i += 7 {
+		end := i + 7
+		if end > len(request) {
+			end = len(request)
+		}
+		n, err := stream.Write([]byte(request[i:end]))
+		checkFatal(t, err)
+		if n != end-i {
+			t.Fatalf("Write() = %d, want %d", n, end-i)
+		}
+	}
+
+	expectedRequest := pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k deepen-since deepen-not\n",
+		"want "+testTagID+"\n",
+		"deepen 1\n",
+		"deepen-since 1500000000\n",
+		"deepen-not main\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"0000",
+	)
+	if underlying.written.String() != expectedRequest {
+		t.Errorf("request = %q, want %q", underlying.written.String(), expectedRequest)
+	}
+
+	response, err := ioutil.ReadAll(stream)
+	checkFatal(t, err)
+	if expected := pktLines("NAK\n", "\x01PACK", "0000"); string(response) != expected {
+		t.Errorf("response = %q, want %q", response, expected)
+	}
+	if !reflect.DeepEqual(fetch.shallow, map[string]bool{testCommitID: true}) {
+		t.Errorf("shallow = %v, want %s", fetch.shallow, testCommitID)
+	}
+	if !reflect.DeepEqual(fetch.unshallow, map[string]bool{testTagID: true}) {
+		t.Errorf("unshallow = %v, want %s", fetch.unshallow, testTagID)
+	}
+}
+
+func TestShallowStreamFromShallowRepository(t *testing.T) {
+	t.Parallel()
+
+	fetch, err := newShallowFetch(&FetchOptions{Depth: 1})
+	checkFatal(t, err)
+	fetch.roots = []string{testTagID}
+	fetch.haves = []string{testTagID}
+	underlying := &fakeSubtransportStream{response: bytes.NewReader(nil)}
+	stream := newShallowStream(underlying, fetch)
+
+	// libgit2 has no history to send haves from.
+	_, err = stream.Write([]byte(pktLines(
+		"want "+testCommitID+" multi_ack_detailed\n",
+		"0000",
+		"done\n",
+	)))
+	checkFatal(t, err)
+
+	expectedRequest := pktLines(
+		"want "+testCommitID+" multi_ack_detailed\n",
+		"shallow "+testTagID+"\n",
+		"deepen 1\n",
+		"0000",
+		"have "+testTagID+"\n",
+		"done\n",
+	)
+	if underlying.written.String() != expectedRequest {
+		t.Errorf("request = %q, want %q", underlying.written.String(), expectedRequest)
+	}
+}
+
+func TestProtocolV2ShallowFetch(t *testing.T) {
+	t.Parallel()
+
+	conn := &fakeProtocolV2Conn{
+		responses: []string{pktLines(
+			"shallow-info\n",
+			"shallow "+testCommitID+"\n",
+			"0001",
+			"packfile\n",
+			"\x01PACK",
+			"0000",
+		)},
+	}
+	session := newProtocolV2Session(conn, map[string]string{"fetch": "shallow"}, false, nil)
+
+	stream := session.newStream(false)
+	stream.Write([]byte(pktLines(
+		"want "+testCommitID+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git2go\n",
+		"deepen 1\n",
+		"0000",
+		"done\n",
+	)))
+	reply, err := ioutil.ReadAll(stream)
+	checkFatal(t, err)
+
+	expectedRequest := pktLines(
+		"command=fetch\n",
+		"0001",
+		"thin-pack\n",
+		"ofs-delta\n",
+		"want "+testCommitID+"\n",
+		"deepen 1\n",
+		"done\n",
+		"0000",
+	)
+	if len(conn.requests) != 1 || conn.requests[0] != expectedRequest {
+		t.Errorf("requests = %q, want %q", conn.requests, expectedRequest)
+	}
+	expectedReply := pktLines(
+		"shallow "+testCommitID+"\n",
+		"0000",
+		"NAK\n",
+		"\x01PACK",
+		"0000",
+	)
+	if string(reply) != expectedReply {
+		t.Errorf("reply = %q, want %q", reply, expectedReply)
+	}
+}
+
+func TestShallowClone(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstID, _ := seedTestRepo(t, serverRepo)
+	secondID, _ := updateReadme(t, serverRepo, "second")
+	headID, _ := updateReadme(t, serverRepo, "third")
+
+	daemon := startTestGitDaemon(t, serverRepo)
+	defer daemon.listener.Close()
+	registeredSmartTransport, err := RegisterManagedGitTransport("gitshallow")
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+	repo, err := Clone(fmt.Sprintf("gitshallow://%s/repo.git", daemon.listener.Addr()), path, &CloneOptions{
+		FetchOptions: FetchOptions{Depth: 2},
+	})
+	checkFatal(t, err)
+	defer repo.Free()
+
+	isShallow, err := repo.IsShallow()
+	checkFatal(t, err)
+	if !isShallow {
+		t.Fatal("the clone is not shallow")
+	}
+	roots, err := repo.ShallowRoots()
+	checkFatal(t, err)
+	if len(roots) != 1 || !roots[0].Equal(secondID) {
+		t.Errorf("shallow roots = %v, want %v", roots, secondID)
+	}
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	if !odb.Exists(headID) || !odb.Exists(secondID) || odb.Exists(firstID) {
+		t.Errorf("the clone does not have the history of depth 2")
+	}
+
+	remote, err := repo.Remotes.Lookup("origin")
+	checkFatal(t, err)
+	defer remote.Free()
+	if err := remote.Fetch(nil, nil, ""); err != ErrShallowRepository {
+		t.Errorf("Fetch() = %v, want %v", err, ErrShallowRepository)
+	}
+
+	// Fetches that limit the history can go on in the shallow clone.
+	newHeadID, _ := updateReadme(t, serverRepo, "fourth")
+	result, err := remote.FetchWithResult(nil, &FetchOptions{Depth: 1}, "")
+	checkFatal(t, err)
+	if len(result.Refs) != 1 || !result.Refs[0].NewId.Equal(newHeadID) {
+		t.Errorf("unexpected fetch result: %+v", result.Refs)
+	}
+	checkFatal(t, odb.Refresh())
+	if !odb.Exists(newHeadID) || odb.Exists(firstID) {
+		t.Errorf("the fetch did not get exactly the new commit")
+	}
+	roots, err = repo.ShallowRoots()
+	checkFatal(t, err)
+	if len(roots) != 2 || !(roots[0].Equal(secondID) && roots[1].Equal(newHeadID) || roots[0].Equal(newHeadID) && roots[1].Equal(secondID)) {
+		t.Errorf("shallow roots = %v, want %v and %v", roots, secondID, newHeadID)
+	}
+
+	checkFatal(t, remote.Fetch(nil, &FetchOptions{Unshallow: true}, ""))
+	isShallow, err = repo.IsShallow()
+	checkFatal(t, err)
+	if isShallow {
+		t.Error("the repository is still shallow")
+	}
+	checkFatal(t, odb.Refresh())
+	if !odb.Exists(firstID) {
+		t.Error("the repository does not have the complete history")
+	}
+}
+
+func TestShallowFetchKeepsConfiguration(t *testing.T) {
+	t.Parallel()
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	firstID, _ := seedTestRepo(t, serverRepo)
+	updateReadme(t, serverRepo, "second")
+
+	// The server only answers the requests that carry the extra header of
+	// the configuration.
+	backend := newTestHTTPBackend(t, serverRepo)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "missing token", http.StatusForbidden)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+	config, err := repo.Config()
+	checkFatal(t, err)
+	defer config.Free()
+	checkFatal(t, config.SetString("http.extraheader", "X-Token: secret"))
+	remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	checkFatal(t, remote.Fetch(nil, &FetchOptions{Depth: 1}, ""))
+	isShallow, err := repo.IsShallow()
+	checkFatal(t, err)
+	if !isShallow {
+		t.Fatal("the repository is not shallow")
+	}
+
+	// Fetching into the shallow repository and unshallowing it go through
+	// a temporary repository, which must send the header too.
+	thirdID, _ := updateReadme(t, serverRepo, "third")
+	checkFatal(t, remote.Fetch(nil, &FetchOptions{Depth: 1}, ""))
+	odb, err := repo.Odb()
+	checkFatal(t, err)
+	defer odb.Free()
+	checkFatal(t, odb.Refresh())
+	if !odb.Exists(thirdID) {
+		t.Error("the shallow fetch did not get the new commit")
+	}
+
+	checkFatal(t, remote.Fetch(nil, &FetchOptions{Unshallow: true}, ""))
+	isShallow, err = repo.IsShallow()
+	checkFatal(t, err)
+	if isShallow {
+		t.Error("the repository is still shallow")
+	}
+	checkFatal(t, odb.Refresh())
+	if !odb.Exists(firstID) {
+		t.Error("the repository does not have the complete history")
+	}
+}
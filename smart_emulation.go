@@ -0,0 +1,312 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// managedTransportAgent is the agent that the managed transports announce to
+// the servers.
+const managedTransportAgent = "git2go"
+
+// protocolV0Capabilities are the capabilities presented to libgit2 when the
+// managed transports answer on behalf of a server that does not speak
+// protocol v0 itself. Such servers do not say whether they accept wants of
+// objects that are not advertised, so libgit2 is allowed to ask, and the
+// server refuses if it does not.
+const protocolV0Capabilities = "multi_ack_detailed side-band-64k ofs-delta thin-pack include-tag no-progress allow-reachable-sha1-in-want agent=" + managedTransportAgent
+
+// advertisedRef is a reference advertised by the server.
+type advertisedRef struct {
+	id           string
+	name         string
+	symrefTarget string
+	peeled       string
+}
+
+// buildAdvertisement builds the protocol v0 ref advertisement for refs. If
+// serviceHeader is set, it starts with the smart HTTP service header.
+func buildAdvertisement(serviceHeader bool, refs []advertisedRef) []byte {
+	capabilities := protocolV0Capabilities
+	for _, ref := range refs {
+		if ref.symrefTarget != "" {
+			capabilities += " symref=" + ref.name + ":" + ref.symrefTarget
+		}
+	}
+
+	var advertisement []byte
+	if serviceHeader {
+		advertisement = appendPktLine(advertisement, "# service=git-upload-pack\n")
+		advertisement = append(advertisement, pktFlush...)
+	}
+	if len(refs) == 0 {
+		advertisement = appendPktLine(advertisement, (&Oid{}).String()+" capabilities^{}\x00"+capabilities+"\n")
+	}
+	for i, ref := range refs {
+		line := ref.id + " " + ref.name
+		if i == 0 {
+			line += "\x00" + capabilities
+		}
+		advertisement = appendPktLine(advertisement, line+"\n")
+		if ref.peeled != "" {
+			advertisement = appendPktLine(advertisement, ref.peeled+" "+ref.name+"^{}\n")
+		}
+	}
+	return append(advertisement, pktFlush...)
+}
+
+// remoteHeadsFromAdvertisedRefs converts refs into the form returned by
+// git_remote_ls, where peeled tags are listed as separate "^{}" entries.
+func remoteHeadsFromAdvertisedRefs(refs []advertisedRef) ([]RemoteHead, error) {
+	var heads []RemoteHead
+	for _, ref := range refs {
+		id, err := NewOid(ref.id)
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, RemoteHead{Id: id, Name: ref.name})
+		if ref.peeled != "" {
+			peeled, err := NewOid(ref.peeled)
+			if err != nil {
+				return nil, err
+			}
+			heads = append(heads, RemoteHead{Id: peeled, Name: ref.name + "^{}"})
+		}
+	}
+	return heads, nil
+}
+
+// uploadPackEmulator answers the protocol v0 upload-pack requests of libgit2
+// on behalf of a server that does not speak that protocol.
+type uploadPackEmulator interface {
+	// advertisement returns the protocol v0 ref advertisement.
+	advertisement() ([]byte, error)
+	// fetchNegotiation returns the state of the fetch in progress.
+	fetchNegotiation() *fetchNegotiation
+	// acknowledge sends the haves of a negotiation round to the server, and
+	// returns those that it has. Until some are acknowledged, libgit2 keeps
+	// sending older haves.
+	acknowledge(haves []string) ([]string, error)
+	// fetch sends the packfile for the negotiated fetch, framed as the
+	// protocol v0 response that follows "done", and resets the negotiation.
+	fetch() (io.Reader, error)
+}
+
+// fetchNegotiation accumulates the wants and haves that libgit2 sends. It
+// may span several streams in stateless connections.
+type fetchNegotiation struct {
+	// capabilities are the capabilities requested in the first want line.
+	capabilities []string
+	wants        []string
+	// common are the haves that the server acknowledged.
+	common []string
+	// roundHaves are the haves sent since the last acknowledgments.
+	roundHaves []string
+	// inRound is set once libgit2 has sent haves since the last flush.
+	inRound bool
+	// shallow holds the shallow and deepen lines that limit the history.
+	shallow []string
+	seen    map[string]bool
+}
+
+func (n *fetchNegotiation) reset() {
+	n.capabilities = nil
+	n.wants = nil
+	n.common = nil
+	n.roundHaves = nil
+	n.inRound = false
+	n.shallow = nil
+	n.seen = make(map[string]bool)
+}
+
+// haves returns the haves to send to the server along with the wants: the
+// acknowledged ones, and those of the current round.
+func (n *fetchNegotiation) haves() []string {
+	haves := make([]string, 0, len(n.common)+len(n.roundHaves))
+	haves = append(haves, n.common...)
+	return append(haves, n.roundHaves...)
+}
+
+// handleRequest consumes the complete pkt-lines that libgit2 has written so
+// far and returns what the server would have replied to them in protocol v0.
+// It returns a nil reader if no reply is due.
+func (n *fetchNegotiation) handleRequest(request *bytes.Buffer, emulator uploadPackEmulator) (io.Reader, error) {
+	var reply []byte
+	for {
+		payload, typ, ok, err := nextBufferedPktLine(request)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		if typ == pktLineFlush {
+			// A flush after a batch of haves asks for the acknowledgments.
+			// libgit2 stops sending haves once some are common.
+			if !n.inRound {
+				continue
+			}
+			n.inRound = false
+			if len(n.roundHaves) > 0 {
+				acks, err := emulator.acknowledge(n.haves())
+				if err != nil {
+					return nil, err
+				}
+				n.roundHaves = nil
+				for _, id := range acks {
+					if !n.seen["common "+id] {
+						n.seen["common "+id] = true
+						n.common = append(n.common, id)
+					}
+					reply = appendPktLine(reply, "ACK "+id+" common\n")
+				}
+			}
+			reply = appendPktLine(reply, "NAK\n")
+			continue
+		}
+		if typ != pktLineData {
+			return nil, errors.New("unexpected pkt-line in fetch request")
+		}
+
+		line := pktLineText(payload)
+		switch {
+		case strings.HasPrefix(line, "want "):
+			fields := strings.Fields(line[len("want "):])
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("invalid want line %q", line)
+			}
+			if len(n.wants) == 0 {
+				n.capabilities = fields[1:]
+			}
+			if !n.seen["want "+fields[0]] {
+				n.seen["want "+fields[0]] = true
+				n.wants = append(n.wants, fields[0])
+			}
+
+		case strings.HasPrefix(line, "have "):
+			id := strings.TrimSpace(line[len("have "):])
+			if !n.seen["have "+id] {
+				n.seen["have "+id] = true
+				n.roundHaves = append(n.roundHaves, id)
+			}
+			n.inRound = true
+
+		case strings.HasPrefix(line, "shallow "), strings.HasPrefix(line, "deepen "),
+			strings.HasPrefix(line, "deepen-since "), strings.HasPrefix(line, "deepen-not "):
+			if !n.seen[line] {
+				n.seen[line] = true
+				n.shallow = append(n.shallow, line)
+			}
+
+		case line == "done":
+			response, err := emulator.fetch()
+			if err != nil {
+				return nil, err
+			}
+			if len(reply) == 0 {
+				return response, nil
+			}
+			return io.MultiReader(bytes.NewReader(reply), response), nil
+
+		default:
+			return nil, fmt.Errorf("unexpected line in fetch request: %q", line)
+		}
+	}
+
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	return bytes.NewReader(reply), nil
+}
+
+// nextBufferedPktLine consumes the next pkt-line from buf if it has been
+// completely written.
+func nextBufferedPktLine(buf *bytes.Buffer) ([]byte, pktLineType, bool, error) {
+	if buf.Len() < 4 {
+		return nil, pktLineData, false, nil
+	}
+	length, err := strconv.ParseUint(string(buf.Bytes()[:4]), 16, 16)
+	if err != nil {
+		return nil, pktLineData, false, errInvalidPktLine
+	}
+	switch length {
+	case 0, 1, 2:
+		buf.Next(4)
+		return nil, pktLineType(length + 1), true, nil
+	case 3:
+		return nil, pktLineData, false, errInvalidPktLine
+	}
+	if buf.Len() < int(length) {
+		return nil, pktLineData, false, nil
+	}
+	buf.Next(4)
+	payload := append([]byte(nil), buf.Next(int(length)-4)...)
+	return payload, pktLineData, true, nil
+}
+
+// emulatedUploadPackStream presents an uploadPackEmulator to libgit2 as a
+// protocol v0 stream.
+type emulatedUploadPackStream struct {
+	emulator  uploadPackEmulator
+	advertise bool
+	request   bytes.Buffer
+	response  io.Reader
+}
+
+// newEmulatedUploadPackStream creates a stream for the emulator. If
+// advertise is set, the stream starts with the ref advertisement.
+func newEmulatedUploadPackStream(emulator uploadPackEmulator, advertise bool) *emulatedUploadPackStream {
+	return &emulatedUploadPackStream{
+		emulator:  emulator,
+		advertise: advertise,
+	}
+}
+
+func (s *emulatedUploadPackStream) Read(buf []byte) (int, error) {
+	for {
+		if s.response == nil {
+			if s.advertise {
+				s.advertise = false
+				advertisement, err := s.emulator.advertisement()
+				if err != nil {
+					return 0, err
+				}
+				s.response = bytes.NewReader(advertisement)
+			} else {
+				response, err := s.emulator.fetchNegotiation().handleRequest(&s.request, s.emulator)
+				if err != nil {
+					return 0, err
+				}
+				if response == nil {
+					return 0, io.EOF
+				}
+				s.response = response
+			}
+		}
+
+		n, err := s.response.Read(buf)
+		if err == io.EOF {
+			s.response = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *emulatedUploadPackStream) Write(buf []byte) (int, error) {
+	return s.request.Write(buf)
+}
+
+func (s *emulatedUploadPackStream) Free() {
+	if closer, ok := s.response.(io.Closer); ok {
+		closer.Close()
+	}
+}
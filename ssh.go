@@ -7,6 +7,9 @@ package git
 */
 import "C"
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -16,20 +19,71 @@ import (
 	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // RegisterManagedSSHTransport registers a Go-native implementation of an SSH
 // transport that doesn't rely on any system libraries (e.g. libssh2).
 //
+// Connections go through the SOCKS5 or HTTP proxy of the proxy options of
+// an operation, unless a proxy command or jump hosts are configured for the
+// host. With ProxyTypeAuto, the proxy is taken from the ALL_PROXY
+// environment variable. The NO_PROXY environment variable is honored.
+//
 // If Shutdown or ReInit are called, make sure that the smart transports are
 // freed before it.
 func RegisterManagedSSHTransport(protocol string) (*RegisteredSmartTransport, error) {
-	return NewRegisteredSmartTransport(protocol, false, sshSmartSubtransportFactory)
+	return RegisterManagedSSHTransportWithOptions(protocol, nil)
+}
+
+// ManagedSSHTransportOptions are the options for the Go-native
+// implementation of the SSH transport.
+type ManagedSSHTransportOptions struct {
+	// ProtocolVersion is the version of the git protocol requested from the
+	// server when fetching. It is requested through the GIT_PROTOCOL
+	// environment variable, which the server has to accept.
+	ProtocolVersion ProtocolVersion
+
+	// MaxAuthAttempts is the number of credentials that are requested from
+	// the credentials callback for a single connection. Key credentials
+	// that the server rejects are followed by a new request, so that
+	// several identities can be tried in order. Once they are exhausted,
+	// the operation fails with an error for which
+	// IsErrorCode(err, ErrorCodeAuth) is true. If zero,
+	// DefaultManagedSSHMaxAuthAttempts is used.
+	MaxAuthAttempts int
+
+	// SSHConfig, if set, is consulted to resolve the host of the remote
+	// URL, so that the host aliases, users, ports, identity files, jump
+	// hosts and proxy commands of OpenSSH client configuration files apply.
+	// The user and port of the URL take precedence over the configured
+	// ones. LoadSSHConfig reads the usual files.
+	SSHConfig *SSHConfig
+
+	// ConnectionPool, if set, keeps connections open after the operations
+	// that made them, so that later operations on the same host can open
+	// new sessions on them. See SSHConnectionPool.
+	ConnectionPool *SSHConnectionPool
+}
+
+// DefaultManagedSSHMaxAuthAttempts is the default number of credentials the
+// managed SSH transport requests for a single connection.
+const DefaultManagedSSHMaxAuthAttempts = 3
+
+// RegisterManagedSSHTransportWithOptions registers a Go-native
+// implementation of an SSH transport like RegisterManagedSSHTransport,
+// configured with the provided options.
+func RegisterManagedSSHTransportWithOptions(protocol string, opts *ManagedSSHTransportOptions) (*RegisteredSmartTransport, error) {
+	return NewRegisteredSmartTransport(protocol, false, newSSHSmartSubtransportFactory(opts))
 }
 
 func registerManagedSSH() error {
@@ -40,7 +94,7 @@ func registerManagedSSH() error {
 		if _, ok := globalRegisteredSmartTransports.transports[protocol]; ok {
 			continue
 		}
-		managed, err := newRegisteredSmartTransport(protocol, false, sshSmartSubtransportFactory, true)
+		managed, err := newRegisteredSmartTransport(protocol, false, newSSHSmartSubtransportFactory(nil), true)
 		if err != nil {
 			return fmt.Errorf("failed to register transport for %q: %v", protocol, err)
 		}
@@ -49,40 +103,69 @@ func registerManagedSSH() error {
 	return nil
 }
 
-func sshSmartSubtransportFactory(remote *Remote, transport *Transport) (SmartSubtransport, error) {
-	return &sshSmartSubtransport{
-		transport: transport,
-	}, nil
+func newSSHSmartSubtransportFactory(opts *ManagedSSHTransportOptions) SmartSubtransportCallback {
+	if opts == nil {
+		opts = &ManagedSSHTransportOptions{}
+	}
+
+	maxAuthAttempts := opts.MaxAuthAttempts
+	if maxAuthAttempts <= 0 {
+		maxAuthAttempts = DefaultManagedSSHMaxAuthAttempts
+	}
+
+	return func(remote *Remote, transport *Transport) (SmartSubtransport, error) {
+		proxy, err := newManagedProxy(remote, transport, maxAuthAttempts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sshSmartSubtransport{
+			remote:          remote,
+			transport:       transport,
+			protocolVersion: resolveProtocolVersion(opts.ProtocolVersion, remote),
+			maxAuthAttempts: maxAuthAttempts,
+			sshConfig:       opts.SSHConfig,
+			pool:            opts.ConnectionPool,
+			proxy:           proxy,
+		}, nil
+	}
 }
 
 type sshSmartSubtransport struct {
-	transport *Transport
+	remote          *Remote
+	transport       *Transport
+	protocolVersion ProtocolVersion
+	maxAuthAttempts int
+	sshConfig       *SSHConfig
+	pool            *SSHConnectionPool
+	proxy           *managedProxy
+	// protocolV2 is set once the server has announced protocol v2.
+	protocolV2 *protocolV2Session
 
-	lastAction    SmartServiceAction
-	client        *ssh.Client
+	lastAction SmartServiceAction
+	// conn is the connection of the subtransport, unless it uses a pooled
+	// one.
+	conn          *sshConnection
+	poolEntry     *sshPoolEntry
+	stopWatching  chan struct{}
 	session       *ssh.Session
 	stdin         io.WriteCloser
 	stdout        io.Reader
-	currentStream *sshSmartSubtransportStream
+	currentStream SmartSubtransportStream
 }
 
 func (t *sshSmartSubtransport) Action(urlString string, action SmartServiceAction) (SmartSubtransportStream, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	u, err := url.Parse(urlString)
+	u, err := parseSSHURL(urlString)
 	if err != nil {
 		return nil, err
 	}
-
-	// Escape \ and '.
-	uPath := strings.Replace(u.Path, `\`, `\\`, -1)
-	uPath = strings.Replace(uPath, `'`, `\'`, -1)
-
-	// TODO: Add percentage decode similar to libgit2.
-	// Refer: https://github.com/libgit2/libgit2/blob/358a60e1b46000ea99ef10b4dd709e92f75ff74b/src/str.c#L455-L481
+	uPath := sshQuote(u.path)
 
 	var cmd string
+	var detectVersion bool
 	switch action {
 	case SmartServiceActionUploadpackLs, SmartServiceActionUploadpack:
 		if t.currentStream != nil {
@@ -91,7 +174,8 @@ func (t *sshSmartSubtransport) Action(urlString string, action SmartServiceActio
 			}
 			t.Close()
 		}
-		cmd = fmt.Sprintf("git-upload-pack '%s'", uPath)
+		cmd = "git-upload-pack " + uPath
+		detectVersion = t.protocolVersion != ProtocolVersionV0
 
 	case SmartServiceActionReceivepackLs, SmartServiceActionReceivepack:
 		if t.currentStream != nil {
@@ -100,85 +184,507 @@ func (t *sshSmartSubtransport) Action(urlString string, action SmartServiceActio
 			}
 			t.Close()
 		}
-		cmd = fmt.Sprintf("git-receive-pack '%s'", uPath)
+		cmd = "git-receive-pack " + uPath
 
 	default:
 		return nil, fmt.Errorf("unexpected action: %v", action)
 	}
 
-	cred, err := t.transport.SmartCredentials("", CredentialTypeSSHKey|CredentialTypeSSHMemory)
+	host := t.resolveHost(u.host, u.user, u.port)
+	addr := net.JoinHostPort(host.HostName, strconv.Itoa(host.Port))
+
+	if err := t.openSession(t.transport.Context(), host, addr); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	t.stdin, err = t.session.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
-	defer cred.Free()
 
-	sshConfig, err := getSSHConfigFromCredential(cred)
+	t.stdout, err = t.session.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
-	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		marshaledKey := key.Marshal()
-		cert := &Certificate{
-			Kind: CertificateHostkey,
-			Hostkey: HostkeyCertificate{
-				Kind:         HostkeySHA1 | HostkeyMD5 | HostkeySHA256 | HostkeyRaw,
-				HashMD5:      md5.Sum(marshaledKey),
-				HashSHA1:     sha1.Sum(marshaledKey),
-				HashSHA256:   sha256.Sum256(marshaledKey),
-				Hostkey:      marshaledKey,
-				SSHPublicKey: key,
-			},
+
+	if detectVersion {
+		// Servers that do not accept the variable simply keep speaking
+		// protocol v0.
+		t.session.Setenv("GIT_PROTOCOL", t.protocolVersion.gitProtocolParameter())
+	}
+
+	if err := t.session.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	t.lastAction = action
+	t.currentStream = &sshSmartSubtransportStream{
+		owner: t,
+	}
+	if detectVersion {
+		t.currentStream = newVersionDetectingStream(t.currentStream, func(capabilities map[string]string, r *bufio.Reader, serviceHeader bool) *protocolV2Session {
+			session := newProtocolV2Session(&sshProtocolV2Conn{owner: t, r: r}, capabilities, serviceHeader, t.transport.fetchRefPrefixes)
+			t.setProtocolV2(session)
+			return session
+		})
+	}
+
+	return t.currentStream, nil
+}
+
+// sshURL is a remote URL of the managed SSH transport.
+type sshURL struct {
+	user string
+	host string
+	// port is zero if the URL does not specify one.
+	port int
+	path string
+}
+
+// parseSSHURL parses a URL the way git does, in either the
+// ssh://[user@]host[:port]/path form, whose components are percent-decoded,
+// or the scp-like [user@]host:path form, whose components are used as they
+// are. IPv6 addresses are enclosed in brackets in both forms, and the
+// scp-like form also accepts [host:port]:path. A path starting with ~user is
+// relative to the home directory of that user.
+func parseSSHURL(rawURL string) (*sshURL, error) {
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		return parseSSHSchemeURL(rawURL, rawURL[i+len("://"):])
+	}
+
+	var userHost, path string
+	colon := strings.IndexByte(rawURL, ':')
+	if open := strings.IndexByte(rawURL, '['); open >= 0 && (colon < 0 || open < colon) {
+		end := strings.IndexByte(rawURL[open:], ']')
+		if end < 0 || open+end+1 >= len(rawURL) || rawURL[open+end+1] != ':' {
+			return nil, fmt.Errorf("invalid SSH URL %q", rawURL)
 		}
+		end += open
+		userHost, path = rawURL[:end+1], rawURL[end+2:]
+	} else if colon >= 0 {
+		userHost, path = rawURL[:colon], rawURL[colon+1:]
+	} else {
+		return nil, fmt.Errorf("invalid SSH URL %q", rawURL)
+	}
 
-		return t.transport.SmartCertificateCheck(cert, true, hostname)
+	u := &sshURL{path: path}
+	if !strings.HasPrefix(userHost, "[") {
+		if at := strings.LastIndexByte(userHost, '@'); at >= 0 {
+			u.user, userHost = userHost[:at], userHost[at+1:]
+		}
+	}
+	hostPort := userHost
+	if strings.HasPrefix(userHost, "[") && strings.HasSuffix(userHost, "]") {
+		hostPort = userHost[1 : len(userHost)-1]
+		// [user@host:port]:path
+		if at := strings.LastIndexByte(hostPort, '@'); at >= 0 {
+			u.user, hostPort = hostPort[:at], hostPort[at+1:]
+		}
+		if strings.Count(hostPort, ":") != 1 {
+			hostPort = "[" + hostPort + "]"
+		}
+	}
+	if err := u.setHostPort(hostPort); err != nil {
+		return nil, fmt.Errorf("invalid SSH URL %q: %v", rawURL, err)
+	}
+	if u.host == "" || u.path == "" {
+		return nil, fmt.Errorf("invalid SSH URL %q", rawURL)
 	}
+	return u, nil
+}
+
+func parseSSHSchemeURL(rawURL, rest string) (*sshURL, error) {
+	slash := strings.IndexByte(rest, '/')
+	if slash < 0 {
+		return nil, fmt.Errorf("invalid SSH URL %q: missing path", rawURL)
+	}
+	authority := rest[:slash]
+
+	u := &sshURL{path: percentDecode(rest[slash:])}
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		userInfo := authority[:at]
+		if colon := strings.IndexByte(userInfo, ':'); colon >= 0 {
+			userInfo = userInfo[:colon]
+		}
+		u.user, authority = percentDecode(userInfo), authority[at+1:]
+	}
+	if err := u.setHostPort(authority); err != nil {
+		return nil, fmt.Errorf("invalid SSH URL %q: %v", rawURL, err)
+	}
+	u.host = percentDecode(u.host)
+	if u.host == "" {
+		return nil, fmt.Errorf("invalid SSH URL %q: missing host", rawURL)
+	}
+
+	// ssh://host/~user/path is relative to the home directory of user.
+	if strings.HasPrefix(u.path, "/~") {
+		u.path = u.path[1:]
+	}
+	return u, nil
+}
 
-	var addr string
-	if u.Port() != "" {
-		addr = fmt.Sprintf("%s:%s", u.Hostname(), u.Port())
+// setHostPort parses host, host:port, [host] or [host]:port.
+func (u *sshURL) setHostPort(hostPort string) error {
+	port := ""
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.IndexByte(hostPort, ']')
+		if end < 0 {
+			return errors.New("missing ']' in host")
+		}
+		u.host = hostPort[1:end]
+		if rest := hostPort[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return fmt.Errorf("unexpected %q after host", rest)
+			}
+			port = rest[1:]
+		}
+	} else if colon := strings.LastIndexByte(hostPort, ':'); colon >= 0 {
+		u.host, port = hostPort[:colon], hostPort[colon+1:]
 	} else {
-		addr = fmt.Sprintf("%s:22", u.Hostname())
+		u.host = hostPort
 	}
 
-	t.client, err = ssh.Dial("tcp", addr, sshConfig)
+	if port != "" {
+		var err error
+		u.port, err = strconv.Atoi(port)
+		if err != nil || u.port <= 0 || u.port > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return nil
+}
+
+// percentDecode decodes the %XX sequences of s, leaving invalid ones as they
+// are, like libgit2 does.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]) {
+			result.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// sshQuote quotes s for the remote shell the way git does, enclosing it in
+// single quotes and escaping the single quotes and exclamation marks it
+// contains.
+func sshQuote(s string) string {
+	var result strings.Builder
+	result.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '!':
+			result.WriteString("'\\")
+			result.WriteByte(s[i])
+			result.WriteByte('\'')
+		default:
+			result.WriteByte(s[i])
+		}
+	}
+	result.WriteByte('\'')
+	return result.String()
+}
+
+// resolveHost returns the settings for host, with the user and port given in
+// the URL taking precedence over the configured ones.
+func (t *sshSmartSubtransport) resolveHost(host, user string, port int) *SSHHostConfig {
+	if t.sshConfig != nil {
+		return t.sshConfig.resolve(host, user, port)
+	}
+	if port == 0 {
+		port = 22
+	}
+	return &SSHHostConfig{
+		Host:     host,
+		HostName: host,
+		User:     user,
+		Port:     port,
+	}
+}
+
+// openSession opens the session of an operation on host, reusing a pooled
+// connection if possible.
+func (t *sshSmartSubtransport) openSession(ctx context.Context, host *SSHHostConfig, addr string) error {
+	auth := &sshAuthenticator{
+		transport:   t.transport,
+		maxAttempts: t.maxAuthAttempts,
+	}
+	defer auth.Close()
+
+	sshConfig, err := auth.clientConfig(host.User, loadSSHIdentities(host.IdentityFiles))
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var poolKey string
+	if t.pool != nil {
+		poolKey = sshPoolKey(addr, host, auth)
+		for {
+			entry := t.pool.get(poolKey)
+			if entry == nil {
+				break
+			}
+			// The host keys are checked again, so that the certificate
+			// check of this operation sees them.
+			if err := t.recheckHostKeys(entry.conn); err != nil {
+				t.pool.release(entry, false)
+				return err
+			}
+			session, err := entry.conn.client.NewSession()
+			if err != nil {
+				// The server closed the connection in the meantime.
+				t.pool.release(entry, true)
+				continue
+			}
+			t.poolEntry = entry
+			t.session = session
+			t.closeOnDone(ctx, session)
+			return nil
+		}
 	}
 
-	t.session, err = t.client.NewSession()
+	t.conn = &sshConnection{}
+	sshConfig.HostKeyCallback = t.hostKeyCallback(t.conn)
+	netConn, err := t.dial(ctx, host, t.conn)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return auth.handshakeError(err, addr)
+	}
+	t.conn.client = ssh.NewClient(c, chans, reqs)
 
-	t.stdin, err = t.session.StdinPipe()
+	t.session, err = t.conn.client.NewSession()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	t.stdout, err = t.session.StdoutPipe()
+	if t.pool != nil {
+		if entry := t.pool.add(poolKey, t.conn); entry != nil {
+			t.poolEntry = entry
+			t.conn = nil
+			// Cancelling the operation must not close a connection that
+			// other operations can use.
+			t.stopWatchingContext()
+			t.closeOnDone(ctx, t.session)
+		}
+	}
+	return nil
+}
+
+// dial connects to host, either directly, through its proxy command or
+// through its jump hosts, whose connections are recorded in conn.
+func (t *sshSmartSubtransport) dial(ctx context.Context, host *SSHHostConfig, conn *sshConnection) (net.Conn, error) {
+	addr := net.JoinHostPort(host.HostName, strconv.Itoa(host.Port))
+	if host.ProxyCommand != "" {
+		conn, err := newSSHProxyCommandConn(host.ProxyCommand, addr)
+		if err != nil {
+			return nil, err
+		}
+		t.closeOnDone(ctx, conn)
+		return conn, nil
+	}
+
+	var jumpClient *ssh.Client
+	for _, jump := range host.ProxyJump {
+		jumpHost, err := t.resolveJumpHost(jump)
+		if err != nil {
+			return nil, err
+		}
+		jumpAddr := net.JoinHostPort(jumpHost.HostName, strconv.Itoa(jumpHost.Port))
+		jumpConn, err := t.dialThrough(ctx, jumpClient, jumpAddr)
+		if err != nil {
+			return nil, err
+		}
+		jumpClient, err = t.handshake(jumpConn, jumpAddr, jumpHost, conn)
+		if err != nil {
+			jumpConn.Close()
+			return nil, err
+		}
+		conn.jumpClients = append(conn.jumpClients, jumpClient)
+	}
+	return t.dialThrough(ctx, jumpClient, addr)
+}
+
+// dialThrough connects to addr through the jump host client is connected
+// to, or if client is nil, directly or through the proxy of the operation.
+func (t *sshSmartSubtransport) dialThrough(ctx context.Context, client *ssh.Client, addr string) (net.Conn, error) {
+	if client != nil {
+		return client.Dial("tcp", addr)
+	}
+
+	conn, err := t.proxy.dialContext(ctx, "ssh", addr)
 	if err != nil {
 		return nil, err
 	}
+	t.closeOnDone(ctx, conn)
+	return conn, nil
+}
 
-	if err := t.session.Start(cmd); err != nil {
+// resolveJumpHost parses a ProxyJump entry, of the form [user@]host[:port]
+// or ssh://[user@]host[:port], and resolves its host.
+func (t *sshSmartSubtransport) resolveJumpHost(jump string) (*SSHHostConfig, error) {
+	u, err := url.Parse("ssh://" + strings.TrimPrefix(jump, "ssh://"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid jump host %q: %v", jump, err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	host := t.resolveHost(u.Hostname(), u.User.Username(), port)
+	host.ProxyJump = nil
+	host.ProxyCommand = ""
+	return host, nil
+}
+
+// handshake establishes an SSH connection to host over conn, whose address
+// addr is used to check the host key. The host key is recorded in
+// connection.
+func (t *sshSmartSubtransport) handshake(conn net.Conn, addr string, host *SSHHostConfig, connection *sshConnection) (*ssh.Client, error) {
+	auth := &sshAuthenticator{
+		transport:   t.transport,
+		maxAttempts: t.maxAuthAttempts,
+	}
+	defer auth.Close()
+
+	sshConfig, err := auth.clientConfig(host.User, loadSSHIdentities(host.IdentityFiles))
+	if err != nil {
 		return nil, err
 	}
+	sshConfig.HostKeyCallback = t.hostKeyCallback(connection)
 
-	t.lastAction = action
-	t.currentStream = &sshSmartSubtransportStream{
-		owner: t,
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		return nil, auth.handshakeError(err, addr)
 	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	return t.currentStream, nil
+// hostKeyCallback checks the host keys of the handshakes of conn, and
+// records them so that later users of conn can check them too.
+func (t *sshSmartSubtransport) hostKeyCallback(conn *sshConnection) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := t.checkHostKey(hostname, remote, key); err != nil {
+			return err
+		}
+		conn.hostKeys = append(conn.hostKeys, sshHostKey{hostname: hostname, remote: remote, key: key})
+		return nil
+	}
+}
+
+// recheckHostKeys checks the host keys of a pooled connection for the
+// operation of the subtransport.
+func (t *sshSmartSubtransport) recheckHostKeys(conn *sshConnection) error {
+	for _, hostKey := range conn.hostKeys {
+		if err := t.checkHostKey(hostKey.hostname, hostKey.remote, hostKey.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sshSmartSubtransport) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	marshaledKey := key.Marshal()
+	cert := &Certificate{
+		Kind: CertificateHostkey,
+		Hostkey: HostkeyCertificate{
+			Kind:         HostkeySHA1 | HostkeyMD5 | HostkeySHA256 | HostkeyRaw,
+			HashMD5:      md5.Sum(marshaledKey),
+			HashSHA1:     sha1.Sum(marshaledKey),
+			HashSHA256:   sha256.Sum256(marshaledKey),
+			Hostkey:      marshaledKey,
+			SSHPublicKey: key,
+		},
+	}
+
+	return t.transport.SmartCertificateCheck(cert, true, hostname)
+}
+
+// closeOnDone closes conn as soon as ctx is done, which makes any blocked
+// read or write on the session fail. Watching stops when the subtransport is
+// closed.
+func (t *sshSmartSubtransport) closeOnDone(ctx context.Context, conn io.Closer) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	if t.stopWatching == nil {
+		t.stopWatching = make(chan struct{})
+	}
+	stop := t.stopWatching
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+}
+
+// setProtocolV2 records the protocol v2 session of the connection, which
+// also lets the remote list refs through it.
+func (t *sshSmartSubtransport) setProtocolV2(session *protocolV2Session) {
+	t.remote.setProtocolV2Connection(t.protocolV2, session)
+	t.protocolV2 = session
+}
+
+// stopWatchingContext stops the watches started by closeOnDone.
+func (t *sshSmartSubtransport) stopWatchingContext() {
+	if t.stopWatching != nil {
+		close(t.stopWatching)
+		t.stopWatching = nil
+	}
 }
 
 func (t *sshSmartSubtransport) Close() error {
+	t.setProtocolV2(nil)
 	t.currentStream = nil
-	if t.client != nil {
-		t.stdin.Close()
-		t.session.Wait()
+	t.stopWatchingContext()
+	if t.session != nil {
+		if t.stdin != nil {
+			t.stdin.Close()
+		}
+		err := t.session.Wait()
 		t.session.Close()
-		t.client = nil
+		t.session = nil
+		t.stdin = nil
+		t.stdout = nil
+
+		if t.poolEntry != nil {
+			// An exit status means that the command failed, not the
+			// connection.
+			_, exited := err.(*ssh.ExitError)
+			t.pool.release(t.poolEntry, err != nil && !exited)
+			t.poolEntry = nil
+		}
+	}
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
 	}
 	return nil
 }
@@ -201,50 +707,362 @@ func (stream *sshSmartSubtransportStream) Write(buf []byte) (int, error) {
 func (stream *sshSmartSubtransportStream) Free() {
 }
 
-func getSSHConfigFromCredential(cred *Credential) (*ssh.ClientConfig, error) {
+// sshProtocolV2Conn sends protocol v2 commands over the session of the
+// subtransport, whose responses are read from r.
+type sshProtocolV2Conn struct {
+	owner *sshSmartSubtransport
+	r     *bufio.Reader
+}
+
+func (c *sshProtocolV2Conn) roundTrip(request []byte) (*bufio.Reader, io.Closer, error) {
+	if _, err := c.owner.stdin.Write(request); err != nil {
+		return nil, nil, err
+	}
+	return c.r, ioutil.NopCloser(nil), nil
+}
+
+// sshCredentialTypes are the credential types that the managed SSH
+// transport can authenticate with. Userpass credentials are used for
+// password and keyboard-interactive authentication.
+const sshCredentialTypes = CredentialTypeSSHKey | CredentialTypeSSHMemory | CredentialTypeSSHCustom | CredentialTypeUserpassPlaintext
+
+// sshAuthenticator authenticates a connection with the credentials returned
+// by the credentials callback. The first credential is requested before the
+// handshake, as it provides the username; the following ones are requested
+// whenever the server rejects all the keys of the previous one, or asks for
+// a password that no credential provided yet.
+type sshAuthenticator struct {
+	transport   *Transport
+	maxAttempts int
+	attempts    int
+
+	// signers are the keys of the last credential that were not offered
+	// to the server yet.
+	signers     []ssh.Signer
+	password    string
+	hasPassword bool
+	username    string
+
+	// err is the error of the credentials callback, which the handshake
+	// would otherwise hide.
+	err error
+	// agents are the connections to the SSH agent, which are needed until
+	// the handshake is over.
+	agents []io.Closer
+}
+
+// clientConfig prepares the authentication of username. The identities are
+// offered before the keys of any credential. The credentials callback is
+// only asked for a credential upfront if there is no identity, or if the
+// username is unknown.
+func (a *sshAuthenticator) clientConfig(username string, identities []ssh.Signer) (*ssh.ClientConfig, error) {
+	a.username = username
+	if len(identities) == 0 || username == "" {
+		if err := a.requestCredential(username, sshCredentialTypes); err != nil {
+			return nil, err
+		}
+	}
+	a.signers = append(identities, a.signers...)
+
+	return &ssh.ClientConfig{
+		User: a.username,
+		Auth: []ssh.AuthMethod{
+			ssh.RetryableAuthMethod(ssh.PublicKeysCallback(a.publicKeys), a.maxAttempts),
+			ssh.PasswordCallback(a.passwordCallback),
+			ssh.KeyboardInteractive(a.keyboardInteractive),
+		},
+	}, nil
+}
+
+// requestCredential asks the credentials callback for a new credential of
+// one of the allowed types and makes it the current one.
+func (a *sshAuthenticator) requestCredential(username string, allowedTypes CredentialType) error {
+	a.attempts++
+	cred, err := a.transport.SmartCredentials(username, allowedTypes)
+	if err != nil {
+		a.err = err
+		return err
+	}
+	defer cred.Free()
+
+	a.signers = nil
+	credUsername, err := a.useCredential(cred)
+	if err != nil {
+		a.err = err
+		return err
+	}
+	if a.username == "" {
+		a.username = credUsername
+	}
+	return nil
+}
+
+func (a *sshAuthenticator) useCredential(cred *Credential) (string, error) {
 	switch cred.Type() {
+	case CredentialTypeUserpassPlaintext:
+		username, password, err := cred.GetUserpassPlaintext()
+		if err != nil {
+			return "", err
+		}
+		a.password = password
+		a.hasPassword = true
+		return username, nil
+
 	case CredentialTypeSSHCustom:
 		credSSHCustom := (*C.git_credential_ssh_custom)(unsafe.Pointer(cred.ptr))
 		data, ok := pointerHandles.Get(credSSHCustom.payload).(*credentialSSHCustomData)
 		if !ok {
-			return nil, errors.New("unsupported custom SSH credentials")
+			return "", errors.New("unsupported custom SSH credentials")
 		}
-		return &ssh.ClientConfig{
-			User: C.GoString(credSSHCustom.username),
-			Auth: []ssh.AuthMethod{ssh.PublicKeys(data.signer)},
-		}, nil
+		a.signers = []ssh.Signer{data.signer}
+		return C.GoString(credSSHCustom.username), nil
+
+	case CredentialTypeSSHKey, CredentialTypeSSHMemory:
+		username, publickey, privatekey, passphrase, err := cred.GetSSHKey()
+		if err != nil {
+			return "", err
+		}
+		// Credentials created by NewCredentialSSHKeyFromAgent have no
+		// private key.
+		if cred.Type() == CredentialTypeSSHKey && privatekey == "" {
+			a.signers, err = a.agentSigners()
+		} else {
+			a.signers, err = sshKeySigners(publickey, privatekey, passphrase, cred.Type() == CredentialTypeSSHMemory)
+		}
+		return username, err
+
+	default:
+		return "", fmt.Errorf("unsupported credential type for SSH: %v", cred.Type())
 	}
+}
 
-	username, _, privatekey, passphrase, err := cred.GetSSHKey()
+// agentSigners returns the identities of the SSH agent listening on
+// SSH_AUTH_SOCK.
+func (a *sshAuthenticator) agentSigners() ([]ssh.Signer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("cannot use the SSH agent: SSH_AUTH_SOCK is not set")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(a.transport.Context(), "unix", socket)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot use the SSH agent: %v", err)
+	}
+	a.agents = append(a.agents, conn)
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("cannot use the SSH agent: %v", err)
 	}
+	return signers, nil
+}
 
+// sshKeySigners parses a private key. If an OpenSSH certificate for the key
+// is available, either as the public key or next to the private key file
+// with a -cert.pub suffix, it is offered before the bare key.
+func sshKeySigners(publickey, privatekey, passphrase string, inMemory bool) ([]ssh.Signer, error) {
 	var pemBytes []byte
-	if cred.Type() == CredentialTypeSSHMemory {
+	var certificates [][]byte
+	if inMemory {
 		pemBytes = []byte(privatekey)
+		if publickey != "" {
+			certificates = append(certificates, []byte(publickey))
+		}
 	} else {
+		var err error
 		pemBytes, err = ioutil.ReadFile(privatekey)
 		if err != nil {
 			return nil, err
 		}
+		for _, path := range []string{publickey, privatekey + "-cert.pub"} {
+			if path == "" {
+				continue
+			}
+			if data, err := ioutil.ReadFile(path); err == nil {
+				certificates = append(certificates, data)
+			}
+		}
 	}
 
 	var key ssh.Signer
+	var err error
 	if passphrase != "" {
 		key, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		key, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range certificates {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			continue
+		}
+		cert, ok := publicKey.(*ssh.Certificate)
+		if !ok || !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, key)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		key, err = ssh.ParsePrivateKey(pemBytes)
+		return []ssh.Signer{certSigner, key}, nil
+	}
+	return []ssh.Signer{key}, nil
+}
+
+// loadSSHIdentities parses the identity files that exist and are not
+// protected by a passphrase, along with their certificates.
+func loadSSHIdentities(paths []string) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, path := range paths {
+		keySigners, err := sshKeySigners("", path, "", false)
 		if err != nil {
+			continue
+		}
+		signers = append(signers, keySigners...)
+	}
+	return signers
+}
+
+// publicKeys returns the keys to offer to the server, requesting a new key
+// credential once those of the current one were rejected.
+func (a *sshAuthenticator) publicKeys() ([]ssh.Signer, error) {
+	if a.signers == nil {
+		if a.hasPassword || a.attempts >= a.maxAttempts {
+			return nil, nil
+		}
+		if err := a.requestCredential(a.username, CredentialTypeSSHKey|CredentialTypeSSHMemory|CredentialTypeSSHCustom); err != nil {
 			return nil, err
 		}
 	}
+	signers := a.signers
+	a.signers = nil
+	return signers, nil
+}
 
-	return &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(key)},
+// errSSHNoPassword stops the handshake when the server only accepts a
+// password and no credential provides one.
+var errSSHNoPassword = errors.New("ssh: no password available")
+
+func (a *sshAuthenticator) passwordCallback() (string, error) {
+	if !a.hasPassword {
+		if a.attempts >= a.maxAttempts {
+			return "", errSSHNoPassword
+		}
+		if err := a.requestCredential(a.username, CredentialTypeUserpassPlaintext); err != nil {
+			return "", err
+		}
+		if !a.hasPassword {
+			return "", errSSHNoPassword
+		}
+	}
+	return a.password, nil
+}
+
+// keyboardInteractive answers the prompts that are not echoed with the
+// password, and the others with the username.
+func (a *sshAuthenticator) keyboardInteractive(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		if echos[i] {
+			answers[i] = a.username
+			continue
+		}
+		password, err := a.passwordCallback()
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = password
+	}
+	return answers, nil
+}
+
+// handshakeError returns the error of the credentials callback if it failed
+// during the handshake, or an authentication error once every credential
+// was rejected.
+func (a *sshAuthenticator) handshakeError(err error, addr string) error {
+	if a.err != nil {
+		return a.err
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") || strings.Contains(err.Error(), errSSHNoPassword.Error()) {
+		return &GitError{
+			Message: fmt.Sprintf("authentication failed for '%s@%s' after %d attempts", a.username, addr, a.attempts),
+			Class:   ErrorClassSSH,
+			Code:    ErrorCodeAuth,
+		}
+	}
+	return err
+}
+
+func (a *sshAuthenticator) Close() error {
+	for _, conn := range a.agents {
+		conn.Close()
+	}
+	a.agents = nil
+	return nil
+}
+
+// sshProxyCommandConn is a connection over the standard input and output of
+// a ProxyCommand.
+type sshProxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   sshProxyCommandAddr
+}
+
+// newSSHProxyCommandConn starts command. It runs until the connection is
+// closed, which may be long after the operation that started it when the
+// connection is pooled.
+func newSSHProxyCommandConn(command, addr string) (*sshProxyCommandConn, error) {
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run the proxy command %q: %v", command, err)
+	}
+
+	return &sshProxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		addr:   sshProxyCommandAddr(addr),
 	}, nil
 }
+
+func (c *sshProxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *sshProxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *sshProxyCommandConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *sshProxyCommandConn) LocalAddr() net.Addr                { return c.addr }
+func (c *sshProxyCommandConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *sshProxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshProxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshProxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sshProxyCommandAddr is the address of the host a ProxyCommand connects
+// to.
+type sshProxyCommandAddr string
+
+func (a sshProxyCommandAddr) Network() string { return "proxy-command" }
+func (a sshProxyCommandAddr) String() string  { return string(a) }
@@ -0,0 +1,369 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSHConfig holds the host settings of OpenSSH client configuration files,
+// which the managed SSH transport can use to resolve host aliases and reach
+// hosts through jump hosts or proxy commands.
+//
+// Only the settings that matter to the transport are kept: HostName, User,
+// Port, IdentityFile, ProxyJump and ProxyCommand. Host blocks and Include
+// directives are supported, but Match blocks never apply.
+type SSHConfig struct {
+	blocks []*sshConfigBlock
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	// never is set for Match blocks, which are not supported.
+	never   bool
+	options []sshConfigOption
+}
+
+type sshConfigOption struct {
+	keyword string
+	args    []string
+}
+
+// SSHHostConfig is the configuration that applies to a host.
+type SSHHostConfig struct {
+	// Host is the name the configuration was resolved for, which can be
+	// an alias.
+	Host string
+	// HostName is the real name of the host to connect to.
+	HostName string
+	// User is the user to log in as. It is empty if it was not
+	// configured, in which case the credentials callback provides it.
+	User string
+	Port int
+	// IdentityFiles are the private keys that are offered to the server
+	// before asking the credentials callback for credentials.
+	IdentityFiles []string
+	// ProxyJump are the jump hosts to go through, in order, as
+	// [user@]host[:port]. Their own ProxyJump and ProxyCommand settings are
+	// not applied.
+	ProxyJump []string
+	// ProxyCommand is the command whose standard input and output are
+	// used instead of a network connection. It is run with sh -c.
+	ProxyCommand string
+}
+
+// sshConfigMaxIncludeDepth bounds nested Include directives.
+const sshConfigMaxIncludeDepth = 16
+
+// LoadSSHConfig reads the OpenSSH client configuration files at paths, in
+// order of precedence. If no path is given, ~/.ssh/config and
+// /etc/ssh/ssh_config are read. Files that do not exist are ignored.
+func LoadSSHConfig(paths ...string) (*SSHConfig, error) {
+	if len(paths) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			paths = append(paths, filepath.Join(home, ".ssh", "config"))
+		}
+		paths = append(paths, "/etc/ssh/ssh_config")
+	}
+
+	config := &SSHConfig{}
+	for _, path := range paths {
+		if err := config.parseFile(path, 0); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// ParseSSHConfig parses an OpenSSH client configuration. Relative Include
+// directives are resolved from ~/.ssh.
+func ParseSSHConfig(r io.Reader) (*SSHConfig, error) {
+	dir := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, ".ssh")
+	}
+
+	config := &SSHConfig{}
+	if err := config.parse(r, "ssh_config", dir, 0); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *SSHConfig) parseFile(path string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.parse(f, path, filepath.Dir(path), depth)
+}
+
+func (c *SSHConfig) parse(r io.Reader, name, dir string, depth int) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		keyword, args, err := parseSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: missing argument for %s", name, lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			c.blocks = append(c.blocks, &sshConfigBlock{patterns: args})
+		case "match":
+			c.blocks = append(c.blocks, &sshConfigBlock{never: true})
+		case "include":
+			if depth >= sshConfigMaxIncludeDepth {
+				return fmt.Errorf("%s:%d: too many nested includes", name, lineNumber)
+			}
+			for _, pattern := range args {
+				pattern = expandSSHConfigHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", name, lineNumber, err)
+				}
+				for _, match := range matches {
+					if err := c.parseFile(match, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if len(c.blocks) == 0 {
+				c.blocks = append(c.blocks, &sshConfigBlock{patterns: []string{"*"}})
+			}
+			block := c.blocks[len(c.blocks)-1]
+			block.options = append(block.options, sshConfigOption{keyword: keyword, args: args})
+		}
+	}
+	return scanner.Err()
+}
+
+// parseSSHConfigLine splits a line into its lowercased keyword and its
+// arguments, which can be quoted. The keyword can be separated from the
+// arguments by an equals sign.
+func parseSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			arg, rest = rest[1:closing+1], rest[closing+2:]
+		} else if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			arg, rest = rest[:i], rest[i:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args, nil
+}
+
+// Resolve returns the configuration that applies to host. As in OpenSSH,
+// the first value obtained for a setting is used, except for IdentityFile,
+// whose values accumulate.
+func (c *SSHConfig) Resolve(host string) *SSHHostConfig {
+	return c.resolve(host, "", 0)
+}
+
+// resolve is like Resolve, but lets a user and port that were given
+// explicitly take precedence over the configured ones.
+func (c *SSHConfig) resolve(host, user string, port int) *SSHHostConfig {
+	values := make(map[string][]string)
+	var identityFiles []string
+	for _, block := range c.blocks {
+		if !block.matches(host) {
+			continue
+		}
+		for _, option := range block.options {
+			if option.keyword == "identityfile" {
+				identityFiles = append(identityFiles, option.args[0])
+				continue
+			}
+			if _, ok := values[option.keyword]; !ok {
+				values[option.keyword] = option.args
+			}
+		}
+	}
+	first := func(keyword string) string {
+		if args := values[keyword]; len(args) > 0 {
+			return args[0]
+		}
+		return ""
+	}
+
+	hostConfig := &SSHHostConfig{
+		Host:     host,
+		HostName: host,
+		User:     user,
+		Port:     port,
+	}
+	if hostConfig.User == "" {
+		hostConfig.User = first("user")
+	}
+	if hostConfig.Port == 0 {
+		hostConfig.Port, _ = strconv.Atoi(first("port"))
+	}
+	if hostConfig.Port == 0 {
+		hostConfig.Port = 22
+	}
+	if hostname := first("hostname"); hostname != "" {
+		hostConfig.HostName = hostConfig.expandTokens(hostname)
+	}
+	for _, identityFile := range identityFiles {
+		if strings.EqualFold(identityFile, "none") {
+			continue
+		}
+		hostConfig.IdentityFiles = append(hostConfig.IdentityFiles, expandSSHConfigHome(hostConfig.expandTokens(identityFile)))
+	}
+	if proxyJump := first("proxyjump"); proxyJump != "" && !strings.EqualFold(proxyJump, "none") {
+		hostConfig.ProxyJump = strings.Split(proxyJump, ",")
+	}
+	if proxyCommand := values["proxycommand"]; len(proxyCommand) > 0 && !strings.EqualFold(proxyCommand[0], "none") {
+		hostConfig.ProxyCommand = hostConfig.expandTokens(strings.Join(proxyCommand, " "))
+	}
+	return hostConfig
+}
+
+func (b *sshConfigBlock) matches(host string) bool {
+	if b.never {
+		return false
+	}
+	matched := false
+	for _, pattern := range b.patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchSSHConfigPattern(pattern[1:], host) {
+				return false
+			}
+		} else if matchSSHConfigPattern(pattern, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchSSHConfigPattern matches name against a pattern in which * matches
+// any sequence of characters and ? matches a single one, ignoring case.
+func matchSSHConfigPattern(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchSSHConfigPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return name == ""
+}
+
+// expandTokens replaces the %h, %p, %r, %n, %d, %u and %% tokens of s.
+func (h *SSHHostConfig) expandTokens(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	localUser := ""
+	home := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+		home = u.HomeDir
+	}
+	remoteUser := h.User
+	if remoteUser == "" {
+		remoteUser = localUser
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i == len(s)-1 {
+			result.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'h':
+			result.WriteString(h.HostName)
+		case 'p':
+			result.WriteString(strconv.Itoa(h.Port))
+		case 'r':
+			result.WriteString(remoteUser)
+		case 'n':
+			result.WriteString(h.Host)
+		case 'd':
+			result.WriteString(home)
+		case 'u':
+			result.WriteString(localUser)
+		case '%':
+			result.WriteByte('%')
+		default:
+			result.WriteByte('%')
+			result.WriteByte(s[i])
+		}
+	}
+	return result.String()
+}
+
+// expandSSHConfigHome replaces a leading ~ with the home directory.
+func expandSSHConfigHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,275 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHConfigResolve(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "included"), []byte(`
+Host *.internal
+	User included
+	IdentityFile ~/.ssh/internal_%r
+`), 0644)
+	checkFatal(t, err)
+	configPath := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configPath, []byte(`
+# Settings from the first matching block win.
+Host git
+	HostName git.internal
+	Port=2222
+	ProxyJump bastion.example.com,admin@10.0.0.1:2200
+
+Host *.internal !secret.internal
+	ProxyCommand "nc" %h %p
+	IdentityFile /keys/%n
+
+Match host secret.internal
+	User matched
+
+Include included
+
+Host *
+	User fallback
+	Port 22
+	IdentityFile /keys/default
+`), 0644)
+	checkFatal(t, err)
+
+	config, err := LoadSSHConfig(configPath, filepath.Join(dir, "missing"))
+	checkFatal(t, err)
+
+	home, err := os.UserHomeDir()
+	checkFatal(t, err)
+
+	for _, test := range []struct {
+		host     string
+		expected SSHHostConfig
+	}{
+		{
+			host: "git",
+			expected: SSHHostConfig{
+				Host:          "git",
+				HostName:      "git.internal",
+				User:          "fallback",
+				Port:          2222,
+				IdentityFiles: []string{"/keys/default"},
+				ProxyJump:     []string{"bastion.example.com", "admin@10.0.0.1:2200"},
+			},
+		},
+		{
+			host: "db.Internal",
+			expected: SSHHostConfig{
+				Host:          "db.Internal",
+				HostName:      "db.Internal",
+				User:          "included",
+				Port:          22,
+				IdentityFiles: []string{"/keys/db.Internal", filepath.Join(home, ".ssh", "internal_included"), "/keys/default"},
+				ProxyCommand:  "nc db.Internal 22",
+			},
+		},
+		{
+			host: "secret.internal",
+			expected: SSHHostConfig{
+				Host:          "secret.internal",
+				HostName:      "secret.internal",
+				User:          "included",
+				Port:          22,
+				IdentityFiles: []string{filepath.Join(home, ".ssh", "internal_included"), "/keys/default"},
+			},
+		},
+	} {
+		if actual := config.Resolve(test.host); !reflect.DeepEqual(*actual, test.expected) {
+			t.Errorf("Resolve(%q) = %+v, want %+v", test.host, *actual, test.expected)
+		}
+	}
+
+	// The user and port of the URL win over the configured ones.
+	actual := config.resolve("db.internal", "urluser", 2200)
+	if actual.User != "urluser" || actual.Port != 2200 || actual.ProxyCommand != "nc db.internal 2200" {
+		t.Errorf("unexpected settings with an explicit user and port: %+v", *actual)
+	}
+}
+
+// startSSHJumpServer starts a server that forwards the connections of the
+// user that authenticates with authorizedKey. Every forwarded address is
+// sent to forwarded.
+func startSSHJumpServer(t *testing.T, hostKey ssh.Signer, user string, authorizedKey ssh.PublicKey, forwarded chan<- string) net.Listener {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != user || !bytes.Equal(pubKey.Marshal(), authorizedKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	checkFatal(t, err)
+
+	go func() {
+		for {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nConn.Close()
+				_, chans, reqs, err := ssh.NewServerConn(nConn, config)
+				if err != nil {
+					t.Logf("failed to handshake: %v", err)
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newChannel := range chans {
+					if newChannel.ChannelType() != "direct-tcpip" {
+						newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+						continue
+					}
+					// RFC 4254 Section 7.2.
+					var payload struct {
+						DestAddr string
+						DestPort uint32
+						OrigAddr string
+						OrigPort uint32
+					}
+					if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+						newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					addr := net.JoinHostPort(payload.DestAddr, fmt.Sprint(payload.DestPort))
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						conn.Close()
+						continue
+					}
+					go ssh.DiscardRequests(requests)
+					forwarded <- addr
+
+					go func() {
+						defer channel.Close()
+						defer conn.Close()
+						go io.Copy(conn, channel)
+						io.Copy(channel, conn)
+					}()
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestManagedSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	generateKey := func(name string) ssh.Signer {
+		privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		checkFatal(t, err)
+		signer, err := ssh.NewSignerFromKey(privKey)
+		checkFatal(t, err)
+		if name != "" {
+			err = ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(privKey),
+			}), 0600)
+			checkFatal(t, err)
+		}
+		return signer
+	}
+	hostSigner := generateKey("")
+	userSigner := generateKey("id_git")
+	jumpSigner := generateKey("id_jump")
+
+	listener := startSSHServer(t, hostSigner, []ssh.PublicKey{userSigner.PublicKey()})
+	defer listener.Close()
+	forwarded := make(chan string, 1)
+	jumpListener := startSSHJumpServer(t, hostSigner, "jumpuser", jumpSigner.PublicKey(), forwarded)
+	defer jumpListener.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	checkFatal(t, err)
+	_, jumpPort, err := net.SplitHostPort(jumpListener.Addr().String())
+	checkFatal(t, err)
+
+	config, err := ParseSSHConfig(strings.NewReader(fmt.Sprintf(`
+Host gitserver
+	HostName 127.0.0.1
+	Port %s
+	User testuser
+	IdentityFile %s
+	ProxyJump jumpuser@jump
+
+Host jump
+	HostName 127.0.0.1
+	Port %s
+	IdentityFile %s
+`, port, filepath.Join(dir, "id_git"), jumpPort, filepath.Join(dir, "id_jump"))))
+	checkFatal(t, err)
+
+	registeredSmartTransport, err := RegisterManagedSSHTransportWithOptions("sshconfig", &ManagedSSHTransportOptions{
+		SSHConfig: config,
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", "sshconfig://gitserver/TestGitRepository")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	err = remote.Fetch(nil, &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				return nil
+			},
+			CredentialsCallback: func(url, username string, allowedTypes CredentialType) (*Credential, error) {
+				return nil, fmt.Errorf("unexpected credentials request for %q", username)
+			},
+		},
+	}, "")
+	checkFatal(t, err)
+
+	select {
+	case addr := <-forwarded:
+		if expected := net.JoinHostPort("127.0.0.1", port); addr != expected {
+			t.Errorf("jump host forwarded %q, want %q", addr, expected)
+		}
+	default:
+		t.Error("the connection did not go through the jump host")
+	}
+}
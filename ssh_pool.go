@@ -0,0 +1,238 @@
+package git
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultSSHPoolIdleTimeout is the default time an unused pooled SSH
+// connection is kept open.
+const DefaultSSHPoolIdleTimeout = 90 * time.Second
+
+// DefaultSSHPoolMaxSessionsPerConnection is the default number of sessions
+// that are multiplexed on a pooled SSH connection, which matches the default
+// MaxSessions of OpenSSH servers.
+const DefaultSSHPoolMaxSessionsPerConnection = 10
+
+// SSHConnectionPool keeps the connections of the managed SSH transport open
+// between operations, so that operations on the same host, as the same user
+// and with the same credentials open a new session on an existing
+// connection instead of connecting again. The credentials callback is still
+// asked for the credential that identifies the connection to use, unless the
+// ssh_config identity files identify it.
+//
+// A pool is enabled through ManagedSSHTransportOptions.ConnectionPool. Its
+// zero value is ready to use, and it can be shared between transports.
+type SSHConnectionPool struct {
+	// IdleTimeout is how long a connection without sessions is kept open.
+	// If zero, DefaultSSHPoolIdleTimeout is used.
+	IdleTimeout time.Duration
+	// MaxSessionsPerConnection is the number of sessions that can be open
+	// at the same time on a connection. If zero,
+	// DefaultSSHPoolMaxSessionsPerConnection is used.
+	MaxSessionsPerConnection int
+	// MaxConnectionsPerKey bounds the number of pooled connections for a
+	// host, user and credential. Connections that are made once the limit
+	// is reached are closed at the end of their operation. If zero, there
+	// is no limit.
+	MaxConnectionsPerKey int
+
+	mu      sync.Mutex
+	entries map[string][]*sshPoolEntry
+	closed  bool
+}
+
+// sshPoolEntry is a pooled connection.
+type sshPoolEntry struct {
+	key  string
+	conn *sshConnection
+	// sessions is the number of operations that use the connection.
+	sessions  int
+	idleTimer *time.Timer
+}
+
+// sshConnection is an established SSH connection, along with the
+// connections to the jump hosts it goes through.
+type sshConnection struct {
+	client      *ssh.Client
+	jumpClients []*ssh.Client
+	// hostKeys are the host keys of the server and the jump hosts, which
+	// are checked again by each operation that reuses the connection.
+	hostKeys []sshHostKey
+}
+
+// sshHostKey is a host key that a server presented in a handshake.
+type sshHostKey struct {
+	hostname string
+	remote   net.Addr
+	key      ssh.PublicKey
+}
+
+func (c *sshConnection) Close() error {
+	if c.client != nil {
+		c.client.Close()
+	}
+	for i := len(c.jumpClients) - 1; i >= 0; i-- {
+		c.jumpClients[i].Close()
+	}
+	return nil
+}
+
+// sshPoolKey identifies the connections to addr that go through the same
+// jump hosts or proxy command, and that authenticate as the same user with
+// the same keys or password.
+func sshPoolKey(addr string, host *SSHHostConfig, auth *sshAuthenticator) string {
+	h := sha256.New()
+	for _, s := range []string{addr, strings.Join(host.ProxyJump, ","), host.ProxyCommand, auth.username} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	for _, signer := range auth.signers {
+		h.Write(signer.PublicKey().Marshal())
+		h.Write([]byte{0})
+	}
+	if auth.hasPassword {
+		io.WriteString(h, auth.password)
+	}
+	return string(h.Sum(nil))
+}
+
+func (p *SSHConnectionPool) maxSessionsPerConnection() int {
+	if p.MaxSessionsPerConnection <= 0 {
+		return DefaultSSHPoolMaxSessionsPerConnection
+	}
+	return p.MaxSessionsPerConnection
+}
+
+func (p *SSHConnectionPool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return DefaultSSHPoolIdleTimeout
+	}
+	return p.IdleTimeout
+}
+
+// get returns a pooled connection for key that can take one more session,
+// reserving that session, or nil if there is none.
+func (p *SSHConnectionPool) get(key string) *sshPoolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, entry := range p.entries[key] {
+		if entry.sessions >= p.maxSessionsPerConnection() {
+			continue
+		}
+		entry.sessions++
+		if entry.idleTimer != nil {
+			entry.idleTimer.Stop()
+			entry.idleTimer = nil
+		}
+		return entry
+	}
+	return nil
+}
+
+// add pools a new connection for key with one reserved session. It returns
+// nil if the pool is closed or full, in which case the caller keeps
+// ownership of the connection.
+func (p *SSHConnectionPool) add(key string, conn *sshConnection) *sshPoolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || (p.MaxConnectionsPerKey > 0 && len(p.entries[key]) >= p.MaxConnectionsPerKey) {
+		return nil
+	}
+	if p.entries == nil {
+		p.entries = make(map[string][]*sshPoolEntry)
+	}
+	entry := &sshPoolEntry{
+		key:      key,
+		conn:     conn,
+		sessions: 1,
+	}
+	p.entries[key] = append(p.entries[key], entry)
+	return entry
+}
+
+// release ends a session of entry. Broken connections are closed right away,
+// and the others once they have been idle for the idle timeout.
+func (p *SSHConnectionPool) release(entry *sshPoolEntry, broken bool) {
+	p.mu.Lock()
+	entry.sessions--
+	if broken || p.closed {
+		p.remove(entry)
+		p.mu.Unlock()
+		entry.conn.Close()
+		return
+	}
+	if entry.sessions == 0 {
+		entry.idleTimer = time.AfterFunc(p.idleTimeout(), func() {
+			p.expire(entry)
+		})
+	}
+	p.mu.Unlock()
+}
+
+// expire closes entry if it is still idle.
+func (p *SSHConnectionPool) expire(entry *sshPoolEntry) {
+	p.mu.Lock()
+	if entry.sessions > 0 || !p.remove(entry) {
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	entry.conn.Close()
+}
+
+// remove takes entry out of the pool, and reports whether it was still in
+// it. The caller holds p.mu.
+func (p *SSHConnectionPool) remove(entry *sshPoolEntry) bool {
+	entries := p.entries[entry.key]
+	for i, e := range entries {
+		if e != entry {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(p.entries, entry.key)
+		} else {
+			p.entries[entry.key] = entries
+		}
+		if entry.idleTimer != nil {
+			entry.idleTimer.Stop()
+			entry.idleTimer = nil
+		}
+		return true
+	}
+	return false
+}
+
+// Close closes the idle connections of the pool. The connections that are in
+// use are closed at the end of their operations, and no new connection is
+// pooled afterwards.
+func (p *SSHConnectionPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	var idle []*sshPoolEntry
+	for _, entries := range p.entries {
+		for _, entry := range entries {
+			if entry.sessions == 0 {
+				idle = append(idle, entry)
+			}
+		}
+	}
+	for _, entry := range idle {
+		p.remove(entry)
+	}
+	p.mu.Unlock()
+
+	for _, entry := range idle {
+		entry.conn.Close()
+	}
+	return nil
+}
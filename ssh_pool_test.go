@@ -0,0 +1,156 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHConnectionPoolLimits(t *testing.T) {
+	t.Parallel()
+
+	pool := &SSHConnectionPool{
+		IdleTimeout:              time.Hour,
+		MaxSessionsPerConnection: 2,
+		MaxConnectionsPerKey:     1,
+	}
+	defer pool.Close()
+
+	if entry := pool.get("key"); entry != nil {
+		t.Fatalf("expected an empty pool, got %+v", entry)
+	}
+	entry := pool.add("key", &sshConnection{})
+	if entry == nil {
+		t.Fatal("the connection was not pooled")
+	}
+	if pool.add("key", &sshConnection{}) != nil {
+		t.Error("the connection limit was not enforced")
+	}
+	if pool.add("other", &sshConnection{}) == nil {
+		t.Error("the connection limit should be per key")
+	}
+
+	if pool.get("key") != entry {
+		t.Fatal("the pooled connection was not reused")
+	}
+	if pool.get("key") != nil {
+		t.Error("the session limit was not enforced")
+	}
+
+	// Broken connections leave the pool.
+	pool.release(entry, false)
+	pool.release(entry, true)
+	if pool.get("key") != nil {
+		t.Error("a broken connection was reused")
+	}
+
+	// Idle connections expire.
+	pool.IdleTimeout = time.Millisecond
+	entry = pool.add("key", &sshConnection{})
+	pool.release(entry, false)
+	time.Sleep(50 * time.Millisecond)
+	if pool.get("key") != nil {
+		t.Error("an idle connection did not expire")
+	}
+}
+
+func TestManagedSSHConnectionPool(t *testing.T) {
+	t.Parallel()
+
+	hostPrivKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	checkFatal(t, err)
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	checkFatal(t, err)
+
+	// Every connection authenticates once.
+	var mu sync.Mutex
+	connections := make(map[string]bool)
+	listener := startSSHServerWithConfig(t, hostSigner, &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(pubKey.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			mu.Lock()
+			connections[string(c.SessionID())] = true
+			mu.Unlock()
+			return nil, nil
+		},
+	})
+	defer listener.Close()
+	connectionCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(connections)
+	}
+
+	pool := &SSHConnectionPool{IdleTimeout: time.Minute}
+	defer pool.Close()
+	registeredSmartTransport, err := RegisterManagedSSHTransportWithOptions("sshpool", &ManagedSSHTransportOptions{
+		ConnectionPool: pool,
+	})
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create(
+		"origin",
+		fmt.Sprintf("sshpool://%s/TestGitRepository", listener.Addr().String()),
+	)
+	checkFatal(t, err)
+	defer remote.Free()
+
+	var certificateChecks int32
+	fetchOpts := &FetchOptions{
+		RemoteCallbacks: RemoteCallbacks{
+			CertificateCheckCallback: func(cert *Certificate, valid bool, hostname string) error {
+				atomic.AddInt32(&certificateChecks, 1)
+				return nil
+			},
+			CredentialsCallback: func(url, username string, allowedTypes CredentialType) (*Credential, error) {
+				return NewCredentialSSHKeyFromSigner("testuser", signer)
+			},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		err = remote.Fetch(nil, fetchOpts, "")
+		checkFatal(t, err)
+	}
+	if count := connectionCount(); count != 1 {
+		t.Errorf("%d connections were made, want 1", count)
+	}
+	// Operations that reuse the connection check the host key too.
+	if checks := atomic.LoadInt32(&certificateChecks); checks != 3 {
+		t.Errorf("the host key was checked %d times, want 3", checks)
+	}
+	rejectingOpts := *fetchOpts
+	rejectingOpts.RemoteCallbacks.CertificateCheckCallback = func(cert *Certificate, valid bool, hostname string) error {
+		return errors.New("untrusted host key")
+	}
+	if err := remote.Fetch(nil, &rejectingOpts, ""); err == nil {
+		t.Error("a pooled connection was reused despite a rejected host key")
+	}
+
+	// Once the pool is closed, every operation connects again.
+	checkFatal(t, pool.Close())
+	for i := 0; i < 2; i++ {
+		err = remote.Fetch(nil, fetchOpts, "")
+		checkFatal(t, err)
+	}
+	if count := connectionCount(); count != 3 {
+		t.Errorf("%d connections were made, want 3", count)
+	}
+}
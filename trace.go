@@ -0,0 +1,110 @@
+package git
+
+/*
+#include <git2.h>
+
+extern int _go_git_trace_set(git_trace_level_t level, int enabled);
+*/
+import "C"
+import (
+	"runtime"
+	"sync"
+)
+
+// TraceLevel is the verbosity of the messages that libgit2 traces.
+type TraceLevel int
+
+const (
+	// TraceLevelNone disables tracing.
+	TraceLevelNone TraceLevel = C.GIT_TRACE_NONE
+	// TraceLevelFatal traces severe errors that may impact the program's
+	// execution.
+	TraceLevelFatal TraceLevel = C.GIT_TRACE_FATAL
+	// TraceLevelError traces errors that do not impact the program's
+	// execution.
+	TraceLevelError TraceLevel = C.GIT_TRACE_ERROR
+	// TraceLevelWarn traces warnings that suggest abnormal data.
+	TraceLevelWarn TraceLevel = C.GIT_TRACE_WARN
+	// TraceLevelInfo traces informational messages about program execution.
+	TraceLevelInfo TraceLevel = C.GIT_TRACE_INFO
+	// TraceLevelDebug traces detailed data that allows for debugging.
+	TraceLevelDebug TraceLevel = C.GIT_TRACE_DEBUG
+	// TraceLevelTrace traces exceptionally detailed debugging data.
+	TraceLevelTrace TraceLevel = C.GIT_TRACE_TRACE
+)
+
+// TraceCallback receives the messages that libgit2 traces. It can be called
+// from any thread, including threads that libgit2 started itself.
+type TraceCallback func(level TraceLevel, message string)
+
+var globalTraceCallback struct {
+	sync.RWMutex
+	level    TraceLevel
+	callback TraceCallback
+}
+
+// SetTrace sets the callback that receives the messages libgit2 traces at
+// level or below, such as those about the negotiation of a fetch. Passing
+// TraceLevelNone or a nil callback disables tracing. It fails if libgit2 was
+// built without tracing support.
+//
+// At TraceLevelTrace, the callback also receives the packets that operations
+// exchange with the streams of the transports registered with
+// NewRegisteredSmartTransport, one message per packet in the format of
+// GIT_TRACE_PACKET. As with PacketTraceCallback, these are the protocol v0
+// packets that libgit2 sees: for servers that are spoken to in protocol v2
+// or over dumb HTTP, they are those of the emulated stream rather than what
+// was sent over the network.
+func SetTrace(level TraceLevel, callback TraceCallback) error {
+	if callback == nil {
+		level = TraceLevelNone
+	}
+
+	globalTraceCallback.Lock()
+	defer globalTraceCallback.Unlock()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ret := C._go_git_trace_set(C.git_trace_level_t(level), cbool(level != TraceLevelNone))
+	if ret < 0 {
+		return MakeGitError(ret)
+	}
+	if level == TraceLevelNone {
+		callback = nil
+	}
+	globalTraceCallback.level = level
+	globalTraceCallback.callback = callback
+	return nil
+}
+
+// tracePacketCallback returns a PacketTraceCallback that passes the packets
+// to the trace callback, or nil if packets are not traced.
+func tracePacketCallback() PacketTraceCallback {
+	globalTraceCallback.RLock()
+	defer globalTraceCallback.RUnlock()
+	if globalTraceCallback.callback == nil || globalTraceCallback.level < TraceLevelTrace {
+		return nil
+	}
+	return func(packet *TracedPacket) {
+		globalTraceCallback.RLock()
+		callback := globalTraceCallback.callback
+		enabled := globalTraceCallback.level >= TraceLevelTrace
+		globalTraceCallback.RUnlock()
+
+		if callback != nil && enabled {
+			callback(TraceLevelTrace, packet.String())
+		}
+	}
+}
+
+//export traceCallback
+func traceCallback(level C.git_trace_level_t, msg *C.char) {
+	globalTraceCallback.RLock()
+	callback := globalTraceCallback.callback
+	globalTraceCallback.RUnlock()
+
+	if callback != nil {
+		callback(TraceLevel(level), C.GoString(msg))
+	}
+}
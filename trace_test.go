@@ -0,0 +1,59 @@
+package git
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetTrace(t *testing.T) {
+	var mu sync.Mutex
+	var packets []string
+	err := SetTrace(TraceLevelTrace, func(level TraceLevel, message string) {
+		if level > TraceLevelTrace || level == TraceLevelNone {
+			t.Errorf("unexpected trace level %d for %q", level, message)
+		}
+		if strings.HasPrefix(message, "packet: ") {
+			mu.Lock()
+			packets = append(packets, message)
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Skipf("libgit2 was built without tracing support: %v", err)
+	}
+	defer SetTrace(TraceLevelNone, nil)
+
+	serverRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, serverRepo)
+	commitID, _ := seedTestRepo(t, serverRepo)
+
+	server := httptest.NewServer(newTestHTTPBackend(t, serverRepo))
+	defer server.Close()
+
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	remote, err := repo.Remotes.Create("origin", server.URL+"/repo.git")
+	checkFatal(t, err)
+	defer remote.Free()
+	checkFatal(t, remote.Fetch(nil, nil, ""))
+
+	checkFatal(t, SetTrace(TraceLevelNone, nil))
+	globalTraceCallback.RLock()
+	if globalTraceCallback.callback != nil {
+		t.Error("the trace callback was not cleared")
+	}
+	globalTraceCallback.RUnlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	trace := strings.Join(packets, "\n")
+	if !strings.Contains(trace, "fetch> want "+commitID.String()) {
+		t.Errorf("the trace callback did not see the want of %v:\n%s", commitID, trace)
+	}
+	if !strings.Contains(trace, "fetch< NAK") {
+		t.Errorf("the trace callback did not see the NAK:\n%s", trace)
+	}
+}
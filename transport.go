@@ -22,6 +22,7 @@ void _go_git_setup_smart_subtransport_stream(_go_managed_smart_subtransport_stre
 */
 import "C"
 import (
+	"context"
 	"fmt"
 	"io"
 	"reflect"
@@ -97,6 +98,49 @@ func (t *Transport) SmartRemoteConnectOptions() (*RemoteConnectOptions, error) {
 	return remoteConnectOptionsFromC(&copts), nil
 }
 
+// Context returns the context of the operation that is currently using this
+// transport. Subtransports should abort any blocking I/O once it is done. If
+// the operation was not started with a context, context.Background() is
+// returned.
+func (t *Transport) Context() context.Context {
+	data := t.remoteCallbacksData()
+	if data == nil || data.ctx == nil {
+		return context.Background()
+	}
+	return data.ctx
+}
+
+// remoteCallbacksData returns the callbacks of the operation that is
+// currently using this transport, or nil if there are none.
+func (t *Transport) remoteCallbacksData() *remoteCallbacksData {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var copts C.git_remote_connect_options
+	if ret := C.git_transport_remote_connect_options(&copts, t.ptr); ret < 0 {
+		return nil
+	}
+	if copts.callbacks.payload == nil {
+		return nil
+	}
+	payload, ok := pointerHandles.lookup(copts.callbacks.payload)
+	if !ok {
+		return nil
+	}
+	data, _ := payload.(*remoteCallbacksData)
+	return data
+}
+
+// fetchRefPrefixes returns the prefixes of the refs that the fetch in
+// progress needs, or nil if it needs all of them.
+func (t *Transport) fetchRefPrefixes() []string {
+	data := t.remoteCallbacksData()
+	if data == nil {
+		return nil
+	}
+	return data.refPrefixes
+}
+
 // SmartCredentials calls the credentials callback for this transport.
 func (t *Transport) SmartCredentials(user string, methods CredentialType) (*Credential, error) {
 	cred := newCredential()
@@ -217,6 +261,9 @@ type RegisteredSmartTransport struct {
 	stateless bool
 	callback  SmartSubtransportCallback
 	handle    unsafe.Pointer
+
+	traceMu             sync.Mutex
+	packetTraceCallback PacketTraceCallback
 }
 
 // NewRegisteredSmartTransport adds a custom transport definition, to be used
@@ -276,6 +323,22 @@ func newRegisteredSmartTransport(
 	return registeredSmartTransport, nil
 }
 
+// SetPacketTraceCallback sets a callback that sees every packet that the
+// operations using this transport exchange with their subtransport streams,
+// in addition to RemoteCallbacks.PacketTraceCallback. A nil callback
+// disables tracing.
+func (t *RegisteredSmartTransport) SetPacketTraceCallback(callback PacketTraceCallback) {
+	t.traceMu.Lock()
+	defer t.traceMu.Unlock()
+	t.packetTraceCallback = callback
+}
+
+func (t *RegisteredSmartTransport) currentPacketTraceCallback() PacketTraceCallback {
+	t.traceMu.Lock()
+	defer t.traceMu.Unlock()
+	return t.packetTraceCallback
+}
+
 // Free releases all resources used by the RegisteredSmartTransport and
 // unregisters the custom transport definition referenced by it.
 func (t *RegisteredSmartTransport) Free() error {
@@ -308,11 +371,13 @@ func smartTransportCallback(
 		// create a new empty remote and set it
 		// as a weak pointer, so that control stays in golang
 		remote = createNewEmptyRemote()
+		remote.ptr = owner
 		remote.weak = true
 	}
 
 	managed := &managedSmartSubtransport{
 		remote:       remote,
+		registered:   registeredSmartTransport,
 		callback:     registeredSmartTransport.callback,
 		subtransport: (*C._go_managed_smart_subtransport)(C.calloc(1, C.size_t(unsafe.Sizeof(C._go_managed_smart_subtransport{})))),
 	}
@@ -342,12 +407,14 @@ func smartTransportSubtransportCallback(
 	if err != nil {
 		return setCallbackError(errorMessage, err)
 	}
+	subtransport.owner = owner
 	subtransport.underlying = underlyingSmartSubtransport
 	return C.int(ErrorCodeOK)
 }
 
 type managedSmartSubtransport struct {
 	owner                *C.git_transport
+	registered           *RegisteredSmartTransport
 	callback             SmartSubtransportCallback
 	remote               *Remote
 	subtransport         *C._go_managed_smart_subtransport
@@ -385,6 +452,18 @@ func smartSubtransportActionCallback(
 		managed := &managedSmartSubtransportStream{
 			underlying: underlyingStream,
 			streamPtr:  stream,
+			tracer:     subtransport.newPacketTracer(C.GoString(url), SmartServiceAction(action)),
+		}
+		if action == C.GIT_SERVICE_UPLOADPACK_LS || action == C.GIT_SERVICE_UPLOADPACK {
+			if fetch := subtransport.shallowFetch(); fetch != nil {
+				managed.shallow = newShallowStream(underlyingStream, fetch)
+			}
+		}
+		if action == C.GIT_SERVICE_RECEIVEPACK_LS || action == C.GIT_SERVICE_RECEIVEPACK {
+			if push := subtransport.pushState(); push != nil {
+				push.setManaged()
+				managed.push = newPushStream(underlyingStream, push, action == C.GIT_SERVICE_RECEIVEPACK_LS)
+			}
 		}
 		managedHandle := pointerHandles.Track(managed)
 		managed.handle = managedHandle
@@ -393,12 +472,53 @@ func smartSubtransportActionCallback(
 		C._go_git_setup_smart_subtransport_stream(stream)
 
 		subtransport.currentManagedStream = managed
+	} else if tracer := subtransport.currentManagedStream.tracer; tracer != nil {
+		tracer.setAction(SmartServiceAction(action))
 	}
 
 	*out = &subtransport.currentManagedStream.streamPtr.parent
 	return C.int(ErrorCodeOK)
 }
 
+// newPacketTracer returns the tracer for a new stream, or nil if neither the
+// registered transport, the operation nor SetTrace has a packet trace
+// callback.
+func (t *managedSmartSubtransport) newPacketTracer(url string, action SmartServiceAction) *packetTracer {
+	var operationCallback PacketTraceCallback
+	if t.owner != nil {
+		if data := (&Transport{ptr: t.owner}).remoteCallbacksData(); data != nil && data.callbacks != nil {
+			operationCallback = data.callbacks.PacketTraceCallback
+		}
+	}
+	return newPacketTracer(url, action, t.registered.currentPacketTraceCallback(), operationCallback, tracePacketCallback())
+}
+
+// shallowFetch returns the shallow fetch of the operation that is using the
+// subtransport, or nil if it does not limit the history.
+func (t *managedSmartSubtransport) shallowFetch() *shallowFetch {
+	if t.owner == nil {
+		return nil
+	}
+	data := (&Transport{ptr: t.owner}).remoteCallbacksData()
+	if data == nil {
+		return nil
+	}
+	return data.shallow
+}
+
+// pushState returns the state of the push that is using the subtransport,
+// or nil if it is not a push.
+func (t *managedSmartSubtransport) pushState() *pushState {
+	if t.owner == nil {
+		return nil
+	}
+	data := (&Transport{ptr: t.owner}).remoteCallbacksData()
+	if data == nil {
+		return nil
+	}
+	return data.push
+}
+
 //export smartSubtransportCloseCallback
 func smartSubtransportCloseCallback(errorMessage **C.char, t *C.git_smart_subtransport) C.int {
 	subtransport := getSmartSubtransportInterface(t)
@@ -434,6 +554,24 @@ type managedSmartSubtransportStream struct {
 	streamPtr  *C._go_managed_smart_subtransport_stream
 	underlying SmartSubtransportStream
 	handle     unsafe.Pointer
+	// tracer, if not nil, sees the data of the stream.
+	tracer *packetTracer
+	// shallow, if not nil, carries the data of the stream for a shallow
+	// fetch.
+	shallow *shallowStream
+	// push, if not nil, carries the data of the stream for a push.
+	push *pushStream
+}
+
+// stream returns the stream that libgit2 reads from and writes to.
+func (s *managedSmartSubtransportStream) stream() SmartSubtransportStream {
+	if s.shallow != nil {
+		return s.shallow
+	}
+	if s.push != nil {
+		return s.push
+	}
+	return s.underlying
 }
 
 func getSmartSubtransportStreamInterface(subtransportStream *C.git_smart_subtransport_stream) *managedSmartSubtransportStream {
@@ -457,8 +595,11 @@ func smartSubtransportStreamReadCallback(
 	header.Len = int(bufSize)
 	header.Data = uintptr(unsafe.Pointer(buffer))
 
-	n, err := stream.underlying.Read(p)
+	n, err := stream.stream().Read(p)
 	*bytesRead = C.size_t(n)
+	if n > 0 && stream.tracer != nil {
+		stream.tracer.trace(p[:n], PacketDirectionReceived)
+	}
 	if n == 0 && err != nil {
 		if err == io.EOF {
 			return C.int(ErrorCodeOK)
@@ -485,9 +626,12 @@ func smartSubtransportStreamWriteCallback(
 	header.Len = int(bufLen)
 	header.Data = uintptr(unsafe.Pointer(buffer))
 
-	if _, err := stream.underlying.Write(p); err != nil {
+	if _, err := stream.stream().Write(p); err != nil {
 		return setCallbackError(errorMessage, err)
 	}
+	if stream.tracer != nil {
+		stream.tracer.trace(p, PacketDirectionSent)
+	}
 
 	return C.int(ErrorCodeOK)
 }
@@ -497,6 +641,9 @@ func smartSubtransportStreamFreeCallback(s *C.git_smart_subtransport_stream) {
 	stream := getSmartSubtransportStreamInterface(s)
 
 	stream.underlying.Free()
+	if stream.tracer != nil {
+		stream.tracer.end()
+	}
 	pointerHandles.Untrack(stream.handle)
 	C.free(unsafe.Pointer(stream.streamPtr))
 	stream.handle = nil
@@ -1,9 +1,13 @@
 package git
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type testSmartSubtransport struct {
@@ -70,3 +74,107 @@ func TestTransport(t *testing.T) {
 		t.Errorf("mismatched remote heads. expected %v, got %v", expectedRemoteHeads, remoteHeads)
 	}
 }
+
+type stalledSmartSubtransport struct {
+	transport *Transport
+}
+
+func (t *stalledSmartSubtransport) Action(url string, action SmartServiceAction) (SmartSubtransportStream, error) {
+	return &stalledSmartSubtransportStream{ctx: t.transport.Context()}, nil
+}
+
+func (t *stalledSmartSubtransport) Close() error {
+	return nil
+}
+
+func (t *stalledSmartSubtransport) Free() {
+}
+
+type stalledSmartSubtransportStream struct {
+	ctx context.Context
+}
+
+func (s *stalledSmartSubtransportStream) Read(buf []byte) (int, error) {
+	<-s.ctx.Done()
+	return 0, s.ctx.Err()
+}
+
+func (s *stalledSmartSubtransportStream) Write(buf []byte) (int, error) {
+	<-s.ctx.Done()
+	return 0, s.ctx.Err()
+}
+
+func (s *stalledSmartSubtransportStream) Free() {
+}
+
+func TestTransportContext(t *testing.T) {
+	t.Parallel()
+	repo := createTestRepo(t)
+	defer cleanupTestRepo(t, repo)
+
+	callback := func(remote *Remote, transport *Transport) (SmartSubtransport, error) {
+		return &stalledSmartSubtransport{transport: transport}, nil
+	}
+	registeredSmartTransport, err := NewRegisteredSmartTransport("stalled", true, callback)
+	checkFatal(t, err)
+	defer registeredSmartTransport.Free()
+
+	remote, err := repo.Remotes.Create("test", "stalled://bar")
+	checkFatal(t, err)
+	defer remote.Free()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = remote.FetchContext(ctx, nil, nil, "")
+	if err != context.Canceled {
+		t.Fatalf("remote.FetchContext() = %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = remote.FetchContext(ctx, nil, nil, "")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("remote.FetchContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The remote of a clone belongs to libgit2, so its transport is stopped
+	// instead.
+	path, err := ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = CloneContext(ctx, "stalled://bar", path, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("CloneContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The transport that is stopped is the one for the URL that libgit2
+	// connects to, here the one set by the ready callback.
+	sourceRepo := createTestRepo(t)
+	defer cleanupTestRepo(t, sourceRepo)
+	commitId, _ := seedTestRepo(t, sourceRepo)
+	path, err = ioutil.TempDir("", "git2go")
+	checkFatal(t, err)
+	defer os.RemoveAll(path)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clone, err := CloneContext(ctx, "stalled://bar", path, &CloneOptions{
+		Bare: true,
+		FetchOptions: FetchOptions{
+			RemoteCallbacks: RemoteCallbacks{
+				RemoteReadyCallback: func(remote *Remote, direction ConnectDirection) error {
+					return remote.SetInstanceUrl(sourceRepo.Workdir())
+				},
+			},
+		},
+	})
+	checkFatal(t, err)
+	defer clone.Free()
+	head, err := clone.Head()
+	checkFatal(t, err)
+	defer head.Free()
+	if !head.Target().Equal(commitId) {
+		t.Errorf("HEAD = %v, want %v", head.Target(), commitId)
+	}
+}
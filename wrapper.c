@@ -4,6 +4,7 @@
 #include <git2/sys/odb_backend.h>
 #include <git2/sys/refdb_backend.h>
 #include <git2/sys/cred.h>
+#include <stdlib.h>
 
 // There are two ways in which to declare a callback:
 //
@@ -351,6 +352,30 @@ static int push_update_reference_callback(const char *refname, const char *statu
 	return set_callback_error(error_message, ret);
 }
 
+static int push_negotiation_callback(const git_push_update **updates, size_t len, void *data)
+{
+	char *error_message = NULL;
+	const int ret = pushNegotiationCallback(
+			&error_message,
+			(git_push_update **)updates,
+			len,
+			data
+	);
+	return set_callback_error(error_message, ret);
+}
+
+static int remote_ready_callback(git_remote *remote, int direction, void *data)
+{
+	char *error_message = NULL;
+	const int ret = remoteReadyCallback(
+			&error_message,
+			remote,
+			direction,
+			data
+	);
+	return set_callback_error(error_message, ret);
+}
+
 void _go_git_populate_remote_callbacks(git_remote_callbacks *callbacks)
 {
 	callbacks->sideband_progress = sideband_progress_callback;
@@ -362,6 +387,47 @@ void _go_git_populate_remote_callbacks(git_remote_callbacks *callbacks)
 	callbacks->pack_progress = pack_progress_callback;
 	callbacks->push_transfer_progress = push_transfer_progress_callback;
 	callbacks->push_update_reference = push_update_reference_callback;
+	callbacks->push_negotiation = push_negotiation_callback;
+	callbacks->remote_ready = remote_ready_callback;
+}
+
+int _go_git_packbuilder_set_callbacks(git_packbuilder *pb, void *payload)
+{
+	return git_packbuilder_set_callbacks(pb, payload ? pack_progress_callback : NULL, payload);
+}
+
+static int proxy_credentials_callback(
+		git_credential **cred,
+		const char *url,
+		const char *username_from_url,
+		unsigned int allowed_types,
+		void *data)
+{
+	char *error_message = NULL;
+	const int ret = proxyCredentialsCallback(
+			&error_message,
+			cred,
+			(char *)url,
+			(char *)username_from_url,
+			allowed_types,
+			data
+	);
+	return set_callback_error(error_message, ret);
+}
+
+void _go_git_populate_proxy_credentials(git_proxy_options *opts)
+{
+	opts->credentials = proxy_credentials_callback;
+}
+
+static void trace_callback(git_trace_level_t level, const char *msg)
+{
+	traceCallback(level, (char *)msg);
+}
+
+int _go_git_trace_set(git_trace_level_t level, int enabled)
+{
+	return git_trace_set(level, enabled ? trace_callback : NULL);
 }
 
 int _go_git_index_add_all(git_index *index, const git_strarray *pathspec, unsigned int flags, void *callback)
@@ -534,6 +600,155 @@ int _go_git_transport_register(const char *prefix, void *param)
 	return git_transport_register(prefix, smart_transport_callback, param);
 }
 
+// A stoppable transport wraps the transport that libgit2 would have created.
+// The transport callback is not given the URL, which libgit2 resolves with
+// insteadOf, the push URL and the remote ready callback, so the wrapped
+// transport is created when libgit2 connects to that URL.
+typedef struct {
+	git_transport parent;
+	git_remote *owner;
+	void *param;
+	git_transport *wrapped;
+} stoppable_transport;
+
+static int stoppable_transport_connect(
+		git_transport *transport,
+		const char *url,
+		int direction,
+		const git_remote_connect_options *connect_opts)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	if (!t->wrapped) {
+		const int ret = git_transport_new(&t->wrapped, t->owner, url);
+		if (ret < 0)
+			return ret;
+		stoppableTransportCreatedCallback(t->wrapped, t->param);
+	}
+	return t->wrapped->connect(t->wrapped, url, direction, connect_opts);
+}
+
+static int stoppable_transport_set_connect_opts(
+		git_transport *transport,
+		const git_remote_connect_options *connect_opts)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	if (!t->wrapped)
+		return 0;
+	return t->wrapped->set_connect_opts(t->wrapped, connect_opts);
+}
+
+static int stoppable_transport_capabilities(
+		unsigned int *capabilities,
+		git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped->capabilities(capabilities, t->wrapped);
+}
+
+static int stoppable_transport_ls(
+		const git_remote_head ***out,
+		size_t *size,
+		git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped->ls(out, size, t->wrapped);
+}
+
+static int stoppable_transport_push(git_transport *transport, git_push *push)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped->push(t->wrapped, push);
+}
+
+static int stoppable_transport_negotiate_fetch(
+		git_transport *transport,
+		git_repository *repo,
+		const git_remote_head * const *refs,
+		size_t count)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped->negotiate_fetch(t->wrapped, repo, refs, count);
+}
+
+static int stoppable_transport_download_pack(
+		git_transport *transport,
+		git_repository *repo,
+		git_indexer_progress *stats)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped->download_pack(t->wrapped, repo, stats);
+}
+
+static int stoppable_transport_is_connected(git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	return t->wrapped && t->wrapped->is_connected(t->wrapped);
+}
+
+static void stoppable_transport_cancel(git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	if (t->wrapped && t->wrapped->cancel)
+		t->wrapped->cancel(t->wrapped);
+}
+
+static int stoppable_transport_close(git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	if (!t->wrapped)
+		return 0;
+	return t->wrapped->close(t->wrapped);
+}
+
+static void stoppable_transport_free(git_transport *transport)
+{
+	stoppable_transport *t = (stoppable_transport *)transport;
+	if (t->wrapped) {
+		stoppableTransportFreeCallback(t->wrapped);
+		t->wrapped->free(t->wrapped);
+	}
+	free(t);
+}
+
+static int stoppable_transport_callback(
+		git_transport **out,
+		git_remote *owner,
+		void *param)
+{
+	stoppable_transport *t = calloc(1, sizeof(stoppable_transport));
+	if (!t) {
+		git_error_set_oom();
+		return -1;
+	}
+	t->parent.version = GIT_TRANSPORT_VERSION;
+	t->parent.connect = stoppable_transport_connect;
+	t->parent.set_connect_opts = stoppable_transport_set_connect_opts;
+	t->parent.capabilities = stoppable_transport_capabilities;
+	t->parent.ls = stoppable_transport_ls;
+	t->parent.push = stoppable_transport_push;
+	t->parent.negotiate_fetch = stoppable_transport_negotiate_fetch;
+	t->parent.download_pack = stoppable_transport_download_pack;
+	t->parent.is_connected = stoppable_transport_is_connected;
+	t->parent.cancel = stoppable_transport_cancel;
+	t->parent.close = stoppable_transport_close;
+	t->parent.free = stoppable_transport_free;
+	t->owner = owner;
+	t->param = param;
+	*out = &t->parent;
+	return 0;
+}
+
+void _go_git_setup_stoppable_transport(git_remote_callbacks *callbacks)
+{
+	callbacks->transport = stoppable_transport_callback;
+}
+
+void _go_git_transport_cancel(git_transport *transport)
+{
+	if (transport->cancel)
+		transport->cancel(transport);
+}
+
 static int smart_subtransport_action_callback(
 		git_smart_subtransport_stream **out,
 		git_smart_subtransport *transport,